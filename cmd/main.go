@@ -8,8 +8,13 @@ import (
 	"mymate/internal/middlewares"
 	"mymate/internal/repository"
 	"mymate/internal/service"
-	"mymate/pkg/cleaner"
+	"mymate/pkg/blobstore"
 	"mymate/pkg/config"
+	"mymate/pkg/mailer"
+	"mymate/pkg/messagebus"
+	"mymate/pkg/notification"
+	"mymate/pkg/telegrambot"
+	"os/exec"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -17,13 +22,11 @@ import (
 	"github.com/robfig/cron/v3"
 )
 
-func initMonthlyCleaner(pool *pgxpool.Pool) {
+func initMonthlyCleaner(flatService service.FlatServiceI) {
 	c := cron.New()
 
 	// Запускать в 00:00 1-го числа каждого месяца
-	_, err := c.AddFunc("0 0 1 * *", func() {
-		cleaner.Clean(pool)
-	})
+	_, err := c.AddFunc("0 0 1 * *", flatService.DeleteExpiredFlats)
 
 	if err != nil {
 		log.Fatalf("Failed to schedule cleanup job: %v", err)
@@ -33,6 +36,153 @@ func initMonthlyCleaner(pool *pgxpool.Pool) {
 
 }
 
+// initBlobStore создает хранилище медиафайлов. Для нескольких реплик нужен s3.
+func initBlobStore(config *config.Config) blobstore.BlobStore {
+	if config.MediaStorage == "s3" {
+		store, err := blobstore.NewS3Store(config.S3Endpoint, config.S3Region, config.S3Bucket, config.S3AccessKey, config.S3SecretKey, config.S3PathStyle)
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+		return store
+	}
+	return blobstore.NewLocalStore(config.MediaRoot, config.MainUrl+"/media", config.MediaURLSecret)
+}
+
+func initUnreadNotifier(chatService service.ChatServiceI) {
+	c := cron.New()
+
+	_, err := c.AddFunc("@every 1m", chatService.NotifyUnread)
+
+	if err != nil {
+		log.Fatalf("Failed to schedule unread notifier: %v", err)
+	}
+
+	_, err = c.AddFunc("@every 5m", chatService.RevalidateConnections)
+
+	if err != nil {
+		log.Fatalf("Failed to schedule connections revalidation: %v", err)
+	}
+
+	go c.Start()
+}
+
+// initPushSenders выбирает отправщика для каждой платформы. Платформа без настроенного провайдера не получает
+// push-уведомлений, а ее устройства не удаляются. Заглушка подключается только явно, через PUSH_STUB.
+func initPushSenders(config *config.Config) map[string]notification.Sender {
+	senders := map[string]notification.Sender{}
+	if config.PushStub {
+		log.Print("WARNING|PUSH_STUB is enabled, push notifications are only written to the log")
+		stub := notification.NewStubSender()
+		senders[notification.PlatformAndroid] = stub
+		senders[notification.PlatformWeb] = stub
+		senders[notification.PlatformIOS] = stub
+	}
+	if config.FCMCredentialsFile == "" && !config.PushStub {
+		log.Print("WARNING|FCM is not configured, push notifications to android and web devices are disabled")
+	}
+	if config.APNsKeyFile == "" && !config.PushStub {
+		log.Print("WARNING|APNs is not configured, push notifications to ios devices are disabled")
+	}
+	if config.FCMCredentialsFile != "" {
+		fcm, err := notification.NewFCMSender(config.FCMCredentialsFile, config.FCMBaseURL)
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+		senders[notification.PlatformAndroid] = fcm
+		senders[notification.PlatformWeb] = fcm
+	}
+	if config.APNsKeyFile != "" {
+		apns, err := notification.NewAPNsSender(config.APNsKeyFile, config.APNsKeyId, config.APNsTeamId, config.APNsTopic, config.APNsBaseURL)
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+		senders[notification.PlatformIOS] = apns
+	}
+	return senders
+}
+
+// initFFmpeg возвращает пустой путь, если ffmpeg не установлен: видео тогда загружаются без постеров
+func initFFmpeg(config *config.Config) string {
+	path, err := exec.LookPath(config.FFmpegPath)
+	if err != nil {
+		log.Printf("WARNING|ffmpeg not found, video posters disabled:%s", err.Error())
+		return ""
+	}
+	return path
+}
+
+func initExpiryNotifier(notificationService service.NotificationServiceI) {
+	c := cron.New()
+
+	_, err := c.AddFunc("@hourly", notificationService.NotifyExpiringFlats)
+
+	if err != nil {
+		log.Fatalf("Failed to schedule listing expiry notifier: %v", err)
+	}
+
+	go c.Start()
+}
+
+func initFavouritesNotifier(favouritesService service.FavouritesServiceI) {
+	c := cron.New()
+
+	_, err := c.AddFunc("@every 15m", favouritesService.NotifyOwners)
+
+	if err != nil {
+		log.Fatalf("Failed to schedule favourites notifier: %v", err)
+	}
+
+	go c.Start()
+}
+
+func initViewsCleaner(flatService service.FlatServiceI) {
+	c := cron.New()
+
+	_, err := c.AddFunc("0 3 * * *", flatService.PruneViews)
+
+	if err != nil {
+		log.Fatalf("Failed to schedule views cleanup: %v", err)
+	}
+
+	go c.Start()
+}
+
+func initUploadCleaner(uploadService service.UploadServiceI) {
+	c := cron.New()
+
+	_, err := c.AddFunc("@hourly", uploadService.CleanUploads)
+
+	if err != nil {
+		log.Fatalf("Failed to schedule upload cleaner: %v", err)
+	}
+
+	go c.Start()
+}
+
+func initMediaCollector(mediaService service.MediaServiceI) {
+	c := cron.New()
+
+	_, err := c.AddFunc("0 4 * * *", mediaService.RunGarbageCollector)
+
+	if err != nil {
+		log.Fatalf("Failed to schedule media garbage collector: %v", err)
+	}
+
+	go c.Start()
+}
+
+func initMediaDeletionWorker(mediaService service.MediaServiceI) {
+	c := cron.New()
+
+	_, err := c.AddFunc("@every 1m", mediaService.RunDeletionJobs)
+
+	if err != nil {
+		log.Fatalf("Failed to schedule media deletion worker: %v", err)
+	}
+
+	go c.Start()
+}
+
 func main() {
 	config, err := config.NewConfig(".env")
 	if err != nil {
@@ -60,6 +210,11 @@ func main() {
 	flatRepository := repository.NewFlatRepository(pool, config.WebHost, config.WebPort, config.MainUrl)
 	favouritesRepository := repository.NewFavouritesRepository(pool, config.WebHost, config.WebPort)
 	chatRepository := repository.NewChatReposiroty(config.WebHost, config.WebPort, pool, userRepository)
+	moderationRepository := repository.NewModerationRepository(pool, config.WebHost, config.WebPort)
+	conversationRepository := repository.NewConversationRepository(pool, config.WebHost, config.WebPort)
+	notificationRepository := repository.NewNotificationRepository(pool, config.WebHost, config.WebPort)
+	mediaRepository := repository.NewMediaRepository(pool, config.WebHost, config.WebPort)
+	uploadRepository := repository.NewUploadRepository(pool, config.WebHost, config.WebPort)
 
 	err = userRepository.CreateTables(context.Background())
 	if err != nil {
@@ -77,27 +232,76 @@ func main() {
 	if err != nil {
 		log.Fatal(err.Error())
 	}
-	initMonthlyCleaner(pool)
+	err = moderationRepository.CreateTables(context.Background())
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	err = conversationRepository.CreateTables(context.Background())
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	err = notificationRepository.CreateTables(context.Background())
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	err = uploadRepository.CreateTables(context.Background())
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	err = mediaRepository.CreateTables(context.Background())
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	blobs := initBlobStore(config)
 
-	tgAuthService := service.NewTelegramAuthService(userRepository, config.WebHost, config.WebPort)
+	var bus messagebus.MessageBusI = messagebus.NewInMemoryBus()
+	if config.MessageBus == "postgres" {
+		postgresBus := messagebus.NewPostgresBus(pool, config.WebHost, config.WebPort)
+		err = postgresBus.CreateTables(context.Background())
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+		bus = postgresBus
+	}
+
+	telegramBot := telegrambot.NewClient(config.TelegramBotToken, config.TelegramBotAPIURL)
 	mailAuthService := service.NewMailAuthService(userRepository, config.WebHost, config.WebPort, config.MailToken, config.From, config.SecretKey)
 	jwtService := service.NewJWTService(config, userRepository)
 	middlewares := middlewares.NewMiddlewares(jwtService, userRepository, config.WebHost, config.WebPort, flatRepository)
-	userService := service.NewUserService(userRepository, config.WebHost, config.WebPort, config.MainUrl)
-	flatService := service.NewFlatService(flatRepository, config.WebHost, config.WebPort, config.MainUrl)
-	favouritesService := service.NewFavouritesService(favouritesRepository, config.WebHost, config.WebPort)
-	chatService := service.NewChatService(chatRepository, userRepository, config.WebHost, config.WebPort)
-	go chatService.KeepAlive()
+	userService := service.NewUserService(userRepository, blobs, config.WebHost, config.WebPort, config.MainUrl)
+	tgAuthService := service.NewTelegramAuthService(userRepository, userService, telegramBot, config.WebHost, config.WebPort)
+	flatService := service.NewFlatService(flatRepository, moderationRepository, blobs, initFFmpeg(config), config.WebHost, config.WebPort, config.MainUrl)
+	initViewsCleaner(flatService)
+	initMonthlyCleaner(flatService)
+	uploadService := service.NewUploadService(uploadRepository, flatService, userService, blobs, config.UploadSessionTTL, config.WebHost, config.WebPort)
+	initUploadCleaner(uploadService)
+	go flatService.RunViewRecorder(context.Background())
+	notificationService := service.NewNotificationService(notificationRepository, flatRepository, userRepository, bus, initPushSenders(config), telegramBot, config.TelegramMiniAppURL, config.WebHost, config.WebPort)
+	initExpiryNotifier(notificationService)
+	go notificationService.Run(context.Background())
+	favouritesService := service.NewFavouritesService(favouritesRepository, notificationService, config.WebHost, config.WebPort)
+	initFavouritesNotifier(favouritesService)
+	chatService := service.NewChatService(chatRepository, userRepository, flatRepository, moderationRepository, conversationRepository, jwtService, bus, notificationService, mailer.NewMailer(config.From, config.MailToken), config.UnreadEmailDelay, config.AllowedOrigins, config.WebHost, config.WebPort)
+	initUnreadNotifier(chatService)
+	go bus.Run(context.Background())
+	mediaService := service.NewMediaService(blobs, conversationRepository, mediaRepository, config.MediaGCGrace, config.WebHost, config.WebPort)
+	initMediaCollector(mediaService)
+	initMediaDeletionWorker(mediaService)
+	moderationService := service.NewModerationService(moderationRepository, userRepository, chatRepository, config.WebHost, config.WebPort)
 	tgAuthHandler := handler.NewTelegramAuthHandler(tgAuthService, jwtService, config)
 	mailAuthHandler := handler.NewMailAuthHandler(mailAuthService, jwtService, config, middlewares)
 	userHandler := handler.NewUserHandler(userService, config.WebHost, config.WebPort, middlewares)
 	flatHandler := handler.NewFlatHandler(flatService, config.WebHost, config.WebPort, middlewares)
 	favouritesHandler := handler.NewFavouritesHandler(favouritesService, middlewares, flatService)
 	chatHandler := handler.NewChatHandler(chatService, config.WebHost, config.WebPort, middlewares, jwtService)
-
-	initMonthlyCleaner(pool)
+	moderationHandler := handler.NewModerationHandler(moderationService, middlewares)
+	conversationHandler := handler.NewConversationHandler(chatService, middlewares)
+	notificationHandler := handler.NewNotificationHandler(notificationService, middlewares)
+	uploadHandler := handler.NewUploadHandler(uploadService, middlewares)
+	mediaHandler := handler.NewMediaHandler(mediaService, jwtService, middlewares)
 
 	router := gin.Default()
+	mediaHandler.RegisterRoutes(&router.RouterGroup)
 	api := router.Group("/api")
 	v1 := api.Group("/v1")
 	auth := v1.Group("/auth")
@@ -111,6 +315,11 @@ func main() {
 	flatHandler.RegisterRoutes(v1)
 	favouritesHandler.RegisterRoutes(v1)
 	chatHandler.RegisterRoutes(v1)
+	moderationHandler.RegisterRoutes(v1)
+	conversationHandler.RegisterRoutes(v1)
+	notificationHandler.RegisterRoutes(v1)
+	uploadHandler.RegisterRoutes(v1)
+	mediaHandler.RegisterAdminRoutes(v1)
 
 	router.Run(config.WebHost + ":" + config.WebPort)
 }
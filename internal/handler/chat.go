@@ -5,19 +5,27 @@ import (
 	"log"
 	"mymate/internal/middlewares"
 	"mymate/internal/service"
+	"mymate/pkg/customerror"
 	"mymate/pkg/user"
 	"net/http"
 	"strconv"
+	"strings"
 
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
 )
 
 type ChatHandlerI interface {
 	RegisterRoutes(group *gin.RouterGroup)
+	CreateTicket(ctx *gin.Context)
 	Connect(ctx *gin.Context)
 	GetChats(ctx *gin.Context)
 	GetMessages(ctx *gin.Context)
+	EditMessage(ctx *gin.Context)
+	DeleteMessage(ctx *gin.Context)
+	SearchMessages(ctx *gin.Context)
+	ExportMessages(ctx *gin.Context)
 }
 
 type ChatHandler struct {
@@ -41,15 +49,108 @@ func NewChatHandler(chatService service.ChatServiceI, host string, port string,
 func (h *ChatHandler) RegisterRoutes(group *gin.RouterGroup) {
 	chats := group.Group("/chats")
 	chats.GET("/", h.middlewares.ValidUser(), h.GetChats)
+	chats.GET("/search", h.middlewares.ValidUser(), h.SearchMessages)
 	chats.GET("/:user_id", h.middlewares.ValidUser(), h.GetMessages)
+	chats.GET("/:user_id/export", h.middlewares.ValidUser(), h.ExportMessages)
+	chats.POST("/ticket", h.middlewares.ValidUser(), h.CreateTicket)
 	chats.GET("/websocket", h.Connect)
+	chats.PATCH("/messages/:message_id", h.middlewares.ValidUser(), h.EditMessage)
+	chats.DELETE("/messages/:message_id", h.middlewares.ValidUser(), h.DeleteMessage)
 }
 
-func (h *ChatHandler) Connect(ctx *gin.Context) {
-	token := ctx.Query("token")
-	user, authErr := h.jwtService.ValidateToken(token)
-	_ = h.chatService.Connect(ctx, user, authErr)
+func (h *ChatHandler) CreateTicket(ctx *gin.Context) {
+	userInterface, exists := ctx.Get("user")
+	if !exists {
+		ctx.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusInternalServerError,
+			"body":   gin.H{},
+			"error":  "Internal Server Error",
+		})
+		return
+	}
+	user := userInterface.(*user.User)
+	tokenExpiresAt, err := h.jwtService.TokenExpiresAt(ctx.GetHeader("Authorization"))
+	if err != nil {
+		ctx.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusUnauthorized,
+			"body":   gin.H{},
+			"error":  "token invalid",
+		})
+		return
+	}
+	ticket, expiresAt, err := h.chatService.CreateTicket(user, tokenExpiresAt)
+	if err != nil {
+		ctx.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusInternalServerError,
+			"body":   gin.H{},
+			"error":  "Internal Server Error",
+		})
+		log.Println(err.Error())
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{
+		"status": http.StatusOK,
+		"body": gin.H{
+			"ticket":     ticket,
+			"expires_at": expiresAt,
+		},
+		"error": nil,
+	})
+}
 
+// Connect аутентифицирует клиента до апгрейда соединения: одноразовым тикетом (?ticket=) или заголовком Authorization.
+// Если нет ни того, ни другого, токен ожидается первым кадром после подключения.
+func (h *ChatHandler) Connect(ctx *gin.Context) {
+	ticket := ctx.Query("ticket")
+	if ticket != "" {
+		user, tokenExpiresAt, err := h.chatService.ConsumeTicket(ticket)
+		if err == customerror.ErrJwtInvalid || err == customerror.ErrJwtVersionIncorrect {
+			ctx.AbortWithStatusJSON(http.StatusOK, gin.H{
+				"status": http.StatusUnauthorized,
+				"body":   gin.H{},
+				"error":  "ticket invalid",
+			})
+			return
+		}
+		if err != nil {
+			ctx.AbortWithStatusJSON(http.StatusOK, gin.H{
+				"status": http.StatusInternalServerError,
+				"body":   gin.H{},
+				"error":  "Internal Server Error",
+			})
+			log.Println(err.Error())
+			return
+		}
+		err = h.chatService.Connect(ctx, user, tokenExpiresAt)
+		if err != nil {
+			log.Println(err.Error())
+		}
+		return
+	}
+	if ctx.GetHeader("Authorization") != "" {
+		h.middlewares.ValidUser()(ctx)
+		if ctx.IsAborted() {
+			return
+		}
+		tokenExpiresAt, err := h.jwtService.TokenExpiresAt(ctx.GetHeader("Authorization"))
+		if err != nil {
+			ctx.AbortWithStatusJSON(http.StatusOK, gin.H{
+				"status": http.StatusUnauthorized,
+				"body":   gin.H{},
+				"error":  "token invalid",
+			})
+			return
+		}
+		err = h.chatService.Connect(ctx, ctx.MustGet("user").(*user.User), tokenExpiresAt)
+		if err != nil {
+			log.Println(err.Error())
+		}
+		return
+	}
+	err := h.chatService.ConnectWithFirstFrame(ctx)
+	if err != nil {
+		log.Println(err.Error())
+	}
 }
 
 func (h *ChatHandler) GetChats(ctx *gin.Context) {
@@ -137,3 +238,262 @@ func (h *ChatHandler) GetMessages(ctx *gin.Context) {
 		"error": nil,
 	})
 }
+
+type EditMessageRequest struct {
+	Message string `json:"message" binding:"required"`
+}
+
+func (h *ChatHandler) EditMessage(ctx *gin.Context) {
+	userInterface, exists := ctx.Get("user")
+	if !exists {
+		ctx.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusInternalServerError,
+			"body":   gin.H{},
+			"error":  "Internal Server Error",
+		})
+		return
+	}
+	user := userInterface.(*user.User)
+	messageId, err := strconv.ParseInt(ctx.Param("message_id"), 10, 64)
+	if err != nil {
+		ctx.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusBadRequest,
+			"body":   gin.H{},
+			"error":  "invalid id",
+		})
+		return
+	}
+	var request EditMessageRequest
+	if err := ctx.ShouldBindBodyWithJSON(&request); err != nil {
+		ctx.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusBadRequest,
+			"body":   gin.H{},
+			"error":  "invalid data",
+		})
+		return
+	}
+	message, err := h.chatService.EditMessage(user, messageId, request.Message)
+	if err == pgx.ErrNoRows {
+		ctx.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusNotFound,
+			"body":   gin.H{},
+			"error":  "message not found",
+		})
+		return
+	}
+	if err == customerror.ErrForbidden {
+		ctx.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusForbidden,
+			"body":   gin.H{},
+			"error":  "Forbidden",
+		})
+		return
+	}
+	if err == customerror.ErrMessageNotEditable {
+		ctx.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusBadRequest,
+			"body":   gin.H{},
+			"error":  "message can not be edited",
+		})
+		return
+	}
+	if err != nil {
+		ctx.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusInternalServerError,
+			"body":   gin.H{},
+			"error":  "Internal Server Error",
+		})
+		log.Println(err.Error())
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{
+		"status": http.StatusOK,
+		"body": gin.H{
+			"message": message,
+		},
+		"error": nil,
+	})
+}
+
+func (h *ChatHandler) DeleteMessage(ctx *gin.Context) {
+	userInterface, exists := ctx.Get("user")
+	if !exists {
+		ctx.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusInternalServerError,
+			"body":   gin.H{},
+			"error":  "Internal Server Error",
+		})
+		return
+	}
+	user := userInterface.(*user.User)
+	messageId, err := strconv.ParseInt(ctx.Param("message_id"), 10, 64)
+	if err != nil {
+		ctx.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusBadRequest,
+			"body":   gin.H{},
+			"error":  "invalid id",
+		})
+		return
+	}
+	forEveryone := ctx.DefaultQuery("for", "me") == "everyone"
+	err = h.chatService.DeleteMessage(user, messageId, forEveryone)
+	if err == pgx.ErrNoRows {
+		ctx.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusNotFound,
+			"body":   gin.H{},
+			"error":  "message not found",
+		})
+		return
+	}
+	if err == customerror.ErrForbidden {
+		ctx.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusForbidden,
+			"body":   gin.H{},
+			"error":  "Forbidden",
+		})
+		return
+	}
+	if err != nil {
+		ctx.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusInternalServerError,
+			"body":   gin.H{},
+			"error":  "Internal Server Error",
+		})
+		log.Println(err.Error())
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{
+		"status": http.StatusOK,
+		"body":   gin.H{},
+		"error":  nil,
+	})
+}
+
+func (h *ChatHandler) SearchMessages(ctx *gin.Context) {
+	user := ctx.MustGet("user").(*user.User)
+	query := strings.TrimSpace(ctx.Query("q"))
+	if query == "" {
+		ctx.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusBadRequest,
+			"body":   gin.H{},
+			"error":  "invalid data",
+		})
+		return
+	}
+	withUser := uuid.Nil
+	if userIdStr := ctx.Query("user_id"); userIdStr != "" {
+		userId, err := uuid.Parse(userIdStr)
+		if err != nil {
+			ctx.AbortWithStatusJSON(http.StatusOK, gin.H{
+				"status": http.StatusBadRequest,
+				"body":   gin.H{},
+				"error":  "invalid user id",
+			})
+			return
+		}
+		withUser = userId
+	}
+	conversationId, err := strconv.ParseInt(ctx.Query("conversation_id"), 10, 64)
+	if err != nil {
+		conversationId = 0
+	}
+	limit, err := strconv.ParseInt(ctx.Query("limit"), 10, 64)
+	if err != nil || limit <= 0 || limit > 50 {
+		limit = 20
+	}
+	offset, err := strconv.ParseInt(ctx.Query("offset"), 10, 64)
+	if err != nil {
+		offset = 0
+	}
+	results, err := h.chatService.SearchMessages(user, query, withUser, conversationId, offset, limit)
+	if err != nil {
+		ctx.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusInternalServerError,
+			"body":   gin.H{},
+			"error":  "Internal Server Error",
+		})
+		log.Println(err.Error())
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{
+		"status": http.StatusOK,
+		"body": gin.H{
+			"results": results,
+		},
+		"error": nil,
+	})
+}
+
+// ExportMessages отдает переписку файлом. Ответ пишется потоком, поэтому ошибки после начала записи только логируются.
+func (h *ChatHandler) ExportMessages(ctx *gin.Context) {
+	user := ctx.MustGet("user").(*user.User)
+	withUser, err := uuid.Parse(ctx.Param("user_id"))
+	if err != nil {
+		ctx.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusBadRequest,
+			"body":   gin.H{},
+			"error":  "invalid user id",
+		})
+		return
+	}
+	format := ctx.DefaultQuery("format", service.ExportFormatJSON)
+	contentType := "application/json; charset=utf-8"
+	switch format {
+	case service.ExportFormatJSON:
+	case service.ExportFormatText:
+		contentType = "text/plain; charset=utf-8"
+	default:
+		ctx.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusBadRequest,
+			"body":   gin.H{},
+			"error":  "invalid format",
+		})
+		return
+	}
+	writer := &exportWriter{ctx: ctx, contentType: contentType, fileName: fmt.Sprintf("chat-%s.%s", withUser, format)}
+	err = h.chatService.ExportMessages(user, withUser, format, writer)
+	if err == pgx.ErrNoRows && !writer.started {
+		ctx.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusNotFound,
+			"body":   gin.H{},
+			"error":  "user not found",
+		})
+		return
+	}
+	if err != nil && !writer.started {
+		ctx.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusInternalServerError,
+			"body":   gin.H{},
+			"error":  "Internal Server Error",
+		})
+		log.Println(err.Error())
+		return
+	}
+	if err != nil {
+		log.Println(err.Error())
+	}
+}
+
+// exportWriter выставляет заголовки файла только при первой записи, чтобы до нее можно было ответить обычной ошибкой
+type exportWriter struct {
+	ctx         *gin.Context
+	contentType string
+	fileName    string
+	started     bool
+}
+
+func (w *exportWriter) Write(data []byte) (int, error) {
+	if !w.started {
+		w.started = true
+		w.ctx.Header("Content-Type", w.contentType)
+		w.ctx.Header("Content-Disposition", `attachment; filename="`+w.fileName+`"`)
+		w.ctx.Status(http.StatusOK)
+	}
+	return w.ctx.Writer.Write(data)
+}
+
+func (w *exportWriter) Flush() {
+	if w.started {
+		w.ctx.Writer.Flush()
+	}
+}
@@ -0,0 +1,317 @@
+package handler
+
+import (
+	"log"
+	"mymate/internal/middlewares"
+	"mymate/internal/service"
+	"mymate/pkg/customerror"
+	"mymate/pkg/user"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+type ConversationHandlerI interface {
+	RegisterRoutes(group *gin.RouterGroup)
+	CreateConversation(ctx *gin.Context)
+	GetConversations(ctx *gin.Context)
+	GetConversation(ctx *gin.Context)
+	GetMessages(ctx *gin.Context)
+	InviteMembers(ctx *gin.Context)
+	RemoveMember(ctx *gin.Context)
+	SetMemberRole(ctx *gin.Context)
+}
+
+type ConversationHandler struct {
+	chatService service.ChatServiceI
+	middlewares middlewares.MiddlewaresI
+}
+
+func NewConversationHandler(chatService service.ChatServiceI, middlewares middlewares.MiddlewaresI) ConversationHandlerI {
+	return &ConversationHandler{
+		chatService: chatService,
+		middlewares: middlewares,
+	}
+}
+
+func (h *ConversationHandler) RegisterRoutes(group *gin.RouterGroup) {
+	conversations := group.Group("/conversations", h.middlewares.ValidUser())
+	conversations.GET("/", h.GetConversations)
+	conversations.POST("/", h.CreateConversation)
+	conversations.GET("/:id", h.GetConversation)
+	conversations.GET("/:id/messages", h.GetMessages)
+	conversations.POST("/:id/members", h.InviteMembers)
+	conversations.PATCH("/:id/members/:user_id", h.SetMemberRole)
+	// Удаление себя - выход из беседы, удаление другого участника - исключение (только для администраторов)
+	conversations.DELETE("/:id/members/:user_id", h.RemoveMember)
+}
+
+// abortWithConversationError отвечает на ошибки сервиса бесед
+func abortWithConversationError(ctx *gin.Context, err error) {
+	switch err {
+	case pgx.ErrNoRows:
+		ctx.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusNotFound,
+			"body":   gin.H{},
+			"error":  "not found",
+		})
+	case customerror.ErrForbidden:
+		ctx.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusForbidden,
+			"body":   gin.H{},
+			"error":  "Forbidden",
+		})
+	case customerror.ErrSelfAction:
+		ctx.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusBadRequest,
+			"body":   gin.H{},
+			"error":  "can not apply to yourself",
+		})
+	case customerror.ErrTooManyMembers:
+		ctx.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusBadRequest,
+			"body":   gin.H{},
+			"error":  "too many members",
+		})
+	default:
+		ctx.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusInternalServerError,
+			"body":   gin.H{},
+			"error":  "Internal Server Error",
+		})
+		log.Println(err.Error())
+	}
+}
+
+type CreateConversationRequest struct {
+	Title     string      `json:"title" binding:"required"`
+	FlatId    int64       `json:"flat_id"`
+	MemberIds []uuid.UUID `json:"member_ids"`
+}
+
+func (h *ConversationHandler) CreateConversation(ctx *gin.Context) {
+	user := ctx.MustGet("user").(*user.User)
+	var request CreateConversationRequest
+	if err := ctx.ShouldBindBodyWithJSON(&request); err != nil {
+		ctx.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusBadRequest,
+			"body":   gin.H{},
+			"error":  "invalid data",
+		})
+		return
+	}
+	conversation, err := h.chatService.CreateConversation(user, request.Title, request.FlatId, request.MemberIds)
+	if err != nil {
+		abortWithConversationError(ctx, err)
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{
+		"status": http.StatusOK,
+		"body": gin.H{
+			"conversation": conversation,
+		},
+		"error": nil,
+	})
+}
+
+func (h *ConversationHandler) GetConversations(ctx *gin.Context) {
+	user := ctx.MustGet("user").(*user.User)
+	conversations, err := h.chatService.GetConversations(user)
+	if err != nil {
+		abortWithConversationError(ctx, err)
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{
+		"status": http.StatusOK,
+		"body": gin.H{
+			"conversations": conversations,
+		},
+		"error": nil,
+	})
+}
+
+func (h *ConversationHandler) GetConversation(ctx *gin.Context) {
+	user := ctx.MustGet("user").(*user.User)
+	conversationId, err := strconv.ParseInt(ctx.Param("id"), 10, 64)
+	if err != nil {
+		ctx.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusBadRequest,
+			"body":   gin.H{},
+			"error":  "invalid id",
+		})
+		return
+	}
+	conversation, err := h.chatService.GetConversation(user, conversationId)
+	if err != nil {
+		abortWithConversationError(ctx, err)
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{
+		"status": http.StatusOK,
+		"body": gin.H{
+			"conversation": conversation,
+		},
+		"error": nil,
+	})
+}
+
+func (h *ConversationHandler) GetMessages(ctx *gin.Context) {
+	user := ctx.MustGet("user").(*user.User)
+	conversationId, err := strconv.ParseInt(ctx.Param("id"), 10, 64)
+	if err != nil {
+		ctx.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusBadRequest,
+			"body":   gin.H{},
+			"error":  "invalid id",
+		})
+		return
+	}
+	limit, err := strconv.ParseInt(ctx.Query("limit"), 10, 64)
+	if err != nil {
+		limit = 20
+	}
+	offset, err := strconv.ParseInt(ctx.Query("offset"), 10, 64)
+	if err != nil {
+		offset = 0
+	}
+	from, err := strconv.ParseInt(ctx.Query("from"), 10, 64)
+	if err != nil {
+		from = -1
+	}
+	messages, err := h.chatService.GetConversationMessages(user, conversationId, from, offset, limit)
+	if err != nil {
+		abortWithConversationError(ctx, err)
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{
+		"status": http.StatusOK,
+		"body": gin.H{
+			"messages": messages,
+		},
+		"error": nil,
+	})
+}
+
+type InviteMembersRequest struct {
+	UserIds []uuid.UUID `json:"user_ids" binding:"required,min=1"`
+}
+
+func (h *ConversationHandler) InviteMembers(ctx *gin.Context) {
+	user := ctx.MustGet("user").(*user.User)
+	conversationId, err := strconv.ParseInt(ctx.Param("id"), 10, 64)
+	if err != nil {
+		ctx.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusBadRequest,
+			"body":   gin.H{},
+			"error":  "invalid id",
+		})
+		return
+	}
+	var request InviteMembersRequest
+	if err := ctx.ShouldBindBodyWithJSON(&request); err != nil {
+		ctx.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusBadRequest,
+			"body":   gin.H{},
+			"error":  "invalid data",
+		})
+		return
+	}
+	conversation, err := h.chatService.InviteMembers(user, conversationId, request.UserIds)
+	if err != nil {
+		abortWithConversationError(ctx, err)
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{
+		"status": http.StatusOK,
+		"body": gin.H{
+			"conversation": conversation,
+		},
+		"error": nil,
+	})
+}
+
+func (h *ConversationHandler) RemoveMember(ctx *gin.Context) {
+	user := ctx.MustGet("user").(*user.User)
+	conversationId, err := strconv.ParseInt(ctx.Param("id"), 10, 64)
+	if err != nil {
+		ctx.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusBadRequest,
+			"body":   gin.H{},
+			"error":  "invalid id",
+		})
+		return
+	}
+	memberId, err := uuid.Parse(ctx.Param("user_id"))
+	if err != nil {
+		ctx.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusBadRequest,
+			"body":   gin.H{},
+			"error":  "invalid user id",
+		})
+		return
+	}
+	if memberId == user.UUID {
+		err = h.chatService.LeaveConversation(user, conversationId)
+	} else {
+		err = h.chatService.KickMember(user, conversationId, memberId)
+	}
+	if err != nil {
+		abortWithConversationError(ctx, err)
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{
+		"status": http.StatusOK,
+		"body":   gin.H{},
+		"error":  nil,
+	})
+}
+
+type SetMemberRoleRequest struct {
+	Role string `json:"role" binding:"required,oneof=admin member"`
+}
+
+func (h *ConversationHandler) SetMemberRole(ctx *gin.Context) {
+	user := ctx.MustGet("user").(*user.User)
+	conversationId, err := strconv.ParseInt(ctx.Param("id"), 10, 64)
+	if err != nil {
+		ctx.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusBadRequest,
+			"body":   gin.H{},
+			"error":  "invalid id",
+		})
+		return
+	}
+	memberId, err := uuid.Parse(ctx.Param("user_id"))
+	if err != nil {
+		ctx.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusBadRequest,
+			"body":   gin.H{},
+			"error":  "invalid user id",
+		})
+		return
+	}
+	var request SetMemberRoleRequest
+	if err := ctx.ShouldBindBodyWithJSON(&request); err != nil {
+		ctx.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusBadRequest,
+			"body":   gin.H{},
+			"error":  "invalid data",
+		})
+		return
+	}
+	conversation, err := h.chatService.SetMemberRole(user, conversationId, memberId, request.Role)
+	if err != nil {
+		abortWithConversationError(ctx, err)
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{
+		"status": http.StatusOK,
+		"body": gin.H{
+			"conversation": conversation,
+		},
+		"error": nil,
+	})
+}
@@ -1,11 +1,14 @@
 package handler
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"mymate/internal/middlewares"
 	"mymate/internal/service"
+	"mymate/pkg/customerror"
 	modelsFlat "mymate/pkg/flat"
+	"mymate/pkg/imageproc"
 	modelsUser "mymate/pkg/user"
 	"net/http"
 	"strconv"
@@ -25,6 +28,12 @@ type FlatHandlerI interface {
 	GetFlatImages(ctx *gin.Context)
 	InsertFlatImage(ctx *gin.Context)
 	DeleteFlatImage(ctx *gin.Context)
+	ReorderFlatImages(ctx *gin.Context)
+	GetFlatMedia(ctx *gin.Context)
+	InsertFlatMedia(ctx *gin.Context)
+	DeleteFlatMedia(ctx *gin.Context)
+	GetFlatStats(ctx *gin.Context)
+	GetRecentlyViewed(ctx *gin.Context)
 }
 
 type FlatHandler struct {
@@ -53,7 +62,14 @@ func (flatHandler *FlatHandler) RegisterRoutes(group *gin.RouterGroup) {
 	flatGroup.DELETE("/:id", flatHandler.middlewares.MyFlat(), flatHandler.DeleteFlat)
 	flatGroup.GET("/:id/images", flatHandler.GetFlatImages)
 	flatGroup.POST("/:id/images", flatHandler.middlewares.MyFlat(), flatHandler.InsertFlatImage)
+	flatGroup.PUT("/:id/images/order", flatHandler.middlewares.MyFlat(), flatHandler.ReorderFlatImages)
 	flatGroup.DELETE("/:id/images/:image_id", flatHandler.middlewares.MyFlat(), flatHandler.DeleteFlatImage)
+	flatGroup.GET("/:id/media", flatHandler.GetFlatMedia)
+	flatGroup.POST("/:id/media", flatHandler.middlewares.MyFlat(), flatHandler.InsertFlatMedia)
+	flatGroup.DELETE("/:id/media/:media_id", flatHandler.middlewares.MyFlat(), flatHandler.DeleteFlatMedia)
+	flatGroup.GET("/:id/stats", flatHandler.middlewares.MyFlat(), flatHandler.GetFlatStats)
+	me := group.Group("/me", flatHandler.middlewares.ValidUser())
+	me.GET("/recently-viewed", flatHandler.GetRecentlyViewed)
 }
 
 func (flatHandler *FlatHandler) GetFlats(ctx *gin.Context) {
@@ -116,6 +132,12 @@ func (flatHandler *FlatHandler) GetFlats(ctx *gin.Context) {
 	} else {
 		filters["created_by_id"] = createdById
 	}
+	viewer := ctx.MustGet("user").(*modelsUser.User)
+	filters["viewer_id"] = viewer.UUID
+	// sort=popular сортирует по числу просмотров, иначе продвинутые и новые объявления первыми
+	if ctx.Query("sort") == "popular" {
+		filters["sort"] = "popular"
+	}
 
 	flats, err := flatHandler.flatService.GetFlats(offsetInt, limitInt, filters)
 	if err != nil {
@@ -128,6 +150,10 @@ func (flatHandler *FlatHandler) GetFlats(ctx *gin.Context) {
 		return
 	}
 
+	for i := range flats {
+		flats[i].HideOwnerStats(viewer)
+	}
+
 	ctx.JSON(http.StatusOK, gin.H{
 		"status": http.StatusOK,
 		"body": gin.H{
@@ -166,6 +192,9 @@ func (flatHandler *FlatHandler) GetFlat(ctx *gin.Context) {
 		log.Print(err.Error())
 		return
 	}
+	viewer := ctx.MustGet("user").(*modelsUser.User)
+	flatHandler.flatService.RecordView(flat, viewer)
+	flat.HideOwnerStats(viewer)
 	ctx.JSON(http.StatusOK, gin.H{
 		"status": http.StatusOK,
 		"body": gin.H{
@@ -400,6 +429,16 @@ func (fileHandler *FlatHandler) GetFlatImages(ctx *gin.Context) {
 		"error": nil,
 	})
 }
+
+type FlatImageUploadResult struct {
+	Filename string                `json:"filename"`
+	Image    *modelsFlat.FlatImage `json:"image"`
+	Error    *string               `json:"error"`
+}
+
+// InsertFlatImage принимает один или несколько файлов в полях file/files и возвращает результат по каждому.
+// Ошибка одного файла не отменяет загрузку остальных, но если не сохранился ни один, в конверте статус ошибки.
+// При загрузке одного файла в теле есть и image, как раньше.
 func (fileHandler *FlatHandler) InsertFlatImage(ctx *gin.Context) {
 	flat, exists := ctx.Get("flat")
 	if !exists {
@@ -412,7 +451,18 @@ func (fileHandler *FlatHandler) InsertFlatImage(ctx *gin.Context) {
 		return
 	}
 	flatInt := flat.(*modelsFlat.Flat)
-	file, err := ctx.FormFile("file")
+	// Запас сверх размера всех фотографий - на заголовки multipart
+	ctx.Request.Body = http.MaxBytesReader(ctx.Writer, ctx.Request.Body, modelsFlat.MaxImages*imageproc.DefaultLimits.MaxBytes+1<<20)
+	form, err := ctx.MultipartForm()
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		ctx.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusRequestEntityTooLarge,
+			"body":   gin.H{},
+			"error":  "request too large",
+		})
+		return
+	}
 	if err != nil {
 		ctx.AbortWithStatusJSON(http.StatusOK, gin.H{
 			"status": http.StatusBadRequest,
@@ -421,7 +471,116 @@ func (fileHandler *FlatHandler) InsertFlatImage(ctx *gin.Context) {
 		})
 		return
 	}
-	err = fileHandler.flatService.InsertFlatImage(file, flatInt)
+	files := append(form.File["file"], form.File["files"]...)
+	if len(files) == 0 {
+		ctx.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusBadRequest,
+			"body":   gin.H{},
+			"error":  "invalid file",
+		})
+		return
+	}
+	if len(files) > modelsFlat.MaxImages {
+		ctx.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusBadRequest,
+			"body":   gin.H{},
+			"error":  "too many images",
+		})
+		return
+	}
+	results := make([]FlatImageUploadResult, 0, len(files))
+	status := http.StatusOK
+	saved := 0
+	for _, file := range files {
+		result := FlatImageUploadResult{Filename: file.Filename}
+		image, err := fileHandler.flatService.InsertFlatImage(file, flatInt)
+		var message string
+		switch {
+		case err == nil:
+			result.Image = image
+			saved++
+		case err == customerror.ErrInvalidImage:
+			message, status = "invalid image", http.StatusBadRequest
+		case err == customerror.ErrImageTooLarge:
+			message, status = "image too large", http.StatusRequestEntityTooLarge
+		case err == customerror.ErrTooManyImages:
+			message, status = "too many images", http.StatusBadRequest
+		default:
+			message, status = "Internal Server Error", http.StatusInternalServerError
+			log.Print(err.Error())
+		}
+		if message != "" {
+			result.Error = &message
+		}
+		results = append(results, result)
+	}
+	// Для одного файла ответ остается прежним: image в теле и ошибка в конверте
+	if len(files) == 1 {
+		if results[0].Error != nil {
+			ctx.AbortWithStatusJSON(http.StatusOK, gin.H{
+				"status": status,
+				"body": gin.H{
+					"results": results,
+				},
+				"error": *results[0].Error,
+			})
+			return
+		}
+		ctx.JSON(http.StatusOK, gin.H{
+			"status": http.StatusOK,
+			"body": gin.H{
+				"image":   results[0].Image,
+				"results": results,
+			},
+			"error": nil,
+		})
+		return
+	}
+	if saved == 0 {
+		ctx.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": status,
+			"body": gin.H{
+				"results": results,
+			},
+			"error": "no images saved",
+		})
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{
+		"status": http.StatusOK,
+		"body": gin.H{
+			"results": results,
+		},
+		"error": nil,
+	})
+}
+
+type ReorderFlatImagesRequest struct {
+	ImageIds []int64 `json:"image_ids" binding:"required"`
+	CoverId  int64   `json:"cover_id"`
+}
+
+// ReorderFlatImages задает порядок галереи. В image_ids должны быть все фотографии объявления.
+func (fileHandler *FlatHandler) ReorderFlatImages(ctx *gin.Context) {
+	flat := ctx.MustGet("flat").(*modelsFlat.Flat)
+	var request ReorderFlatImagesRequest
+	if err := ctx.ShouldBindBodyWithJSON(&request); err != nil {
+		ctx.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusBadRequest,
+			"body":   gin.H{},
+			"error":  "invalid data",
+		})
+		return
+	}
+	images, err := fileHandler.flatService.ReorderFlatImages(flat, request.ImageIds, request.CoverId)
+	if err == customerror.ErrInvalidImageOrder {
+		ctx.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusBadRequest,
+			"body":   gin.H{},
+			"error":  "image_ids must list every image of the flat once",
+		})
+		return
+	}
 	if err != nil {
 		ctx.AbortWithStatusJSON(http.StatusOK, gin.H{
 			"status": http.StatusInternalServerError,
@@ -433,10 +592,13 @@ func (fileHandler *FlatHandler) InsertFlatImage(ctx *gin.Context) {
 	}
 	ctx.JSON(http.StatusOK, gin.H{
 		"status": http.StatusOK,
-		"body":   gin.H{},
-		"error":  nil,
+		"body": gin.H{
+			"images": images,
+		},
+		"error": nil,
 	})
 }
+
 func (fileHandler *FlatHandler) DeleteFlatImage(ctx *gin.Context) {
 	flat, exists := ctx.Get("flat")
 	if !exists {
@@ -494,3 +656,210 @@ func (fileHandler *FlatHandler) DeleteFlatImage(ctx *gin.Context) {
 		"error":  "image not found",
 	})
 }
+
+// GetFlatMedia отдает видео и планировки объявления, kind=video|floor_plan оставляет только один вид
+func (flatHandler *FlatHandler) GetFlatMedia(ctx *gin.Context) {
+	flatId, err := strconv.ParseInt(ctx.Param("id"), 10, 64)
+	if err != nil {
+		ctx.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusBadRequest,
+			"body":   gin.H{},
+			"error":  "invalid id",
+		})
+		return
+	}
+	kind := ctx.Query("kind")
+	if kind != "" && modelsFlat.MaxMedia(kind) == 0 {
+		ctx.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusBadRequest,
+			"body":   gin.H{},
+			"error":  "invalid kind",
+		})
+		return
+	}
+	media, err := flatHandler.flatService.GetFlatMedia(flatId, kind)
+	if err != nil {
+		ctx.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusInternalServerError,
+			"body":   gin.H{},
+			"error":  "Internal Server Error",
+		})
+		log.Print(err.Error())
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{
+		"status": http.StatusOK,
+		"body": gin.H{
+			"media": media,
+		},
+		"error": nil,
+	})
+}
+
+// InsertFlatMedia принимает один файл в поле file, вид задается полем kind (video или floor_plan)
+func (flatHandler *FlatHandler) InsertFlatMedia(ctx *gin.Context) {
+	flat := ctx.MustGet("flat").(*modelsFlat.Flat)
+	// Запас сверх размера видео - на заголовки multipart
+	ctx.Request.Body = http.MaxBytesReader(ctx.Writer, ctx.Request.Body, modelsFlat.MaxVideoBytes+1<<20)
+	file, err := ctx.FormFile("file")
+	if err != nil {
+		ctx.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusBadRequest,
+			"body":   gin.H{},
+			"error":  "invalid file",
+		})
+		return
+	}
+	var media *modelsFlat.FlatMedia
+	switch ctx.PostForm("kind") {
+	case modelsFlat.MediaKindVideo:
+		media, err = flatHandler.flatService.InsertFlatVideo(file, flat)
+	case modelsFlat.MediaKindFloorPlan:
+		media, err = flatHandler.flatService.InsertFloorPlan(file, flat)
+	default:
+		ctx.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusBadRequest,
+			"body":   gin.H{},
+			"error":  "invalid kind",
+		})
+		return
+	}
+	var message string
+	switch err {
+	case nil:
+	case customerror.ErrInvalidVideo:
+		message = "invalid video"
+	case customerror.ErrVideoTooLarge:
+		message = fmt.Sprintf("video larger than %d MB", modelsFlat.MaxVideoBytes>>20)
+	case customerror.ErrVideoTooLong:
+		message = fmt.Sprintf("video longer than %s", modelsFlat.MaxVideoDuration)
+	case customerror.ErrInvalidImage:
+		message = "invalid image"
+	case customerror.ErrImageTooLarge:
+		message = "image too large"
+	case customerror.ErrTooManyMedia:
+		message = "too many media"
+	default:
+		ctx.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusInternalServerError,
+			"body":   gin.H{},
+			"error":  "Internal Server Error",
+		})
+		log.Print(err.Error())
+		return
+	}
+	if message != "" {
+		ctx.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusBadRequest,
+			"body":   gin.H{},
+			"error":  message,
+		})
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{
+		"status": http.StatusOK,
+		"body": gin.H{
+			"media": media,
+		},
+		"error": nil,
+	})
+}
+
+func (flatHandler *FlatHandler) DeleteFlatMedia(ctx *gin.Context) {
+	flat := ctx.MustGet("flat").(*modelsFlat.Flat)
+	mediaId, err := strconv.ParseInt(ctx.Param("media_id"), 10, 64)
+	if err != nil {
+		ctx.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusBadRequest,
+			"body":   gin.H{},
+			"error":  "invalid id",
+		})
+		return
+	}
+	media, err := flatHandler.flatService.GetFlatMediaItem(flat.Id, mediaId)
+	if err == nil {
+		err = flatHandler.flatService.DeleteFlatMedia(media)
+	}
+	if err == pgx.ErrNoRows {
+		ctx.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusNotFound,
+			"body":   gin.H{},
+			"error":  "media not found",
+		})
+		return
+	}
+	if err != nil {
+		ctx.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusInternalServerError,
+			"body":   gin.H{},
+			"error":  "Internal Server Error",
+		})
+		log.Print(err.Error())
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{
+		"status": http.StatusOK,
+		"body":   gin.H{},
+		"error":  nil,
+	})
+}
+
+// GetFlatStats отдает владельцу статистику объявления за последние days дней (по умолчанию 30, не больше 365)
+func (flatHandler *FlatHandler) GetFlatStats(ctx *gin.Context) {
+	flat := ctx.MustGet("flat").(*modelsFlat.Flat)
+	days, err := strconv.ParseInt(ctx.DefaultQuery("days", "30"), 10, 64)
+	if err != nil || days <= 0 || days > 365 {
+		ctx.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusBadRequest,
+			"body":   gin.H{},
+			"error":  "invalid days",
+		})
+		return
+	}
+	stats, err := flatHandler.flatService.GetFlatStats(flat, days)
+	if err != nil {
+		ctx.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusInternalServerError,
+			"body":   gin.H{},
+			"error":  "Internal Server Error",
+		})
+		log.Print(err.Error())
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{
+		"status": http.StatusOK,
+		"body": gin.H{
+			"stats": stats,
+		},
+		"error": nil,
+	})
+}
+
+func (flatHandler *FlatHandler) GetRecentlyViewed(ctx *gin.Context) {
+	user := ctx.MustGet("user").(*modelsUser.User)
+	limit, err := strconv.ParseInt(ctx.DefaultQuery("limit", "20"), 10, 64)
+	if err != nil || limit <= 0 || limit > 100 {
+		limit = 20
+	}
+	offset, err := strconv.ParseInt(ctx.DefaultQuery("offset", "0"), 10, 64)
+	if err != nil || offset < 0 {
+		offset = 0
+	}
+	viewed, err := flatHandler.flatService.GetRecentlyViewed(user, offset, limit)
+	if err != nil {
+		ctx.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusInternalServerError,
+			"body":   gin.H{},
+			"error":  "Internal Server Error",
+		})
+		log.Print(err.Error())
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{
+		"status": http.StatusOK,
+		"body": gin.H{
+			"flats": viewed,
+		},
+		"error": nil,
+	})
+}
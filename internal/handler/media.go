@@ -0,0 +1,182 @@
+package handler
+
+import (
+	"errors"
+	"io"
+	"log"
+	"mymate/internal/middlewares"
+	"mymate/internal/service"
+	"mymate/pkg/blobstore"
+	"mymate/pkg/customerror"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/jackc/pgx/v5"
+)
+
+type MediaHandlerI interface {
+	RegisterRoutes(group *gin.RouterGroup)
+	RegisterAdminRoutes(group *gin.RouterGroup)
+	ServeMedia(ctx *gin.Context)
+	CollectGarbage(ctx *gin.Context)
+}
+
+type MediaHandler struct {
+	mediaService service.MediaServiceI
+	jwtService   service.JWTServiceI
+	middlewares  middlewares.MiddlewaresI
+}
+
+func NewMediaHandler(mediaService service.MediaServiceI, jwtService service.JWTServiceI, middlewares middlewares.MiddlewaresI) MediaHandlerI {
+	return &MediaHandler{
+		mediaService: mediaService,
+		jwtService:   jwtService,
+		middlewares:  middlewares,
+	}
+}
+
+// RegisterRoutes регистрирует /media в корне, по тем же адресам, что сохранены в url изображений
+func (h *MediaHandler) RegisterRoutes(group *gin.RouterGroup) {
+	group.GET("/media/*path", h.ServeMedia)
+	group.HEAD("/media/*path", h.ServeMedia)
+}
+
+func (h *MediaHandler) RegisterAdminRoutes(group *gin.RouterGroup) {
+	moderationGroup := group.Group("/moderation", h.middlewares.ValidUser(), h.middlewares.SuperUser())
+	moderationGroup.POST("/media-gc", h.CollectGarbage)
+}
+
+// ServeMedia отдает файл из хранилища. В отличие от API ответы здесь с настоящими HTTP-статусами:
+// файлы запрашивают браузер и CDN, которым нужны 304, 206 и 404.
+func (h *MediaHandler) ServeMedia(ctx *gin.Context) {
+	key, err := blobstore.CleanKey(strings.TrimPrefix(ctx.Param("path"), "/"))
+	if err != nil || hasHiddenSegment(key) {
+		ctx.Status(http.StatusNotFound)
+		return
+	}
+	private := h.mediaService.IsPrivate(key)
+	if private && !h.mediaService.VerifySignature(key, ctx.Query("expires"), ctx.Query("signature")) {
+		user, err := h.jwtService.ValidateToken(ctx.GetHeader("Authorization"))
+		if errors.Is(err, jwt.ErrTokenExpired) || err == customerror.ErrJwtInvalid || err == customerror.ErrJwtVersionIncorrect || err == pgx.ErrNoRows {
+			ctx.Status(http.StatusUnauthorized)
+			return
+		}
+		if err != nil {
+			ctx.Status(http.StatusInternalServerError)
+			customErr := err.(customerror.CustomError)
+			customErr.AppendModule("ServeMedia")
+			log.Println(customErr.Error())
+			return
+		}
+		allowed, err := h.mediaService.CanAccess(key, user)
+		if err != nil {
+			ctx.Status(http.StatusInternalServerError)
+			customErr := err.(customerror.CustomError)
+			customErr.AppendModule("ServeMedia")
+			log.Println(customErr.Error())
+			return
+		}
+		if !allowed {
+			ctx.Status(http.StatusForbidden)
+			return
+		}
+	}
+	object, err := h.mediaService.Open(ctx.Request.Context(), key)
+	if err == blobstore.ErrNotFound || err == blobstore.ErrInvalidKey {
+		ctx.Status(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		ctx.Status(http.StatusInternalServerError)
+		customErr := err.(customerror.CustomError)
+		customErr.AppendModule("ServeMedia")
+		log.Println(customErr.Error())
+		return
+	}
+	defer object.Body.Close()
+	contentType, err := mediaContentType(object)
+	if err != nil {
+		ctx.Status(http.StatusInternalServerError)
+		log.Printf("ERROR|ServeMedia:%s", err.Error())
+		return
+	}
+	header := ctx.Writer.Header()
+	if !inlineMediaType(contentType) {
+		contentType = "application/octet-stream"
+		header.Set("Content-Disposition", "attachment")
+	}
+	header.Set("Content-Type", contentType)
+	header.Set("X-Content-Type-Options", "nosniff")
+	// Загруженный пользователем файл не должен исполняться как страница нашего домена
+	header.Set("Content-Security-Policy", "default-src 'none'; style-src 'unsafe-inline'; sandbox")
+	if object.ETag != "" {
+		header.Set("ETag", object.ETag)
+	}
+	cacheControl := "public, max-age=3600"
+	if h.mediaService.IsImmutable(key) {
+		cacheControl = "public, max-age=31536000, immutable"
+	}
+	if private {
+		cacheControl = strings.Replace(cacheControl, "public", "private", 1)
+		header.Set("Vary", "Authorization")
+	}
+	header.Set("Cache-Control", cacheControl)
+	http.ServeContent(ctx.Writer, ctx.Request, path.Base(key), object.ModTime, object.Body)
+}
+
+// hasHiddenSegment отсекает служебные файлы хранилища, например недописанные загрузки
+func hasHiddenSegment(key string) bool {
+	for _, part := range strings.Split(key, "/") {
+		if strings.HasPrefix(part, ".") {
+			return true
+		}
+	}
+	return false
+}
+
+// inlineMediaType - типы, которые можно показывать в браузере. Остальное отдается на скачивание.
+func inlineMediaType(contentType string) bool {
+	return strings.HasPrefix(contentType, "image/") || strings.HasPrefix(contentType, "video/") ||
+		strings.HasPrefix(contentType, "audio/") || contentType == "application/pdf"
+}
+
+// mediaContentType доверяет типу из хранилища, а если его нет, определяет тип по первым байтам файла
+func mediaContentType(object *blobstore.Object) (string, error) {
+	if object.ContentType != "" && object.ContentType != "application/octet-stream" && object.ContentType != "binary/octet-stream" {
+		return object.ContentType, nil
+	}
+	buffer := make([]byte, 512)
+	n, err := io.ReadFull(object.Body, buffer)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", err
+	}
+	if _, err := object.Body.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	return http.DetectContentType(buffer[:n]), nil
+}
+
+// CollectGarbage запускает сверку хранилища с базой. По умолчанию только отчет, удаление - с dry_run=false.
+func (h *MediaHandler) CollectGarbage(ctx *gin.Context) {
+	dryRun := ctx.DefaultQuery("dry_run", "true") != "false"
+	report, err := h.mediaService.CollectGarbage(dryRun)
+	if err != nil {
+		ctx.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusInternalServerError,
+			"body":   gin.H{},
+			"error":  "Internal Server Error",
+		})
+		log.Println(err.Error())
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{
+		"status": http.StatusOK,
+		"body": gin.H{
+			"report": report,
+		},
+		"error": nil,
+	})
+}
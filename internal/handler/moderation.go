@@ -0,0 +1,445 @@
+package handler
+
+import (
+	"log"
+	"mymate/internal/middlewares"
+	"mymate/internal/service"
+	"mymate/pkg/customerror"
+	"mymate/pkg/moderation"
+	"mymate/pkg/user"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+type ModerationHandlerI interface {
+	RegisterRoutes(group *gin.RouterGroup)
+	BlockUser(ctx *gin.Context)
+	UnblockUser(ctx *gin.Context)
+	GetBlocks(ctx *gin.Context)
+	ReportUser(ctx *gin.Context)
+	GetReports(ctx *gin.Context)
+	UpdateReport(ctx *gin.Context)
+	GetChatStats(ctx *gin.Context)
+	UnmuteUser(ctx *gin.Context)
+	GetDuplicateImages(ctx *gin.Context)
+	UpdateDuplicateImage(ctx *gin.Context)
+}
+
+type ModerationHandler struct {
+	moderationService service.ModerationServiceI
+	middlewares       middlewares.MiddlewaresI
+}
+
+func NewModerationHandler(moderationService service.ModerationServiceI, middlewares middlewares.MiddlewaresI) ModerationHandlerI {
+	return &ModerationHandler{
+		moderationService: moderationService,
+		middlewares:       middlewares,
+	}
+}
+
+func (h *ModerationHandler) RegisterRoutes(group *gin.RouterGroup) {
+	users := group.Group("/users", h.middlewares.ValidUser())
+	users.GET("/:id/blocks", h.middlewares.ThisUserOrAdmin(), h.GetBlocks)
+	users.POST("/:id/block", h.BlockUser)
+	users.DELETE("/:id/block", h.UnblockUser)
+	users.POST("/:id/report", h.ReportUser)
+	moderationGroup := group.Group("/moderation", h.middlewares.ValidUser(), h.middlewares.SuperUser())
+	moderationGroup.GET("/reports", h.GetReports)
+	moderationGroup.PATCH("/reports/:id", h.UpdateReport)
+	moderationGroup.GET("/chat-stats", h.GetChatStats)
+	moderationGroup.DELETE("/mutes/:id", h.UnmuteUser)
+	moderationGroup.GET("/duplicate-images", h.GetDuplicateImages)
+	moderationGroup.PATCH("/duplicate-images/:id", h.UpdateDuplicateImage)
+}
+
+func (h *ModerationHandler) BlockUser(ctx *gin.Context) {
+	user := ctx.MustGet("user").(*user.User)
+	blockedId, err := uuid.Parse(ctx.Param("id"))
+	if err != nil {
+		ctx.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusBadRequest,
+			"body":   gin.H{},
+			"error":  "invalid id",
+		})
+		return
+	}
+	err = h.moderationService.BlockUser(user, blockedId)
+	if err == customerror.ErrSelfAction {
+		ctx.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusBadRequest,
+			"body":   gin.H{},
+			"error":  "can not block yourself",
+		})
+		return
+	}
+	if err == pgx.ErrNoRows {
+		ctx.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusNotFound,
+			"body":   gin.H{},
+			"error":  "user not found",
+		})
+		return
+	}
+	if err != nil {
+		ctx.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusInternalServerError,
+			"body":   gin.H{},
+			"error":  "Internal Server Error",
+		})
+		log.Println(err.Error())
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{
+		"status": http.StatusOK,
+		"body":   gin.H{},
+		"error":  nil,
+	})
+}
+
+func (h *ModerationHandler) UnblockUser(ctx *gin.Context) {
+	user := ctx.MustGet("user").(*user.User)
+	blockedId, err := uuid.Parse(ctx.Param("id"))
+	if err != nil {
+		ctx.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusBadRequest,
+			"body":   gin.H{},
+			"error":  "invalid id",
+		})
+		return
+	}
+	err = h.moderationService.UnblockUser(user, blockedId)
+	if err == pgx.ErrNoRows {
+		ctx.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusNotFound,
+			"body":   gin.H{},
+			"error":  "block not found",
+		})
+		return
+	}
+	if err != nil {
+		ctx.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusInternalServerError,
+			"body":   gin.H{},
+			"error":  "Internal Server Error",
+		})
+		log.Println(err.Error())
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{
+		"status": http.StatusOK,
+		"body":   gin.H{},
+		"error":  nil,
+	})
+}
+
+func (h *ModerationHandler) GetBlocks(ctx *gin.Context) {
+	blockerId, err := uuid.Parse(ctx.Param("id"))
+	if err != nil {
+		ctx.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusBadRequest,
+			"body":   gin.H{},
+			"error":  "invalid id",
+		})
+		return
+	}
+	blocks, err := h.moderationService.GetBlocks(blockerId)
+	if err != nil {
+		ctx.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusInternalServerError,
+			"body":   gin.H{},
+			"error":  "Internal Server Error",
+		})
+		log.Println(err.Error())
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{
+		"status": http.StatusOK,
+		"body": gin.H{
+			"blocks": blocks,
+		},
+		"error": nil,
+	})
+}
+
+type ReportUserRequest struct {
+	Reason string `json:"reason" binding:"required"`
+}
+
+func (h *ModerationHandler) ReportUser(ctx *gin.Context) {
+	user := ctx.MustGet("user").(*user.User)
+	reportedId, err := uuid.Parse(ctx.Param("id"))
+	if err != nil {
+		ctx.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusBadRequest,
+			"body":   gin.H{},
+			"error":  "invalid id",
+		})
+		return
+	}
+	var request ReportUserRequest
+	if err := ctx.ShouldBindBodyWithJSON(&request); err != nil {
+		ctx.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusBadRequest,
+			"body":   gin.H{},
+			"error":  "invalid data",
+		})
+		return
+	}
+	id, err := h.moderationService.ReportUser(user, reportedId, request.Reason)
+	if err == customerror.ErrSelfAction {
+		ctx.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusBadRequest,
+			"body":   gin.H{},
+			"error":  "can not report yourself",
+		})
+		return
+	}
+	if err == pgx.ErrNoRows {
+		ctx.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusNotFound,
+			"body":   gin.H{},
+			"error":  "user not found",
+		})
+		return
+	}
+	if err != nil {
+		ctx.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusInternalServerError,
+			"body":   gin.H{},
+			"error":  "Internal Server Error",
+		})
+		log.Println(err.Error())
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{
+		"status": http.StatusOK,
+		"body": gin.H{
+			"id": id,
+		},
+		"error": nil,
+	})
+}
+
+func (h *ModerationHandler) GetReports(ctx *gin.Context) {
+	limit, err := strconv.ParseInt(ctx.Query("limit"), 10, 64)
+	if err != nil {
+		limit = 20
+	}
+	offset, err := strconv.ParseInt(ctx.Query("offset"), 10, 64)
+	if err != nil {
+		offset = 0
+	}
+	status := ctx.DefaultQuery("status", moderation.ReportStatusPending)
+	reports, err := h.moderationService.GetReports(status, offset, limit)
+	if err != nil {
+		ctx.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusInternalServerError,
+			"body":   gin.H{},
+			"error":  "Internal Server Error",
+		})
+		log.Println(err.Error())
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{
+		"status": http.StatusOK,
+		"body": gin.H{
+			"reports": reports,
+		},
+		"error": nil,
+	})
+}
+
+type UpdateReportRequest struct {
+	Status string `json:"status" binding:"required"`
+}
+
+func (h *ModerationHandler) UpdateReport(ctx *gin.Context) {
+	id, err := strconv.ParseInt(ctx.Param("id"), 10, 64)
+	if err != nil {
+		ctx.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusBadRequest,
+			"body":   gin.H{},
+			"error":  "invalid id",
+		})
+		return
+	}
+	var request UpdateReportRequest
+	if err := ctx.ShouldBindBodyWithJSON(&request); err != nil ||
+		(request.Status != moderation.ReportStatusPending && request.Status != moderation.ReportStatusResolved && request.Status != moderation.ReportStatusDismissed) {
+		ctx.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusBadRequest,
+			"body":   gin.H{},
+			"error":  "invalid data",
+		})
+		return
+	}
+	err = h.moderationService.UpdateReportStatus(id, request.Status)
+	if err == pgx.ErrNoRows {
+		ctx.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusNotFound,
+			"body":   gin.H{},
+			"error":  "report not found",
+		})
+		return
+	}
+	if err != nil {
+		ctx.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusInternalServerError,
+			"body":   gin.H{},
+			"error":  "Internal Server Error",
+		})
+		log.Println(err.Error())
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{
+		"status": http.StatusOK,
+		"body":   gin.H{},
+		"error":  nil,
+	})
+}
+
+func (h *ModerationHandler) GetChatStats(ctx *gin.Context) {
+	days, err := strconv.ParseInt(ctx.Query("days"), 10, 64)
+	if err != nil || days <= 0 || days > 90 {
+		days = 7
+	}
+	limit, err := strconv.ParseInt(ctx.Query("limit"), 10, 64)
+	if err != nil {
+		limit = 20
+	}
+	offset, err := strconv.ParseInt(ctx.Query("offset"), 10, 64)
+	if err != nil {
+		offset = 0
+	}
+	stats, err := h.moderationService.GetChatStats(days, offset, limit)
+	if err != nil {
+		ctx.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusInternalServerError,
+			"body":   gin.H{},
+			"error":  "Internal Server Error",
+		})
+		log.Println(err.Error())
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{
+		"status": http.StatusOK,
+		"body": gin.H{
+			"stats": stats,
+		},
+		"error": nil,
+	})
+}
+
+func (h *ModerationHandler) UnmuteUser(ctx *gin.Context) {
+	userId, err := uuid.Parse(ctx.Param("id"))
+	if err != nil {
+		ctx.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusBadRequest,
+			"body":   gin.H{},
+			"error":  "invalid id",
+		})
+		return
+	}
+	err = h.moderationService.UnmuteUser(userId)
+	if err == pgx.ErrNoRows {
+		ctx.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusNotFound,
+			"body":   gin.H{},
+			"error":  "mute not found",
+		})
+		return
+	}
+	if err != nil {
+		ctx.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusInternalServerError,
+			"body":   gin.H{},
+			"error":  "Internal Server Error",
+		})
+		log.Println(err.Error())
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{
+		"status": http.StatusOK,
+		"body":   gin.H{},
+		"error":  nil,
+	})
+}
+
+// GetDuplicateImages - очередь фотографий, совпавших с фотографиями объявлений других пользователей
+func (h *ModerationHandler) GetDuplicateImages(ctx *gin.Context) {
+	limit, err := strconv.ParseInt(ctx.Query("limit"), 10, 64)
+	if err != nil {
+		limit = 20
+	}
+	offset, err := strconv.ParseInt(ctx.Query("offset"), 10, 64)
+	if err != nil {
+		offset = 0
+	}
+	status := ctx.DefaultQuery("status", moderation.ReportStatusPending)
+	flags, err := h.moderationService.GetDuplicateImageFlags(status, offset, limit)
+	if err != nil {
+		ctx.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusInternalServerError,
+			"body":   gin.H{},
+			"error":  "Internal Server Error",
+		})
+		log.Println(err.Error())
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{
+		"status": http.StatusOK,
+		"body": gin.H{
+			"duplicates": flags,
+		},
+		"error": nil,
+	})
+}
+
+func (h *ModerationHandler) UpdateDuplicateImage(ctx *gin.Context) {
+	id, err := strconv.ParseInt(ctx.Param("id"), 10, 64)
+	if err != nil {
+		ctx.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusBadRequest,
+			"body":   gin.H{},
+			"error":  "invalid id",
+		})
+		return
+	}
+	var request UpdateReportRequest
+	if err := ctx.ShouldBindBodyWithJSON(&request); err != nil ||
+		(request.Status != moderation.ReportStatusPending && request.Status != moderation.ReportStatusResolved && request.Status != moderation.ReportStatusDismissed) {
+		ctx.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusBadRequest,
+			"body":   gin.H{},
+			"error":  "invalid data",
+		})
+		return
+	}
+	err = h.moderationService.UpdateDuplicateImageFlagStatus(id, request.Status)
+	if err == pgx.ErrNoRows {
+		ctx.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusNotFound,
+			"body":   gin.H{},
+			"error":  "duplicate flag not found",
+		})
+		return
+	}
+	if err != nil {
+		ctx.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusInternalServerError,
+			"body":   gin.H{},
+			"error":  "Internal Server Error",
+		})
+		log.Println(err.Error())
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{
+		"status": http.StatusOK,
+		"body":   gin.H{},
+		"error":  nil,
+	})
+}
@@ -0,0 +1,282 @@
+package handler
+
+import (
+	"log"
+	"mymate/internal/middlewares"
+	"mymate/internal/service"
+	"mymate/pkg/customerror"
+	"mymate/pkg/notification"
+	"mymate/pkg/user"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+)
+
+type NotificationHandlerI interface {
+	RegisterRoutes(group *gin.RouterGroup)
+	RegisterDevice(ctx *gin.Context)
+	UnregisterDevice(ctx *gin.Context)
+	GetPreferences(ctx *gin.Context)
+	UpdatePreferences(ctx *gin.Context)
+	GetNotifications(ctx *gin.Context)
+	MarkRead(ctx *gin.Context)
+	MarkAllRead(ctx *gin.Context)
+}
+
+type NotificationHandler struct {
+	notificationService service.NotificationServiceI
+	middlewares         middlewares.MiddlewaresI
+}
+
+func NewNotificationHandler(notificationService service.NotificationServiceI, middlewares middlewares.MiddlewaresI) NotificationHandlerI {
+	return &NotificationHandler{
+		notificationService: notificationService,
+		middlewares:         middlewares,
+	}
+}
+
+func (h *NotificationHandler) RegisterRoutes(group *gin.RouterGroup) {
+	devices := group.Group("/devices", h.middlewares.ValidUser())
+	devices.POST("/", h.RegisterDevice)
+	devices.DELETE("/:token", h.UnregisterDevice)
+	notifications := group.Group("/notifications", h.middlewares.ValidUser())
+	notifications.GET("/preferences", h.GetPreferences)
+	notifications.PUT("/preferences", h.UpdatePreferences)
+	notifications.GET("/", h.GetNotifications)
+	notifications.PATCH("/:id/read", h.MarkRead)
+	notifications.POST("/read-all", h.MarkAllRead)
+}
+
+type RegisterDeviceRequest struct {
+	Platform string `json:"platform" binding:"required,oneof=android ios web"`
+	Token    string `json:"token" binding:"required"`
+}
+
+func (h *NotificationHandler) RegisterDevice(ctx *gin.Context) {
+	user := ctx.MustGet("user").(*user.User)
+	var request RegisterDeviceRequest
+	if err := ctx.ShouldBindBodyWithJSON(&request); err != nil {
+		ctx.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusBadRequest,
+			"body":   gin.H{},
+			"error":  "invalid data",
+		})
+		return
+	}
+	device, err := h.notificationService.RegisterDevice(user, request.Platform, request.Token)
+	if err == customerror.ErrInvalidDeviceToken {
+		ctx.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusBadRequest,
+			"body":   gin.H{},
+			"error":  "invalid device token",
+		})
+		return
+	}
+	if err != nil {
+		ctx.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusInternalServerError,
+			"body":   gin.H{},
+			"error":  "Internal Server Error",
+		})
+		err := err.(customerror.CustomError)
+		err.AppendModule("RegisterDevice")
+		log.Println(err.Error())
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{
+		"status": http.StatusOK,
+		"body": gin.H{
+			"device": device,
+		},
+		"error": nil,
+	})
+}
+
+func (h *NotificationHandler) UnregisterDevice(ctx *gin.Context) {
+	user := ctx.MustGet("user").(*user.User)
+	err := h.notificationService.UnregisterDevice(user, ctx.Param("token"))
+	if err == pgx.ErrNoRows {
+		ctx.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusNotFound,
+			"body":   gin.H{},
+			"error":  "device not found",
+		})
+		return
+	}
+	if err != nil {
+		ctx.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusInternalServerError,
+			"body":   gin.H{},
+			"error":  "Internal Server Error",
+		})
+		err := err.(customerror.CustomError)
+		err.AppendModule("UnregisterDevice")
+		log.Println(err.Error())
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{
+		"status": http.StatusOK,
+		"body":   gin.H{},
+		"error":  nil,
+	})
+}
+
+func (h *NotificationHandler) GetPreferences(ctx *gin.Context) {
+	user := ctx.MustGet("user").(*user.User)
+	preferences, err := h.notificationService.GetPreferences(user)
+	if err != nil {
+		ctx.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusInternalServerError,
+			"body":   gin.H{},
+			"error":  "Internal Server Error",
+		})
+		err := err.(customerror.CustomError)
+		err.AppendModule("GetPreferences")
+		log.Println(err.Error())
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{
+		"status": http.StatusOK,
+		"body": gin.H{
+			"preferences": preferences,
+		},
+		"error": nil,
+	})
+}
+
+// UpdatePreferences меняет только переданные поля
+func (h *NotificationHandler) UpdatePreferences(ctx *gin.Context) {
+	user := ctx.MustGet("user").(*user.User)
+	var request notification.PreferencesUpdate
+	if err := ctx.ShouldBindBodyWithJSON(&request); err != nil {
+		ctx.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusBadRequest,
+			"body":   gin.H{},
+			"error":  "invalid data",
+		})
+		return
+	}
+	preferences, err := h.notificationService.UpdatePreferences(user, &request)
+	if err == customerror.ErrTelegramNotLinked {
+		ctx.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusBadRequest,
+			"body":   gin.H{},
+			"error":  "telegram not linked",
+		})
+		return
+	}
+	if err != nil {
+		ctx.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusInternalServerError,
+			"body":   gin.H{},
+			"error":  "Internal Server Error",
+		})
+		err := err.(customerror.CustomError)
+		err.AppendModule("UpdatePreferences")
+		log.Println(err.Error())
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{
+		"status": http.StatusOK,
+		"body": gin.H{
+			"preferences": preferences,
+		},
+		"error": nil,
+	})
+}
+
+func (h *NotificationHandler) GetNotifications(ctx *gin.Context) {
+	user := ctx.MustGet("user").(*user.User)
+	limit, err := strconv.ParseInt(ctx.Query("limit"), 10, 64)
+	if err != nil || limit <= 0 || limit > 100 {
+		limit = 20
+	}
+	offset, err := strconv.ParseInt(ctx.Query("offset"), 10, 64)
+	if err != nil || offset < 0 {
+		offset = 0
+	}
+	unreadOnly := ctx.Query("unread") == "true"
+	notifications, unread, err := h.notificationService.GetNotifications(user, unreadOnly, offset, limit)
+	if err != nil {
+		ctx.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusInternalServerError,
+			"body":   gin.H{},
+			"error":  "Internal Server Error",
+		})
+		err := err.(customerror.CustomError)
+		err.AppendModule("GetNotifications")
+		log.Println(err.Error())
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{
+		"status": http.StatusOK,
+		"body": gin.H{
+			"notifications": notifications,
+			"unread_count":  unread,
+		},
+		"error": nil,
+	})
+}
+
+func (h *NotificationHandler) MarkRead(ctx *gin.Context) {
+	user := ctx.MustGet("user").(*user.User)
+	id, err := strconv.ParseInt(ctx.Param("id"), 10, 64)
+	if err != nil {
+		ctx.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusBadRequest,
+			"body":   gin.H{},
+			"error":  "invalid id",
+		})
+		return
+	}
+	err = h.notificationService.MarkRead(user, id)
+	if err == pgx.ErrNoRows {
+		ctx.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusNotFound,
+			"body":   gin.H{},
+			"error":  "notification not found",
+		})
+		return
+	}
+	if err != nil {
+		ctx.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusInternalServerError,
+			"body":   gin.H{},
+			"error":  "Internal Server Error",
+		})
+		err := err.(customerror.CustomError)
+		err.AppendModule("MarkRead")
+		log.Println(err.Error())
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{
+		"status": http.StatusOK,
+		"body":   gin.H{},
+		"error":  nil,
+	})
+}
+
+func (h *NotificationHandler) MarkAllRead(ctx *gin.Context) {
+	user := ctx.MustGet("user").(*user.User)
+	count, err := h.notificationService.MarkAllRead(user)
+	if err != nil {
+		ctx.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusInternalServerError,
+			"body":   gin.H{},
+			"error":  "Internal Server Error",
+		})
+		err := err.(customerror.CustomError)
+		err.AppendModule("MarkAllRead")
+		log.Println(err.Error())
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{
+		"status": http.StatusOK,
+		"body": gin.H{
+			"marked": count,
+		},
+		"error": nil,
+	})
+}
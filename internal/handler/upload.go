@@ -0,0 +1,228 @@
+package handler
+
+import (
+	"io"
+	"log"
+	"mime"
+	"mymate/internal/middlewares"
+	"mymate/internal/service"
+	"mymate/pkg/customerror"
+	"mymate/pkg/upload"
+	"mymate/pkg/user"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+type UploadHandlerI interface {
+	RegisterRoutes(group *gin.RouterGroup)
+	CreateUpload(ctx *gin.Context)
+	GetUpload(ctx *gin.Context)
+	PatchUpload(ctx *gin.Context)
+	DeleteUpload(ctx *gin.Context)
+}
+
+type UploadHandler struct {
+	uploadService service.UploadServiceI
+	middlewares   middlewares.MiddlewaresI
+}
+
+func NewUploadHandler(uploadService service.UploadServiceI, middlewares middlewares.MiddlewaresI) UploadHandlerI {
+	return &UploadHandler{
+		uploadService: uploadService,
+		middlewares:   middlewares,
+	}
+}
+
+// Возобновляемая загрузка по образцу tus: POST создает сессию, HEAD возвращает принятое смещение в Upload-Offset,
+// PATCH с заголовком Upload-Offset дописывает следующую часть. После последней части файл обрабатывается как обычная загрузка.
+func (h *UploadHandler) RegisterRoutes(group *gin.RouterGroup) {
+	uploads := group.Group("/uploads", h.middlewares.ValidUser())
+	uploads.POST("/", h.CreateUpload)
+	uploads.GET("/:id", h.GetUpload)
+	uploads.HEAD("/:id", h.GetUpload)
+	uploads.PATCH("/:id", h.PatchUpload)
+	uploads.DELETE("/:id", h.DeleteUpload)
+}
+
+type CreateUploadRequest struct {
+	Kind     string `json:"kind" binding:"required,oneof=flat_image avatar"`
+	FlatId   int64  `json:"flat_id" binding:"required_if=Kind flat_image"`
+	Filename string `json:"filename" binding:"required"`
+	Size     int64  `json:"size" binding:"required,min=1"`
+}
+
+func (h *UploadHandler) CreateUpload(ctx *gin.Context) {
+	user := ctx.MustGet("user").(*user.User)
+	var request CreateUploadRequest
+	if err := ctx.ShouldBindBodyWithJSON(&request); err != nil {
+		ctx.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusBadRequest,
+			"body":   gin.H{},
+			"error":  "invalid data",
+		})
+		return
+	}
+	session, err := h.uploadService.CreateUpload(user, &upload.Session{
+		Kind:     request.Kind,
+		FlatId:   request.FlatId,
+		Filename: request.Filename,
+		Size:     request.Size,
+	})
+	if err == pgx.ErrNoRows {
+		ctx.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusNotFound,
+			"body":   gin.H{},
+			"error":  "flat not found",
+		})
+		return
+	}
+	if err != nil {
+		h.abortWithError(ctx, err)
+		return
+	}
+	setUploadHeaders(ctx, session)
+	ctx.Header("Location", ctx.Request.URL.Path+session.Id.String())
+	ctx.JSON(http.StatusOK, gin.H{
+		"status": http.StatusCreated,
+		"body": gin.H{
+			"upload": session,
+		},
+		"error": nil,
+	})
+}
+
+// GetUpload обслуживает и HEAD: у HEAD нет тела, поэтому статус передается настоящим HTTP-кодом
+func (h *UploadHandler) GetUpload(ctx *gin.Context) {
+	user := ctx.MustGet("user").(*user.User)
+	id, err := uuid.Parse(ctx.Param("id"))
+	if err != nil {
+		abortUpload(ctx, http.StatusNotFound, "upload not found")
+		return
+	}
+	session, err := h.uploadService.GetUpload(user, id)
+	if err != nil {
+		h.abortWithError(ctx, err)
+		return
+	}
+	setUploadHeaders(ctx, session)
+	if ctx.Request.Method == http.MethodHead {
+		ctx.Status(http.StatusOK)
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{
+		"status": http.StatusOK,
+		"body": gin.H{
+			"upload": session,
+		},
+		"error": nil,
+	})
+}
+
+func (h *UploadHandler) PatchUpload(ctx *gin.Context) {
+	user := ctx.MustGet("user").(*user.User)
+	id, err := uuid.Parse(ctx.Param("id"))
+	if err != nil {
+		abortUpload(ctx, http.StatusNotFound, "upload not found")
+		return
+	}
+	offset, err := strconv.ParseInt(ctx.GetHeader("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		abortUpload(ctx, http.StatusBadRequest, "invalid Upload-Offset")
+		return
+	}
+	contentType, _, _ := mime.ParseMediaType(ctx.ContentType())
+	if ctx.Request.ContentLength != 0 && contentType != "application/offset+octet-stream" && contentType != "application/octet-stream" {
+		abortUpload(ctx, http.StatusUnsupportedMediaType, "content type must be application/offset+octet-stream")
+		return
+	}
+	if ctx.Request.ContentLength > upload.MaxChunkSize {
+		abortUpload(ctx, http.StatusRequestEntityTooLarge, "chunk too large")
+		return
+	}
+	// Часть принимается только целиком: оборванный запрос ничего не меняет, клиент продолжает с Upload-Offset из HEAD
+	data, err := io.ReadAll(io.LimitReader(ctx.Request.Body, upload.MaxChunkSize+1))
+	if err != nil {
+		abortUpload(ctx, http.StatusBadRequest, "incomplete chunk")
+		return
+	}
+	if len(data) > upload.MaxChunkSize {
+		abortUpload(ctx, http.StatusRequestEntityTooLarge, "chunk too large")
+		return
+	}
+	session, result, err := h.uploadService.PatchUpload(user, id, offset, data)
+	if err != nil {
+		h.abortWithError(ctx, err)
+		return
+	}
+	setUploadHeaders(ctx, session)
+	ctx.JSON(http.StatusOK, gin.H{
+		"status": http.StatusOK,
+		"body": gin.H{
+			"upload": session,
+			"result": result,
+		},
+		"error": nil,
+	})
+}
+
+func (h *UploadHandler) DeleteUpload(ctx *gin.Context) {
+	user := ctx.MustGet("user").(*user.User)
+	id, err := uuid.Parse(ctx.Param("id"))
+	if err != nil {
+		abortUpload(ctx, http.StatusNotFound, "upload not found")
+		return
+	}
+	err = h.uploadService.DeleteUpload(user, id)
+	if err != nil {
+		h.abortWithError(ctx, err)
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{
+		"status": http.StatusOK,
+		"body":   gin.H{},
+		"error":  nil,
+	})
+}
+
+func (h *UploadHandler) abortWithError(ctx *gin.Context, err error) {
+	switch err {
+	case pgx.ErrNoRows:
+		abortUpload(ctx, http.StatusNotFound, "upload not found")
+	case customerror.ErrUploadConflict:
+		abortUpload(ctx, http.StatusConflict, "upload offset conflict")
+	case customerror.ErrImageTooLarge:
+		abortUpload(ctx, http.StatusRequestEntityTooLarge, "image too large")
+	case customerror.ErrInvalidImage:
+		abortUpload(ctx, http.StatusBadRequest, "invalid image")
+	case customerror.ErrTooManyImages:
+		abortUpload(ctx, http.StatusBadRequest, "too many images")
+	case customerror.ErrForbidden:
+		abortUpload(ctx, http.StatusForbidden, "Forbidden")
+	default:
+		log.Print(err.Error())
+		abortUpload(ctx, http.StatusInternalServerError, "Internal Server Error")
+	}
+}
+
+func abortUpload(ctx *gin.Context, status int, message string) {
+	if ctx.Request.Method == http.MethodHead {
+		ctx.AbortWithStatus(status)
+		return
+	}
+	ctx.AbortWithStatusJSON(http.StatusOK, gin.H{
+		"status": status,
+		"body":   gin.H{},
+		"error":  message,
+	})
+}
+
+func setUploadHeaders(ctx *gin.Context, session *upload.Session) {
+	ctx.Header("Upload-Offset", strconv.FormatInt(session.Offset, 10))
+	ctx.Header("Upload-Length", strconv.FormatInt(session.Size, 10))
+	ctx.Header("Upload-Expires", session.ExpiresAt.UTC().Format(http.TimeFormat))
+	ctx.Header("Cache-Control", "no-store")
+}
@@ -2,9 +2,12 @@ package handler
 
 import (
 	"database/sql"
+	"fmt"
+	"hash/fnv"
 	"log"
 	"mymate/internal/middlewares"
 	"mymate/internal/service"
+	"mymate/pkg/avatar"
 	"mymate/pkg/customerror"
 	userModel "mymate/pkg/user"
 	"net/http"
@@ -21,6 +24,7 @@ type UserHandlerI interface {
 	UpdateUser(ctx *gin.Context)
 	UpdateAvatar(ctx *gin.Context)
 	DeleteAvatar(ctx *gin.Context)
+	GetInitialsAvatar(ctx *gin.Context)
 }
 
 type UserHandler struct {
@@ -40,6 +44,8 @@ func NewUserHandler(userService service.UserServiceI, host, port string, middlew
 }
 
 func (userHandler *UserHandler) RegisterRoutes(group *gin.RouterGroup) {
+	// Аватар запрашивается тегом img, поэтому без авторизации
+	group.GET("/users/:id/avatar/initials.svg", userHandler.GetInitialsAvatar)
 	users := group.Group("/users", userHandler.middlewares.ValidUser())
 	users.GET("/:id", userHandler.GetUser)
 	users.PATCH("/:id", userHandler.middlewares.ThisUserOrAdmin(), userHandler.UpdateUser)
@@ -80,7 +86,7 @@ func (userHandler *UserHandler) GetUser(ctx *gin.Context) {
 		return
 	}
 	if user.AvatarUrl == "" {
-		user.AvatarUrl = "/media/user_placeholder.png"
+		user.AvatarUrl = avatar.InitialsPath(user.UUID)
 	}
 	ctx.JSON(http.StatusOK, gin.H{
 		"status": http.StatusOK,
@@ -138,6 +144,7 @@ func (userHandler *UserHandler) UpdateUser(ctx *gin.Context) {
 	userPatch.EducationLevel = userFromRequest.EducationLevel
 	userPatch.AvatarFileName = user.AvatarFileName
 	userPatch.AvatarUrl = user.AvatarUrl
+	userPatch.AvatarVariants = user.AvatarVariants
 	userPatch.About = userFromRequest.About
 	userPatch.Birthdate = sql.NullTime{Time: userFromRequest.Birthdate, Valid: true}
 	if userFromRequest.Birthdate.IsZero() {
@@ -201,6 +208,22 @@ func (userHandler *UserHandler) UpdateAvatar(ctx *gin.Context) {
 		return
 	}
 	err = userHandler.userService.SaveUserAvatar(user, file)
+	if err == customerror.ErrInvalidImage {
+		ctx.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusBadRequest,
+			"body":   gin.H{},
+			"error":  "invalid image",
+		})
+		return
+	}
+	if err == customerror.ErrImageTooLarge {
+		ctx.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusBadRequest,
+			"body":   gin.H{},
+			"error":  "image too large",
+		})
+		return
+	}
 	if err != nil {
 		customErr := err.(customerror.CustomError)
 		customErr.AppendModule("UserHandler.UpdateAvatar")
@@ -256,3 +279,37 @@ func (userHandler *UserHandler) DeleteAvatar(ctx *gin.Context) {
 		"error":  "",
 	})
 }
+
+// GetInitialsAvatar отдает SVG с инициалами. Как и файлы из /media, отвечает настоящими HTTP-статусами.
+func (userHandler *UserHandler) GetInitialsAvatar(ctx *gin.Context) {
+	id, err := uuid.Parse(ctx.Param("id"))
+	if err != nil {
+		ctx.Status(http.StatusNotFound)
+		return
+	}
+	user, err := userHandler.userService.GetUser(id)
+	if err == pgx.ErrNoRows {
+		ctx.Status(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		customErr := err.(customerror.CustomError)
+		customErr.AppendModule("UserHandler.GetInitialsAvatar")
+		log.Print(customErr.Error())
+		ctx.Status(http.StatusInternalServerError)
+		return
+	}
+	svg := avatar.InitialsSVG(user.UUID, user.Firstname, user.Lastname)
+	hash := fnv.New64a()
+	hash.Write(svg)
+	etag := fmt.Sprintf(`"%x"`, hash.Sum64())
+	ctx.Header("ETag", etag)
+	ctx.Header("Cache-Control", "public, max-age=3600")
+	ctx.Header("X-Content-Type-Options", "nosniff")
+	ctx.Header("Content-Security-Policy", "default-src 'none'; style-src 'unsafe-inline'; sandbox")
+	if ctx.GetHeader("If-None-Match") == etag {
+		ctx.Status(http.StatusNotModified)
+		return
+	}
+	ctx.Data(http.StatusOK, "image/svg+xml", svg)
+}
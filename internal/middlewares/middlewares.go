@@ -22,6 +22,7 @@ type MiddlewaresI interface {
 	ValidUser() gin.HandlerFunc
 	ThisUserOrAdmin() gin.HandlerFunc
 	MyFlat() gin.HandlerFunc
+	SuperUser() gin.HandlerFunc
 }
 
 type Middlewares struct {
@@ -158,3 +159,27 @@ func (middlewares *Middlewares) MyFlat() gin.HandlerFunc {
 		ctx.Next()
 	}
 }
+
+func (middlewares *Middlewares) SuperUser() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		authUser, exists := ctx.Get("user")
+		if !exists {
+			ctx.AbortWithStatusJSON(http.StatusOK, gin.H{
+				"status": http.StatusInternalServerError,
+				"body":   gin.H{},
+				"error":  "Internal Server Error",
+			})
+			return
+		}
+		user := authUser.(*user.User)
+		if !user.IsSuperUser {
+			ctx.AbortWithStatusJSON(http.StatusOK, gin.H{
+				"status": http.StatusForbidden,
+				"body":   gin.H{},
+				"error":  "Forbidden",
+			})
+			return
+		}
+		ctx.Next()
+	}
+}
@@ -2,11 +2,15 @@ package repository
 
 import (
 	"context"
+	"errors"
 	chatmessages "mymate/pkg/chat_messages"
 	"mymate/pkg/customerror"
 	"mymate/pkg/user"
+	"slices"
+	"time"
 
 	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
@@ -19,9 +23,39 @@ type ChatRepositoryI interface {
 	CreateTables(ctx context.Context) error
 	GetChats(ctx context.Context, user *user.User) ([]ChatWithUser, error)
 	GetMessages(ctx context.Context, whatUser uuid.UUID, withUser uuid.UUID, fromMessage int64, offset int64, limit int64) ([]chatmessages.ChatMessage, error)
-	AddMessage(ctx context.Context, senderId uuid.UUID, receiverId uuid.UUID, message string) (int64, error)
+	AddMessage(ctx context.Context, message *chatmessages.ChatMessage) (int64, error)
+	AddDirectMessage(ctx context.Context, message *chatmessages.ChatMessage) (bool, error)
+	GetMessage(ctx context.Context, id int64) (*chatmessages.ChatMessage, error)
+	EditMessage(ctx context.Context, id int64, actorId uuid.UUID, message string) (*chatmessages.ChatMessage, error)
+	DeleteMessage(ctx context.Context, id int64, actorId uuid.UUID) (*chatmessages.ChatMessage, error)
+	HideMessage(ctx context.Context, id int64, userId uuid.UUID) error
+	GetMessagesAfter(ctx context.Context, userId uuid.UUID, afterMessage int64, limit int64) ([]chatmessages.ChatMessage, error)
+	MarkRead(ctx context.Context, readerId uuid.UUID, senderId uuid.UUID, upToMessage int64) error
+	ClaimUnreadForEmail(ctx context.Context, createdAfter time.Time, createdBefore time.Time) ([]chatmessages.ChatMessage, error)
+	SearchMessages(ctx context.Context, userId uuid.UUID, tsQuery string, digitsTsQuery string, withUser uuid.UUID, conversationId int64, offset int64, limit int64) ([]chatmessages.ChatMessage, error)
+	GetMessageContext(ctx context.Context, userId uuid.UUID, message *chatmessages.ChatMessage, size int64) ([]chatmessages.ChatMessage, []chatmessages.ChatMessage, error)
+	GetMessagesPage(ctx context.Context, whatUser uuid.UUID, withUser uuid.UUID, afterMessage int64, limit int64) ([]chatmessages.ChatMessage, error)
+	GetReportExcerpt(ctx context.Context, reporterId uuid.UUID, reportedId uuid.UUID, limit int64) ([]chatmessages.ChatMessage, error)
+	CreateTicket(ctx context.Context, ticket string, userId uuid.UUID, jwtVersion uint, tokenExpiresAt time.Time, expiresAt time.Time) error
+	ConsumeTicket(ctx context.Context, ticket string) (uuid.UUID, uint, time.Time, error)
 }
 
+// participantCondition - пользователь $1 участник личной переписки или участник групповой беседы на момент отправки.
+// После повторного приглашения joined_at сдвигается, поэтому пропущенное вне беседы не видно.
+const participantCondition = `($1 IN (sender_id, receiver_id) OR EXISTS (
+		SELECT 1 FROM conversation_members
+		WHERE conversation_id = chat_messages.conversation_id AND user_id = $1 AND receiver_id IS NULL
+			AND joined_at <= chat_messages.created_at AND (left_at IS NULL OR left_at >= chat_messages.created_at)
+	))`
+
+// visibleMessageCondition - сообщение видно пользователю $1: он участник на момент отправки, и сообщение не скрыто им.
+const visibleMessageCondition = participantCondition + `
+	AND NOT EXISTS (SELECT 1 FROM chat_message_hidden WHERE message_id = chat_messages.id AND user_id = $1)`
+
+const addMessageQuery = `INSERT INTO chat_messages (sender_id, receiver_id, conversation_id, message, kind, flat_id) VALUES ($1,$2,$3,$4,$5,$6) RETURNING id, created_at`
+
+const messageColumns = `id, sender_id, receiver_id, message, created_at, COALESCE(conversation_id, 0), kind, flat_id, edited_at, deleted_at`
+
 type ChatRepository struct {
 	Host           string
 	Port           string
@@ -50,6 +84,111 @@ func (r *ChatRepository) CreateTables(ctx context.Context) error {
 	if err != nil {
 		return customerror.NewError("ChatRepository.CreateTables", r.Host+":"+r.Port, err.Error())
 	}
+	alterQuery := `ALTER TABLE chat_messages ADD COLUMN IF NOT EXISTS kind TEXT NOT NULL DEFAULT 'text';`
+	_, err = r.Pool.Exec(ctx, alterQuery)
+	if err != nil {
+		return customerror.NewError("ChatRepository.CreateTables", r.Host+":"+r.Port, err.Error())
+	}
+	alterQuery = `ALTER TABLE chat_messages ADD COLUMN IF NOT EXISTS flat_id BIGINT NOT NULL DEFAULT 0;`
+	_, err = r.Pool.Exec(ctx, alterQuery)
+	if err != nil {
+		return customerror.NewError("ChatRepository.CreateTables", r.Host+":"+r.Port, err.Error())
+	}
+	alterQuery = `ALTER TABLE chat_messages ADD COLUMN IF NOT EXISTS edited_at TIMESTAMP;`
+	_, err = r.Pool.Exec(ctx, alterQuery)
+	if err != nil {
+		return customerror.NewError("ChatRepository.CreateTables", r.Host+":"+r.Port, err.Error())
+	}
+	alterQuery = `ALTER TABLE chat_messages ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMP;`
+	_, err = r.Pool.Exec(ctx, alterQuery)
+	if err != nil {
+		return customerror.NewError("ChatRepository.CreateTables", r.Host+":"+r.Port, err.Error())
+	}
+	alterQuery = `ALTER TABLE chat_messages ADD COLUMN IF NOT EXISTS read_at TIMESTAMP;`
+	_, err = r.Pool.Exec(ctx, alterQuery)
+	if err != nil {
+		return customerror.NewError("ChatRepository.CreateTables", r.Host+":"+r.Port, err.Error())
+	}
+	alterQuery = `ALTER TABLE chat_messages ADD COLUMN IF NOT EXISTS email_notified_at TIMESTAMP;`
+	_, err = r.Pool.Exec(ctx, alterQuery)
+	if err != nil {
+		return customerror.NewError("ChatRepository.CreateTables", r.Host+":"+r.Port, err.Error())
+	}
+	unreadIndexQuery := `CREATE INDEX IF NOT EXISTS chat_messages_unread_idx ON chat_messages(created_at) WHERE read_at IS NULL AND email_notified_at IS NULL;`
+	_, err = r.Pool.Exec(ctx, unreadIndexQuery)
+	if err != nil {
+		return customerror.NewError("ChatRepository.CreateTables", r.Host+":"+r.Port, err.Error())
+	}
+	hiddenQuery := `CREATE TABLE IF NOT EXISTS chat_message_hidden (
+		message_id BIGINT NOT NULL REFERENCES chat_messages(id) ON DELETE CASCADE,
+		user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (message_id, user_id)
+	);`
+	_, err = r.Pool.Exec(ctx, hiddenQuery)
+	if err != nil {
+		return customerror.NewError("ChatRepository.CreateTables", r.Host+":"+r.Port, err.Error())
+	}
+	// Исходный текст отредактированных и удаленных сообщений хранится здесь для модерации
+	auditQuery := `CREATE TABLE IF NOT EXISTS chat_message_audit (
+		id BIGSERIAL PRIMARY KEY,
+		message_id BIGINT NOT NULL,
+		action TEXT NOT NULL,
+		message TEXT,
+		actor_id UUID NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);`
+	_, err = r.Pool.Exec(ctx, auditQuery)
+	if err != nil {
+		return customerror.NewError("ChatRepository.CreateTables", r.Host+":"+r.Port, err.Error())
+	}
+	createIndexQuery := `CREATE INDEX IF NOT EXISTS chat_message_audit_message_id_idx ON chat_message_audit(message_id);`
+	_, err = r.Pool.Exec(ctx, createIndexQuery)
+	if err != nil {
+		return customerror.NewError("ChatRepository.CreateTables", r.Host+":"+r.Port, err.Error())
+	}
+	ticketsQuery := `CREATE TABLE IF NOT EXISTS chat_ws_tickets (
+		ticket TEXT PRIMARY KEY,
+		user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		jwt_version INTEGER NOT NULL,
+		expires_at TIMESTAMP NOT NULL
+	);`
+	_, err = r.Pool.Exec(ctx, ticketsQuery)
+	if err != nil {
+		return customerror.NewError("ChatRepository.CreateTables", r.Host+":"+r.Port, err.Error())
+	}
+	// Срок токена, по которому выдан тикет: соединение закрывается, когда он истекает
+	_, err = r.Pool.Exec(ctx, `ALTER TABLE chat_ws_tickets ADD COLUMN IF NOT EXISTS token_expires_at TIMESTAMPTZ`)
+	if err != nil {
+		return customerror.NewError("ChatRepository.CreateTables", r.Host+":"+r.Port, err.Error())
+	}
+	// Конфигурация 'simple' без стемминга: в переписке смешаны языки, адреса и телефоны
+	alterQuery = `ALTER TABLE chat_messages ADD COLUMN IF NOT EXISTS search_vector tsvector
+		GENERATED ALWAYS AS (to_tsvector('simple', COALESCE(message, ''))) STORED;`
+	_, err = r.Pool.Exec(ctx, alterQuery)
+	if err != nil {
+		return customerror.NewError("ChatRepository.CreateTables", r.Host+":"+r.Port, err.Error())
+	}
+	searchIndexQuery := `CREATE INDEX IF NOT EXISTS chat_messages_search_idx ON chat_messages USING GIN (search_vector);`
+	_, err = r.Pool.Exec(ctx, searchIndexQuery)
+	if err != nil {
+		return customerror.NewError("ChatRepository.CreateTables", r.Host+":"+r.Port, err.Error())
+	}
+	// Парсер разбивает "123-45-67" на 123, -45 и -67, поэтому телефоны ищутся по копии текста,
+	// где разделители между цифрами убраны, а знаки перед числами заменены пробелами
+	alterQuery = `ALTER TABLE chat_messages ADD COLUMN IF NOT EXISTS search_digits_vector tsvector
+		GENERATED ALWAYS AS (to_tsvector('simple', regexp_replace(
+			regexp_replace(COALESCE(message, ''), '(\d)[\s\-().]+(?=\d)', '\1', 'g'),
+			'[+\-](?=\d)', ' ', 'g'))) STORED;`
+	_, err = r.Pool.Exec(ctx, alterQuery)
+	if err != nil {
+		return customerror.NewError("ChatRepository.CreateTables", r.Host+":"+r.Port, err.Error())
+	}
+	searchIndexQuery = `CREATE INDEX IF NOT EXISTS chat_messages_search_digits_idx ON chat_messages USING GIN (search_digits_vector);`
+	_, err = r.Pool.Exec(ctx, searchIndexQuery)
+	if err != nil {
+		return customerror.NewError("ChatRepository.CreateTables", r.Host+":"+r.Port, err.Error())
+	}
 	return nil
 }
 
@@ -63,11 +202,23 @@ func (r *ChatRepository) GetChats(ctx context.Context, user *user.User) ([]ChatW
     		sender_id,
     		receiver_id,
     		message,
-    		created_at
+    		created_at,
+    		COALESCE(conversation_id, 0),
+    		kind,
+    		flat_id,
+    		edited_at,
+    		deleted_at
 		FROM 
 		    chat_messages
 		WHERE 
 		    $1 IN (sender_id, receiver_id)
+		    AND receiver_id IS NOT NULL
+		    AND NOT EXISTS (SELECT 1 FROM chat_message_hidden WHERE message_id = chat_messages.id AND user_id = $1)
+		    AND NOT EXISTS (
+		        SELECT 1 FROM user_blocks
+		        WHERE (blocker_id = $1 AND blocked_id IN (sender_id, receiver_id))
+		            OR (blocked_id = $1 AND blocker_id IN (sender_id, receiver_id))
+		    )
 		ORDER BY 
 		    LEAST(sender_id, receiver_id),
 		    GREATEST(sender_id, receiver_id),
@@ -80,7 +231,7 @@ func (r *ChatRepository) GetChats(ctx context.Context, user *user.User) ([]ChatW
 	var chats []ChatWithUser
 	for rows.Next() {
 		var chat ChatWithUser
-		err := rows.Scan(&chat.Chat.Id, &chat.Chat.SenderId, &chat.Chat.ReceiverId, &chat.Chat.Message, &chat.Chat.CreatedAt)
+		err := rows.Scan(&chat.Chat.Id, &chat.Chat.SenderId, &chat.Chat.ReceiverId, &chat.Chat.Message, &chat.Chat.CreatedAt, &chat.Chat.ConversationId, &chat.Chat.Kind, &chat.Chat.FlatId, &chat.Chat.EditedAt, &chat.Chat.DeletedAt)
 		if err != nil {
 			continue
 		}
@@ -106,10 +257,16 @@ func (r *ChatRepository) GetMessages(ctx context.Context, whatUser uuid.UUID, wi
     		sender_id,
     		receiver_id,
     		message,
-    		created_at
+    		created_at,
+    		COALESCE(conversation_id, 0),
+    		kind,
+    		flat_id,
+    		edited_at,
+    		deleted_at
 		FROM
 			chat_messages
 		WHERE (sender_id = $1 OR receiver_id=$1) AND (sender_id = $2 OR receiver_id=$2) AND id <= $3
+			AND NOT EXISTS (SELECT 1 FROM chat_message_hidden WHERE message_id = chat_messages.id AND user_id = $1)
 		ORDER BY id DESC
 		OFFSET $4
 		LIMIT $5;
@@ -121,10 +278,16 @@ func (r *ChatRepository) GetMessages(ctx context.Context, whatUser uuid.UUID, wi
     		sender_id,
     		receiver_id,
     		message,
-    		created_at
+    		created_at,
+    		COALESCE(conversation_id, 0),
+    		kind,
+    		flat_id,
+    		edited_at,
+    		deleted_at
 		FROM
 			chat_messages
 		WHERE (sender_id = $1 OR receiver_id=$1) AND (sender_id = $2 OR receiver_id=$2) AND id != $3
+			AND NOT EXISTS (SELECT 1 FROM chat_message_hidden WHERE message_id = chat_messages.id AND user_id = $1)
 		ORDER BY id DESC
 		OFFSET $4
 		LIMIT $5;
@@ -137,7 +300,7 @@ func (r *ChatRepository) GetMessages(ctx context.Context, whatUser uuid.UUID, wi
 	var messages []chatmessages.ChatMessage
 	for rows.Next() {
 		var message chatmessages.ChatMessage
-		err := rows.Scan(&message.Id, &message.SenderId, &message.ReceiverId, &message.Message, &message.CreatedAt)
+		err := rows.Scan(&message.Id, &message.SenderId, &message.ReceiverId, &message.Message, &message.CreatedAt, &message.ConversationId, &message.Kind, &message.FlatId, &message.EditedAt, &message.DeletedAt)
 		if err != nil {
 			continue
 		}
@@ -146,13 +309,362 @@ func (r *ChatRepository) GetMessages(ctx context.Context, whatUser uuid.UUID, wi
 	return messages, nil
 }
 
-func (r *ChatRepository) AddMessage(ctx context.Context, senderId uuid.UUID, receiverId uuid.UUID, message string) (int64, error) {
+// GetReportExcerpt возвращает последние limit сообщений личной переписки для жалобы. В отличие от GetMessages
+// сообщения, скрытые участниками у себя, не исключаются: модератор должен видеть переписку целиком.
+func (r *ChatRepository) GetReportExcerpt(ctx context.Context, reporterId uuid.UUID, reportedId uuid.UUID, limit int64) ([]chatmessages.ChatMessage, error) {
+	query := `SELECT ` + messageColumns + ` FROM chat_messages
+		WHERE (sender_id = $1 AND receiver_id = $2) OR (sender_id = $2 AND receiver_id = $1)
+		ORDER BY id DESC
+		LIMIT $3`
+	rows, err := r.Pool.Query(ctx, query, reporterId, reportedId, limit)
+	if err != nil {
+		return nil, customerror.NewError("ChatRepository.GetReportExcerpt", r.Host+":"+r.Port, err.Error())
+	}
+	defer rows.Close()
+	messages := []chatmessages.ChatMessage{}
+	for rows.Next() {
+		var message chatmessages.ChatMessage
+		err := rows.Scan(&message.Id, &message.SenderId, &message.ReceiverId, &message.Message, &message.CreatedAt, &message.ConversationId, &message.Kind, &message.FlatId, &message.EditedAt, &message.DeletedAt)
+		if err != nil {
+			return nil, customerror.NewError("ChatRepository.GetReportExcerpt", r.Host+":"+r.Port, err.Error())
+		}
+		messages = append(messages, message)
+	}
+	if rows.Err() != nil {
+		return nil, customerror.NewError("ChatRepository.GetReportExcerpt", r.Host+":"+r.Port, rows.Err().Error())
+	}
+	return messages, nil
+}
+
+func (r *ChatRepository) AddMessage(ctx context.Context, message *chatmessages.ChatMessage) (int64, error) {
+	if message.Kind == "" {
+		message.Kind = chatmessages.KindText
+	}
+	// В групповых беседах получателя нет
+	var receiverId any
+	if message.ReceiverId != uuid.Nil {
+		receiverId = message.ReceiverId
+	}
+	var conversationId any
+	if message.ConversationId != 0 {
+		conversationId = message.ConversationId
+	}
+	err := r.Pool.QueryRow(ctx, addMessageQuery, message.SenderId, receiverId, conversationId, message.Message, message.Kind, message.FlatId).Scan(&message.Id, &message.CreatedAt)
+	if err != nil {
+		return 0, customerror.NewError("ChatRepository.AddMessage", r.Host+":"+r.Port, err.Error())
+	}
+	return message.Id, nil
+}
+
+// AddDirectMessage записывает личное сообщение, при необходимости создавая беседу в той же транзакции.
+// Возвращает true, если беседа создана этим сообщением.
+func (r *ChatRepository) AddDirectMessage(ctx context.Context, message *chatmessages.ChatMessage) (bool, error) {
+	if message.Kind == "" {
+		message.Kind = chatmessages.KindText
+	}
+	tx, err := r.Pool.Begin(ctx)
+	if err != nil {
+		return false, customerror.NewError("ChatRepository.AddDirectMessage", r.Host+":"+r.Port, err.Error())
+	}
+	defer tx.Rollback(ctx)
+	conversationId, created, err := getOrCreateDirect(ctx, tx, message.SenderId, message.ReceiverId)
+	if err != nil {
+		return false, customerror.NewError("ChatRepository.AddDirectMessage", r.Host+":"+r.Port, err.Error())
+	}
+	err = tx.QueryRow(ctx, addMessageQuery, message.SenderId, message.ReceiverId, conversationId, message.Message, message.Kind, message.FlatId).Scan(&message.Id, &message.CreatedAt)
+	if err != nil {
+		return false, customerror.NewError("ChatRepository.AddDirectMessage", r.Host+":"+r.Port, err.Error())
+	}
+	err = tx.Commit(ctx)
+	if err != nil {
+		return false, customerror.NewError("ChatRepository.AddDirectMessage", r.Host+":"+r.Port, err.Error())
+	}
+	message.ConversationId = conversationId
+	return created, nil
+}
+
+func (r *ChatRepository) GetMessage(ctx context.Context, id int64) (*chatmessages.ChatMessage, error) {
 	query := `
-		INSERT INTO chat_messages (sender_id, receiver_id, message) VALUES ($1,$2,$3);
+		SELECT id, sender_id, receiver_id, message, created_at, COALESCE(conversation_id, 0), kind, flat_id, edited_at, deleted_at
+		FROM chat_messages
+		WHERE id = $1;
 	`
-	_, err := r.Pool.Exec(ctx, query, senderId, receiverId, message)
+	var message chatmessages.ChatMessage
+	err := r.Pool.QueryRow(ctx, query, id).Scan(&message.Id, &message.SenderId, &message.ReceiverId, &message.Message, &message.CreatedAt, &message.ConversationId,
+		&message.Kind, &message.FlatId, &message.EditedAt, &message.DeletedAt)
 	if err != nil {
-		return 0, customerror.NewError("ChatRepository.AddMessage", r.Host+":"+r.Port, err.Error())
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, pgx.ErrNoRows
+		}
+		return nil, customerror.NewError("ChatRepository.GetMessage", r.Host+":"+r.Port, err.Error())
+	}
+	return &message, nil
+}
+
+func (r *ChatRepository) EditMessage(ctx context.Context, id int64, actorId uuid.UUID, message string) (*chatmessages.ChatMessage, error) {
+	return r.changeMessage(ctx, "ChatRepository.EditMessage", id, actorId, "edit",
+		`UPDATE chat_messages SET message = $2, edited_at = CURRENT_TIMESTAMP WHERE id = $1 AND deleted_at IS NULL
+		RETURNING id, sender_id, receiver_id, message, created_at, COALESCE(conversation_id, 0), kind, flat_id, edited_at, deleted_at`, message)
+}
+
+func (r *ChatRepository) DeleteMessage(ctx context.Context, id int64, actorId uuid.UUID) (*chatmessages.ChatMessage, error) {
+	return r.changeMessage(ctx, "ChatRepository.DeleteMessage", id, actorId, "delete",
+		`UPDATE chat_messages SET message = '', flat_id = 0, deleted_at = CURRENT_TIMESTAMP WHERE id = $1 AND deleted_at IS NULL
+		RETURNING id, sender_id, receiver_id, message, created_at, COALESCE(conversation_id, 0), kind, flat_id, edited_at, deleted_at`)
+}
+
+// changeMessage в одной транзакции сохраняет текущий текст сообщения в chat_message_audit и применяет updateQuery.
+func (r *ChatRepository) changeMessage(ctx context.Context, module string, id int64, actorId uuid.UUID, action string, updateQuery string, args ...any) (*chatmessages.ChatMessage, error) {
+	tx, err := r.Pool.Begin(ctx)
+	if err != nil {
+		return nil, customerror.NewError(module, r.Host+":"+r.Port, err.Error())
+	}
+	defer tx.Rollback(ctx)
+	auditQuery := `
+		INSERT INTO chat_message_audit (message_id, action, message, actor_id)
+		SELECT id, $2, message, $3 FROM chat_messages WHERE id = $1 AND deleted_at IS NULL;
+	`
+	command, err := tx.Exec(ctx, auditQuery, id, action, actorId)
+	if err != nil {
+		return nil, customerror.NewError(module, r.Host+":"+r.Port, err.Error())
 	}
-	return 0, nil
+	if command.RowsAffected() == 0 {
+		return nil, pgx.ErrNoRows
+	}
+	var message chatmessages.ChatMessage
+	err = tx.QueryRow(ctx, updateQuery, append([]any{id}, args...)...).Scan(&message.Id, &message.SenderId, &message.ReceiverId, &message.Message,
+		&message.CreatedAt, &message.ConversationId, &message.Kind, &message.FlatId, &message.EditedAt, &message.DeletedAt)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, pgx.ErrNoRows
+		}
+		return nil, customerror.NewError(module, r.Host+":"+r.Port, err.Error())
+	}
+	err = tx.Commit(ctx)
+	if err != nil {
+		return nil, customerror.NewError(module, r.Host+":"+r.Port, err.Error())
+	}
+	return &message, nil
+}
+
+// HideMessage скрывает сообщение у пользователя, который был участником переписки в момент отправки,
+// в том числе если он уже покинул беседу. Иначе возвращает pgx.ErrNoRows.
+func (r *ChatRepository) HideMessage(ctx context.Context, id int64, userId uuid.UUID) error {
+	query := `
+	WITH message AS (
+		SELECT id FROM chat_messages WHERE id = $2 AND ` + participantCondition + `
+	), hidden AS (
+		INSERT INTO chat_message_hidden (message_id, user_id) SELECT id, $1 FROM message ON CONFLICT DO NOTHING
+	)
+	SELECT COUNT(*) FROM message`
+	var count int64
+	err := r.Pool.QueryRow(ctx, query, userId, id).Scan(&count)
+	if err != nil {
+		return customerror.NewError("ChatRepository.HideMessage", r.Host+":"+r.Port, err.Error())
+	}
+	if count == 0 {
+		return pgx.ErrNoRows
+	}
+	return nil
+}
+
+func (r *ChatRepository) GetMessagesAfter(ctx context.Context, userId uuid.UUID, afterMessage int64, limit int64) ([]chatmessages.ChatMessage, error) {
+	query := `
+		SELECT ` + messageColumns + `
+		FROM chat_messages
+		WHERE id > $2 AND ` + visibleMessageCondition + `
+		ORDER BY id ASC
+		LIMIT $3;
+	`
+	rows, err := r.Pool.Query(ctx, query, userId, afterMessage, limit)
+	if err != nil {
+		return nil, customerror.NewError("ChatRepository.GetMessagesAfter", r.Host+":"+r.Port, err.Error())
+	}
+	defer rows.Close()
+	var messages []chatmessages.ChatMessage
+	for rows.Next() {
+		var message chatmessages.ChatMessage
+		err := rows.Scan(&message.Id, &message.SenderId, &message.ReceiverId, &message.Message, &message.CreatedAt, &message.ConversationId,
+			&message.Kind, &message.FlatId, &message.EditedAt, &message.DeletedAt)
+		if err != nil {
+			return nil, customerror.NewError("ChatRepository.GetMessagesAfter", r.Host+":"+r.Port, err.Error())
+		}
+		messages = append(messages, message)
+	}
+	return messages, nil
+}
+
+func (r *ChatRepository) MarkRead(ctx context.Context, readerId uuid.UUID, senderId uuid.UUID, upToMessage int64) error {
+	query := `
+		UPDATE chat_messages SET read_at = CURRENT_TIMESTAMP
+		WHERE receiver_id = $1 AND sender_id = $2 AND id <= $3 AND read_at IS NULL;
+	`
+	_, err := r.Pool.Exec(ctx, query, readerId, senderId, upToMessage)
+	if err != nil {
+		return customerror.NewError("ChatRepository.MarkRead", r.Host+":"+r.Port, err.Error())
+	}
+	return nil
+}
+
+// ClaimUnreadForEmail помечает непрочитанные сообщения из заданного интервала как отправленные на почту и возвращает их.
+// UPDATE ... RETURNING гарантирует, что при нескольких репликах каждое сообщение попадет только в одно письмо.
+func (r *ChatRepository) ClaimUnreadForEmail(ctx context.Context, createdAfter time.Time, createdBefore time.Time) ([]chatmessages.ChatMessage, error) {
+	query := `
+		UPDATE chat_messages SET email_notified_at = CURRENT_TIMESTAMP
+		WHERE read_at IS NULL AND email_notified_at IS NULL AND deleted_at IS NULL AND receiver_id IS NOT NULL
+			AND created_at > $1 AND created_at <= $2
+		RETURNING id, sender_id, receiver_id, created_at;
+	`
+	rows, err := r.Pool.Query(ctx, query, createdAfter, createdBefore)
+	if err != nil {
+		return nil, customerror.NewError("ChatRepository.ClaimUnreadForEmail", r.Host+":"+r.Port, err.Error())
+	}
+	defer rows.Close()
+	var messages []chatmessages.ChatMessage
+	for rows.Next() {
+		var message chatmessages.ChatMessage
+		err := rows.Scan(&message.Id, &message.SenderId, &message.ReceiverId, &message.CreatedAt)
+		if err != nil {
+			return nil, customerror.NewError("ChatRepository.ClaimUnreadForEmail", r.Host+":"+r.Port, err.Error())
+		}
+		messages = append(messages, message)
+	}
+	if rows.Err() != nil {
+		return nil, customerror.NewError("ChatRepository.ClaimUnreadForEmail", r.Host+":"+r.Port, rows.Err().Error())
+	}
+	return messages, nil
+}
+
+func (r *ChatRepository) CreateTicket(ctx context.Context, ticket string, userId uuid.UUID, jwtVersion uint, tokenExpiresAt time.Time, expiresAt time.Time) error {
+	_, err := r.Pool.Exec(ctx, `DELETE FROM chat_ws_tickets WHERE expires_at < NOW()`)
+	if err != nil {
+		return customerror.NewError("ChatRepository.CreateTicket", r.Host+":"+r.Port, err.Error())
+	}
+	query := `INSERT INTO chat_ws_tickets (ticket, user_id, jwt_version, expires_at, token_expires_at) VALUES ($1, $2, $3, $4, $5)`
+	_, err = r.Pool.Exec(ctx, query, ticket, userId, jwtVersion, expiresAt, tokenExpiresAt)
+	if err != nil {
+		return customerror.NewError("ChatRepository.CreateTicket", r.Host+":"+r.Port, err.Error())
+	}
+	return nil
+}
+
+// ConsumeTicket удаляет тикет и возвращает его владельца и срок его токена; DELETE ... RETURNING гарантирует одноразовость
+func (r *ChatRepository) ConsumeTicket(ctx context.Context, ticket string) (uuid.UUID, uint, time.Time, error) {
+	// У тикетов, выданных до появления token_expires_at, срок токена неизвестен: такое соединение закроется при ближайшей проверке
+	query := `DELETE FROM chat_ws_tickets WHERE ticket = $1 RETURNING user_id, jwt_version, expires_at, COALESCE(token_expires_at, CURRENT_TIMESTAMP)`
+	var userId uuid.UUID
+	var jwtVersion uint
+	var expiresAt time.Time
+	var tokenExpiresAt time.Time
+	err := r.Pool.QueryRow(ctx, query, ticket).Scan(&userId, &jwtVersion, &expiresAt, &tokenExpiresAt)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return uuid.Nil, 0, time.Time{}, pgx.ErrNoRows
+		}
+		return uuid.Nil, 0, time.Time{}, customerror.NewError("ChatRepository.ConsumeTicket", r.Host+":"+r.Port, err.Error())
+	}
+	if expiresAt.Before(time.Now()) {
+		return uuid.Nil, 0, time.Time{}, pgx.ErrNoRows
+	}
+	return userId, jwtVersion, tokenExpiresAt, nil
+}
+
+func scanMessages(rows pgx.Rows) ([]chatmessages.ChatMessage, error) {
+	defer rows.Close()
+	messages := []chatmessages.ChatMessage{}
+	for rows.Next() {
+		var message chatmessages.ChatMessage
+		err := rows.Scan(&message.Id, &message.SenderId, &message.ReceiverId, &message.Message, &message.CreatedAt, &message.ConversationId,
+			&message.Kind, &message.FlatId, &message.EditedAt, &message.DeletedAt)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, message)
+	}
+	return messages, rows.Err()
+}
+
+// SearchMessages ищет по тексту сообщений, видимых пользователю. digitsTsQuery проверяется по тексту со склеенными числами.
+// withUser ограничивает поиск личной перепиской, conversationId - одной беседой; нулевые значения означают поиск по всем перепискам.
+func (r *ChatRepository) SearchMessages(ctx context.Context, userId uuid.UUID, tsQuery string, digitsTsQuery string, withUser uuid.UUID, conversationId int64, offset int64, limit int64) ([]chatmessages.ChatMessage, error) {
+	query := `
+		SELECT ` + messageColumns + `
+		FROM chat_messages
+		WHERE (search_vector @@ to_tsquery('simple', $2) OR search_digits_vector @@ to_tsquery('simple', $7)) AND deleted_at IS NULL AND ` + visibleMessageCondition + `
+			AND ($3::uuid IS NULL OR (sender_id IN ($1, $3) AND receiver_id IN ($1, $3)))
+			AND ($4::bigint = 0 OR conversation_id = $4)
+		ORDER BY id DESC
+		OFFSET $5
+		LIMIT $6;
+	`
+	var withUserArg any
+	if withUser != uuid.Nil {
+		withUserArg = withUser
+	}
+	rows, err := r.Pool.Query(ctx, query, userId, tsQuery, withUserArg, conversationId, offset, limit, digitsTsQuery)
+	if err != nil {
+		return nil, customerror.NewError("ChatRepository.SearchMessages", r.Host+":"+r.Port, err.Error())
+	}
+	messages, err := scanMessages(rows)
+	if err != nil {
+		return nil, customerror.NewError("ChatRepository.SearchMessages", r.Host+":"+r.Port, err.Error())
+	}
+	return messages, nil
+}
+
+// GetMessageContext возвращает до size видимых пользователю сообщений той же беседы до и после message
+func (r *ChatRepository) GetMessageContext(ctx context.Context, userId uuid.UUID, message *chatmessages.ChatMessage, size int64) ([]chatmessages.ChatMessage, []chatmessages.ChatMessage, error) {
+	beforeQuery := `
+		SELECT ` + messageColumns + `
+		FROM chat_messages
+		WHERE conversation_id = $2 AND id < $3 AND ` + visibleMessageCondition + `
+		ORDER BY id DESC
+		LIMIT $4;
+	`
+	rows, err := r.Pool.Query(ctx, beforeQuery, userId, message.ConversationId, message.Id, size)
+	if err != nil {
+		return nil, nil, customerror.NewError("ChatRepository.GetMessageContext", r.Host+":"+r.Port, err.Error())
+	}
+	before, err := scanMessages(rows)
+	if err != nil {
+		return nil, nil, customerror.NewError("ChatRepository.GetMessageContext", r.Host+":"+r.Port, err.Error())
+	}
+	slices.Reverse(before)
+	afterQuery := `
+		SELECT ` + messageColumns + `
+		FROM chat_messages
+		WHERE conversation_id = $2 AND id > $3 AND ` + visibleMessageCondition + `
+		ORDER BY id ASC
+		LIMIT $4;
+	`
+	rows, err = r.Pool.Query(ctx, afterQuery, userId, message.ConversationId, message.Id, size)
+	if err != nil {
+		return nil, nil, customerror.NewError("ChatRepository.GetMessageContext", r.Host+":"+r.Port, err.Error())
+	}
+	after, err := scanMessages(rows)
+	if err != nil {
+		return nil, nil, customerror.NewError("ChatRepository.GetMessageContext", r.Host+":"+r.Port, err.Error())
+	}
+	return before, after, nil
+}
+
+// GetMessagesPage возвращает личную переписку по возрастанию id начиная после afterMessage, используется для выгрузки
+func (r *ChatRepository) GetMessagesPage(ctx context.Context, whatUser uuid.UUID, withUser uuid.UUID, afterMessage int64, limit int64) ([]chatmessages.ChatMessage, error) {
+	query := `
+		SELECT ` + messageColumns + `
+		FROM chat_messages
+		WHERE sender_id IN ($1, $2) AND receiver_id IN ($1, $2) AND id > $3
+			AND NOT EXISTS (SELECT 1 FROM chat_message_hidden WHERE message_id = chat_messages.id AND user_id = $1)
+		ORDER BY id ASC
+		LIMIT $4;
+	`
+	rows, err := r.Pool.Query(ctx, query, whatUser, withUser, afterMessage, limit)
+	if err != nil {
+		return nil, customerror.NewError("ChatRepository.GetMessagesPage", r.Host+":"+r.Port, err.Error())
+	}
+	messages, err := scanMessages(rows)
+	if err != nil {
+		return nil, customerror.NewError("ChatRepository.GetMessagesPage", r.Host+":"+r.Port, err.Error())
+	}
+	return messages, nil
 }
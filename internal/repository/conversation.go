@@ -0,0 +1,440 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	chatmessages "mymate/pkg/chat_messages"
+	"mymate/pkg/customerror"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+type ConversationRepositoryI interface {
+	CreateTables(ctx context.Context) error
+	FindDirect(ctx context.Context, firstId uuid.UUID, secondId uuid.UUID) (int64, error)
+	CreateConversation(ctx context.Context, conversation *chatmessages.Conversation, memberIds []uuid.UUID) (int64, error)
+	GetConversation(ctx context.Context, id int64) (*chatmessages.Conversation, error)
+	GetConversations(ctx context.Context, userId uuid.UUID) ([]chatmessages.Conversation, error)
+	GetMember(ctx context.Context, conversationId int64, userId uuid.UUID) (*chatmessages.ConversationMember, error)
+	GetMemberIds(ctx context.Context, conversationId int64) ([]uuid.UUID, error)
+	AddMember(ctx context.Context, conversationId int64, userId uuid.UUID) error
+	RemoveMember(ctx context.Context, conversationId int64, userId uuid.UUID) error
+	SetMemberRole(ctx context.Context, conversationId int64, userId uuid.UUID, role string) error
+	GetMessages(ctx context.Context, conversationId int64, userId uuid.UUID, fromMessage int64, offset int64, limit int64) ([]chatmessages.ChatMessage, error)
+}
+
+type ConversationRepository struct {
+	Pool *pgxpool.Pool
+	Host string
+	Port string
+}
+
+func NewConversationRepository(pool *pgxpool.Pool, host string, port string) ConversationRepositoryI {
+	return &ConversationRepository{
+		Pool: pool,
+		Host: host,
+		Port: port,
+	}
+}
+
+// CreateTables должен вызываться после ChatRepository.CreateTables: здесь же переносится история личных переписок в беседы.
+func (r *ConversationRepository) CreateTables(ctx context.Context) error {
+	createTableQuery := `
+	CREATE TABLE IF NOT EXISTS conversations (
+		id BIGSERIAL PRIMARY KEY,
+		kind TEXT NOT NULL DEFAULT 'group',
+		title TEXT NOT NULL DEFAULT '',
+		flat_id BIGINT NOT NULL DEFAULT 0,
+		created_by UUID REFERENCES users(id) ON DELETE SET NULL,
+		direct_key TEXT UNIQUE,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);`
+	_, err := r.Pool.Exec(ctx, createTableQuery)
+	if err != nil {
+		return customerror.NewError("conversationRepo.CreateTables", r.Host+":"+r.Port, err.Error())
+	}
+	createTableQuery = `
+	CREATE TABLE IF NOT EXISTS conversation_members (
+		conversation_id BIGINT NOT NULL REFERENCES conversations(id) ON DELETE CASCADE,
+		user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		role TEXT NOT NULL DEFAULT 'member',
+		joined_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		left_at TIMESTAMP,
+		PRIMARY KEY (conversation_id, user_id)
+	);`
+	_, err = r.Pool.Exec(ctx, createTableQuery)
+	if err != nil {
+		return customerror.NewError("conversationRepo.CreateTables", r.Host+":"+r.Port, err.Error())
+	}
+	createIndexQuery := `CREATE INDEX IF NOT EXISTS conversation_members_user_id_idx ON conversation_members(user_id);`
+	_, err = r.Pool.Exec(ctx, createIndexQuery)
+	if err != nil {
+		return customerror.NewError("conversationRepo.CreateTables", r.Host+":"+r.Port, err.Error())
+	}
+	alterQuery := `ALTER TABLE chat_messages ADD COLUMN IF NOT EXISTS conversation_id BIGINT REFERENCES conversations(id) ON DELETE CASCADE;`
+	_, err = r.Pool.Exec(ctx, alterQuery)
+	if err != nil {
+		return customerror.NewError("conversationRepo.CreateTables", r.Host+":"+r.Port, err.Error())
+	}
+	alterQuery = `ALTER TABLE chat_messages ALTER COLUMN receiver_id DROP NOT NULL;`
+	_, err = r.Pool.Exec(ctx, alterQuery)
+	if err != nil {
+		return customerror.NewError("conversationRepo.CreateTables", r.Host+":"+r.Port, err.Error())
+	}
+	createIndexQuery = `CREATE INDEX IF NOT EXISTS chat_messages_conversation_id_idx ON chat_messages(conversation_id, id);`
+	_, err = r.Pool.Exec(ctx, createIndexQuery)
+	if err != nil {
+		return customerror.NewError("conversationRepo.CreateTables", r.Host+":"+r.Port, err.Error())
+	}
+	return r.migrateDirectChats(ctx)
+}
+
+// migrateDirectChats создает беседы из двух участников для личных переписок, у сообщений которых еще нет conversation_id.
+// Повторный запуск ничего не меняет.
+func (r *ConversationRepository) migrateDirectChats(ctx context.Context) error {
+	tx, err := r.Pool.Begin(ctx)
+	if err != nil {
+		return customerror.NewError("conversationRepo.migrateDirectChats", r.Host+":"+r.Port, err.Error())
+	}
+	defer tx.Rollback(ctx)
+	insertConversationsQuery := `
+		INSERT INTO conversations (kind, direct_key, created_at)
+		SELECT 'direct', LEAST(sender_id, receiver_id)::text || ':' || GREATEST(sender_id, receiver_id)::text, MIN(created_at)
+		FROM chat_messages
+		WHERE conversation_id IS NULL AND receiver_id IS NOT NULL
+		GROUP BY LEAST(sender_id, receiver_id), GREATEST(sender_id, receiver_id)
+		ON CONFLICT (direct_key) DO NOTHING;
+	`
+	_, err = tx.Exec(ctx, insertConversationsQuery)
+	if err != nil {
+		return customerror.NewError("conversationRepo.migrateDirectChats", r.Host+":"+r.Port, err.Error())
+	}
+	insertMembersQuery := `
+		INSERT INTO conversation_members (conversation_id, user_id, role, joined_at)
+		SELECT id, split_part(direct_key, ':', 1)::uuid, 'member', created_at FROM conversations WHERE kind = 'direct'
+		UNION ALL
+		SELECT id, split_part(direct_key, ':', 2)::uuid, 'member', created_at FROM conversations WHERE kind = 'direct'
+		ON CONFLICT DO NOTHING;
+	`
+	_, err = tx.Exec(ctx, insertMembersQuery)
+	if err != nil {
+		return customerror.NewError("conversationRepo.migrateDirectChats", r.Host+":"+r.Port, err.Error())
+	}
+	updateMessagesQuery := `
+		UPDATE chat_messages SET conversation_id = conversations.id
+		FROM conversations
+		WHERE chat_messages.conversation_id IS NULL AND chat_messages.receiver_id IS NOT NULL
+			AND conversations.direct_key = LEAST(chat_messages.sender_id, chat_messages.receiver_id)::text || ':' || GREATEST(chat_messages.sender_id, chat_messages.receiver_id)::text;
+	`
+	_, err = tx.Exec(ctx, updateMessagesQuery)
+	if err != nil {
+		return customerror.NewError("conversationRepo.migrateDirectChats", r.Host+":"+r.Port, err.Error())
+	}
+	err = tx.Commit(ctx)
+	if err != nil {
+		return customerror.NewError("conversationRepo.migrateDirectChats", r.Host+":"+r.Port, err.Error())
+	}
+	return nil
+}
+
+func directKey(firstId uuid.UUID, secondId uuid.UUID) string {
+	if firstId.String() > secondId.String() {
+		firstId, secondId = secondId, firstId
+	}
+	return firstId.String() + ":" + secondId.String()
+}
+
+// FindDirect возвращает личную беседу двух пользователей или pgx.ErrNoRows, если они еще не переписывались
+func (r *ConversationRepository) FindDirect(ctx context.Context, firstId uuid.UUID, secondId uuid.UUID) (int64, error) {
+	var id int64
+	err := r.Pool.QueryRow(ctx, `SELECT id FROM conversations WHERE direct_key = $1`, directKey(firstId, secondId)).Scan(&id)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return 0, pgx.ErrNoRows
+		}
+		return 0, customerror.NewError("conversationRepo.FindDirect", r.Host+":"+r.Port, err.Error())
+	}
+	return id, nil
+}
+
+// getOrCreateDirect создает личную беседу в транзакции первого сообщения, чтобы без сообщения беседа не появлялась
+func getOrCreateDirect(ctx context.Context, tx pgx.Tx, firstId uuid.UUID, secondId uuid.UUID) (int64, bool, error) {
+	// DO UPDATE вместо DO NOTHING, чтобы RETURNING вернул id и для уже существующей беседы.
+	// xmax = 0 только у только что вставленной строки.
+	query := `
+		INSERT INTO conversations (kind, direct_key) VALUES ('direct', $1)
+		ON CONFLICT (direct_key) DO UPDATE SET direct_key = EXCLUDED.direct_key
+		RETURNING id, (xmax = 0);
+	`
+	var id int64
+	var created bool
+	err := tx.QueryRow(ctx, query, directKey(firstId, secondId)).Scan(&id, &created)
+	if err != nil {
+		return 0, false, err
+	}
+	membersQuery := `
+		INSERT INTO conversation_members (conversation_id, user_id, role) VALUES ($1, $2, 'member'), ($1, $3, 'member')
+		ON CONFLICT DO NOTHING;
+	`
+	_, err = tx.Exec(ctx, membersQuery, id, firstId, secondId)
+	if err != nil {
+		return 0, false, err
+	}
+	return id, created, nil
+}
+
+// CreateConversation создает групповую беседу, создатель становится администратором
+func (r *ConversationRepository) CreateConversation(ctx context.Context, conversation *chatmessages.Conversation, memberIds []uuid.UUID) (int64, error) {
+	tx, err := r.Pool.Begin(ctx)
+	if err != nil {
+		return 0, customerror.NewError("conversationRepo.CreateConversation", r.Host+":"+r.Port, err.Error())
+	}
+	defer tx.Rollback(ctx)
+	query := `
+		INSERT INTO conversations (kind, title, flat_id, created_by) VALUES ($1, $2, $3, $4)
+		RETURNING id, created_at;
+	`
+	err = tx.QueryRow(ctx, query, chatmessages.ConversationKindGroup, conversation.Title, conversation.FlatId, conversation.CreatedBy).Scan(&conversation.Id, &conversation.CreatedAt)
+	if err != nil {
+		return 0, customerror.NewError("conversationRepo.CreateConversation", r.Host+":"+r.Port, err.Error())
+	}
+	conversation.Kind = chatmessages.ConversationKindGroup
+	memberQuery := `INSERT INTO conversation_members (conversation_id, user_id, role) VALUES ($1, $2, $3) ON CONFLICT DO NOTHING`
+	_, err = tx.Exec(ctx, memberQuery, conversation.Id, conversation.CreatedBy, chatmessages.MemberRoleAdmin)
+	if err != nil {
+		return 0, customerror.NewError("conversationRepo.CreateConversation", r.Host+":"+r.Port, err.Error())
+	}
+	for _, memberId := range memberIds {
+		_, err = tx.Exec(ctx, memberQuery, conversation.Id, memberId, chatmessages.MemberRoleMember)
+		if err != nil {
+			return 0, customerror.NewError("conversationRepo.CreateConversation", r.Host+":"+r.Port, err.Error())
+		}
+	}
+	err = tx.Commit(ctx)
+	if err != nil {
+		return 0, customerror.NewError("conversationRepo.CreateConversation", r.Host+":"+r.Port, err.Error())
+	}
+	return conversation.Id, nil
+}
+
+// GetConversation возвращает беседу вместе с текущими участниками
+func (r *ConversationRepository) GetConversation(ctx context.Context, id int64) (*chatmessages.Conversation, error) {
+	query := `
+		SELECT id, kind, title, flat_id, created_by, created_at
+		FROM conversations
+		WHERE id = $1;
+	`
+	var conversation chatmessages.Conversation
+	err := r.Pool.QueryRow(ctx, query, id).Scan(&conversation.Id, &conversation.Kind, &conversation.Title, &conversation.FlatId,
+		&conversation.CreatedBy, &conversation.CreatedAt)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, pgx.ErrNoRows
+		}
+		return nil, customerror.NewError("conversationRepo.GetConversation", r.Host+":"+r.Port, err.Error())
+	}
+	membersQuery := `
+		SELECT user_id, role, joined_at, left_at
+		FROM conversation_members
+		WHERE conversation_id = $1 AND left_at IS NULL
+		ORDER BY joined_at;
+	`
+	rows, err := r.Pool.Query(ctx, membersQuery, id)
+	if err != nil {
+		return nil, customerror.NewError("conversationRepo.GetConversation", r.Host+":"+r.Port, err.Error())
+	}
+	defer rows.Close()
+	conversation.Members = []chatmessages.ConversationMember{}
+	for rows.Next() {
+		var member chatmessages.ConversationMember
+		err := rows.Scan(&member.UserId, &member.Role, &member.JoinedAt, &member.LeftAt)
+		if err != nil {
+			return nil, customerror.NewError("conversationRepo.GetConversation", r.Host+":"+r.Port, err.Error())
+		}
+		conversation.Members = append(conversation.Members, member)
+	}
+	return &conversation, nil
+}
+
+// GetConversations возвращает групповые беседы пользователя с последним видимым ему сообщением.
+// Личные переписки по-прежнему отдаются через ChatRepository.GetChats.
+func (r *ConversationRepository) GetConversations(ctx context.Context, userId uuid.UUID) ([]chatmessages.Conversation, error) {
+	query := `
+		SELECT c.id, c.kind, c.title, c.flat_id, c.created_by, c.created_at,
+			COALESCE(m.id, 0), m.sender_id, COALESCE(m.message, ''), m.created_at, COALESCE(m.kind, ''), COALESCE(m.flat_id, 0), m.edited_at, m.deleted_at
+		FROM conversations c
+		JOIN conversation_members cm ON cm.conversation_id = c.id AND cm.user_id = $1 AND cm.left_at IS NULL
+		LEFT JOIN LATERAL (
+			SELECT id, sender_id, message, created_at, kind, flat_id, edited_at, deleted_at
+			FROM chat_messages
+			WHERE conversation_id = c.id AND created_at >= cm.joined_at
+				AND NOT EXISTS (SELECT 1 FROM chat_message_hidden WHERE message_id = chat_messages.id AND user_id = $1)
+			ORDER BY id DESC
+			LIMIT 1
+		) m ON TRUE
+		WHERE c.kind = 'group'
+		ORDER BY COALESCE(m.created_at, c.created_at) DESC;
+	`
+	rows, err := r.Pool.Query(ctx, query, userId)
+	if err != nil {
+		return nil, customerror.NewError("conversationRepo.GetConversations", r.Host+":"+r.Port, err.Error())
+	}
+	defer rows.Close()
+	conversations := []chatmessages.Conversation{}
+	for rows.Next() {
+		var conversation chatmessages.Conversation
+		var lastMessage chatmessages.ChatMessage
+		err := rows.Scan(&conversation.Id, &conversation.Kind, &conversation.Title, &conversation.FlatId, &conversation.CreatedBy, &conversation.CreatedAt,
+			&lastMessage.Id, &lastMessage.SenderId, &lastMessage.Message, &lastMessage.CreatedAt, &lastMessage.Kind, &lastMessage.FlatId, &lastMessage.EditedAt, &lastMessage.DeletedAt)
+		if err != nil {
+			return nil, customerror.NewError("conversationRepo.GetConversations", r.Host+":"+r.Port, err.Error())
+		}
+		if lastMessage.Id != 0 {
+			lastMessage.ConversationId = conversation.Id
+			conversation.LastMessage = &lastMessage
+		}
+		conversations = append(conversations, conversation)
+	}
+	if rows.Err() != nil {
+		return nil, customerror.NewError("conversationRepo.GetConversations", r.Host+":"+r.Port, rows.Err().Error())
+	}
+	return conversations, nil
+}
+
+// GetMember возвращает участника беседы, в том числе покинувшего ее (с заполненным LeftAt)
+func (r *ConversationRepository) GetMember(ctx context.Context, conversationId int64, userId uuid.UUID) (*chatmessages.ConversationMember, error) {
+	query := `
+		SELECT user_id, role, joined_at, left_at
+		FROM conversation_members
+		WHERE conversation_id = $1 AND user_id = $2;
+	`
+	var member chatmessages.ConversationMember
+	err := r.Pool.QueryRow(ctx, query, conversationId, userId).Scan(&member.UserId, &member.Role, &member.JoinedAt, &member.LeftAt)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, pgx.ErrNoRows
+		}
+		return nil, customerror.NewError("conversationRepo.GetMember", r.Host+":"+r.Port, err.Error())
+	}
+	return &member, nil
+}
+
+func (r *ConversationRepository) GetMemberIds(ctx context.Context, conversationId int64) ([]uuid.UUID, error) {
+	query := `SELECT user_id FROM conversation_members WHERE conversation_id = $1 AND left_at IS NULL`
+	rows, err := r.Pool.Query(ctx, query, conversationId)
+	if err != nil {
+		return nil, customerror.NewError("conversationRepo.GetMemberIds", r.Host+":"+r.Port, err.Error())
+	}
+	defer rows.Close()
+	var memberIds []uuid.UUID
+	for rows.Next() {
+		var memberId uuid.UUID
+		err := rows.Scan(&memberId)
+		if err != nil {
+			return nil, customerror.NewError("conversationRepo.GetMemberIds", r.Host+":"+r.Port, err.Error())
+		}
+		memberIds = append(memberIds, memberId)
+	}
+	return memberIds, nil
+}
+
+// AddMember добавляет участника. Вернувшийся участник снова становится обычным участником
+// и видит сообщения только с момента возвращения.
+func (r *ConversationRepository) AddMember(ctx context.Context, conversationId int64, userId uuid.UUID) error {
+	query := `
+		INSERT INTO conversation_members (conversation_id, user_id, role) VALUES ($1, $2, 'member')
+		ON CONFLICT (conversation_id, user_id) DO UPDATE SET role = 'member', joined_at = CURRENT_TIMESTAMP, left_at = NULL
+		WHERE conversation_members.left_at IS NOT NULL;
+	`
+	_, err := r.Pool.Exec(ctx, query, conversationId, userId)
+	if err != nil {
+		return customerror.NewError("conversationRepo.AddMember", r.Host+":"+r.Port, err.Error())
+	}
+	return nil
+}
+
+// RemoveMember отмечает выход участника. Если в беседе не осталось администраторов,
+// администратором становится участник, который состоит в ней дольше всех.
+func (r *ConversationRepository) RemoveMember(ctx context.Context, conversationId int64, userId uuid.UUID) error {
+	tx, err := r.Pool.Begin(ctx)
+	if err != nil {
+		return customerror.NewError("conversationRepo.RemoveMember", r.Host+":"+r.Port, err.Error())
+	}
+	defer tx.Rollback(ctx)
+	query := `
+		UPDATE conversation_members SET left_at = CURRENT_TIMESTAMP, role = 'member'
+		WHERE conversation_id = $1 AND user_id = $2 AND left_at IS NULL;
+	`
+	command, err := tx.Exec(ctx, query, conversationId, userId)
+	if err != nil {
+		return customerror.NewError("conversationRepo.RemoveMember", r.Host+":"+r.Port, err.Error())
+	}
+	if command.RowsAffected() == 0 {
+		return pgx.ErrNoRows
+	}
+	promoteQuery := `
+		UPDATE conversation_members SET role = 'admin'
+		WHERE conversation_id = $1 AND user_id = (
+			SELECT user_id FROM conversation_members
+			WHERE conversation_id = $1 AND left_at IS NULL
+			ORDER BY joined_at
+			LIMIT 1
+		) AND NOT EXISTS (
+			SELECT 1 FROM conversation_members WHERE conversation_id = $1 AND left_at IS NULL AND role = 'admin'
+		);
+	`
+	_, err = tx.Exec(ctx, promoteQuery, conversationId)
+	if err != nil {
+		return customerror.NewError("conversationRepo.RemoveMember", r.Host+":"+r.Port, err.Error())
+	}
+	err = tx.Commit(ctx)
+	if err != nil {
+		return customerror.NewError("conversationRepo.RemoveMember", r.Host+":"+r.Port, err.Error())
+	}
+	return nil
+}
+
+func (r *ConversationRepository) SetMemberRole(ctx context.Context, conversationId int64, userId uuid.UUID, role string) error {
+	query := `UPDATE conversation_members SET role = $3 WHERE conversation_id = $1 AND user_id = $2 AND left_at IS NULL`
+	command, err := r.Pool.Exec(ctx, query, conversationId, userId, role)
+	if err != nil {
+		return customerror.NewError("conversationRepo.SetMemberRole", r.Host+":"+r.Port, err.Error())
+	}
+	if command.RowsAffected() == 0 {
+		return pgx.ErrNoRows
+	}
+	return nil
+}
+
+// GetMessages возвращает сообщения беседы. Участник видит историю с момента вступления (последнего приглашения) и до выхода.
+func (r *ConversationRepository) GetMessages(ctx context.Context, conversationId int64, userId uuid.UUID, fromMessage int64, offset int64, limit int64) ([]chatmessages.ChatMessage, error) {
+	query := `
+		SELECT id, sender_id, receiver_id, message, created_at, conversation_id, kind, flat_id, edited_at, deleted_at
+		FROM chat_messages
+		WHERE conversation_id = $1 AND ($3::bigint = -1 OR id <= $3)
+			AND NOT EXISTS (SELECT 1 FROM chat_message_hidden WHERE message_id = chat_messages.id AND user_id = $2)
+			AND created_at <= COALESCE((SELECT left_at FROM conversation_members WHERE conversation_id = $1 AND user_id = $2), 'infinity')
+			AND created_at >= COALESCE((SELECT joined_at FROM conversation_members WHERE conversation_id = $1 AND user_id = $2), '-infinity')
+		ORDER BY id DESC
+		OFFSET $4
+		LIMIT $5;
+	`
+	rows, err := r.Pool.Query(ctx, query, conversationId, userId, fromMessage, offset, limit)
+	if err != nil {
+		return nil, customerror.NewError("conversationRepo.GetMessages", r.Host+":"+r.Port, err.Error())
+	}
+	defer rows.Close()
+	messages := []chatmessages.ChatMessage{}
+	for rows.Next() {
+		var message chatmessages.ChatMessage
+		err := rows.Scan(&message.Id, &message.SenderId, &message.ReceiverId, &message.Message, &message.CreatedAt, &message.ConversationId,
+			&message.Kind, &message.FlatId, &message.EditedAt, &message.DeletedAt)
+		if err != nil {
+			return nil, customerror.NewError("conversationRepo.GetMessages", r.Host+":"+r.Port, err.Error())
+		}
+		messages = append(messages, message)
+	}
+	return messages, nil
+}
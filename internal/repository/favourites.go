@@ -3,6 +3,7 @@ package repository
 import (
 	"context"
 	"mymate/pkg/customerror"
+	"mymate/pkg/favourites"
 	"mymate/pkg/flat"
 	"mymate/pkg/user"
 
@@ -15,6 +16,9 @@ type FavouritesRepositoryI interface {
 	GetFavourites(ctx context.Context, offset int64, limit int64, userId uuid.UUID) ([]flat.Flat, error)
 	InsertFavourite(ctx context.Context, flat *flat.Flat, user *user.User) (int64, error)
 	DeleteFavourite(ctx context.Context, id int64, user *user.User) error
+	IsNewMatch(ctx context.Context, userId uuid.UUID, ownerId uuid.UUID) (bool, error)
+	ClaimOwnerBatches(ctx context.Context) ([]favourites.OwnerBatch, error)
+	ReleaseOwnerBatch(ctx context.Context, batch *favourites.OwnerBatch) error
 }
 
 type FavouritesRepository struct {
@@ -43,6 +47,20 @@ func (r *FavouritesRepository) CreateTables(ctx context.Context) error {
 	if err != nil {
 		return customerror.NewError("favouritesRepo.CreateTables", r.Host+":"+r.Port, err.Error())
 	}
+	// Уже существующие добавления считаются известными владельцу, новые ждут пачечного уведомления
+	alterQueries := []string{
+		`ALTER TABLE favourites ADD COLUMN IF NOT EXISTS created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP`,
+		`ALTER TABLE favourites ADD COLUMN IF NOT EXISTS owner_notified_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP`,
+		`ALTER TABLE favourites ALTER COLUMN owner_notified_at DROP DEFAULT`,
+		`CREATE INDEX IF NOT EXISTS favourites_flat_id_idx ON favourites(flat_id)`,
+		`CREATE INDEX IF NOT EXISTS favourites_owner_pending_idx ON favourites(id) WHERE owner_notified_at IS NULL`,
+	}
+	for _, query := range alterQueries {
+		_, err = r.Pool.Exec(ctx, query)
+		if err != nil {
+			return customerror.NewError("favouritesRepo.CreateTables", r.Host+":"+r.Port, err.Error())
+		}
+	}
 	return nil
 }
 
@@ -50,7 +68,8 @@ func (r *FavouritesRepository) GetFavourites(ctx context.Context, offset int64,
 	query := `
 		SELECT flat.id, flat.name, flat.about, flat.price_from, flat.price_to, flat.neighborhoods_count, 
 		flat.neighborhood_age_from, flat.neighborhood_age_to, flat.sex,
-		flat.created_at, flat.created_by_id, flat.up_in_search
+		flat.created_at, flat.created_by_id, flat.up_in_search,
+		(SELECT COUNT(*) FROM favourites AS counted WHERE counted.flat_id = flat.id)
 		FROM favourites JOIN flat ON favourites.flat_id = flat.id
 		WHERE favourites.user_id = $1
 		ORDER BY favourites.id DESC LIMIT $2 OFFSET $3; 
@@ -64,7 +83,7 @@ func (r *FavouritesRepository) GetFavourites(ctx context.Context, offset int64,
 	for rows.Next() {
 		var flat flat.Flat
 		err := rows.Scan(&flat.Id, &flat.Name, &flat.About, &flat.PriceFrom, &flat.PriceTo, &flat.NeighborhoodsCount,
-			&flat.NeighborhoodAgeFrom, &flat.NeighborhoodAgeTo, &flat.Sex, &flat.CreatedAt, &flat.CreatedById, &flat.UpInSearch)
+			&flat.NeighborhoodAgeFrom, &flat.NeighborhoodAgeTo, &flat.Sex, &flat.CreatedAt, &flat.CreatedById, &flat.UpInSearch, &flat.FavouritesCount)
 		if err != nil {
 			return nil, customerror.NewError("favouritesRepo.GetFavourites", r.Host+":"+r.Port, err.Error())
 		}
@@ -73,7 +92,15 @@ func (r *FavouritesRepository) GetFavourites(ctx context.Context, offset int64,
 	return flats, nil
 }
 func (r *FavouritesRepository) InsertFavourite(ctx context.Context, flat *flat.Flat, user *user.User) (int64, error) {
-	query := `INSERT INTO favourites (user_id, flat_id) VALUES ($1, $2) RETURNING id`
+	// Счетчик дневной статистики объявления увеличивается тем же запросом
+	query := `
+	WITH inserted AS (
+		INSERT INTO favourites (user_id, flat_id) VALUES ($1, $2) RETURNING id, flat_id
+	), stat AS (
+		INSERT INTO flat_stats_daily (flat_id, day, favourites) SELECT flat_id, CURRENT_DATE, 1 FROM inserted
+		ON CONFLICT (flat_id, day) DO UPDATE SET favourites = flat_stats_daily.favourites + 1
+	)
+	SELECT id FROM inserted`
 	var id int64
 	err := r.Pool.QueryRow(ctx, query, user.UUID, flat.Id).Scan(&id)
 	if err != nil {
@@ -89,3 +116,68 @@ func (r *FavouritesRepository) DeleteFavourite(ctx context.Context, flatId int64
 	}
 	return nil
 }
+
+// IsNewMatch проверяет, что после добавления в избранное возникла взаимная симпатия: владелец уже добавил
+// в избранное объявление пользователя, а у пользователя это первое избранное объявление владельца.
+// Так повторные добавления объявлений того же владельца не считаются новым совпадением.
+func (r *FavouritesRepository) IsNewMatch(ctx context.Context, userId uuid.UUID, ownerId uuid.UUID) (bool, error) {
+	query := `
+	SELECT (SELECT COUNT(*) FROM favourites JOIN flat ON favourites.flat_id = flat.id
+			WHERE favourites.user_id = $1 AND flat.created_by_id = $2) = 1
+		AND EXISTS (SELECT 1 FROM favourites JOIN flat ON favourites.flat_id = flat.id
+			WHERE favourites.user_id = $2 AND flat.created_by_id = $1)`
+	var match bool
+	err := r.Pool.QueryRow(ctx, query, userId, ownerId).Scan(&match)
+	if err != nil {
+		return false, customerror.NewError("favouritesRepo.IsNewMatch", r.Host+":"+r.Port, err.Error())
+	}
+	return match, nil
+}
+
+// ClaimOwnerBatches отмечает новые добавления в избранное как известные владельцу и возвращает их,
+// сгруппированные по объявлениям. Добавления владельцем собственного объявления отмечаются, но не возвращаются.
+func (r *FavouritesRepository) ClaimOwnerBatches(ctx context.Context) ([]favourites.OwnerBatch, error) {
+	query := `
+	WITH claimed AS (
+		UPDATE favourites SET owner_notified_at = CURRENT_TIMESTAMP
+		FROM flat
+		WHERE favourites.flat_id = flat.id AND favourites.owner_notified_at IS NULL
+		RETURNING favourites.flat_id, favourites.user_id, favourites.created_at, favourites.owner_notified_at, flat.created_by_id
+	), batches AS (
+		SELECT flat_id, COUNT(*) AS count, (array_agg(user_id ORDER BY created_at DESC))[1] AS last_user_id, MAX(owner_notified_at) AS claimed_at
+		FROM claimed WHERE user_id <> created_by_id
+		GROUP BY flat_id
+	)
+	SELECT flat.id, flat.name, flat.created_by_id, batches.count, users.id, users.firstname, users.lastname, users.avatar_url, batches.claimed_at
+	FROM batches JOIN flat ON flat.id = batches.flat_id JOIN users ON users.id = batches.last_user_id`
+	rows, err := r.Pool.Query(ctx, query)
+	if err != nil {
+		return nil, customerror.NewError("favouritesRepo.ClaimOwnerBatches", r.Host+":"+r.Port, err.Error())
+	}
+	defer rows.Close()
+	batches := []favourites.OwnerBatch{}
+	for rows.Next() {
+		var batch favourites.OwnerBatch
+		err := rows.Scan(&batch.FlatId, &batch.FlatName, &batch.OwnerId, &batch.Count,
+			&batch.LastUser.UUID, &batch.LastUser.Firstname, &batch.LastUser.Lastname, &batch.LastUser.AvatarUrl, &batch.ClaimedAt)
+		if err != nil {
+			return nil, customerror.NewError("favouritesRepo.ClaimOwnerBatches", r.Host+":"+r.Port, err.Error())
+		}
+		batches = append(batches, batch)
+	}
+	if rows.Err() != nil {
+		return nil, customerror.NewError("favouritesRepo.ClaimOwnerBatches", r.Host+":"+r.Port, rows.Err().Error())
+	}
+	return batches, nil
+}
+
+// ReleaseOwnerBatch возвращает добавления пачки в очередь, если уведомление о них не удалось отправить.
+// Добавления, появившиеся после захвата, не затрагиваются.
+func (r *FavouritesRepository) ReleaseOwnerBatch(ctx context.Context, batch *favourites.OwnerBatch) error {
+	query := `UPDATE favourites SET owner_notified_at = NULL WHERE flat_id = $1 AND owner_notified_at = $2`
+	_, err := r.Pool.Exec(ctx, query, batch.FlatId, batch.ClaimedAt)
+	if err != nil {
+		return customerror.NewError("favouritesRepo.ReleaseOwnerBatch", r.Host+":"+r.Port, err.Error())
+	}
+	return nil
+}
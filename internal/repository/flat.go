@@ -7,11 +7,27 @@ import (
 	"mymate/pkg/customerror"
 	"mymate/pkg/flat"
 	"mymate/pkg/user"
+	"time"
 
+	"github.com/google/uuid"
 	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
+// phashBands - на сколько частей делится перцептивный хеш фотографии. Хеши, различающиеся не больше чем
+// на phashBands-1 бит, совпадают хотя бы в одной части, поэтому похожие фотографии ищутся по индексам частей.
+const phashBands = 7
+
+// phashBandExpr возвращает выражение для части band хеша: по 9 бит, последняя часть - оставшиеся 10
+func phashBandExpr(band int) string {
+	width := 64 / phashBands
+	shift := band * width
+	if band == phashBands-1 {
+		width = 64 - shift
+	}
+	return fmt.Sprintf("((phash >> %d) & %d)::int", shift, 1<<width-1)
+}
+
 type FlatRepositoryI interface {
 	CreateTables(ctx context.Context) error
 	GetFlats(ctx context.Context, offset int64, limit int64, filters map[string]any) ([]flat.Flat, error)
@@ -19,10 +35,27 @@ type FlatRepositoryI interface {
 	InsertFlat(ctx context.Context, flat *flat.Flat) (int64, error)
 	UpdateFlat(ctx context.Context, flat *flat.Flat, user *user.User) error
 	DeleteFlat(ctx context.Context, id int64, user *user.User) error
+	GetFlatIdsCreatedBefore(ctx context.Context, before time.Time) ([]int64, error)
 
 	GetFlatImages(ctx context.Context, flatId int64) ([]flat.FlatImage, error)
 	InsertFlatImage(ctx context.Context, flatImage *flat.FlatImage) error
+	CountFlatImages(ctx context.Context, flatId int64) (int64, error)
+	ReorderFlatImages(ctx context.Context, flatId int64, imageIds []int64, coverId int64) error
 	DeleteFlatImage(ctx context.Context, flatImage *flat.FlatImage) error
+
+	GetFlatMedia(ctx context.Context, flatId int64, kind string) ([]flat.FlatMedia, error)
+	GetFlatMediaItem(ctx context.Context, flatId int64, id int64) (*flat.FlatMedia, error)
+	CountFlatMedia(ctx context.Context, flatId int64, kind string) (int64, error)
+	InsertFlatMedia(ctx context.Context, media *flat.FlatMedia) error
+	DeleteFlatMedia(ctx context.Context, media *flat.FlatMedia) error
+	EnqueueFileDeletions(ctx context.Context, keys []string) error
+
+	ClaimExpiringFlats(ctx context.Context, createdBefore time.Time) ([]flat.Flat, error)
+	IncrementFlatStat(ctx context.Context, flatId int64, counter string) error
+	GetFlatStats(ctx context.Context, flatId int64, days int64) ([]flat.DailyStats, error)
+	InsertViews(ctx context.Context, views []flat.View) error
+	GetRecentlyViewed(ctx context.Context, userId uuid.UUID, offset int64, limit int64) ([]flat.RecentlyViewed, error)
+	DeleteViewsBefore(ctx context.Context, before time.Time) (int64, error)
 }
 
 type FlatRepository struct {
@@ -75,6 +108,13 @@ func (flatRepo *FlatRepository) CreateTables(ctx context.Context) error {
 		return customerror.NewError("flatRepo.CreateTables", flatRepo.Host+":"+flatRepo.Port, err.Error())
 	}
 
+	// Когда владельцу отправлено предупреждение о скором удалении объявления
+	alterQuery := `ALTER TABLE flat ADD COLUMN IF NOT EXISTS expiry_notified_at TIMESTAMP`
+	_, err = flatRepo.Pool.Exec(ctx, alterQuery)
+	if err != nil {
+		return customerror.NewError("flatRepo.CreateTables", flatRepo.Host+":"+flatRepo.Port, err.Error())
+	}
+
 	createIndexQuery := `CREATE INDEX IF NOT EXISTS flat_id_idx ON flat(id);`
 	_, err = flatRepo.Pool.Exec(ctx, createIndexQuery)
 	if err != nil {
@@ -92,6 +132,134 @@ func (flatRepo *FlatRepository) CreateTables(ctx context.Context) error {
 	if err != nil {
 		return customerror.NewError("flatRepo.CreateTables", flatRepo.Host+":"+flatRepo.Port, err.Error())
 	}
+
+	alterQuery = `ALTER TABLE flat_image
+		ADD COLUMN IF NOT EXISTS width INT NOT NULL DEFAULT 0,
+		ADD COLUMN IF NOT EXISTS height INT NOT NULL DEFAULT 0,
+		ADD COLUMN IF NOT EXISTS variants JSONB NOT NULL DEFAULT '{}'`
+	_, err = flatRepo.Pool.Exec(ctx, alterQuery)
+	if err != nil {
+		return customerror.NewError("flatRepo.CreateTables", flatRepo.Host+":"+flatRepo.Port, err.Error())
+	}
+
+	alterQuery = `ALTER TABLE flat_image
+		ADD COLUMN IF NOT EXISTS position INT NOT NULL DEFAULT 0,
+		ADD COLUMN IF NOT EXISTS is_cover BOOLEAN NOT NULL DEFAULT false,
+		ADD COLUMN IF NOT EXISTS phash BIGINT`
+	_, err = flatRepo.Pool.Exec(ctx, alterQuery)
+	if err != nil {
+		return customerror.NewError("flatRepo.CreateTables", flatRepo.Host+":"+flatRepo.Port, err.Error())
+	}
+
+	// Фотографиям, загруженным до появления порядка, проставляем его по времени загрузки
+	updateQuery := `UPDATE flat_image SET position = numbered.position
+	FROM (SELECT id, ROW_NUMBER() OVER (PARTITION BY flat_id ORDER BY id) - 1 AS position FROM flat_image
+		WHERE flat_id IN (SELECT flat_id FROM flat_image GROUP BY flat_id HAVING COUNT(DISTINCT position) < COUNT(*))) numbered
+	WHERE flat_image.id = numbered.id`
+	_, err = flatRepo.Pool.Exec(ctx, updateQuery)
+	if err != nil {
+		return customerror.NewError("flatRepo.CreateTables", flatRepo.Host+":"+flatRepo.Port, err.Error())
+	}
+
+	createIndexQuery = `CREATE INDEX IF NOT EXISTS flat_image_position_idx ON flat_image(flat_id, is_cover DESC, position, id);`
+	_, err = flatRepo.Pool.Exec(ctx, createIndexQuery)
+	if err != nil {
+		return customerror.NewError("flatRepo.CreateTables", flatRepo.Host+":"+flatRepo.Port, err.Error())
+	}
+
+	for band := range phashBands {
+		alterQuery = fmt.Sprintf(`ALTER TABLE flat_image ADD COLUMN IF NOT EXISTS phash_band_%d INT GENERATED ALWAYS AS (%s) STORED`, band, phashBandExpr(band))
+		_, err = flatRepo.Pool.Exec(ctx, alterQuery)
+		if err != nil {
+			return customerror.NewError("flatRepo.CreateTables", flatRepo.Host+":"+flatRepo.Port, err.Error())
+		}
+		createIndexQuery = fmt.Sprintf(`CREATE INDEX IF NOT EXISTS flat_image_phash_band_%[1]d_idx ON flat_image(phash_band_%[1]d)`, band)
+		_, err = flatRepo.Pool.Exec(ctx, createIndexQuery)
+		if err != nil {
+			return customerror.NewError("flatRepo.CreateTables", flatRepo.Host+":"+flatRepo.Port, err.Error())
+		}
+	}
+
+	alterQuery = `ALTER TABLE flat ADD COLUMN IF NOT EXISTS views_count BIGINT NOT NULL DEFAULT 0`
+	_, err = flatRepo.Pool.Exec(ctx, alterQuery)
+	if err != nil {
+		return customerror.NewError("flatRepo.CreateTables", flatRepo.Host+":"+flatRepo.Port, err.Error())
+	}
+
+	createIndexQuery = `CREATE INDEX IF NOT EXISTS flat_views_count_idx ON flat(views_count DESC, created_at DESC);`
+	_, err = flatRepo.Pool.Exec(ctx, createIndexQuery)
+	if err != nil {
+		return customerror.NewError("flatRepo.CreateTables", flatRepo.Host+":"+flatRepo.Port, err.Error())
+	}
+
+	// Один просмотр пользователя на объявление в день, viewed_at - время последнего просмотра
+	createTableQuery = `
+	CREATE TABLE IF NOT EXISTS flat_views (
+		user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		flat_id BIGINT NOT NULL REFERENCES flat(id) ON DELETE CASCADE,
+		day DATE NOT NULL,
+		viewed_at TIMESTAMP NOT NULL,
+		PRIMARY KEY (user_id, flat_id, day)
+	);`
+	_, err = flatRepo.Pool.Exec(ctx, createTableQuery)
+	if err != nil {
+		return customerror.NewError("flatRepo.CreateTables", flatRepo.Host+":"+flatRepo.Port, err.Error())
+	}
+
+	createIndexQuery = `CREATE INDEX IF NOT EXISTS flat_views_user_viewed_at_idx ON flat_views(user_id, viewed_at DESC);`
+	_, err = flatRepo.Pool.Exec(ctx, createIndexQuery)
+	if err != nil {
+		return customerror.NewError("flatRepo.CreateTables", flatRepo.Host+":"+flatRepo.Port, err.Error())
+	}
+
+	createIndexQuery = `CREATE INDEX IF NOT EXISTS flat_views_day_idx ON flat_views(day);`
+	_, err = flatRepo.Pool.Exec(ctx, createIndexQuery)
+	if err != nil {
+		return customerror.NewError("flatRepo.CreateTables", flatRepo.Host+":"+flatRepo.Port, err.Error())
+	}
+
+	createTableQuery = `
+	CREATE TABLE IF NOT EXISTS flat_stats_daily (
+		flat_id BIGINT NOT NULL REFERENCES flat(id) ON DELETE CASCADE,
+		day DATE NOT NULL,
+		views BIGINT NOT NULL DEFAULT 0,
+		favourites BIGINT NOT NULL DEFAULT 0,
+		chat_starts BIGINT NOT NULL DEFAULT 0,
+		PRIMARY KEY (flat_id, day)
+	);`
+	_, err = flatRepo.Pool.Exec(ctx, createTableQuery)
+	if err != nil {
+		return customerror.NewError("flatRepo.CreateTables", flatRepo.Host+":"+flatRepo.Port, err.Error())
+	}
+
+	// Видео и планировки, порядок ведется отдельно для каждого вида
+	createTableQuery = `
+	CREATE TABLE IF NOT EXISTS flat_media (
+		id BIGSERIAL PRIMARY KEY,
+		flat_id BIGINT NOT NULL REFERENCES flat(id) ON DELETE CASCADE,
+		kind TEXT NOT NULL,
+		url TEXT NOT NULL,
+		filename TEXT NOT NULL,
+		content_type TEXT NOT NULL,
+		size BIGINT NOT NULL DEFAULT 0,
+		width INT NOT NULL DEFAULT 0,
+		height INT NOT NULL DEFAULT 0,
+		duration_ms BIGINT NOT NULL DEFAULT 0,
+		poster_url TEXT NOT NULL DEFAULT '',
+		variants JSONB NOT NULL DEFAULT '{}',
+		position INT NOT NULL DEFAULT 0,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);`
+	_, err = flatRepo.Pool.Exec(ctx, createTableQuery)
+	if err != nil {
+		return customerror.NewError("flatRepo.CreateTables", flatRepo.Host+":"+flatRepo.Port, err.Error())
+	}
+
+	createIndexQuery = `CREATE INDEX IF NOT EXISTS flat_media_flat_id_idx ON flat_media(flat_id, kind, position);`
+	_, err = flatRepo.Pool.Exec(ctx, createIndexQuery)
+	if err != nil {
+		return customerror.NewError("flatRepo.CreateTables", flatRepo.Host+":"+flatRepo.Port, err.Error())
+	}
 	return nil
 }
 
@@ -100,8 +268,12 @@ func (flatRepo *FlatRepository) GetFlats(ctx context.Context, offset int64, limi
 	filtersCount := 1
 	query := `SELECT flat.id, flat.name, flat.about, flat.price_from, flat.price_to, flat.neighborhoods_count, 
 	flat.neighborhood_age_from, flat.neighborhood_age_to, flat.sex,
-	flat.created_at, flat.created_by_id, flat.up_in_search, users.id, users.firstname, users.lastname, users.avatar_url 
-	FROM flat JOIN users ON flat.created_by_id = users.id WHERE flat.id IS NOT NULL`
+	flat.created_at, flat.created_by_id, flat.up_in_search, users.id, users.firstname, users.lastname, users.avatar_url,
+	(SELECT COUNT(*) FROM favourites WHERE favourites.flat_id = flat.id), flat.views_count, to_jsonb(cover)
+	FROM flat JOIN users ON flat.created_by_id = users.id
+	LEFT JOIN LATERAL (SELECT id, flat_id, url, filename, width, height, variants, position, is_cover FROM flat_image
+		WHERE flat_image.flat_id = flat.id ORDER BY is_cover DESC, position, id LIMIT 1) cover ON true
+	WHERE flat.id IS NOT NULL`
 	params := []any{}
 	fmt.Print(filters)
 	if filters["name"] != nil {
@@ -164,8 +336,21 @@ func (flatRepo *FlatRepository) GetFlats(ctx context.Context, offset int64, limi
 		filtersCount++
 	}
 
+	// Скрываем объявления пользователей, с которыми у смотрящего есть блокировка в любую сторону
+	if filters["viewer_id"] != nil {
+		query += fmt.Sprintf(` AND NOT EXISTS (SELECT 1 FROM user_blocks
+			WHERE (user_blocks.blocker_id = $%d AND user_blocks.blocked_id = flat.created_by_id)
+			OR (user_blocks.blocked_id = $%d AND user_blocks.blocker_id = flat.created_by_id))`, filtersCount, filtersCount)
+		params = append(params, filters["viewer_id"])
+		filtersCount++
+	}
+
 	params = append(params, offset, limit)
-	query += fmt.Sprintf(` ORDER BY flat.up_in_search DESC, flat.created_at DESC OFFSET $%d LIMIT $%d;`, filtersCount, filtersCount+1)
+	orderBy := "flat.up_in_search DESC, flat.created_at DESC"
+	if filters["sort"] == "popular" {
+		orderBy = "flat.views_count DESC, flat.created_at DESC"
+	}
+	query += fmt.Sprintf(` ORDER BY %s OFFSET $%d LIMIT $%d;`, orderBy, filtersCount, filtersCount+1)
 	rows, err := flatRepo.Pool.Query(ctx, query, params...)
 	if err != nil {
 		return nil, customerror.NewError("flatRepo.GetFlats", flatRepo.Host+":"+flatRepo.Port, err.Error())
@@ -190,6 +375,9 @@ func (flatRepo *FlatRepository) GetFlats(ctx context.Context, offset int64, limi
 			&user.Firstname,
 			&user.Lastname,
 			&user.AvatarUrl,
+			&flat.FavouritesCount,
+			&flat.ViewsCount,
+			&flat.Cover,
 		)
 		if err != nil {
 			return nil, customerror.NewError("flatRepo.GetFlats", flatRepo.Host+":"+flatRepo.Port, err.Error())
@@ -204,7 +392,8 @@ func (flatRepo *FlatRepository) GetFlat(ctx context.Context, id int64) (*flat.Fl
 	var flat flat.Flat
 	query := `SELECT flat.id, flat.name, flat.about, flat.price_from, flat.price_to, flat.neighborhoods_count, 
 	flat.neighborhood_age_from, flat.neighborhood_age_to, flat.sex,
-	flat.created_at, flat.created_by_id, flat.up_in_search, users.id, users.firstname, users.lastname, users.avatar_url 
+	flat.created_at, flat.created_by_id, flat.up_in_search, users.id, users.firstname, users.lastname, users.avatar_url,
+	(SELECT COUNT(*) FROM favourites WHERE favourites.flat_id = flat.id), flat.views_count
 	FROM flat JOIN users ON flat.created_by_id = users.id WHERE flat.id = $1`
 	row := flatRepo.Pool.QueryRow(ctx, query, id)
 	err := row.Scan(
@@ -224,6 +413,8 @@ func (flatRepo *FlatRepository) GetFlat(ctx context.Context, id int64) (*flat.Fl
 		&flat.CreatedByUser.Firstname,
 		&flat.CreatedByUser.Lastname,
 		&flat.CreatedByUser.AvatarUrl,
+		&flat.FavouritesCount,
+		&flat.ViewsCount,
 	)
 	if err == pgx.ErrNoRows {
 		return nil, pgx.ErrNoRows
@@ -264,25 +455,129 @@ func (flatRepo *FlatRepository) UpdateFlat(ctx context.Context, flat *flat.Flat,
 	return nil
 }
 
+// DeleteFlat в одной транзакции удаляет объявление вместе с фотографиями, медиафайлами, избранным и статистикой,
+// а файлы хранилища ставит в очередь media_deletion_jobs. user == nil - удаление системой, без проверки владельца.
 func (flatRepo *FlatRepository) DeleteFlat(ctx context.Context, id int64, user *user.User) error {
+	tx, err := flatRepo.Pool.Begin(ctx)
+	if err != nil {
+		return customerror.NewError("flatRepo.DeleteFlat", flatRepo.Host+":"+flatRepo.Port, err.Error())
+	}
+	defer tx.Rollback(ctx)
 	args := []any{id}
-	query := `DELETE FROM flat WHERE id = $1`
-	if !user.IsSuperUser {
+	query := `SELECT id FROM flat WHERE id = $1`
+	if user != nil && !user.IsSuperUser {
 		query += ` AND created_by_id = $2`
 		args = append(args, user.UUID)
 	}
-	command, err := flatRepo.Pool.Exec(ctx, query, args...)
+	err = tx.QueryRow(ctx, query+` FOR UPDATE`, args...).Scan(&id)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return pgx.ErrNoRows
+	}
 	if err != nil {
 		return customerror.NewError("flatRepo.DeleteFlat", flatRepo.Host+":"+flatRepo.Port, err.Error())
 	}
-	if command.RowsAffected() == 0 {
-		return pgx.ErrNoRows
+	keys, err := flatFileKeys(ctx, tx, id)
+	if err != nil {
+		return customerror.NewError("flatRepo.DeleteFlat", flatRepo.Host+":"+flatRepo.Port, err.Error())
+	}
+	// Зависимые строки удаляются явно, не полагаясь на ON DELETE CASCADE в таблицах, созданных старыми версиями
+	for _, query := range []string{
+		`DELETE FROM image_duplicate_flags WHERE image_id IN (SELECT id FROM flat_image WHERE flat_id = $1)
+			OR matched_image_id IN (SELECT id FROM flat_image WHERE flat_id = $1)`,
+		`DELETE FROM favourites WHERE flat_id = $1`,
+		`DELETE FROM flat_views WHERE flat_id = $1`,
+		`DELETE FROM flat_stats_daily WHERE flat_id = $1`,
+		`DELETE FROM upload_session WHERE flat_id = $1`,
+		`DELETE FROM flat_media WHERE flat_id = $1`,
+		`DELETE FROM flat_image WHERE flat_id = $1`,
+		`DELETE FROM flat WHERE id = $1`,
+	} {
+		_, err = tx.Exec(ctx, query, id)
+		if err != nil {
+			return customerror.NewError("flatRepo.DeleteFlat", flatRepo.Host+":"+flatRepo.Port, err.Error())
+		}
+	}
+	err = enqueueMediaDeletions(ctx, tx, keys)
+	if err != nil {
+		return customerror.NewError("flatRepo.DeleteFlat", flatRepo.Host+":"+flatRepo.Port, err.Error())
+	}
+	err = tx.Commit(ctx)
+	if err != nil {
+		return customerror.NewError("flatRepo.DeleteFlat", flatRepo.Host+":"+flatRepo.Port, err.Error())
 	}
 	return nil
 }
 
+// flatFileKeys собирает ключи хранилища всех файлов объявления: фотографий, видео, планировок и частей незавершенных загрузок
+func flatFileKeys(ctx context.Context, tx pgx.Tx, flatId int64) ([]string, error) {
+	var keys []string
+	rows, err := tx.Query(ctx, `SELECT flat_id, filename, variants FROM flat_image WHERE flat_id = $1 AND filename <> ''`, flatId)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var image flat.FlatImage
+		err := rows.Scan(&image.FlatId, &image.Filename, &image.Variants)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		keys = append(keys, image.Keys()...)
+	}
+	rows.Close()
+	if rows.Err() != nil {
+		return nil, rows.Err()
+	}
+	rows, err = tx.Query(ctx, `SELECT flat_id, filename, poster_url, variants FROM flat_media WHERE flat_id = $1`, flatId)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var media flat.FlatMedia
+		err := rows.Scan(&media.FlatId, &media.Filename, &media.PosterUrl, &media.Variants)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		keys = append(keys, media.Keys()...)
+	}
+	rows.Close()
+	if rows.Err() != nil {
+		return nil, rows.Err()
+	}
+	var chunks []string
+	err = tx.QueryRow(ctx, `SELECT COALESCE(array_agg(chunk), '{}') FROM upload_session, unnest(chunks) AS chunk WHERE flat_id = $1`, flatId).Scan(&chunks)
+	if err != nil {
+		return nil, err
+	}
+	return append(keys, chunks...), nil
+}
+
+// GetFlatIdsCreatedBefore возвращает объявления, созданные раньше before, - кандидатов на удаление по сроку
+func (flatRepo *FlatRepository) GetFlatIdsCreatedBefore(ctx context.Context, before time.Time) ([]int64, error) {
+	rows, err := flatRepo.Pool.Query(ctx, `SELECT id FROM flat WHERE created_at < $1 ORDER BY id`, before)
+	if err != nil {
+		return nil, customerror.NewError("flatRepo.GetFlatIdsCreatedBefore", flatRepo.Host+":"+flatRepo.Port, err.Error())
+	}
+	defer rows.Close()
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		err := rows.Scan(&id)
+		if err != nil {
+			return nil, customerror.NewError("flatRepo.GetFlatIdsCreatedBefore", flatRepo.Host+":"+flatRepo.Port, err.Error())
+		}
+		ids = append(ids, id)
+	}
+	if rows.Err() != nil {
+		return nil, customerror.NewError("flatRepo.GetFlatIdsCreatedBefore", flatRepo.Host+":"+flatRepo.Port, rows.Err().Error())
+	}
+	return ids, nil
+}
+
 func (flatRepo *FlatRepository) GetFlatImages(ctx context.Context, flatId int64) ([]flat.FlatImage, error) {
-	query := `SELECT id, flat_id, url, filename FROM flat_image WHERE flat_id = $1`
+	query := `SELECT id, flat_id, url, filename, width, height, variants, position, is_cover FROM flat_image
+	WHERE flat_id = $1 ORDER BY position, id`
 	rows, err := flatRepo.Pool.Query(ctx, query, flatId)
 	if err != nil {
 		return nil, customerror.NewError("flatRepo.GetFlatImages", flatRepo.Host+":"+flatRepo.Port, err.Error())
@@ -290,7 +585,7 @@ func (flatRepo *FlatRepository) GetFlatImages(ctx context.Context, flatId int64)
 	var flatImages []flat.FlatImage
 	for rows.Next() {
 		var flatImage flat.FlatImage
-		err := rows.Scan(&flatImage.Id, &flatImage.FlatId, &flatImage.Url, &flatImage.Filename)
+		err := rows.Scan(&flatImage.Id, &flatImage.FlatId, &flatImage.Url, &flatImage.Filename, &flatImage.Width, &flatImage.Height, &flatImage.Variants, &flatImage.Position, &flatImage.IsCover)
 		if err != nil {
 			return nil, customerror.NewError("flatRepo.GetFlatImages", flatRepo.Host+":"+flatRepo.Port, err.Error())
 		}
@@ -298,19 +593,383 @@ func (flatRepo *FlatRepository) GetFlatImages(ctx context.Context, flatId int64)
 	}
 	return flatImages, nil
 }
+
+// InsertFlatImage добавляет фотографию в конец галереи. Если у объявления уже flat.MaxImages фотографий, возвращает customerror.ErrTooManyImages.
 func (flatRepo *FlatRepository) InsertFlatImage(ctx context.Context, flatImage *flat.FlatImage) error {
-	query := `INSERT INTO flat_image (flat_id, url, filename) VALUES ($1, $2, $3)`
-	_, err := flatRepo.Pool.Exec(ctx, query, flatImage.FlatId, flatImage.Url, flatImage.Filename)
+	tx, err := flatRepo.Pool.Begin(ctx)
+	if err != nil {
+		return customerror.NewError("flatRepo.InsertFlatImage", flatRepo.Host+":"+flatRepo.Port, err.Error())
+	}
+	defer tx.Rollback(ctx)
+	// Блокировка объявления не дает параллельным загрузкам превысить лимит
+	_, err = tx.Exec(ctx, `SELECT id FROM flat WHERE id = $1 FOR UPDATE`, flatImage.FlatId)
+	if err != nil {
+		return customerror.NewError("flatRepo.InsertFlatImage", flatRepo.Host+":"+flatRepo.Port, err.Error())
+	}
+	var hash any
+	if flatImage.Hash != 0 {
+		hash = int64(flatImage.Hash)
+	}
+	query := `INSERT INTO flat_image (flat_id, url, filename, width, height, variants, phash, position)
+	SELECT $1, $2, $3, $4, $5, $6, $7, COALESCE(MAX(position) + 1, 0) FROM flat_image WHERE flat_id = $1
+	HAVING COUNT(*) < $8
+	RETURNING id, position`
+	err = tx.QueryRow(ctx, query, flatImage.FlatId, flatImage.Url, flatImage.Filename, flatImage.Width, flatImage.Height, flatImage.Variants, hash, flat.MaxImages).Scan(&flatImage.Id, &flatImage.Position)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return customerror.ErrTooManyImages
+	}
+	if err != nil {
+		return customerror.NewError("flatRepo.InsertFlatImage", flatRepo.Host+":"+flatRepo.Port, err.Error())
+	}
+	err = tx.Commit(ctx)
 	if err != nil {
 		return customerror.NewError("flatRepo.InsertFlatImage", flatRepo.Host+":"+flatRepo.Port, err.Error())
 	}
 	return nil
 }
+
+func (flatRepo *FlatRepository) CountFlatImages(ctx context.Context, flatId int64) (int64, error) {
+	var count int64
+	err := flatRepo.Pool.QueryRow(ctx, `SELECT COUNT(*) FROM flat_image WHERE flat_id = $1`, flatId).Scan(&count)
+	if err != nil {
+		return 0, customerror.NewError("flatRepo.CountFlatImages", flatRepo.Host+":"+flatRepo.Port, err.Error())
+	}
+	return count, nil
+}
+
+// ReorderFlatImages расставляет фотографии в порядке imageIds. coverId = 0 оставляет обложку прежней.
+func (flatRepo *FlatRepository) ReorderFlatImages(ctx context.Context, flatId int64, imageIds []int64, coverId int64) error {
+	query := `UPDATE flat_image SET position = ordered.position,
+		is_cover = CASE WHEN $3::bigint = 0 THEN flat_image.is_cover ELSE flat_image.id = $3 END
+	FROM (SELECT id, ordinality - 1 AS position FROM unnest($2::bigint[]) WITH ORDINALITY AS ids(id, ordinality)) ordered
+	WHERE flat_image.flat_id = $1 AND flat_image.id = ordered.id`
+	_, err := flatRepo.Pool.Exec(ctx, query, flatId, imageIds, coverId)
+	if err != nil {
+		return customerror.NewError("flatRepo.ReorderFlatImages", flatRepo.Host+":"+flatRepo.Port, err.Error())
+	}
+	return nil
+}
+
+// DeleteFlatImage удаляет фотографию и в той же транзакции ставит ее файлы в очередь media_deletion_jobs
 func (flatRepo *FlatRepository) DeleteFlatImage(ctx context.Context, flatImage *flat.FlatImage) error {
-	query := `DELETE FROM flat_image WHERE id = $1`
-	_, err := flatRepo.Pool.Exec(ctx, query, flatImage.Id)
+	tx, err := flatRepo.Pool.Begin(ctx)
 	if err != nil {
 		return customerror.NewError("flatRepo.DeleteFlatImage", flatRepo.Host+":"+flatRepo.Port, err.Error())
 	}
+	defer tx.Rollback(ctx)
+	var deleted flat.FlatImage
+	query := `DELETE FROM flat_image WHERE id = $1 RETURNING flat_id, filename, variants`
+	err = tx.QueryRow(ctx, query, flatImage.Id).Scan(&deleted.FlatId, &deleted.Filename, &deleted.Variants)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return pgx.ErrNoRows
+	}
+	if err != nil {
+		return customerror.NewError("flatRepo.DeleteFlatImage", flatRepo.Host+":"+flatRepo.Port, err.Error())
+	}
+	// У старых фотографий файла в хранилище нет
+	if deleted.Filename != "" {
+		err = enqueueMediaDeletions(ctx, tx, deleted.Keys())
+		if err != nil {
+			return customerror.NewError("flatRepo.DeleteFlatImage", flatRepo.Host+":"+flatRepo.Port, err.Error())
+		}
+	}
+	err = tx.Commit(ctx)
+	if err != nil {
+		return customerror.NewError("flatRepo.DeleteFlatImage", flatRepo.Host+":"+flatRepo.Port, err.Error())
+	}
+	return nil
+}
+
+// ClaimExpiringFlats отмечает объявления, созданные раньше createdBefore и еще не получившие предупреждения,
+// и возвращает их. Отметка ставится в том же запросе, поэтому несколько узлов не предупредят владельца дважды.
+func (flatRepo *FlatRepository) ClaimExpiringFlats(ctx context.Context, createdBefore time.Time) ([]flat.Flat, error) {
+	query := `UPDATE flat SET expiry_notified_at = CURRENT_TIMESTAMP
+	WHERE created_at < $1 AND expiry_notified_at IS NULL
+	RETURNING id, name, created_at, created_by_id`
+	rows, err := flatRepo.Pool.Query(ctx, query, createdBefore)
+	if err != nil {
+		return nil, customerror.NewError("flatRepo.ClaimExpiringFlats", flatRepo.Host+":"+flatRepo.Port, err.Error())
+	}
+	defer rows.Close()
+	flats := []flat.Flat{}
+	for rows.Next() {
+		var flat flat.Flat
+		err := rows.Scan(&flat.Id, &flat.Name, &flat.CreatedAt, &flat.CreatedById)
+		if err != nil {
+			return nil, customerror.NewError("flatRepo.ClaimExpiringFlats", flatRepo.Host+":"+flatRepo.Port, err.Error())
+		}
+		flats = append(flats, flat)
+	}
+	if rows.Err() != nil {
+		return nil, customerror.NewError("flatRepo.ClaimExpiringFlats", flatRepo.Host+":"+flatRepo.Port, rows.Err().Error())
+	}
+	return flats, nil
+}
+
+// IncrementFlatStat увеличивает счетчик статистики объявления за сегодня
+func (flatRepo *FlatRepository) IncrementFlatStat(ctx context.Context, flatId int64, counter string) error {
+	switch counter {
+	case flat.StatViews, flat.StatFavourites, flat.StatChatStarts:
+	default:
+		return customerror.NewError("flatRepo.IncrementFlatStat", flatRepo.Host+":"+flatRepo.Port, "unknown counter "+counter)
+	}
+	query := fmt.Sprintf(`INSERT INTO flat_stats_daily (flat_id, day, %[1]s) VALUES ($1, CURRENT_DATE, 1)
+	ON CONFLICT (flat_id, day) DO UPDATE SET %[1]s = flat_stats_daily.%[1]s + 1`, counter)
+	_, err := flatRepo.Pool.Exec(ctx, query, flatId)
+	if err != nil {
+		return customerror.NewError("flatRepo.IncrementFlatStat", flatRepo.Host+":"+flatRepo.Port, err.Error())
+	}
+	return nil
+}
+
+// GetFlatStats возвращает статистику за последние days дней, включая сегодняшний, дни без событий заполнены нулями.
+// Границы дней берутся из CURRENT_DATE, как и в IncrementFlatStat, чтобы ряд не сдвигался около полуночи.
+func (flatRepo *FlatRepository) GetFlatStats(ctx context.Context, flatId int64, days int64) ([]flat.DailyStats, error) {
+	query := `SELECT series.day::date, COALESCE(stats.views, 0), COALESCE(stats.favourites, 0), COALESCE(stats.chat_starts, 0)
+	FROM generate_series((CURRENT_DATE - ($2::int - 1))::timestamp, CURRENT_DATE::timestamp, INTERVAL '1 day') AS series(day)
+	LEFT JOIN flat_stats_daily stats ON stats.flat_id = $1 AND stats.day = series.day::date
+	ORDER BY series.day`
+	rows, err := flatRepo.Pool.Query(ctx, query, flatId, days)
+	if err != nil {
+		return nil, customerror.NewError("flatRepo.GetFlatStats", flatRepo.Host+":"+flatRepo.Port, err.Error())
+	}
+	defer rows.Close()
+	stats := []flat.DailyStats{}
+	for rows.Next() {
+		var day flat.DailyStats
+		err := rows.Scan(&day.Day, &day.Views, &day.Favourites, &day.ChatStarts)
+		if err != nil {
+			return nil, customerror.NewError("flatRepo.GetFlatStats", flatRepo.Host+":"+flatRepo.Port, err.Error())
+		}
+		stats = append(stats, day)
+	}
+	if rows.Err() != nil {
+		return nil, customerror.NewError("flatRepo.GetFlatStats", flatRepo.Host+":"+flatRepo.Port, rows.Err().Error())
+	}
+	return stats, nil
+}
+
+// InsertViews записывает пачку просмотров. Первый за день просмотр объявления пользователем
+// увеличивает дневную статистику и общий счетчик объявления, повторные только обновляют viewed_at.
+// День определяется по часам базы, как и в IncrementFlatStat; повторы внутри пачки схлопываются по нему же.
+func (flatRepo *FlatRepository) InsertViews(ctx context.Context, views []flat.View) error {
+	userIds := make([]uuid.UUID, 0, len(views))
+	flatIds := make([]int64, 0, len(views))
+	viewedAt := make([]time.Time, 0, len(views))
+	for _, view := range views {
+		userIds = append(userIds, view.UserId)
+		flatIds = append(flatIds, view.FlatId)
+		viewedAt = append(viewedAt, view.ViewedAt)
+	}
+	query := `
+	WITH input AS (
+		SELECT DISTINCT ON (user_id, flat_id, viewed_at::date) user_id, flat_id, viewed_at
+		FROM unnest($1::uuid[], $2::bigint[], $3::timestamptz[]) AS t(user_id, flat_id, viewed_at)
+		ORDER BY user_id, flat_id, viewed_at::date, viewed_at DESC
+	), upserted AS (
+		INSERT INTO flat_views (user_id, flat_id, day, viewed_at)
+		SELECT input.user_id, input.flat_id, input.viewed_at::date, input.viewed_at FROM input
+		WHERE EXISTS (SELECT 1 FROM flat WHERE flat.id = input.flat_id)
+		ON CONFLICT (user_id, flat_id, day) DO UPDATE SET viewed_at = GREATEST(flat_views.viewed_at, EXCLUDED.viewed_at)
+		RETURNING flat_id, day, (xmax = 0) AS inserted
+	), new_views AS (
+		SELECT flat_id, day, COUNT(*) AS count FROM upserted WHERE inserted GROUP BY flat_id, day
+	), stats AS (
+		INSERT INTO flat_stats_daily (flat_id, day, views) SELECT flat_id, day, count FROM new_views
+		ON CONFLICT (flat_id, day) DO UPDATE SET views = flat_stats_daily.views + EXCLUDED.views
+	)
+	UPDATE flat SET views_count = flat.views_count + totals.count
+	FROM (SELECT flat_id, SUM(count) AS count FROM new_views GROUP BY flat_id) AS totals
+	WHERE flat.id = totals.flat_id`
+	_, err := flatRepo.Pool.Exec(ctx, query, userIds, flatIds, viewedAt)
+	if err != nil {
+		return customerror.NewError("flatRepo.InsertViews", flatRepo.Host+":"+flatRepo.Port, err.Error())
+	}
+	return nil
+}
+
+// GetRecentlyViewed возвращает просмотренные пользователем объявления, последние просмотренные первыми
+func (flatRepo *FlatRepository) GetRecentlyViewed(ctx context.Context, userId uuid.UUID, offset int64, limit int64) ([]flat.RecentlyViewed, error) {
+	query := `SELECT flat.id, flat.name, flat.about, flat.price_from, flat.price_to, flat.neighborhoods_count,
+	flat.neighborhood_age_from, flat.neighborhood_age_to, flat.sex,
+	flat.created_at, flat.created_by_id, flat.up_in_search, users.id, users.firstname, users.lastname, users.avatar_url,
+	(SELECT COUNT(*) FROM favourites WHERE favourites.flat_id = flat.id), flat.views_count, recent.viewed_at
+	FROM (
+		SELECT flat_id, MAX(viewed_at) AS viewed_at FROM flat_views WHERE user_id = $1 GROUP BY flat_id
+	) AS recent
+	JOIN flat ON flat.id = recent.flat_id JOIN users ON flat.created_by_id = users.id
+	ORDER BY recent.viewed_at DESC LIMIT $2 OFFSET $3`
+	rows, err := flatRepo.Pool.Query(ctx, query, userId, limit, offset)
+	if err != nil {
+		return nil, customerror.NewError("flatRepo.GetRecentlyViewed", flatRepo.Host+":"+flatRepo.Port, err.Error())
+	}
+	defer rows.Close()
+	viewed := []flat.RecentlyViewed{}
+	for rows.Next() {
+		var item flat.RecentlyViewed
+		err := rows.Scan(
+			&item.Flat.Id,
+			&item.Flat.Name,
+			&item.Flat.About,
+			&item.Flat.PriceFrom,
+			&item.Flat.PriceTo,
+			&item.Flat.NeighborhoodsCount,
+			&item.Flat.NeighborhoodAgeFrom,
+			&item.Flat.NeighborhoodAgeTo,
+			&item.Flat.Sex,
+			&item.Flat.CreatedAt,
+			&item.Flat.CreatedById,
+			&item.Flat.UpInSearch,
+			&item.Flat.CreatedByUser.UUID,
+			&item.Flat.CreatedByUser.Firstname,
+			&item.Flat.CreatedByUser.Lastname,
+			&item.Flat.CreatedByUser.AvatarUrl,
+			&item.Flat.FavouritesCount,
+			&item.Flat.ViewsCount,
+			&item.ViewedAt,
+		)
+		if err != nil {
+			return nil, customerror.NewError("flatRepo.GetRecentlyViewed", flatRepo.Host+":"+flatRepo.Port, err.Error())
+		}
+		viewed = append(viewed, item)
+	}
+	if rows.Err() != nil {
+		return nil, customerror.NewError("flatRepo.GetRecentlyViewed", flatRepo.Host+":"+flatRepo.Port, rows.Err().Error())
+	}
+	return viewed, nil
+}
+
+// DeleteViewsBefore удаляет историю просмотров старше before. Дневная статистика и счетчики объявлений сохраняются.
+func (flatRepo *FlatRepository) DeleteViewsBefore(ctx context.Context, before time.Time) (int64, error) {
+	query := `DELETE FROM flat_views WHERE day < $1::date`
+	tag, err := flatRepo.Pool.Exec(ctx, query, before)
+	if err != nil {
+		return 0, customerror.NewError("flatRepo.DeleteViewsBefore", flatRepo.Host+":"+flatRepo.Port, err.Error())
+	}
+	return tag.RowsAffected(), nil
+}
+
+const flatMediaColumns = `id, flat_id, kind, url, filename, content_type, size, width, height, duration_ms, poster_url, variants, position, created_at`
+
+func scanFlatMedia(row pgx.Row, media *flat.FlatMedia) error {
+	return row.Scan(&media.Id, &media.FlatId, &media.Kind, &media.Url, &media.Filename, &media.ContentType, &media.Size,
+		&media.Width, &media.Height, &media.DurationMs, &media.PosterUrl, &media.Variants, &media.Position, &media.CreatedAt)
+}
+
+// GetFlatMedia возвращает медиафайлы объявления, пустой kind - всех видов
+func (flatRepo *FlatRepository) GetFlatMedia(ctx context.Context, flatId int64, kind string) ([]flat.FlatMedia, error) {
+	query := `SELECT ` + flatMediaColumns + ` FROM flat_media WHERE flat_id = $1 AND ($2 = '' OR kind = $2) ORDER BY kind, position, id`
+	rows, err := flatRepo.Pool.Query(ctx, query, flatId, kind)
+	if err != nil {
+		return nil, customerror.NewError("flatRepo.GetFlatMedia", flatRepo.Host+":"+flatRepo.Port, err.Error())
+	}
+	defer rows.Close()
+	media := []flat.FlatMedia{}
+	for rows.Next() {
+		var item flat.FlatMedia
+		err := scanFlatMedia(rows, &item)
+		if err != nil {
+			return nil, customerror.NewError("flatRepo.GetFlatMedia", flatRepo.Host+":"+flatRepo.Port, err.Error())
+		}
+		media = append(media, item)
+	}
+	if rows.Err() != nil {
+		return nil, customerror.NewError("flatRepo.GetFlatMedia", flatRepo.Host+":"+flatRepo.Port, rows.Err().Error())
+	}
+	return media, nil
+}
+
+func (flatRepo *FlatRepository) GetFlatMediaItem(ctx context.Context, flatId int64, id int64) (*flat.FlatMedia, error) {
+	var media flat.FlatMedia
+	err := scanFlatMedia(flatRepo.Pool.QueryRow(ctx, `SELECT `+flatMediaColumns+` FROM flat_media WHERE flat_id = $1 AND id = $2`, flatId, id), &media)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, pgx.ErrNoRows
+	}
+	if err != nil {
+		return nil, customerror.NewError("flatRepo.GetFlatMediaItem", flatRepo.Host+":"+flatRepo.Port, err.Error())
+	}
+	return &media, nil
+}
+
+func (flatRepo *FlatRepository) CountFlatMedia(ctx context.Context, flatId int64, kind string) (int64, error) {
+	var count int64
+	err := flatRepo.Pool.QueryRow(ctx, `SELECT COUNT(*) FROM flat_media WHERE flat_id = $1 AND kind = $2`, flatId, kind).Scan(&count)
+	if err != nil {
+		return 0, customerror.NewError("flatRepo.CountFlatMedia", flatRepo.Host+":"+flatRepo.Port, err.Error())
+	}
+	return count, nil
+}
+
+// InsertFlatMedia добавляет файл в конец списка своего вида. Если лимит вида исчерпан - customerror.ErrTooManyMedia.
+func (flatRepo *FlatRepository) InsertFlatMedia(ctx context.Context, media *flat.FlatMedia) error {
+	tx, err := flatRepo.Pool.Begin(ctx)
+	if err != nil {
+		return customerror.NewError("flatRepo.InsertFlatMedia", flatRepo.Host+":"+flatRepo.Port, err.Error())
+	}
+	defer tx.Rollback(ctx)
+	_, err = tx.Exec(ctx, `SELECT id FROM flat WHERE id = $1 FOR UPDATE`, media.FlatId)
+	if err != nil {
+		return customerror.NewError("flatRepo.InsertFlatMedia", flatRepo.Host+":"+flatRepo.Port, err.Error())
+	}
+	variants := media.Variants
+	if variants == nil {
+		variants = map[string]string{}
+	}
+	query := `INSERT INTO flat_media (flat_id, kind, url, filename, content_type, size, width, height, duration_ms, poster_url, variants, position)
+	SELECT $1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, COALESCE(MAX(position) + 1, 0) FROM flat_media WHERE flat_id = $1 AND kind = $2
+	HAVING COUNT(*) < $12
+	RETURNING id, position, created_at`
+	err = tx.QueryRow(ctx, query, media.FlatId, media.Kind, media.Url, media.Filename, media.ContentType, media.Size, media.Width, media.Height,
+		media.DurationMs, media.PosterUrl, variants, flat.MaxMedia(media.Kind)).Scan(&media.Id, &media.Position, &media.CreatedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return customerror.ErrTooManyMedia
+	}
+	if err != nil {
+		return customerror.NewError("flatRepo.InsertFlatMedia", flatRepo.Host+":"+flatRepo.Port, err.Error())
+	}
+	err = tx.Commit(ctx)
+	if err != nil {
+		return customerror.NewError("flatRepo.InsertFlatMedia", flatRepo.Host+":"+flatRepo.Port, err.Error())
+	}
+	return nil
+}
+
+// DeleteFlatMedia удаляет медиафайл объявления и в той же транзакции ставит его файлы в очередь media_deletion_jobs
+func (flatRepo *FlatRepository) DeleteFlatMedia(ctx context.Context, media *flat.FlatMedia) error {
+	tx, err := flatRepo.Pool.Begin(ctx)
+	if err != nil {
+		return customerror.NewError("flatRepo.DeleteFlatMedia", flatRepo.Host+":"+flatRepo.Port, err.Error())
+	}
+	defer tx.Rollback(ctx)
+	var deleted flat.FlatMedia
+	query := `DELETE FROM flat_media WHERE id = $1 RETURNING flat_id, filename, poster_url, variants`
+	err = tx.QueryRow(ctx, query, media.Id).Scan(&deleted.FlatId, &deleted.Filename, &deleted.PosterUrl, &deleted.Variants)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return pgx.ErrNoRows
+	}
+	if err != nil {
+		return customerror.NewError("flatRepo.DeleteFlatMedia", flatRepo.Host+":"+flatRepo.Port, err.Error())
+	}
+	err = enqueueMediaDeletions(ctx, tx, deleted.Keys())
+	if err != nil {
+		return customerror.NewError("flatRepo.DeleteFlatMedia", flatRepo.Host+":"+flatRepo.Port, err.Error())
+	}
+	err = tx.Commit(ctx)
+	if err != nil {
+		return customerror.NewError("flatRepo.DeleteFlatMedia", flatRepo.Host+":"+flatRepo.Port, err.Error())
+	}
+	return nil
+}
+
+// EnqueueFileDeletions ставит в очередь media_deletion_jobs файлы, на которые не ссылается ни одна строка,
+// например загруженные перед неудачной вставкой
+func (flatRepo *FlatRepository) EnqueueFileDeletions(ctx context.Context, keys []string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	_, err := flatRepo.Pool.Exec(ctx, enqueueMediaDeletionsQuery, keys)
+	if err != nil {
+		return customerror.NewError("flatRepo.EnqueueFileDeletions", flatRepo.Host+":"+flatRepo.Port, err.Error())
+	}
 	return nil
 }
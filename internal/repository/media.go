@@ -0,0 +1,194 @@
+package repository
+
+import (
+	"context"
+	"mymate/pkg/customerror"
+	"mymate/pkg/flat"
+	"mymate/pkg/media"
+	"mymate/pkg/user"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+type MediaRepositoryI interface {
+	CreateTables(ctx context.Context) error
+	GetReferences(ctx context.Context) ([]media.Reference, error)
+	ClaimDeletionJobs(ctx context.Context, limit int, lease time.Duration) ([]media.DeletionJob, error)
+	DeleteDeletionJob(ctx context.Context, id int64) error
+	FailDeletionJob(ctx context.Context, id int64, message string, retryIn time.Duration) error
+	MarkDeletionJobDead(ctx context.Context, id int64, message string) error
+}
+
+type MediaRepository struct {
+	Pool *pgxpool.Pool
+	Host string
+	Port string
+}
+
+func NewMediaRepository(pool *pgxpool.Pool, host string, port string) MediaRepositoryI {
+	return &MediaRepository{
+		Pool: pool,
+		Host: host,
+		Port: port,
+	}
+}
+
+func (r *MediaRepository) CreateTables(ctx context.Context) error {
+	// Файлы удаляемых строк: строки удаляются в транзакции, а файлы - потом, отдельным обработчиком
+	createTableQuery := `
+	CREATE TABLE IF NOT EXISTS media_deletion_jobs (
+		id BIGSERIAL PRIMARY KEY,
+		key TEXT NOT NULL,
+		attempts INT NOT NULL DEFAULT 0,
+		last_error TEXT NOT NULL DEFAULT '',
+		next_attempt_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+	);`
+	_, err := r.Pool.Exec(ctx, createTableQuery)
+	if err != nil {
+		return customerror.NewError("mediaRepo.CreateTables", r.Host+":"+r.Port, err.Error())
+	}
+	// Мертвое задание остается в таблице для разбора, но обработчику больше не выдается
+	alterQuery := `ALTER TABLE media_deletion_jobs ADD COLUMN IF NOT EXISTS dead_at TIMESTAMP`
+	_, err = r.Pool.Exec(ctx, alterQuery)
+	if err != nil {
+		return customerror.NewError("mediaRepo.CreateTables", r.Host+":"+r.Port, err.Error())
+	}
+	createIndexQuery := `CREATE INDEX IF NOT EXISTS media_deletion_jobs_next_attempt_at_idx ON media_deletion_jobs(next_attempt_at);`
+	_, err = r.Pool.Exec(ctx, createIndexQuery)
+	if err != nil {
+		return customerror.NewError("mediaRepo.CreateTables", r.Host+":"+r.Port, err.Error())
+	}
+	return nil
+}
+
+// GetReferences возвращает все ключи хранилища, на которые ссылается база: фотографии, видео и планировки объявлений и аватары вместе с копиями
+func (r *MediaRepository) GetReferences(ctx context.Context) ([]media.Reference, error) {
+	references := []media.Reference{}
+	rows, err := r.Pool.Query(ctx, `SELECT id, flat_id, filename, variants FROM flat_image WHERE filename <> ''`)
+	if err != nil {
+		return nil, customerror.NewError("mediaRepo.GetReferences", r.Host+":"+r.Port, err.Error())
+	}
+	for rows.Next() {
+		var image flat.FlatImage
+		err := rows.Scan(&image.Id, &image.FlatId, &image.Filename, &image.Variants)
+		if err != nil {
+			rows.Close()
+			return nil, customerror.NewError("mediaRepo.GetReferences", r.Host+":"+r.Port, err.Error())
+		}
+		for _, key := range image.Keys() {
+			references = append(references, media.Reference{Kind: media.ReferenceFlatImage, Id: strconv.FormatInt(image.Id, 10), Key: key})
+		}
+	}
+	rows.Close()
+	if rows.Err() != nil {
+		return nil, customerror.NewError("mediaRepo.GetReferences", r.Host+":"+r.Port, rows.Err().Error())
+	}
+	rows, err = r.Pool.Query(ctx, `SELECT id, flat_id, filename, poster_url, variants FROM flat_media`)
+	if err != nil {
+		return nil, customerror.NewError("mediaRepo.GetReferences", r.Host+":"+r.Port, err.Error())
+	}
+	for rows.Next() {
+		var item flat.FlatMedia
+		err := rows.Scan(&item.Id, &item.FlatId, &item.Filename, &item.PosterUrl, &item.Variants)
+		if err != nil {
+			rows.Close()
+			return nil, customerror.NewError("mediaRepo.GetReferences", r.Host+":"+r.Port, err.Error())
+		}
+		for _, key := range item.Keys() {
+			references = append(references, media.Reference{Kind: media.ReferenceFlatMedia, Id: strconv.FormatInt(item.Id, 10), Key: key})
+		}
+	}
+	rows.Close()
+	if rows.Err() != nil {
+		return nil, customerror.NewError("mediaRepo.GetReferences", r.Host+":"+r.Port, rows.Err().Error())
+	}
+	rows, err = r.Pool.Query(ctx, `SELECT id, avatar_file_name, avatar_variants FROM users WHERE COALESCE(avatar_file_name, '') <> ''`)
+	if err != nil {
+		return nil, customerror.NewError("mediaRepo.GetReferences", r.Host+":"+r.Port, err.Error())
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var owner user.User
+		err := rows.Scan(&owner.UUID, &owner.AvatarFileName, &owner.AvatarVariants)
+		if err != nil {
+			return nil, customerror.NewError("mediaRepo.GetReferences", r.Host+":"+r.Port, err.Error())
+		}
+		for _, filename := range owner.AvatarFileNames() {
+			references = append(references, media.Reference{Kind: media.ReferenceAvatar, Id: owner.UUID.String(), Key: media.AvatarKey(owner.UUID, filename)})
+		}
+	}
+	if rows.Err() != nil {
+		return nil, customerror.NewError("mediaRepo.GetReferences", r.Host+":"+r.Port, rows.Err().Error())
+	}
+	return references, nil
+}
+
+const enqueueMediaDeletionsQuery = `INSERT INTO media_deletion_jobs (key) SELECT unnest($1::text[])`
+
+// enqueueMediaDeletions ставит файлы в очередь на удаление в транзакции, которая удаляет ссылавшиеся на них строки
+func enqueueMediaDeletions(ctx context.Context, tx pgx.Tx, keys []string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	_, err := tx.Exec(ctx, enqueueMediaDeletionsQuery, keys)
+	return err
+}
+
+// ClaimDeletionJobs выдает до limit готовых к повтору заданий и откладывает их на lease, чтобы другие реплики их не взяли
+func (r *MediaRepository) ClaimDeletionJobs(ctx context.Context, limit int, lease time.Duration) ([]media.DeletionJob, error) {
+	query := `UPDATE media_deletion_jobs SET next_attempt_at = CURRENT_TIMESTAMP + make_interval(secs => $2)
+	WHERE id IN (
+		SELECT id FROM media_deletion_jobs WHERE dead_at IS NULL AND next_attempt_at <= CURRENT_TIMESTAMP
+		ORDER BY next_attempt_at, id LIMIT $1 FOR UPDATE SKIP LOCKED
+	)
+	RETURNING id, key, attempts, last_error, next_attempt_at, created_at`
+	rows, err := r.Pool.Query(ctx, query, limit, lease.Seconds())
+	if err != nil {
+		return nil, customerror.NewError("mediaRepo.ClaimDeletionJobs", r.Host+":"+r.Port, err.Error())
+	}
+	defer rows.Close()
+	jobs := []media.DeletionJob{}
+	for rows.Next() {
+		var job media.DeletionJob
+		err := rows.Scan(&job.Id, &job.Key, &job.Attempts, &job.LastError, &job.NextAttemptAt, &job.CreatedAt)
+		if err != nil {
+			return nil, customerror.NewError("mediaRepo.ClaimDeletionJobs", r.Host+":"+r.Port, err.Error())
+		}
+		jobs = append(jobs, job)
+	}
+	if rows.Err() != nil {
+		return nil, customerror.NewError("mediaRepo.ClaimDeletionJobs", r.Host+":"+r.Port, rows.Err().Error())
+	}
+	return jobs, nil
+}
+
+func (r *MediaRepository) DeleteDeletionJob(ctx context.Context, id int64) error {
+	_, err := r.Pool.Exec(ctx, `DELETE FROM media_deletion_jobs WHERE id = $1`, id)
+	if err != nil {
+		return customerror.NewError("mediaRepo.DeleteDeletionJob", r.Host+":"+r.Port, err.Error())
+	}
+	return nil
+}
+
+func (r *MediaRepository) FailDeletionJob(ctx context.Context, id int64, message string, retryIn time.Duration) error {
+	query := `UPDATE media_deletion_jobs SET attempts = attempts + 1, last_error = $2,
+	next_attempt_at = CURRENT_TIMESTAMP + make_interval(secs => $3) WHERE id = $1`
+	_, err := r.Pool.Exec(ctx, query, id, message, retryIn.Seconds())
+	if err != nil {
+		return customerror.NewError("mediaRepo.FailDeletionJob", r.Host+":"+r.Port, err.Error())
+	}
+	return nil
+}
+
+func (r *MediaRepository) MarkDeletionJobDead(ctx context.Context, id int64, message string) error {
+	query := `UPDATE media_deletion_jobs SET attempts = attempts + 1, last_error = $2, dead_at = CURRENT_TIMESTAMP WHERE id = $1`
+	_, err := r.Pool.Exec(ctx, query, id, message)
+	if err != nil {
+		return customerror.NewError("mediaRepo.MarkDeletionJobDead", r.Host+":"+r.Port, err.Error())
+	}
+	return nil
+}
@@ -0,0 +1,400 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"mymate/pkg/customerror"
+	"mymate/pkg/moderation"
+	"mymate/pkg/user"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+type ModerationRepositoryI interface {
+	CreateTables(ctx context.Context) error
+	BlockUser(ctx context.Context, blockerId uuid.UUID, blockedId uuid.UUID) error
+	UnblockUser(ctx context.Context, blockerId uuid.UUID, blockedId uuid.UUID) error
+	GetBlocks(ctx context.Context, blockerId uuid.UUID) ([]moderation.UserBlock, error)
+	IsBlocked(ctx context.Context, firstId uuid.UUID, secondId uuid.UUID) (bool, error)
+	InsertReport(ctx context.Context, report *moderation.Report) (int64, error)
+	GetReports(ctx context.Context, status string, offset int64, limit int64) ([]moderation.Report, error)
+	UpdateReportStatus(ctx context.Context, id int64, status string) error
+	MuteUser(ctx context.Context, userId uuid.UUID, until time.Time, reason string) error
+	UnmuteUser(ctx context.Context, userId uuid.UUID) error
+	GetMute(ctx context.Context, userId uuid.UUID) (time.Time, error)
+	IncrementChatCounter(ctx context.Context, userId uuid.UUID, counter string) error
+	GetChatStats(ctx context.Context, since time.Time, offset int64, limit int64) ([]moderation.ChatStats, error)
+	FlagDuplicateImages(ctx context.Context, imageId int64, maxDistance int) (int64, error)
+	GetDuplicateImageFlags(ctx context.Context, status string, offset int64, limit int64) ([]moderation.DuplicateImageFlag, error)
+	UpdateDuplicateImageFlagStatus(ctx context.Context, id int64, status string) error
+}
+
+type ModerationRepository struct {
+	Pool *pgxpool.Pool
+	Host string
+	Port string
+}
+
+func NewModerationRepository(pool *pgxpool.Pool, host string, port string) ModerationRepositoryI {
+	return &ModerationRepository{
+		Pool: pool,
+		Host: host,
+		Port: port,
+	}
+}
+
+func (r *ModerationRepository) CreateTables(ctx context.Context) error {
+	createTableQuery := `
+	CREATE TABLE IF NOT EXISTS user_blocks (
+		blocker_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		blocked_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (blocker_id, blocked_id)
+	);`
+	_, err := r.Pool.Exec(ctx, createTableQuery)
+	if err != nil {
+		return customerror.NewError("moderationRepo.CreateTables", r.Host+":"+r.Port, err.Error())
+	}
+	createIndexQuery := `CREATE INDEX IF NOT EXISTS user_blocks_blocked_id_idx ON user_blocks(blocked_id);`
+	_, err = r.Pool.Exec(ctx, createIndexQuery)
+	if err != nil {
+		return customerror.NewError("moderationRepo.CreateTables", r.Host+":"+r.Port, err.Error())
+	}
+	createTableQuery = `
+	CREATE TABLE IF NOT EXISTS user_reports (
+		id BIGSERIAL PRIMARY KEY,
+		reporter_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		reported_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		reason TEXT NOT NULL DEFAULT '',
+		excerpt JSONB NOT NULL DEFAULT '[]',
+		status TEXT NOT NULL DEFAULT 'pending',
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);`
+	_, err = r.Pool.Exec(ctx, createTableQuery)
+	if err != nil {
+		return customerror.NewError("moderationRepo.CreateTables", r.Host+":"+r.Port, err.Error())
+	}
+	createIndexQuery = `CREATE INDEX IF NOT EXISTS user_reports_status_idx ON user_reports(status, id);`
+	_, err = r.Pool.Exec(ctx, createIndexQuery)
+	if err != nil {
+		return customerror.NewError("moderationRepo.CreateTables", r.Host+":"+r.Port, err.Error())
+	}
+	createTableQuery = `
+	CREATE TABLE IF NOT EXISTS chat_mutes (
+		user_id UUID PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+		muted_until TIMESTAMP NOT NULL,
+		reason TEXT NOT NULL DEFAULT '',
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);`
+	_, err = r.Pool.Exec(ctx, createTableQuery)
+	if err != nil {
+		return customerror.NewError("moderationRepo.CreateTables", r.Host+":"+r.Port, err.Error())
+	}
+	createTableQuery = `
+	CREATE TABLE IF NOT EXISTS chat_spam_counters (
+		user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		day DATE NOT NULL DEFAULT CURRENT_DATE,
+		rate_limited BIGINT NOT NULL DEFAULT 0,
+		spam_detected BIGINT NOT NULL DEFAULT 0,
+		mutes BIGINT NOT NULL DEFAULT 0,
+		PRIMARY KEY (user_id, day)
+	);`
+	_, err = r.Pool.Exec(ctx, createTableQuery)
+	if err != nil {
+		return customerror.NewError("moderationRepo.CreateTables", r.Host+":"+r.Port, err.Error())
+	}
+	createTableQuery = `
+	CREATE TABLE IF NOT EXISTS image_duplicate_flags (
+		id BIGSERIAL PRIMARY KEY,
+		image_id BIGINT NOT NULL REFERENCES flat_image(id) ON DELETE CASCADE,
+		matched_image_id BIGINT NOT NULL REFERENCES flat_image(id) ON DELETE CASCADE,
+		distance INT NOT NULL,
+		status TEXT NOT NULL DEFAULT 'pending',
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		UNIQUE (image_id, matched_image_id)
+	);`
+	_, err = r.Pool.Exec(ctx, createTableQuery)
+	if err != nil {
+		return customerror.NewError("moderationRepo.CreateTables", r.Host+":"+r.Port, err.Error())
+	}
+	createIndexQuery = `CREATE INDEX IF NOT EXISTS image_duplicate_flags_status_idx ON image_duplicate_flags(status, id);`
+	_, err = r.Pool.Exec(ctx, createIndexQuery)
+	if err != nil {
+		return customerror.NewError("moderationRepo.CreateTables", r.Host+":"+r.Port, err.Error())
+	}
+	return nil
+}
+
+func (r *ModerationRepository) BlockUser(ctx context.Context, blockerId uuid.UUID, blockedId uuid.UUID) error {
+	query := `INSERT INTO user_blocks (blocker_id, blocked_id) VALUES ($1, $2) ON CONFLICT DO NOTHING`
+	_, err := r.Pool.Exec(ctx, query, blockerId, blockedId)
+	if err != nil {
+		return customerror.NewError("moderationRepo.BlockUser", r.Host+":"+r.Port, err.Error())
+	}
+	return nil
+}
+
+func (r *ModerationRepository) UnblockUser(ctx context.Context, blockerId uuid.UUID, blockedId uuid.UUID) error {
+	query := `DELETE FROM user_blocks WHERE blocker_id = $1 AND blocked_id = $2`
+	command, err := r.Pool.Exec(ctx, query, blockerId, blockedId)
+	if err != nil {
+		return customerror.NewError("moderationRepo.UnblockUser", r.Host+":"+r.Port, err.Error())
+	}
+	if command.RowsAffected() == 0 {
+		return pgx.ErrNoRows
+	}
+	return nil
+}
+
+func (r *ModerationRepository) GetBlocks(ctx context.Context, blockerId uuid.UUID) ([]moderation.UserBlock, error) {
+	query := `SELECT user_blocks.blocker_id, user_blocks.blocked_id, user_blocks.created_at,
+	users.id, users.firstname, users.lastname, users.avatar_url
+	FROM user_blocks JOIN users ON user_blocks.blocked_id = users.id
+	WHERE user_blocks.blocker_id = $1
+	ORDER BY user_blocks.created_at DESC`
+	rows, err := r.Pool.Query(ctx, query, blockerId)
+	if err != nil {
+		return nil, customerror.NewError("moderationRepo.GetBlocks", r.Host+":"+r.Port, err.Error())
+	}
+	defer rows.Close()
+	blocks := []moderation.UserBlock{}
+	for rows.Next() {
+		var block moderation.UserBlock
+		var blockedUser user.User
+		err := rows.Scan(&block.BlockerId, &block.BlockedId, &block.CreatedAt,
+			&blockedUser.UUID, &blockedUser.Firstname, &blockedUser.Lastname, &blockedUser.AvatarUrl)
+		if err != nil {
+			return nil, customerror.NewError("moderationRepo.GetBlocks", r.Host+":"+r.Port, err.Error())
+		}
+		block.User = &blockedUser
+		blocks = append(blocks, block)
+	}
+	return blocks, nil
+}
+
+// IsBlocked проверяет блокировку в обе стороны
+func (r *ModerationRepository) IsBlocked(ctx context.Context, firstId uuid.UUID, secondId uuid.UUID) (bool, error) {
+	query := `SELECT EXISTS (
+		SELECT 1 FROM user_blocks
+		WHERE (blocker_id = $1 AND blocked_id = $2) OR (blocker_id = $2 AND blocked_id = $1)
+	)`
+	var blocked bool
+	err := r.Pool.QueryRow(ctx, query, firstId, secondId).Scan(&blocked)
+	if err != nil {
+		return false, customerror.NewError("moderationRepo.IsBlocked", r.Host+":"+r.Port, err.Error())
+	}
+	return blocked, nil
+}
+
+func (r *ModerationRepository) InsertReport(ctx context.Context, report *moderation.Report) (int64, error) {
+	query := `INSERT INTO user_reports (reporter_id, reported_id, reason, excerpt, status) VALUES ($1, $2, $3, $4, $5) RETURNING id, created_at`
+	if report.Status == "" {
+		report.Status = moderation.ReportStatusPending
+	}
+	err := r.Pool.QueryRow(ctx, query, report.ReporterId, report.ReportedId, report.Reason, report.Excerpt, report.Status).Scan(&report.Id, &report.CreatedAt)
+	if err != nil {
+		return 0, customerror.NewError("moderationRepo.InsertReport", r.Host+":"+r.Port, err.Error())
+	}
+	return report.Id, nil
+}
+
+func (r *ModerationRepository) GetReports(ctx context.Context, status string, offset int64, limit int64) ([]moderation.Report, error) {
+	query := `SELECT id, reporter_id, reported_id, reason, excerpt, status, created_at
+	FROM user_reports WHERE status = $1 ORDER BY id DESC OFFSET $2 LIMIT $3`
+	rows, err := r.Pool.Query(ctx, query, status, offset, limit)
+	if err != nil {
+		return nil, customerror.NewError("moderationRepo.GetReports", r.Host+":"+r.Port, err.Error())
+	}
+	defer rows.Close()
+	reports := []moderation.Report{}
+	for rows.Next() {
+		var report moderation.Report
+		err := rows.Scan(&report.Id, &report.ReporterId, &report.ReportedId, &report.Reason, &report.Excerpt, &report.Status, &report.CreatedAt)
+		if err != nil {
+			return nil, customerror.NewError("moderationRepo.GetReports", r.Host+":"+r.Port, err.Error())
+		}
+		reports = append(reports, report)
+	}
+	return reports, nil
+}
+
+func (r *ModerationRepository) UpdateReportStatus(ctx context.Context, id int64, status string) error {
+	query := `UPDATE user_reports SET status = $1 WHERE id = $2`
+	command, err := r.Pool.Exec(ctx, query, status, id)
+	if err != nil {
+		return customerror.NewError("moderationRepo.UpdateReportStatus", r.Host+":"+r.Port, err.Error())
+	}
+	if command.RowsAffected() == 0 {
+		return pgx.ErrNoRows
+	}
+	return nil
+}
+
+// MuteUser запрещает пользователю писать в чат до until. Уже действующий более долгий мут не сокращается.
+func (r *ModerationRepository) MuteUser(ctx context.Context, userId uuid.UUID, until time.Time, reason string) error {
+	query := `
+		INSERT INTO chat_mutes (user_id, muted_until, reason) VALUES ($1, $2, $3)
+		ON CONFLICT (user_id) DO UPDATE SET
+			muted_until = GREATEST(chat_mutes.muted_until, EXCLUDED.muted_until),
+			reason = EXCLUDED.reason,
+			created_at = CURRENT_TIMESTAMP;
+	`
+	_, err := r.Pool.Exec(ctx, query, userId, until, reason)
+	if err != nil {
+		return customerror.NewError("moderationRepo.MuteUser", r.Host+":"+r.Port, err.Error())
+	}
+	return nil
+}
+
+func (r *ModerationRepository) UnmuteUser(ctx context.Context, userId uuid.UUID) error {
+	query := `DELETE FROM chat_mutes WHERE user_id = $1 AND muted_until > NOW()`
+	command, err := r.Pool.Exec(ctx, query, userId)
+	if err != nil {
+		return customerror.NewError("moderationRepo.UnmuteUser", r.Host+":"+r.Port, err.Error())
+	}
+	if command.RowsAffected() == 0 {
+		return pgx.ErrNoRows
+	}
+	return nil
+}
+
+// GetMute возвращает время окончания действующего мута или pgx.ErrNoRows
+func (r *ModerationRepository) GetMute(ctx context.Context, userId uuid.UUID) (time.Time, error) {
+	query := `SELECT muted_until FROM chat_mutes WHERE user_id = $1 AND muted_until > NOW()`
+	var mutedUntil time.Time
+	err := r.Pool.QueryRow(ctx, query, userId).Scan(&mutedUntil)
+	if err == pgx.ErrNoRows {
+		return time.Time{}, err
+	}
+	if err != nil {
+		return time.Time{}, customerror.NewError("moderationRepo.GetMute", r.Host+":"+r.Port, err.Error())
+	}
+	return mutedUntil, nil
+}
+
+func (r *ModerationRepository) IncrementChatCounter(ctx context.Context, userId uuid.UUID, counter string) error {
+	if counter != moderation.CounterRateLimited && counter != moderation.CounterSpam && counter != moderation.CounterMutes {
+		return customerror.NewError("moderationRepo.IncrementChatCounter", r.Host+":"+r.Port, "unknown counter "+counter)
+	}
+	// Имя столбца проверено выше, подставлять его в запрос безопасно
+	query := `
+		INSERT INTO chat_spam_counters (user_id, ` + counter + `) VALUES ($1, 1)
+		ON CONFLICT (user_id, day) DO UPDATE SET ` + counter + ` = chat_spam_counters.` + counter + ` + 1;
+	`
+	_, err := r.Pool.Exec(ctx, query, userId)
+	if err != nil {
+		return customerror.NewError("moderationRepo.IncrementChatCounter", r.Host+":"+r.Port, err.Error())
+	}
+	return nil
+}
+
+// GetChatStats суммирует счетчики с даты since, самые частые нарушители первыми
+func (r *ModerationRepository) GetChatStats(ctx context.Context, since time.Time, offset int64, limit int64) ([]moderation.ChatStats, error) {
+	query := `
+		SELECT c.user_id, SUM(c.rate_limited), SUM(c.spam_detected), SUM(c.mutes), MAX(m.muted_until)
+		FROM chat_spam_counters c
+		LEFT JOIN chat_mutes m ON m.user_id = c.user_id AND m.muted_until > NOW()
+		WHERE c.day >= $1::date
+		GROUP BY c.user_id
+		ORDER BY SUM(c.spam_detected) DESC, SUM(c.mutes) DESC, SUM(c.rate_limited) DESC
+		OFFSET $2
+		LIMIT $3;
+	`
+	rows, err := r.Pool.Query(ctx, query, since, offset, limit)
+	if err != nil {
+		return nil, customerror.NewError("moderationRepo.GetChatStats", r.Host+":"+r.Port, err.Error())
+	}
+	defer rows.Close()
+	stats := []moderation.ChatStats{}
+	for rows.Next() {
+		var stat moderation.ChatStats
+		err := rows.Scan(&stat.UserId, &stat.RateLimited, &stat.SpamDetected, &stat.Mutes, &stat.MutedUntil)
+		if err != nil {
+			return nil, customerror.NewError("moderationRepo.GetChatStats", r.Host+":"+r.Port, err.Error())
+		}
+		stats = append(stats, stat)
+	}
+	return stats, nil
+}
+
+// phashCandidateCondition отбирает по индексам частей хеша фотографии, совпадающие с загруженной хотя бы в одной части
+var phashCandidateCondition = func() string {
+	condition := ""
+	for band := range phashBands {
+		if band > 0 {
+			condition += " OR "
+		}
+		condition += fmt.Sprintf("candidate.phash_band_%[1]d = uploaded.phash_band_%[1]d", band)
+	}
+	return "(" + condition + ")"
+}()
+
+// FlagDuplicateImages ставит в очередь модерации совпадения фотографии imageId с фотографиями объявлений других пользователей,
+// если хеши отличаются не больше чем на maxDistance бит. Возвращает число новых отметок.
+// Полное сравнение хешей идет только для фотографий, совпадающих с загруженной в одной из частей хеша,
+// поэтому maxDistance должен быть меньше phashBands.
+func (r *ModerationRepository) FlagDuplicateImages(ctx context.Context, imageId int64, maxDistance int) (int64, error) {
+	if maxDistance >= phashBands {
+		return 0, customerror.NewError("moderationRepo.FlagDuplicateImages", r.Host+":"+r.Port, fmt.Sprintf("max distance %d is not supported, must be less than %d", maxDistance, phashBands))
+	}
+	query := `
+	INSERT INTO image_duplicate_flags (image_id, matched_image_id, distance)
+	SELECT uploaded.id, candidate.id, matches.distance
+	FROM flat_image uploaded
+	JOIN flat uploaded_flat ON uploaded_flat.id = uploaded.flat_id
+	JOIN flat_image candidate ON ` + phashCandidateCondition + ` AND candidate.phash IS NOT NULL AND candidate.id <> uploaded.id
+	JOIN flat candidate_flat ON candidate_flat.id = candidate.flat_id AND candidate_flat.created_by_id <> uploaded_flat.created_by_id
+	CROSS JOIN LATERAL (SELECT length(replace((uploaded.phash # candidate.phash)::bit(64)::text, '0', '')) AS distance) matches
+	WHERE uploaded.id = $1 AND uploaded.phash IS NOT NULL AND matches.distance <= $2
+	ON CONFLICT (image_id, matched_image_id) DO NOTHING`
+	command, err := r.Pool.Exec(ctx, query, imageId, maxDistance)
+	if err != nil {
+		return 0, customerror.NewError("moderationRepo.FlagDuplicateImages", r.Host+":"+r.Port, err.Error())
+	}
+	return command.RowsAffected(), nil
+}
+
+func (r *ModerationRepository) GetDuplicateImageFlags(ctx context.Context, status string, offset int64, limit int64) ([]moderation.DuplicateImageFlag, error) {
+	query := `
+	SELECT flags.id, image.id, image.url, image_flat.id, image_flat.created_by_id,
+		matched.id, matched.url, matched_flat.id, matched_flat.created_by_id,
+		flags.distance, flags.status, flags.created_at
+	FROM image_duplicate_flags flags
+	JOIN flat_image image ON image.id = flags.image_id
+	JOIN flat image_flat ON image_flat.id = image.flat_id
+	JOIN flat_image matched ON matched.id = flags.matched_image_id
+	JOIN flat matched_flat ON matched_flat.id = matched.flat_id
+	WHERE flags.status = $1 ORDER BY flags.id DESC OFFSET $2 LIMIT $3`
+	rows, err := r.Pool.Query(ctx, query, status, offset, limit)
+	if err != nil {
+		return nil, customerror.NewError("moderationRepo.GetDuplicateImageFlags", r.Host+":"+r.Port, err.Error())
+	}
+	defer rows.Close()
+	flags := []moderation.DuplicateImageFlag{}
+	for rows.Next() {
+		var flag moderation.DuplicateImageFlag
+		err := rows.Scan(&flag.Id, &flag.ImageId, &flag.ImageUrl, &flag.FlatId, &flag.OwnerId,
+			&flag.MatchedImageId, &flag.MatchedImageUrl, &flag.MatchedFlatId, &flag.MatchedOwnerId,
+			&flag.Distance, &flag.Status, &flag.CreatedAt)
+		if err != nil {
+			return nil, customerror.NewError("moderationRepo.GetDuplicateImageFlags", r.Host+":"+r.Port, err.Error())
+		}
+		flags = append(flags, flag)
+	}
+	return flags, nil
+}
+
+func (r *ModerationRepository) UpdateDuplicateImageFlagStatus(ctx context.Context, id int64, status string) error {
+	query := `UPDATE image_duplicate_flags SET status = $1 WHERE id = $2`
+	command, err := r.Pool.Exec(ctx, query, status, id)
+	if err != nil {
+		return customerror.NewError("moderationRepo.UpdateDuplicateImageFlagStatus", r.Host+":"+r.Port, err.Error())
+	}
+	if command.RowsAffected() == 0 {
+		return pgx.ErrNoRows
+	}
+	return nil
+}
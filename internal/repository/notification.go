@@ -0,0 +1,259 @@
+package repository
+
+import (
+	"context"
+	"mymate/pkg/customerror"
+	"mymate/pkg/notification"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+type NotificationRepositoryI interface {
+	CreateTables(ctx context.Context) error
+	UpsertDevice(ctx context.Context, device *notification.Device) error
+	DeleteDevice(ctx context.Context, userId uuid.UUID, token string) error
+	DeleteDeviceByToken(ctx context.Context, token string) error
+	GetDevices(ctx context.Context, userId uuid.UUID) ([]notification.Device, error)
+	GetPreferences(ctx context.Context, userId uuid.UUID) (*notification.Preferences, error)
+	UpsertPreferences(ctx context.Context, preferences *notification.Preferences) error
+	InsertNotification(ctx context.Context, notification *notification.Notification) error
+	GetNotifications(ctx context.Context, userId uuid.UUID, unreadOnly bool, offset int64, limit int64) ([]notification.Notification, error)
+	CountUnread(ctx context.Context, userId uuid.UUID) (int64, error)
+	MarkRead(ctx context.Context, userId uuid.UUID, id int64) error
+	MarkAllRead(ctx context.Context, userId uuid.UUID) (int64, error)
+}
+
+type NotificationRepository struct {
+	Pool *pgxpool.Pool
+	Host string
+	Port string
+}
+
+func NewNotificationRepository(pool *pgxpool.Pool, host string, port string) NotificationRepositoryI {
+	return &NotificationRepository{
+		Pool: pool,
+		Host: host,
+		Port: port,
+	}
+}
+
+func (r *NotificationRepository) CreateTables(ctx context.Context) error {
+	createTableQuery := `
+	CREATE TABLE IF NOT EXISTS user_devices (
+		id BIGSERIAL PRIMARY KEY,
+		user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		platform TEXT NOT NULL,
+		token TEXT NOT NULL UNIQUE,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		last_seen_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);`
+	_, err := r.Pool.Exec(ctx, createTableQuery)
+	if err != nil {
+		return customerror.NewError("notificationRepo.CreateTables", r.Host+":"+r.Port, err.Error())
+	}
+	createIndexQuery := `CREATE INDEX IF NOT EXISTS user_devices_user_id_idx ON user_devices(user_id);`
+	_, err = r.Pool.Exec(ctx, createIndexQuery)
+	if err != nil {
+		return customerror.NewError("notificationRepo.CreateTables", r.Host+":"+r.Port, err.Error())
+	}
+	createTableQuery = `
+	CREATE TABLE IF NOT EXISTS notification_preferences (
+		user_id UUID PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+		chat_messages BOOLEAN NOT NULL DEFAULT TRUE,
+		matches BOOLEAN NOT NULL DEFAULT TRUE,
+		listing_expiry BOOLEAN NOT NULL DEFAULT TRUE,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);`
+	_, err = r.Pool.Exec(ctx, createTableQuery)
+	if err != nil {
+		return customerror.NewError("notificationRepo.CreateTables", r.Host+":"+r.Port, err.Error())
+	}
+	alterQuery := `ALTER TABLE notification_preferences ADD COLUMN IF NOT EXISTS telegram BOOLEAN NOT NULL DEFAULT FALSE`
+	_, err = r.Pool.Exec(ctx, alterQuery)
+	if err != nil {
+		return customerror.NewError("notificationRepo.CreateTables", r.Host+":"+r.Port, err.Error())
+	}
+	createTableQuery = `
+	CREATE TABLE IF NOT EXISTS notifications (
+		id BIGSERIAL PRIMARY KEY,
+		user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		type TEXT NOT NULL,
+		title TEXT NOT NULL DEFAULT '',
+		body TEXT NOT NULL DEFAULT '',
+		data JSONB NOT NULL DEFAULT '{}',
+		link TEXT NOT NULL DEFAULT '',
+		read_at TIMESTAMP,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);`
+	_, err = r.Pool.Exec(ctx, createTableQuery)
+	if err != nil {
+		return customerror.NewError("notificationRepo.CreateTables", r.Host+":"+r.Port, err.Error())
+	}
+	createIndexQuery = `CREATE INDEX IF NOT EXISTS notifications_user_id_idx ON notifications(user_id, id);`
+	_, err = r.Pool.Exec(ctx, createIndexQuery)
+	if err != nil {
+		return customerror.NewError("notificationRepo.CreateTables", r.Host+":"+r.Port, err.Error())
+	}
+	createIndexQuery = `CREATE INDEX IF NOT EXISTS notifications_unread_idx ON notifications(user_id) WHERE read_at IS NULL;`
+	_, err = r.Pool.Exec(ctx, createIndexQuery)
+	if err != nil {
+		return customerror.NewError("notificationRepo.CreateTables", r.Host+":"+r.Port, err.Error())
+	}
+	return nil
+}
+
+// UpsertDevice регистрирует токен. Если токен уже был у другого пользователя (перелогин на том же устройстве),
+// он переходит к новому владельцу.
+func (r *NotificationRepository) UpsertDevice(ctx context.Context, device *notification.Device) error {
+	query := `
+	INSERT INTO user_devices (user_id, platform, token) VALUES ($1, $2, $3)
+	ON CONFLICT (token) DO UPDATE SET user_id = EXCLUDED.user_id, platform = EXCLUDED.platform, last_seen_at = CURRENT_TIMESTAMP
+	RETURNING id, created_at, last_seen_at`
+	err := r.Pool.QueryRow(ctx, query, device.UserId, device.Platform, device.Token).Scan(&device.Id, &device.CreatedAt, &device.LastSeenAt)
+	if err != nil {
+		return customerror.NewError("notificationRepo.UpsertDevice", r.Host+":"+r.Port, err.Error())
+	}
+	return nil
+}
+
+func (r *NotificationRepository) DeleteDevice(ctx context.Context, userId uuid.UUID, token string) error {
+	query := `DELETE FROM user_devices WHERE user_id = $1 AND token = $2`
+	tag, err := r.Pool.Exec(ctx, query, userId, token)
+	if err != nil {
+		return customerror.NewError("notificationRepo.DeleteDevice", r.Host+":"+r.Port, err.Error())
+	}
+	if tag.RowsAffected() == 0 {
+		return pgx.ErrNoRows
+	}
+	return nil
+}
+
+func (r *NotificationRepository) DeleteDeviceByToken(ctx context.Context, token string) error {
+	query := `DELETE FROM user_devices WHERE token = $1`
+	_, err := r.Pool.Exec(ctx, query, token)
+	if err != nil {
+		return customerror.NewError("notificationRepo.DeleteDeviceByToken", r.Host+":"+r.Port, err.Error())
+	}
+	return nil
+}
+
+func (r *NotificationRepository) GetDevices(ctx context.Context, userId uuid.UUID) ([]notification.Device, error) {
+	query := `SELECT id, user_id, platform, token, created_at, last_seen_at FROM user_devices WHERE user_id = $1 ORDER BY id`
+	rows, err := r.Pool.Query(ctx, query, userId)
+	if err != nil {
+		return nil, customerror.NewError("notificationRepo.GetDevices", r.Host+":"+r.Port, err.Error())
+	}
+	defer rows.Close()
+	devices := []notification.Device{}
+	for rows.Next() {
+		var device notification.Device
+		err := rows.Scan(&device.Id, &device.UserId, &device.Platform, &device.Token, &device.CreatedAt, &device.LastSeenAt)
+		if err != nil {
+			return nil, customerror.NewError("notificationRepo.GetDevices", r.Host+":"+r.Port, err.Error())
+		}
+		devices = append(devices, device)
+	}
+	if rows.Err() != nil {
+		return nil, customerror.NewError("notificationRepo.GetDevices", r.Host+":"+r.Port, rows.Err().Error())
+	}
+	return devices, nil
+}
+
+// GetPreferences возвращает настройки по умолчанию, если пользователь их не менял
+func (r *NotificationRepository) GetPreferences(ctx context.Context, userId uuid.UUID) (*notification.Preferences, error) {
+	query := `SELECT chat_messages, matches, listing_expiry, telegram FROM notification_preferences WHERE user_id = $1`
+	preferences := notification.DefaultPreferences(userId)
+	err := r.Pool.QueryRow(ctx, query, userId).Scan(&preferences.ChatMessages, &preferences.Matches, &preferences.ListingExpiry, &preferences.Telegram)
+	if err == pgx.ErrNoRows {
+		return preferences, nil
+	}
+	if err != nil {
+		return nil, customerror.NewError("notificationRepo.GetPreferences", r.Host+":"+r.Port, err.Error())
+	}
+	return preferences, nil
+}
+
+func (r *NotificationRepository) UpsertPreferences(ctx context.Context, preferences *notification.Preferences) error {
+	query := `
+	INSERT INTO notification_preferences (user_id, chat_messages, matches, listing_expiry, telegram) VALUES ($1, $2, $3, $4, $5)
+	ON CONFLICT (user_id) DO UPDATE SET chat_messages = EXCLUDED.chat_messages, matches = EXCLUDED.matches,
+		listing_expiry = EXCLUDED.listing_expiry, telegram = EXCLUDED.telegram, updated_at = CURRENT_TIMESTAMP`
+	_, err := r.Pool.Exec(ctx, query, preferences.UserId, preferences.ChatMessages, preferences.Matches, preferences.ListingExpiry, preferences.Telegram)
+	if err != nil {
+		return customerror.NewError("notificationRepo.UpsertPreferences", r.Host+":"+r.Port, err.Error())
+	}
+	return nil
+}
+
+func (r *NotificationRepository) InsertNotification(ctx context.Context, notification *notification.Notification) error {
+	data := notification.Data
+	if data == nil {
+		data = map[string]string{}
+	}
+	query := `INSERT INTO notifications (user_id, type, title, body, data, link) VALUES ($1, $2, $3, $4, $5, $6) RETURNING id, created_at`
+	err := r.Pool.QueryRow(ctx, query, notification.UserId, notification.Type, notification.Title, notification.Body, data, notification.Link).Scan(&notification.Id, &notification.CreatedAt)
+	if err != nil {
+		return customerror.NewError("notificationRepo.InsertNotification", r.Host+":"+r.Port, err.Error())
+	}
+	return nil
+}
+
+func (r *NotificationRepository) GetNotifications(ctx context.Context, userId uuid.UUID, unreadOnly bool, offset int64, limit int64) ([]notification.Notification, error) {
+	query := `SELECT id, user_id, type, title, body, data, link, read_at, created_at FROM notifications
+	WHERE user_id = $1 AND (NOT $2 OR read_at IS NULL)
+	ORDER BY id DESC LIMIT $3 OFFSET $4`
+	rows, err := r.Pool.Query(ctx, query, userId, unreadOnly, limit, offset)
+	if err != nil {
+		return nil, customerror.NewError("notificationRepo.GetNotifications", r.Host+":"+r.Port, err.Error())
+	}
+	defer rows.Close()
+	notifications := []notification.Notification{}
+	for rows.Next() {
+		var notification notification.Notification
+		err := rows.Scan(&notification.Id, &notification.UserId, &notification.Type, &notification.Title, &notification.Body,
+			&notification.Data, &notification.Link, &notification.ReadAt, &notification.CreatedAt)
+		if err != nil {
+			return nil, customerror.NewError("notificationRepo.GetNotifications", r.Host+":"+r.Port, err.Error())
+		}
+		notifications = append(notifications, notification)
+	}
+	if rows.Err() != nil {
+		return nil, customerror.NewError("notificationRepo.GetNotifications", r.Host+":"+r.Port, rows.Err().Error())
+	}
+	return notifications, nil
+}
+
+func (r *NotificationRepository) CountUnread(ctx context.Context, userId uuid.UUID) (int64, error) {
+	query := `SELECT COUNT(*) FROM notifications WHERE user_id = $1 AND read_at IS NULL`
+	var count int64
+	err := r.Pool.QueryRow(ctx, query, userId).Scan(&count)
+	if err != nil {
+		return 0, customerror.NewError("notificationRepo.CountUnread", r.Host+":"+r.Port, err.Error())
+	}
+	return count, nil
+}
+
+// MarkRead возвращает pgx.ErrNoRows, если уведомления нет или оно принадлежит другому пользователю.
+// Повторная отметка уже прочитанного уведомления не меняет read_at.
+func (r *NotificationRepository) MarkRead(ctx context.Context, userId uuid.UUID, id int64) error {
+	query := `UPDATE notifications SET read_at = COALESCE(read_at, CURRENT_TIMESTAMP) WHERE id = $1 AND user_id = $2`
+	tag, err := r.Pool.Exec(ctx, query, id, userId)
+	if err != nil {
+		return customerror.NewError("notificationRepo.MarkRead", r.Host+":"+r.Port, err.Error())
+	}
+	if tag.RowsAffected() == 0 {
+		return pgx.ErrNoRows
+	}
+	return nil
+}
+
+func (r *NotificationRepository) MarkAllRead(ctx context.Context, userId uuid.UUID) (int64, error) {
+	query := `UPDATE notifications SET read_at = CURRENT_TIMESTAMP WHERE user_id = $1 AND read_at IS NULL`
+	tag, err := r.Pool.Exec(ctx, query, userId)
+	if err != nil {
+		return 0, customerror.NewError("notificationRepo.MarkAllRead", r.Host+":"+r.Port, err.Error())
+	}
+	return tag.RowsAffected(), nil
+}
@@ -0,0 +1,184 @@
+package repository
+
+import (
+	"context"
+	"mymate/pkg/customerror"
+	"mymate/pkg/upload"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+type UploadRepositoryI interface {
+	CreateTables(ctx context.Context) error
+	InsertUpload(ctx context.Context, session *upload.Session, ttl time.Duration) error
+	GetUpload(ctx context.Context, id uuid.UUID) (*upload.Session, error)
+	AppendChunk(ctx context.Context, id uuid.UUID, offset int64, size int64, key string, ttl time.Duration) (*upload.Session, error)
+	SetUploadStatus(ctx context.Context, id uuid.UUID, from string, to string) error
+	DeleteUpload(ctx context.Context, id uuid.UUID) ([]string, error)
+	DeleteExpiredUploads(ctx context.Context) ([]upload.Session, error)
+	GetExistingUploads(ctx context.Context, ids []uuid.UUID) ([]uuid.UUID, error)
+}
+
+type UploadRepository struct {
+	Pool *pgxpool.Pool
+	Host string
+	Port string
+}
+
+func NewUploadRepository(pool *pgxpool.Pool, host string, port string) UploadRepositoryI {
+	return &UploadRepository{
+		Pool: pool,
+		Host: host,
+		Port: port,
+	}
+}
+
+func (r *UploadRepository) CreateTables(ctx context.Context) error {
+	createTableQuery := `
+	CREATE TABLE IF NOT EXISTS upload_session (
+		id UUID PRIMARY KEY,
+		user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		kind TEXT NOT NULL,
+		flat_id BIGINT REFERENCES flat(id) ON DELETE CASCADE,
+		filename TEXT NOT NULL DEFAULT '',
+		size BIGINT NOT NULL,
+		"offset" BIGINT NOT NULL DEFAULT 0,
+		status TEXT NOT NULL DEFAULT 'uploading',
+		chunks TEXT[] NOT NULL DEFAULT '{}',
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		expires_at TIMESTAMP NOT NULL
+	);`
+	_, err := r.Pool.Exec(ctx, createTableQuery)
+	if err != nil {
+		return customerror.NewError("uploadRepo.CreateTables", r.Host+":"+r.Port, err.Error())
+	}
+	createIndexQuery := `CREATE INDEX IF NOT EXISTS upload_session_expires_at_idx ON upload_session(expires_at);`
+	_, err = r.Pool.Exec(ctx, createIndexQuery)
+	if err != nil {
+		return customerror.NewError("uploadRepo.CreateTables", r.Host+":"+r.Port, err.Error())
+	}
+	return nil
+}
+
+func (r *UploadRepository) InsertUpload(ctx context.Context, session *upload.Session, ttl time.Duration) error {
+	var flatId any
+	if session.FlatId != 0 {
+		flatId = session.FlatId
+	}
+	query := `INSERT INTO upload_session (id, user_id, kind, flat_id, filename, size, expires_at)
+	VALUES ($1, $2, $3, $4, $5, $6, CURRENT_TIMESTAMP + make_interval(secs => $7))
+	RETURNING "offset", status, created_at, expires_at`
+	err := r.Pool.QueryRow(ctx, query, session.Id, session.UserId, session.Kind, flatId, session.Filename, session.Size, ttl.Seconds()).
+		Scan(&session.Offset, &session.Status, &session.CreatedAt, &session.ExpiresAt)
+	if err != nil {
+		return customerror.NewError("uploadRepo.InsertUpload", r.Host+":"+r.Port, err.Error())
+	}
+	return nil
+}
+
+// GetUpload не возвращает просроченные сессии, даже если их еще не удалила очистка
+func (r *UploadRepository) GetUpload(ctx context.Context, id uuid.UUID) (*upload.Session, error) {
+	query := `SELECT id, user_id, kind, COALESCE(flat_id, 0), filename, size, "offset", status, chunks, created_at, expires_at
+	FROM upload_session WHERE id = $1 AND expires_at > CURRENT_TIMESTAMP`
+	var session upload.Session
+	err := r.Pool.QueryRow(ctx, query, id).Scan(&session.Id, &session.UserId, &session.Kind, &session.FlatId, &session.Filename,
+		&session.Size, &session.Offset, &session.Status, &session.Chunks, &session.CreatedAt, &session.ExpiresAt)
+	if err == pgx.ErrNoRows {
+		return nil, err
+	}
+	if err != nil {
+		return nil, customerror.NewError("uploadRepo.GetUpload", r.Host+":"+r.Port, err.Error())
+	}
+	return &session, nil
+}
+
+// AppendChunk добавляет часть и продлевает сессию на ttl. Часть добавляется, только если смещение не сдвинулось с момента чтения сессии.
+// Иначе возвращает customerror.ErrUploadConflict.
+func (r *UploadRepository) AppendChunk(ctx context.Context, id uuid.UUID, offset int64, size int64, key string, ttl time.Duration) (*upload.Session, error) {
+	query := `UPDATE upload_session SET "offset" = "offset" + $3, chunks = array_append(chunks, $4),
+		expires_at = CURRENT_TIMESTAMP + make_interval(secs => $5)
+	WHERE id = $1 AND "offset" = $2 AND "offset" + $3 <= size AND status = 'uploading' AND expires_at > CURRENT_TIMESTAMP
+	RETURNING id, user_id, kind, COALESCE(flat_id, 0), filename, size, "offset", status, chunks, created_at, expires_at`
+	var session upload.Session
+	err := r.Pool.QueryRow(ctx, query, id, offset, size, key, ttl.Seconds()).Scan(&session.Id, &session.UserId, &session.Kind, &session.FlatId,
+		&session.Filename, &session.Size, &session.Offset, &session.Status, &session.Chunks, &session.CreatedAt, &session.ExpiresAt)
+	if err == pgx.ErrNoRows {
+		return nil, customerror.ErrUploadConflict
+	}
+	if err != nil {
+		return nil, customerror.NewError("uploadRepo.AppendChunk", r.Host+":"+r.Port, err.Error())
+	}
+	return &session, nil
+}
+
+// SetUploadStatus переводит полностью загруженную сессию из статуса from в to. Если статус уже другой - customerror.ErrUploadConflict.
+func (r *UploadRepository) SetUploadStatus(ctx context.Context, id uuid.UUID, from string, to string) error {
+	query := `UPDATE upload_session SET status = $3 WHERE id = $1 AND status = $2 AND "offset" = size`
+	tag, err := r.Pool.Exec(ctx, query, id, from, to)
+	if err != nil {
+		return customerror.NewError("uploadRepo.SetUploadStatus", r.Host+":"+r.Port, err.Error())
+	}
+	if tag.RowsAffected() == 0 {
+		return customerror.ErrUploadConflict
+	}
+	return nil
+}
+
+// DeleteUpload удаляет сессию и возвращает ключи ее частей
+func (r *UploadRepository) DeleteUpload(ctx context.Context, id uuid.UUID) ([]string, error) {
+	var chunks []string
+	err := r.Pool.QueryRow(ctx, `DELETE FROM upload_session WHERE id = $1 RETURNING chunks`, id).Scan(&chunks)
+	if err == pgx.ErrNoRows {
+		return nil, err
+	}
+	if err != nil {
+		return nil, customerror.NewError("uploadRepo.DeleteUpload", r.Host+":"+r.Port, err.Error())
+	}
+	return chunks, nil
+}
+
+func (r *UploadRepository) DeleteExpiredUploads(ctx context.Context) ([]upload.Session, error) {
+	rows, err := r.Pool.Query(ctx, `DELETE FROM upload_session WHERE expires_at <= CURRENT_TIMESTAMP RETURNING id, chunks`)
+	if err != nil {
+		return nil, customerror.NewError("uploadRepo.DeleteExpiredUploads", r.Host+":"+r.Port, err.Error())
+	}
+	defer rows.Close()
+	sessions := []upload.Session{}
+	for rows.Next() {
+		var session upload.Session
+		err := rows.Scan(&session.Id, &session.Chunks)
+		if err != nil {
+			return nil, customerror.NewError("uploadRepo.DeleteExpiredUploads", r.Host+":"+r.Port, err.Error())
+		}
+		sessions = append(sessions, session)
+	}
+	if rows.Err() != nil {
+		return nil, customerror.NewError("uploadRepo.DeleteExpiredUploads", r.Host+":"+r.Port, rows.Err().Error())
+	}
+	return sessions, nil
+}
+
+// GetExistingUploads возвращает те из ids, для которых сессия еще есть в базе
+func (r *UploadRepository) GetExistingUploads(ctx context.Context, ids []uuid.UUID) ([]uuid.UUID, error) {
+	rows, err := r.Pool.Query(ctx, `SELECT id FROM upload_session WHERE id = ANY($1)`, ids)
+	if err != nil {
+		return nil, customerror.NewError("uploadRepo.GetExistingUploads", r.Host+":"+r.Port, err.Error())
+	}
+	defer rows.Close()
+	existing := []uuid.UUID{}
+	for rows.Next() {
+		var id uuid.UUID
+		err := rows.Scan(&id)
+		if err != nil {
+			return nil, customerror.NewError("uploadRepo.GetExistingUploads", r.Host+":"+r.Port, err.Error())
+		}
+		existing = append(existing, id)
+	}
+	if rows.Err() != nil {
+		return nil, customerror.NewError("uploadRepo.GetExistingUploads", r.Host+":"+r.Port, rows.Err().Error())
+	}
+	return existing, nil
+}
@@ -69,6 +69,11 @@ func (userRepo *UserRepository) CreateTables(ctx context.Context) error {
 	if err != nil {
 		return customerror.NewError("userRepo.CreateTables", userRepo.Host+":"+userRepo.Port, err.Error())
 	}
+	alterQuery := `ALTER TABLE users ADD COLUMN IF NOT EXISTS avatar_variants JSONB NOT NULL DEFAULT '{}'`
+	_, err = userRepo.Pool.Exec(ctx, alterQuery)
+	if err != nil {
+		return customerror.NewError("userRepo.CreateTables", userRepo.Host+":"+userRepo.Port, err.Error())
+	}
 	createIndexQuery := `CREATE INDEX IF NOT EXISTS user_id_idx ON users(id);`
 	_, err = userRepo.Pool.Exec(ctx, createIndexQuery)
 	if err != nil {
@@ -78,7 +83,7 @@ func (userRepo *UserRepository) CreateTables(ctx context.Context) error {
 }
 func (userRepo *UserRepository) GetUser(ctx context.Context, id uuid.UUID) (*user.User, error) {
 	var user user.User
-	query := `SELECT id, email, telegram_id, firstname, lastname, avatar_url, birthdate, status, education_place, education_level, about,jwt_version, avatar_file_name, is_superuser, amount, otp, otp_created_at, reset_hash, reset_hash_created_at, is_active, reset_hash_attempts, otp_attempts FROM users WHERE id=$1`
+	query := `SELECT id, email, telegram_id, firstname, lastname, avatar_url, birthdate, status, education_place, education_level, about,jwt_version, avatar_file_name, is_superuser, amount, otp, otp_created_at, reset_hash, reset_hash_created_at, is_active, reset_hash_attempts, otp_attempts, avatar_variants FROM users WHERE id=$1`
 	err := userRepo.Pool.QueryRow(ctx, query, id).Scan(
 		&user.UUID,
 		&user.Email,
@@ -102,6 +107,7 @@ func (userRepo *UserRepository) GetUser(ctx context.Context, id uuid.UUID) (*use
 		&user.IsActive,
 		&user.ResetHashAttempts,
 		&user.OTPAttempts,
+		&user.AvatarVariants,
 	)
 	if err != nil {
 		if errors.Is(err, pgx.ErrNoRows) {
@@ -118,7 +124,7 @@ field подставлять только вручную, не давать по
 */
 func (userRepo *UserRepository) GetUserByCredentials(ctx context.Context, field string, value any) (*user.User, error) {
 	var user user.User
-	query := fmt.Sprintf(`SELECT id, email, telegram_id, firstname, lastname, avatar_url, birthdate, status, education_place, education_level, about, jwt_version, avatar_file_name, is_superuser, amount, otp, otp_created_at, reset_hash, reset_hash_created_at, is_active, reset_hash_attempts, otp_attempts, password_hash FROM users WHERE %s`, field) + `=$1`
+	query := fmt.Sprintf(`SELECT id, email, telegram_id, firstname, lastname, avatar_url, birthdate, status, education_place, education_level, about, jwt_version, avatar_file_name, is_superuser, amount, otp, otp_created_at, reset_hash, reset_hash_created_at, is_active, reset_hash_attempts, otp_attempts, password_hash, avatar_variants FROM users WHERE %s`, field) + `=$1`
 	err := userRepo.Pool.QueryRow(ctx, query, value).Scan(
 		&user.UUID,
 		&user.Email,
@@ -143,6 +149,7 @@ func (userRepo *UserRepository) GetUserByCredentials(ctx context.Context, field
 		&user.ResetHashAttempts,
 		&user.OTPAttempts,
 		&user.PasswordHash,
+		&user.AvatarVariants,
 	)
 	if err != nil {
 		if errors.Is(err, pgx.ErrNoRows) {
@@ -186,7 +193,8 @@ func (userRepo *UserRepository) UpdateUser(ctx context.Context, user *user.User)
 		reset_hash_created_at=$14,
 		is_active=$15,
 		otp_attempts=$16,
-		reset_hash_attempts=$17
+		reset_hash_attempts=$17,
+		avatar_variants=COALESCE($19, '{}'::jsonb)
 		WHERE id=$18`
 	command, err := userRepo.Pool.Exec(ctx, query,
 		user.Firstname,
@@ -207,6 +215,7 @@ func (userRepo *UserRepository) UpdateUser(ctx context.Context, user *user.User)
 		user.OTPAttempts,
 		user.ResetHashAttempts,
 		user.UUID,
+		user.AvatarVariants,
 	)
 	fmt.Print(err)
 	if command.RowsAffected() == 0 {
@@ -2,197 +2,674 @@ package service
 
 import (
 	"context"
-	"database/sql"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"mymate/internal/repository"
 	chatmessages "mymate/pkg/chat_messages"
 	"mymate/pkg/customerror"
+	"mymate/pkg/flat"
+	"mymate/pkg/mailer"
+	"mymate/pkg/messagebus"
+	"mymate/pkg/notification"
 	"mymate/pkg/user"
 	"net/http"
+	"slices"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
+	"unicode"
 
 	"github.com/gin-gonic/gin"
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
+	"github.com/jackc/pgx/v5"
 )
 
 type ChatServiceI interface {
-	Connect(ctx *gin.Context, user *user.User, authErr error) error
-	ServeWebSocket(connection *websocket.Conn)
+	CreateTicket(user *user.User, tokenExpiresAt time.Time) (string, time.Time, error)
+	ConsumeTicket(ticket string) (*user.User, time.Time, error)
+	Connect(ctx *gin.Context, user *user.User, tokenExpiresAt time.Time) error
+	ConnectWithFirstFrame(ctx *gin.Context) error
 	SendToUser(message *chatmessages.ChatMessage)
 	GetChats(user *user.User) ([]repository.ChatWithUser, error)
 	GetMessages(whatUser uuid.UUID, withUser uuid.UUID, fromMessage int64, offset int64, limit int64) ([]chatmessages.ChatMessage, error)
-	KeepAlive()
+	EditMessage(user *user.User, messageId int64, text string) (*chatmessages.ChatMessage, error)
+	DeleteMessage(user *user.User, messageId int64, forEveryone bool) error
+	CreateConversation(user *user.User, title string, flatId int64, memberIds []uuid.UUID) (*chatmessages.Conversation, error)
+	GetConversations(user *user.User) ([]chatmessages.Conversation, error)
+	GetConversation(user *user.User, conversationId int64) (*chatmessages.Conversation, error)
+	GetConversationMessages(user *user.User, conversationId int64, fromMessage int64, offset int64, limit int64) ([]chatmessages.ChatMessage, error)
+	InviteMembers(user *user.User, conversationId int64, memberIds []uuid.UUID) (*chatmessages.Conversation, error)
+	LeaveConversation(user *user.User, conversationId int64) error
+	KickMember(user *user.User, conversationId int64, memberId uuid.UUID) error
+	SetMemberRole(user *user.User, conversationId int64, memberId uuid.UUID, role string) (*chatmessages.Conversation, error)
+	NotifyUnread()
+	RevalidateConnections()
+	SearchMessages(user *user.User, query string, withUser uuid.UUID, conversationId int64, offset int64, limit int64) ([]chatmessages.MessageSearchResult, error)
+	ExportMessages(user *user.User, withUser uuid.UUID, format string, writer io.Writer) error
+}
+
+// Канал шины, через который узлы пересылают друг другу кадры для локальных websocket-соединений
+const ChatChannel = "chat"
+
+// Сообщение можно отредактировать только в течение этого времени после отправки
+const MessageEditWindow = 15 * time.Minute
+
+// Время жизни одноразового тикета для подключения к websocket
+const websocketTicketTTL = 30 * time.Second
+
+// Сколько ждем первый кадр с токеном, если клиент подключился без тикета
+const firstFrameAuthTimeout = 10 * time.Second
+
+// Сколько сообщений до и после найденного возвращается в результатах поиска
+const searchContextSize = 2
+
+// Размер пачки сообщений, читаемых из базы при выгрузке переписки
+const exportBatchSize = 500
+
+const (
+	ExportFormatJSON = "json"
+	ExportFormatText = "txt"
+)
+
+// Размер пачки сообщений в одном кадре синхронизации
+const syncBatchSize = 100
+
+const (
+	EventMessageEdited  = "message_edited"
+	EventMessageDeleted = "message_deleted"
+	EventSync           = "sync"
+	EventNotification   = "notification"
+)
+
+// Типы входящих кадров. Пустой тип означает отправку сообщения.
+const (
+	WebsocketTypeMessage = "message"
+	WebsocketTypeSync    = "sync"
+	WebsocketTypeRead    = "read"
+	WebsocketTypeAuth    = "auth"
+)
+
+// WebsocketEvent - служебный кадр от сервера: изменения уже отправленных сообщений и синхронизация после переподключения.
+// Новые сообщения по-прежнему отправляются как chatmessages.ChatMessage без обертки.
+// Синхронизация идет пачками: при has_more клиент повторяет sync с полученным last_message_id.
+type WebsocketEvent struct {
+	Event         string                     `json:"event"`
+	Message       *chatmessages.ChatMessage  `json:"message,omitempty"`
+	Messages      []chatmessages.ChatMessage `json:"messages,omitempty"`
+	HasMore       bool                       `json:"has_more,omitempty"`
+	LastMessageId int64                      `json:"last_message_id,omitempty"`
+	Conversation  *chatmessages.Conversation `json:"conversation,omitempty"`
+	Notification  *notification.Notification `json:"notification,omitempty"`
 }
 
 type ChatService struct {
-	Connections sync.Map
-	ChatRepo    repository.ChatRepositoryI
-	UserRepo    repository.UserRepositoryI
-	Upgrader    websocket.Upgrader
-	Host        string
-	Port        string
-}
-
-func NewChatService(chatRepo repository.ChatRepositoryI, userRepo repository.UserRepositoryI, host string, port string) ChatServiceI {
-	return &ChatService{
-		Connections: sync.Map{},
-		ChatRepo:    chatRepo,
-		UserRepo:    userRepo,
+	Connections      sync.Map
+	ChatRepo         repository.ChatRepositoryI
+	UserRepo         repository.UserRepositoryI
+	FlatRepo         repository.FlatRepositoryI
+	ModerationRepo   repository.ModerationRepositoryI
+	ConversationRepo repository.ConversationRepositoryI
+	Guard            *chatGuard
+	JWTService       JWTServiceI
+	Bus              messagebus.MessageBusI
+	Notifications    NotificationServiceI
+	Mailer           *mailer.Mailer
+	Upgrader         websocket.Upgrader
+	Host             string
+	Port             string
+	// Через сколько непрочитанное сообщение попадает в письмо-напоминание
+	UnreadEmailDelay time.Duration
+}
+
+func NewChatService(chatRepo repository.ChatRepositoryI, userRepo repository.UserRepositoryI, flatRepo repository.FlatRepositoryI, moderationRepo repository.ModerationRepositoryI, conversationRepo repository.ConversationRepositoryI, jwtService JWTServiceI, bus messagebus.MessageBusI, notificationService NotificationServiceI, mailer *mailer.Mailer, unreadEmailDelay time.Duration, allowedOrigins []string, host string, port string) ChatServiceI {
+	chatService := &ChatService{
+		Connections:      sync.Map{},
+		ChatRepo:         chatRepo,
+		UserRepo:         userRepo,
+		FlatRepo:         flatRepo,
+		ModerationRepo:   moderationRepo,
+		ConversationRepo: conversationRepo,
+		Guard:            newChatGuard(),
+		JWTService:       jwtService,
+		Bus:              bus,
+		Notifications:    notificationService,
+		Mailer:           mailer,
+		UnreadEmailDelay: unreadEmailDelay,
 		Upgrader: websocket.Upgrader{
-			CheckOrigin: func(r *http.Request) bool {
-				return true
-			},
+			CheckOrigin: checkOrigin(allowedOrigins),
 		},
 		Host: host,
 		Port: port,
 	}
+	bus.Subscribe(ChatChannel, chatService.deliver)
+	return chatService
+}
+
+// checkOrigin пропускает только браузеры с разрешенным Origin. Запросы без Origin (мобильные клиенты) разрешены.
+// Если список пуст, используется проверка gorilla/websocket по умолчанию: Origin должен совпадать с Host.
+func checkOrigin(allowedOrigins []string) func(r *http.Request) bool {
+	if len(allowedOrigins) == 0 {
+		return nil
+	}
+	return func(r *http.Request) bool {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			return true
+		}
+		for _, allowedOrigin := range allowedOrigins {
+			if strings.EqualFold(origin, allowedOrigin) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// CreateTicket выдает тикет для подключения к websocket. tokenExpiresAt - срок токена, которым тикет получен,
+// после него соединение закрывается.
+func (s *ChatService) CreateTicket(user *user.User, tokenExpiresAt time.Time) (string, time.Time, error) {
+	buffer := make([]byte, 32)
+	_, err := rand.Read(buffer)
+	if err != nil {
+		return "", time.Time{}, customerror.NewError("ChatService.CreateTicket", s.Host+":"+s.Port, err.Error())
+	}
+	ticket := hex.EncodeToString(buffer)
+	expiresAt := time.Now().Add(websocketTicketTTL)
+	ctx, close := context.WithTimeout(context.Background(), time.Minute)
+	defer close()
+	err = s.ChatRepo.CreateTicket(ctx, ticket, user.UUID, user.JWTVersion, tokenExpiresAt, expiresAt)
+	if err != nil {
+		err := err.(customerror.CustomError)
+		err.AppendModule("ChatService.CreateTicket")
+		return "", time.Time{}, err
+	}
+	return ticket, expiresAt, nil
+}
+
+// ConsumeTicket погашает тикет и возвращает его владельца и срок токена, по которому тикет выдан. Повторное использование,
+// истекший тикет или смена jwt_version после выдачи тикета дают customerror.ErrJwtInvalid.
+func (s *ChatService) ConsumeTicket(ticket string) (*user.User, time.Time, error) {
+	ctx, close := context.WithTimeout(context.Background(), time.Minute)
+	defer close()
+	userId, jwtVersion, tokenExpiresAt, err := s.ChatRepo.ConsumeTicket(ctx, ticket)
+	if err == pgx.ErrNoRows {
+		return nil, time.Time{}, customerror.ErrJwtInvalid
+	}
+	if err != nil {
+		err := err.(customerror.CustomError)
+		err.AppendModule("ChatService.ConsumeTicket")
+		return nil, time.Time{}, err
+	}
+	user, err := s.UserRepo.GetUser(ctx, userId)
+	if err == pgx.ErrNoRows {
+		return nil, time.Time{}, customerror.ErrJwtInvalid
+	}
+	if err != nil {
+		err := err.(customerror.CustomError)
+		err.AppendModule("ChatService.ConsumeTicket")
+		return nil, time.Time{}, err
+	}
+	if user.JWTVersion != jwtVersion {
+		return nil, time.Time{}, customerror.ErrJwtVersionIncorrect
+	}
+	return user, tokenExpiresAt, nil
 }
 
-func (s *ChatService) Connect(ctx *gin.Context, user *user.User, authErr error) error {
+// Connect открывает websocket для уже аутентифицированного пользователя. Соединение закрывается после tokenExpiresAt.
+func (s *ChatService) Connect(ctx *gin.Context, user *user.User, tokenExpiresAt time.Time) error {
 	connection, err := s.Upgrader.Upgrade(ctx.Writer, ctx.Request, nil)
 	if err != nil {
 		return customerror.NewError("chatService.Connect", s.Host+":"+s.Port, err.Error())
 	}
-	if authErr == jwt.ErrTokenExpired {
+	s.register(ctx, connection, user, tokenExpiresAt)
+	return nil
+}
+
+// ConnectWithFirstFrame открывает websocket и ждет первым кадром {"type":"auth","token":"..."}.
+// До успешной проверки токена соединение не регистрируется и не получает сообщений.
+func (s *ChatService) ConnectWithFirstFrame(ctx *gin.Context) error {
+	connection, err := s.Upgrader.Upgrade(ctx.Writer, ctx.Request, nil)
+	if err != nil {
+		return customerror.NewError("chatService.ConnectWithFirstFrame", s.Host+":"+s.Port, err.Error())
+	}
+	var message WebsocketMessage
+	connection.SetReadLimit(maxFrameSize)
+	connection.SetReadDeadline(time.Now().Add(firstFrameAuthTimeout))
+	err = connection.ReadJSON(&message)
+	if err != nil || message.Type != WebsocketTypeAuth {
+		connection.Close()
+		return customerror.NewError("chatService.ConnectWithFirstFrame", s.Host+":"+s.Port, "auth frame expected")
+	}
+	connection.SetReadDeadline(time.Time{})
+	user, authErr := s.JWTService.ValidateToken(message.Token)
+	var tokenExpiresAt time.Time
+	if authErr == nil {
+		tokenExpiresAt, authErr = s.JWTService.TokenExpiresAt(message.Token)
+	}
+	if authErr != nil {
+		errorMessage := "token invalid"
+		if errors.Is(authErr, jwt.ErrTokenExpired) {
+			errorMessage = "token expired"
+		}
+		connection.SetWriteDeadline(time.Now().Add(writeWait))
 		connection.WriteJSON(gin.H{
 			"status": http.StatusUnauthorized,
 			"body":   gin.H{},
-			"error":  "token expired",
+			"error":  errorMessage,
 		})
-	}
-	if authErr != nil {
 		connection.Close()
-		return customerror.NewError("chatService.Connect", s.Host+":"+s.Port, authErr.Error())
+		return customerror.NewError("chatService.ConnectWithFirstFrame", s.Host+":"+s.Port, authErr.Error())
 	}
-	s.Connections.Store(connection, user)
-	go s.ServeWebSocket(connection)
+	s.register(ctx, connection, user, tokenExpiresAt)
 	return nil
 }
 
+func (s *ChatService) register(ctx *gin.Context, connection *websocket.Conn, user *user.User, tokenExpiresAt time.Time) {
+	client := newWsClient(connection, user, tokenExpiresAt)
+	s.Connections.Store(client, user)
+	go client.writePump()
+	lastMessageId, err := strconv.ParseInt(ctx.Query("last_message_id"), 10, 64)
+	if err == nil {
+		s.syncMessages(client, lastMessageId)
+	}
+	go s.readPump(client)
+}
+
+// RevalidateConnections закрывает соединения, токен которых истек, и соединения пользователей,
+// у которых сменилась jwt_version (смена пароля или почты) или которые были удалены.
+func (s *ChatService) RevalidateConnections() {
+	ctx, close := context.WithTimeout(context.Background(), time.Minute)
+	defer close()
+	s.Connections.Range(func(key, value any) bool {
+		client := key.(*wsClient)
+		connectedUser := value.(*user.User)
+		if time.Now().After(client.tokenExpiresAt) {
+			client.enqueueJSON(gin.H{
+				"status": http.StatusUnauthorized,
+				"body":   gin.H{},
+				"error":  "token expired",
+			})
+			client.close()
+			s.Connections.Delete(client)
+			return true
+		}
+		actualUser, err := s.UserRepo.GetUser(ctx, connectedUser.UUID)
+		if err != nil && err != pgx.ErrNoRows {
+			log.Println(err.Error())
+			return true
+		}
+		if err == pgx.ErrNoRows || actualUser.JWTVersion != connectedUser.JWTVersion {
+			client.enqueueJSON(gin.H{
+				"status": http.StatusUnauthorized,
+				"body":   gin.H{},
+				"error":  "token invalid",
+			})
+			client.close()
+			s.Connections.Delete(client)
+		}
+		return true
+	})
+}
+
 type WebsocketMessage struct {
-	Receiver string `json:"receiver_id"`
-	Message  string `json:"message"`
+	Type          string `json:"type"`
+	Receiver      string `json:"receiver_id"`
+	Message       string `json:"message"`
+	Kind          string `json:"kind"`
+	FlatId        int64  `json:"flat_id"`
+	LastMessageId int64  `json:"last_message_id"`
+	UserId        string `json:"user_id"`
+	Token         string `json:"token"`
+	// Если указан, сообщение отправляется в групповую беседу, а receiver_id игнорируется
+	ConversationId int64 `json:"conversation_id"`
 }
 
-func (s *ChatService) ServeWebSocket(connection *websocket.Conn) {
+// readPump читает входящие кадры клиента. Запись в соединение выполняет только writePump.
+func (s *ChatService) readPump(client *wsClient) {
 	defer func() {
 		if r := recover(); r != nil {
-			log.Printf("recovered from panic in ServeWebSocket: %v", r)
+			log.Printf("recovered from panic in readPump: %v", r)
 		}
-		connection.Close()
-		s.Connections.Delete(connection)
+		client.close()
+		s.Connections.Delete(client)
 	}()
+	client.prepareRead()
+	sender := client.user
 	for {
 		var message WebsocketMessage
-		err := connection.ReadJSON(&message)
+		err := client.conn.ReadJSON(&message)
 		if err != nil {
-			fmt.Println(err)
-			connection.Close()
-			s.Connections.Delete(connection)
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				log.Println(err.Error())
+			}
 			return
 		}
-		receiverUUID, err := uuid.Parse(message.Receiver)
-		if err != nil {
-			fmt.Println(err)
-			connection.Close()
-			s.Connections.Delete(connection)
-			return
+		if message.Type == WebsocketTypeSync {
+			s.syncMessages(client, message.LastMessageId)
+			continue
 		}
-		senderInteface, ok := s.Connections.Load(connection)
-		if !ok {
-			fmt.Println("sender not found")
-			connection.Close()
-			s.Connections.Delete(connection)
-			return
+		if message.Type == WebsocketTypeRead {
+			peerUUID, err := uuid.Parse(message.UserId)
+			if err != nil {
+				continue
+			}
+			err = s.ChatRepo.MarkRead(context.Background(), sender.UUID, peerUUID, message.LastMessageId)
+			if err != nil {
+				log.Println(err.Error())
+			}
+			continue
+		}
+		if !s.guardSend(client) {
+			continue
+		}
+		chatMessage := chatmessages.ChatMessage{
+			SenderId: sender.UUID,
+			Message:  message.Message,
+			Kind:     chatmessages.KindText,
+		}
+		// Первое сообщение в новом личном диалоге
+		newChat := false
+		if message.ConversationId != 0 {
+			err = s.checkGroupMember(context.Background(), message.ConversationId, sender.UUID)
+			if err != nil {
+				if err != pgx.ErrNoRows {
+					log.Println(err.Error())
+				}
+				client.enqueueJSON(gin.H{
+					"status": http.StatusNotFound,
+					"body":   gin.H{},
+					"error":  "conversation not found",
+				})
+				continue
+			}
+			chatMessage.ConversationId = message.ConversationId
+		} else {
+			receiverUUID, err := uuid.Parse(message.Receiver)
+			if err != nil {
+				log.Println(err.Error())
+				return
+			}
+			blocked, err := s.ModerationRepo.IsBlocked(context.Background(), sender.UUID, receiverUUID)
+			if err != nil {
+				log.Println(err.Error())
+				continue
+			}
+			if blocked {
+				client.enqueueJSON(gin.H{
+					"status": http.StatusForbidden,
+					"body":   gin.H{},
+					"error":  "user blocked",
+				})
+				continue
+			}
+			chatMessage.ReceiverId = receiverUUID
+			// Беседа создается только вместе с первым сообщением, поэтому отклоненное антиспамом сообщение ее не оставляет
+			conversationId, err := s.ConversationRepo.FindDirect(context.Background(), sender.UUID, receiverUUID)
+			if err != nil && err != pgx.ErrNoRows {
+				log.Println(err.Error())
+				continue
+			}
+			if err == pgx.ErrNoRows && !s.checkSpam(client, receiverUUID, &message) {
+				continue
+			}
+			chatMessage.ConversationId = conversationId
+		}
+		if message.Kind == chatmessages.KindFlat {
+			card := s.flatCard(context.Background(), message.FlatId)
+			if card.Status != chatmessages.FlatStatusActive {
+				client.enqueueJSON(gin.H{
+					"status": http.StatusNotFound,
+					"body":   gin.H{},
+					"error":  "flat not found",
+				})
+				continue
+			}
+			chatMessage.Kind = chatmessages.KindFlat
+			chatMessage.FlatId = message.FlatId
+			chatMessage.Flat = card
+		}
+		if chatMessage.ReceiverId != uuid.Nil {
+			newChat, err = s.ChatRepo.AddDirectMessage(context.Background(), &chatMessage)
+		} else {
+			_, err = s.ChatRepo.AddMessage(context.Background(), &chatMessage)
 		}
-		sender := senderInteface.(*user.User)
-		messageId, err := s.ChatRepo.AddMessage(context.Background(), sender.UUID, receiverUUID, message.Message)
 		if err != nil {
-			fmt.Println(err)
-			connection.Close()
-			s.Connections.Delete(connection)
+			log.Println(err.Error())
 			return
 		}
-		fmt.Println(&chatmessages.ChatMessage{
-			Id:         messageId,
-			SenderId:   sender.UUID,
-			ReceiverId: receiverUUID,
-			Message:    message.Message,
-			CreatedAt: sql.NullTime{
-				Time:  time.Now(),
-				Valid: true,
-			},
-		})
-		s.SendToUser(&chatmessages.ChatMessage{
-			Id:         messageId,
-			SenderId:   sender.UUID,
-			ReceiverId: receiverUUID,
-			Message:    message.Message,
-			CreatedAt: sql.NullTime{
-				Time:  time.Now(),
-				Valid: true,
-			},
-		})
+		s.SendToUser(&chatMessage)
+		if newChat {
+			s.notifyNewChat(sender, &chatMessage)
+			// Диалог, начатый с карточки объявления, засчитывается объявлению
+			if chatMessage.Kind == chatmessages.KindFlat {
+				err = s.FlatRepo.IncrementFlatStat(context.Background(), chatMessage.FlatId, flat.StatChatStarts)
+				if err != nil {
+					log.Println(err.Error())
+				}
+			}
+		}
 	}
 }
-func (s *ChatService) SendToUser(message *chatmessages.ChatMessage) {
-	s.Connections.Range(func(key, value any) bool {
-		connection := key.(*websocket.Conn)
-		valueUser := value.(*user.User)
-		if valueUser.UUID != message.ReceiverId {
-			return false
+
+// notifyNewChat добавляет в центр уведомлений получателя событие о первом сообщении от нового собеседника
+func (s *ChatService) notifyNewChat(sender *user.User, message *chatmessages.ChatMessage) {
+	s.Notifications.Notify(&notification.Notification{
+		Type:   notification.TypeNewChat,
+		UserId: message.ReceiverId,
+		Title:  "Новый собеседник",
+		Body:   strings.TrimSpace(sender.Firstname+" "+sender.Lastname) + " написал(а) вам",
+		Data: map[string]string{
+			"sender_id":       sender.UUID.String(),
+			"message_id":      strconv.FormatInt(message.Id, 10),
+			"conversation_id": strconv.FormatInt(message.ConversationId, 10),
+		},
+		Link: notification.ChatLink(sender.UUID),
+	})
+}
+
+// syncMessages досылает в соединение одну пачку сообщений пользователя новее lastMessageId по всем диалогам.
+// Следующую пачку клиент запрашивает сам, поэтому долгий простой не переполняет очередь отправки.
+func (s *ChatService) syncMessages(client *wsClient, lastMessageId int64) {
+	ctx, close := context.WithTimeout(context.Background(), time.Minute)
+	defer close()
+	messages, err := s.ChatRepo.GetMessagesAfter(ctx, client.user.UUID, lastMessageId, syncBatchSize+1)
+	if err != nil {
+		log.Println(err.Error())
+		return
+	}
+	event := &WebsocketEvent{
+		Event:    EventSync,
+		Messages: messages,
+	}
+	if len(messages) > syncBatchSize {
+		event.Messages = messages[:syncBatchSize]
+		event.HasMore = true
+		event.LastMessageId = event.Messages[syncBatchSize-1].Id
+	}
+	s.attachFlatCards(ctx, event.Messages)
+	client.enqueueJSON(event)
+}
+
+// flatCard собирает снимок объявления для сообщения. Удаленное объявление не считается ошибкой:
+// карточка возвращается со статусом FlatStatusDeleted, чтобы клиент мог показать заглушку.
+func (s *ChatService) flatCard(ctx context.Context, flatId int64) *chatmessages.FlatCard {
+	card := &chatmessages.FlatCard{
+		Id:     flatId,
+		Status: chatmessages.FlatStatusDeleted,
+	}
+	if flatId == 0 {
+		return card
+	}
+	flat, err := s.FlatRepo.GetFlat(ctx, flatId)
+	if err != nil {
+		if err != pgx.ErrNoRows {
+			log.Println(err.Error())
 		}
-		err := connection.WriteJSON(message)
-		if err != nil {
-			connection.Close()
-			s.Connections.Delete(connection)
-			return false
+		return card
+	}
+	card.Name = flat.Name
+	card.PriceFrom = flat.PriceFrom
+	card.PriceTo = flat.PriceTo
+	card.Status = chatmessages.FlatStatusActive
+	images, err := s.FlatRepo.GetFlatImages(ctx, flatId)
+	if err != nil {
+		log.Println(err.Error())
+		return card
+	}
+	if len(images) > 0 {
+		card.ImageUrl = images[0].VariantURL("medium")
+	}
+	return card
+}
+
+func (s *ChatService) attachFlatCards(ctx context.Context, messages []chatmessages.ChatMessage) {
+	cards := map[int64]*chatmessages.FlatCard{}
+	for i := range messages {
+		if messages[i].Kind != chatmessages.KindFlat {
+			continue
 		}
-		return true
+		card, ok := cards[messages[i].FlatId]
+		if !ok {
+			card = s.flatCard(ctx, messages[i].FlatId)
+			cards[messages[i].FlatId] = card
+		}
+		messages[i].Flat = card
+	}
+}
+
+// SendToUser доставляет новое сообщение получателю, а в групповой беседе - всем участникам, кроме отправителя
+func (s *ChatService) SendToUser(message *chatmessages.ChatMessage) {
+	recipients := s.newMessageRecipients(message)
+	s.sendToUsers(message, recipients...)
+	s.pushMessage(message, recipients)
+}
+
+func (s *ChatService) newMessageRecipients(message *chatmessages.ChatMessage) []uuid.UUID {
+	if message.ReceiverId != uuid.Nil {
+		return []uuid.UUID{message.ReceiverId}
+	}
+	ctx, close := context.WithTimeout(context.Background(), 10*time.Second)
+	defer close()
+	memberIds, err := s.ConversationRepo.GetMemberIds(ctx, message.ConversationId)
+	if err != nil {
+		log.Println(err.Error())
+		return nil
+	}
+	return slices.DeleteFunc(memberIds, func(memberId uuid.UUID) bool {
+		return memberId == message.SenderId
 	})
 }
 
-func (s *ChatService) KeepAlive() {
-	var deadCandidates sync.Map
-	for {
-		deadCandidates.Range(func(key, value any) bool {
-			if _, ok := s.Connections.Load(key); ok {
-				deadCandidates.Delete(key)
-				return false
-			}
-			retries := value.(int)
-			if retries > 10 {
-				key := key.(*websocket.Conn)
-				key.Close()
-				s.Connections.Delete(key)
-				deadCandidates.Delete(key)
-				return false
-			}
-			deadCandidates.Store(key, retries+1)
-			return true
-		})
-		s.Connections.Range(func(key, value any) bool {
-			connection := key.(*websocket.Conn)
-			err := connection.WriteMessage(websocket.PingMessage, nil)
-			if err != nil {
-				if _, ok := deadCandidates.Load(key); !ok {
-					deadCandidates.Store(key, 1)
-				}
-				return false
-			}
-			if _, ok := deadCandidates.Load(key); ok {
-				deadCandidates.Delete(key)
-			}
-			return true
+// Максимальная длина текста сообщения в push-уведомлении
+const pushPreviewLength = 200
+
+// pushMessage отправляет push-уведомления получателям без открытого websocket на этом узле.
+// Соединения на других репликах здесь не видны, поэтому клиент сам скрывает push, пока открыт чат.
+func (s *ChatService) pushMessage(message *chatmessages.ChatMessage, recipients []uuid.UUID) {
+	offline := slices.DeleteFunc(slices.Clone(recipients), s.isConnected)
+	if len(offline) == 0 {
+		return
+	}
+	ctx, close := context.WithTimeout(context.Background(), 10*time.Second)
+	defer close()
+	title := "Новое сообщение"
+	sender, err := s.UserRepo.GetUser(ctx, message.SenderId)
+	if err == nil {
+		title = strings.TrimSpace(sender.Firstname + " " + sender.Lastname)
+	}
+	body := message.Message
+	if message.Kind == chatmessages.KindFlat && message.Flat != nil {
+		body = "Объявление: " + message.Flat.Name
+	}
+	if preview := []rune(body); len(preview) > pushPreviewLength {
+		body = string(preview[:pushPreviewLength]) + "…"
+	}
+	data := map[string]string{
+		"message_id":      strconv.FormatInt(message.Id, 10),
+		"sender_id":       message.SenderId.String(),
+		"conversation_id": strconv.FormatInt(message.ConversationId, 10),
+	}
+	link := notification.ChatLink(message.SenderId)
+	if message.ReceiverId == uuid.Nil {
+		link = notification.ConversationLink(message.ConversationId)
+	}
+	for _, userId := range offline {
+		s.Notifications.Notify(&notification.Notification{
+			Type:   notification.TypeChatMessage,
+			UserId: userId,
+			Title:  title,
+			Body:   body,
+			Data:   data,
+			Link:   link,
 		})
-		time.Sleep(10 * time.Second)
 	}
 }
 
+// isConnected сообщает, есть ли у пользователя websocket-соединение с этим узлом
+func (s *ChatService) isConnected(userId uuid.UUID) bool {
+	connected := false
+	s.Connections.Range(func(key, value any) bool {
+		connected = value.(*user.User).UUID == userId
+		return !connected
+	})
+	return connected
+}
+
+type busDelivery struct {
+	UserIds []uuid.UUID     `json:"user_ids"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+// sendToUsers публикует кадр в шину, каждый узел доставляет его своим соединениям в deliver.
+func (s *ChatService) sendToUsers(payload any, userIds ...uuid.UUID) {
+	err := publishToUsers(s.Bus, payload, userIds...)
+	if err != nil {
+		customErr := err.(customerror.CustomError)
+		customErr.AppendModule("ChatService.sendToUsers")
+		log.Println(customErr.Error())
+	}
+}
+
+// publishToUsers публикует кадр для websocket-соединений пользователей в канал чата.
+// Через него в чат пишут и другие сервисы, которым нужна доставка в реальном времени.
+func publishToUsers(bus messagebus.MessageBusI, payload any, userIds ...uuid.UUID) error {
+	encodedPayload, err := json.Marshal(payload)
+	if err != nil {
+		return customerror.NewError("publishToUsers", ChatChannel, err.Error())
+	}
+	delivery, err := json.Marshal(busDelivery{UserIds: userIds, Payload: encodedPayload})
+	if err != nil {
+		return customerror.NewError("publishToUsers", ChatChannel, err.Error())
+	}
+	ctx, close := context.WithTimeout(context.Background(), 10*time.Second)
+	defer close()
+	return bus.Publish(ctx, ChatChannel, delivery)
+}
+
+func (s *ChatService) deliver(payload []byte) {
+	var delivery busDelivery
+	if err := json.Unmarshal(payload, &delivery); err != nil {
+		log.Println(customerror.NewError("ChatService.deliver", s.Host+":"+s.Port, err.Error()).Error())
+		return
+	}
+	s.Connections.Range(func(key, value any) bool {
+		client := key.(*wsClient)
+		valueUser := value.(*user.User)
+		if slices.Contains(delivery.UserIds, valueUser.UUID) && !client.enqueue(delivery.Payload) {
+			s.Connections.Delete(client)
+		}
+		return true
+	})
+}
+
 func (s *ChatService) GetChats(user *user.User) ([]repository.ChatWithUser, error) {
 	chats, err := s.ChatRepo.GetChats(context.Background(), user)
 	if err != nil {
@@ -200,6 +677,11 @@ func (s *ChatService) GetChats(user *user.User) ([]repository.ChatWithUser, erro
 		err.AppendModule("ChatService.GetChats")
 		return nil, err
 	}
+	for i := range chats {
+		if chats[i].Chat.Kind == chatmessages.KindFlat {
+			chats[i].Chat.Flat = s.flatCard(context.Background(), chats[i].Chat.FlatId)
+		}
+	}
 	return chats, nil
 }
 
@@ -212,5 +694,295 @@ func (s *ChatService) GetMessages(whatUser uuid.UUID, withUser uuid.UUID, fromMe
 		err.AppendModule("ChatService.GetMessages")
 		return nil, err
 	}
+	s.attachFlatCards(ctx, messages)
+	for _, message := range messages {
+		if message.ReceiverId == whatUser {
+			err = s.ChatRepo.MarkRead(ctx, whatUser, withUser, message.Id)
+			if err != nil {
+				log.Println(err.Error())
+			}
+			break
+		}
+	}
 	return messages, nil
 }
+
+func (s *ChatService) EditMessage(user *user.User, messageId int64, text string) (*chatmessages.ChatMessage, error) {
+	ctx, close := context.WithTimeout(context.Background(), time.Minute)
+	defer close()
+	message, err := s.ChatRepo.GetMessage(ctx, messageId)
+	if err == pgx.ErrNoRows {
+		return nil, err
+	}
+	if err != nil {
+		err := err.(customerror.CustomError)
+		err.AppendModule("ChatService.EditMessage")
+		return nil, err
+	}
+	if message.SenderId != user.UUID {
+		return nil, customerror.ErrForbidden
+	}
+	if message.DeletedAt.Valid || message.CreatedAt.Time.Add(MessageEditWindow).Before(time.Now()) {
+		return nil, customerror.ErrMessageNotEditable
+	}
+	message, err = s.ChatRepo.EditMessage(ctx, messageId, user.UUID, text)
+	if err == pgx.ErrNoRows {
+		return nil, customerror.ErrMessageNotEditable
+	}
+	if err != nil {
+		err := err.(customerror.CustomError)
+		err.AppendModule("ChatService.EditMessage")
+		return nil, err
+	}
+	if message.Kind == chatmessages.KindFlat {
+		message.Flat = s.flatCard(ctx, message.FlatId)
+	}
+	recipients, err := s.messageRecipients(ctx, message)
+	if err != nil {
+		return nil, err
+	}
+	s.sendToUsers(&WebsocketEvent{Event: EventMessageEdited, Message: message}, recipients...)
+	return message, nil
+}
+
+func (s *ChatService) DeleteMessage(user *user.User, messageId int64, forEveryone bool) error {
+	ctx, close := context.WithTimeout(context.Background(), time.Minute)
+	defer close()
+	message, err := s.ChatRepo.GetMessage(ctx, messageId)
+	if err == pgx.ErrNoRows {
+		return err
+	}
+	if err != nil {
+		err := err.(customerror.CustomError)
+		err.AppendModule("ChatService.DeleteMessage")
+		return err
+	}
+	// Скрыть у себя может и тот, кто уже покинул беседу: участие проверяется на момент отправки
+	if !forEveryone {
+		err = s.ChatRepo.HideMessage(ctx, messageId, user.UUID)
+		if err == pgx.ErrNoRows {
+			return err
+		}
+		if err != nil {
+			err := err.(customerror.CustomError)
+			err.AppendModule("ChatService.DeleteMessage")
+			return err
+		}
+		s.sendToUsers(&WebsocketEvent{Event: EventMessageDeleted, Message: message}, user.UUID)
+		return nil
+	}
+	recipients, err := s.messageRecipients(ctx, message)
+	if err != nil {
+		return err
+	}
+	if message.SenderId != user.UUID && !slices.Contains(recipients, user.UUID) {
+		return pgx.ErrNoRows
+	}
+	if message.SenderId != user.UUID {
+		return customerror.ErrForbidden
+	}
+	message, err = s.ChatRepo.DeleteMessage(ctx, messageId, user.UUID)
+	if err == pgx.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		err := err.(customerror.CustomError)
+		err.AppendModule("ChatService.DeleteMessage")
+		return err
+	}
+	s.sendToUsers(&WebsocketEvent{Event: EventMessageDeleted, Message: message}, recipients...)
+	return nil
+}
+
+// NotifyUnread отправляет каждому получателю одно письмо по сообщениям, которые остаются непрочитанными дольше UnreadEmailDelay.
+// Сообщения старше суток не рассылаются, чтобы после простоя не отправлять письма о давно неактуальной переписке.
+func (s *ChatService) NotifyUnread() {
+	ctx, close := context.WithTimeout(context.Background(), time.Minute)
+	defer close()
+	createdBefore := time.Now().Add(-s.UnreadEmailDelay)
+	messages, err := s.ChatRepo.ClaimUnreadForEmail(ctx, createdBefore.Add(-24*time.Hour), createdBefore)
+	if err != nil {
+		err := err.(customerror.CustomError)
+		err.AppendModule("ChatService.NotifyUnread")
+		log.Println(err.Error())
+		return
+	}
+	senders := map[uuid.UUID]map[uuid.UUID]int{}
+	for _, message := range messages {
+		if senders[message.ReceiverId] == nil {
+			senders[message.ReceiverId] = map[uuid.UUID]int{}
+		}
+		senders[message.ReceiverId][message.SenderId]++
+	}
+	for receiverId, counts := range senders {
+		receiver, err := s.UserRepo.GetUser(ctx, receiverId)
+		if err != nil || receiver.Email == "" || !receiver.IsActive {
+			continue
+		}
+		total := 0
+		body := "Здравствуйте, " + receiver.Firstname + "!\n\nУ вас есть непрочитанные сообщения в MyMate:\n"
+		for senderId, count := range counts {
+			total += count
+			name := "Пользователь"
+			sender, err := s.UserRepo.GetUser(ctx, senderId)
+			if err == nil {
+				name = strings.TrimSpace(sender.Firstname + " " + sender.Lastname)
+			}
+			body += fmt.Sprintf("- %s: %d\n", name, count)
+		}
+		subject := fmt.Sprintf("У вас %d непрочитанных сообщений в MyMate", total)
+		go func(email string, subject string, body string) {
+			if err := s.Mailer.Send(email, subject, body); err != nil {
+				log.Println(err.Error())
+			}
+		}(receiver.Email, subject, body)
+	}
+}
+
+// searchTsQuery превращает строку поиска в tsquery: каждое слово ищется по префиксу, все слова должны встретиться
+func searchTsQuery(query string) string {
+	words := strings.FieldsFunc(strings.ToLower(query), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	if len(words) > 10 {
+		words = words[:10]
+	}
+	for i := range words {
+		words[i] += ":*"
+	}
+	return strings.Join(words, " & ")
+}
+
+// joinDigitRuns убирает пробелы, дефисы, скобки и точки между цифрами, как search_digits_vector в базе:
+// "+7 (999) 123-45-67" превращается в "+79991234567"
+func joinDigitRuns(query string) string {
+	runes := []rune(query)
+	var joined strings.Builder
+	for i := 0; i < len(runes); i++ {
+		joined.WriteRune(runes[i])
+		if !unicode.IsDigit(runes[i]) {
+			continue
+		}
+		j := i + 1
+		for j < len(runes) && (unicode.IsSpace(runes[j]) || strings.ContainsRune("-().", runes[j])) {
+			j++
+		}
+		if j > i+1 && j < len(runes) && unicode.IsDigit(runes[j]) {
+			i = j - 1
+		}
+	}
+	return joined.String()
+}
+
+func (s *ChatService) SearchMessages(user *user.User, query string, withUser uuid.UUID, conversationId int64, offset int64, limit int64) ([]chatmessages.MessageSearchResult, error) {
+	results := []chatmessages.MessageSearchResult{}
+	tsQuery := searchTsQuery(query)
+	if tsQuery == "" {
+		return results, nil
+	}
+	ctx, close := context.WithTimeout(context.Background(), time.Minute)
+	defer close()
+	messages, err := s.ChatRepo.SearchMessages(ctx, user.UUID, tsQuery, searchTsQuery(joinDigitRuns(query)), withUser, conversationId, offset, limit)
+	if err != nil {
+		err := err.(customerror.CustomError)
+		err.AppendModule("ChatService.SearchMessages")
+		return nil, err
+	}
+	s.attachFlatCards(ctx, messages)
+	for _, message := range messages {
+		before, after, err := s.ChatRepo.GetMessageContext(ctx, user.UUID, &message, searchContextSize)
+		if err != nil {
+			err := err.(customerror.CustomError)
+			err.AppendModule("ChatService.SearchMessages")
+			return nil, err
+		}
+		results = append(results, chatmessages.MessageSearchResult{
+			Message: message,
+			Before:  before,
+			After:   after,
+		})
+	}
+	return results, nil
+}
+
+// ExportMessages пишет личную переписку в writer пачками, не загружая ее в память целиком.
+// До начала записи проверяется собеседник, поэтому pgx.ErrNoRows можно вернуть клиенту обычным ответом.
+func (s *ChatService) ExportMessages(user *user.User, withUser uuid.UUID, format string, writer io.Writer) error {
+	ctx, close := context.WithTimeout(context.Background(), 10*time.Minute)
+	defer close()
+	peer, err := s.UserRepo.GetUser(ctx, withUser)
+	if err == pgx.ErrNoRows {
+		return err
+	}
+	if err != nil {
+		err := err.(customerror.CustomError)
+		err.AppendModule("ChatService.ExportMessages")
+		return err
+	}
+	names := map[uuid.UUID]string{
+		user.UUID: strings.TrimSpace(user.Firstname + " " + user.Lastname),
+		peer.UUID: strings.TrimSpace(peer.Firstname + " " + peer.Lastname),
+	}
+	flusher, _ := writer.(http.Flusher)
+	if format == ExportFormatJSON {
+		encodedPeer, err := json.Marshal(chatmessages.ExportPeer{
+			Id:        peer.UUID,
+			Firstname: peer.Firstname,
+			Lastname:  peer.Lastname,
+			AvatarUrl: peer.AvatarUrl,
+		})
+		if err != nil {
+			return customerror.NewError("ChatService.ExportMessages", s.Host+":"+s.Port, err.Error())
+		}
+		fmt.Fprintf(writer, `{"exported_at":%q,"peer":%s,"messages":[`, time.Now().UTC().Format(time.RFC3339), encodedPeer)
+	}
+	first := true
+	var lastMessageId int64
+	for {
+		messages, err := s.ChatRepo.GetMessagesPage(ctx, user.UUID, withUser, lastMessageId, exportBatchSize)
+		if err != nil {
+			err := err.(customerror.CustomError)
+			err.AppendModule("ChatService.ExportMessages")
+			return err
+		}
+		for _, message := range messages {
+			if format == ExportFormatJSON {
+				encodedMessage, err := json.Marshal(message)
+				if err != nil {
+					return customerror.NewError("ChatService.ExportMessages", s.Host+":"+s.Port, err.Error())
+				}
+				if !first {
+					encodedMessage = append([]byte(","), encodedMessage...)
+				}
+				_, err = writer.Write(encodedMessage)
+				if err != nil {
+					return customerror.NewError("ChatService.ExportMessages", s.Host+":"+s.Port, err.Error())
+				}
+				first = false
+				continue
+			}
+			if message.DeletedAt.Valid {
+				continue
+			}
+			text := message.Message
+			if message.Kind == chatmessages.KindFlat {
+				text = fmt.Sprintf("[объявление #%d] %s", message.FlatId, text)
+			}
+			_, err = fmt.Fprintf(writer, "[%s] %s: %s\n", message.CreatedAt.Time.Format("2006-01-02 15:04"), names[message.SenderId], text)
+			if err != nil {
+				return customerror.NewError("ChatService.ExportMessages", s.Host+":"+s.Port, err.Error())
+			}
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		if len(messages) < exportBatchSize {
+			break
+		}
+		lastMessageId = messages[len(messages)-1].Id
+	}
+	if format == ExportFormatJSON {
+		writer.Write([]byte("]}"))
+	}
+	return nil
+}
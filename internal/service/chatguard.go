@@ -0,0 +1,190 @@
+package service
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"log"
+	"math"
+	"mymate/pkg/moderation"
+	"mymate/pkg/ratelimit"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	// В среднем одно сообщение в секунду, подряд можно отправить messageBurst
+	messageRate  = 1.0
+	messageBurst = 10
+	// Столько отказов лимитера подряд считается флудом и приводит к муту
+	floodStrikes = 30
+	// Одинаковый текст, отправленный такому количеству новых собеседников за spamWindow, считается рассылкой
+	spamRecipientsThreshold = 15
+	spamWindow              = 10 * time.Minute
+	muteDuration            = 30 * time.Minute
+)
+
+// chatGuard хранит состояние антиспама в памяти узла. Муты и счетчики пишутся в базу и действуют на всех репликах.
+type chatGuard struct {
+	limiter *ratelimit.Limiter
+	mu      sync.Mutex
+	strikes map[uuid.UUID]int
+	recent  map[uuid.UUID]map[[sha256.Size]byte]*spamEntry
+	// Когда последний раз удалялись устаревшие записи всех отправителей
+	lastSweep time.Time
+}
+
+type spamEntry struct {
+	firstSeen  time.Time
+	recipients map[uuid.UUID]struct{}
+}
+
+func newChatGuard() *chatGuard {
+	return &chatGuard{
+		limiter:   ratelimit.NewLimiter(messageRate, messageBurst),
+		strikes:   map[uuid.UUID]int{},
+		recent:    map[uuid.UUID]map[[sha256.Size]byte]*spamEntry{},
+		lastSweep: time.Now(),
+	}
+}
+
+// allow тратит токен пользователя. flood = true, если пользователь упирается в лимит слишком долго.
+func (g *chatGuard) allow(userId uuid.UUID) (ok bool, retryAfter time.Duration, flood bool) {
+	ok, retryAfter = g.limiter.Allow(userId.String())
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if ok {
+		delete(g.strikes, userId)
+		return true, 0, false
+	}
+	g.strikes[userId]++
+	if g.strikes[userId] >= floodStrikes {
+		delete(g.strikes, userId)
+		return false, retryAfter, true
+	}
+	return false, retryAfter, false
+}
+
+// recordNewRecipient запоминает отправку текста новому собеседнику и сообщает, превышен ли порог рассылки
+func (g *chatGuard) recordNewRecipient(senderId uuid.UUID, receiverId uuid.UUID, text string) bool {
+	key := sha256.Sum256([]byte(strings.Join(strings.Fields(strings.ToLower(text)), " ")))
+	now := time.Now()
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if now.Sub(g.lastSweep) > spamWindow {
+		for userId, entries := range g.recent {
+			for entryKey, entry := range entries {
+				if now.Sub(entry.firstSeen) > spamWindow {
+					delete(entries, entryKey)
+				}
+			}
+			if len(entries) == 0 {
+				delete(g.recent, userId)
+			}
+		}
+		g.lastSweep = now
+	}
+	entries, ok := g.recent[senderId]
+	if !ok {
+		entries = map[[sha256.Size]byte]*spamEntry{}
+		g.recent[senderId] = entries
+	}
+	for entryKey, entry := range entries {
+		if now.Sub(entry.firstSeen) > spamWindow {
+			delete(entries, entryKey)
+		}
+	}
+	entry, ok := entries[key]
+	if !ok {
+		entry = &spamEntry{firstSeen: now, recipients: map[uuid.UUID]struct{}{}}
+		entries[key] = entry
+	}
+	entry.recipients[receiverId] = struct{}{}
+	if len(entry.recipients) >= spamRecipientsThreshold {
+		delete(entries, key)
+		return true
+	}
+	return false
+}
+
+// guardSend проверяет мут и лимит сообщений. При отказе клиент получает кадр с ошибкой и временем повтора.
+// Ошибки базы не блокируют отправку, чтобы сбой антиспама не останавливал чат.
+func (s *ChatService) guardSend(client *wsClient) bool {
+	ctx, close := context.WithTimeout(context.Background(), 10*time.Second)
+	defer close()
+	mutedUntil, err := s.ModerationRepo.GetMute(ctx, client.user.UUID)
+	if err == nil {
+		client.enqueueJSON(mutedFrame(mutedUntil))
+		return false
+	}
+	if err != pgx.ErrNoRows {
+		log.Println(err.Error())
+	}
+	ok, retryAfter, flood := s.Guard.allow(client.user.UUID)
+	if ok {
+		return true
+	}
+	s.countChat(ctx, client.user.UUID, moderation.CounterRateLimited)
+	if flood {
+		s.mute(ctx, client, "flood")
+		return false
+	}
+	client.enqueueJSON(gin.H{
+		"status": http.StatusTooManyRequests,
+		"body": gin.H{
+			"retry_after": int64(math.Ceil(retryAfter.Seconds())),
+		},
+		"error": "too many messages",
+	})
+	return false
+}
+
+// checkSpam вызывается для первого сообщения новому собеседнику
+func (s *ChatService) checkSpam(client *wsClient, receiverId uuid.UUID, message *WebsocketMessage) bool {
+	text := message.Message
+	if message.FlatId != 0 {
+		text = fmt.Sprintf("%s flat:%d", text, message.FlatId)
+	}
+	if !s.Guard.recordNewRecipient(client.user.UUID, receiverId, text) {
+		return true
+	}
+	ctx, close := context.WithTimeout(context.Background(), 10*time.Second)
+	defer close()
+	s.countChat(ctx, client.user.UUID, moderation.CounterSpam)
+	s.mute(ctx, client, "spam")
+	return false
+}
+
+func (s *ChatService) mute(ctx context.Context, client *wsClient, reason string) {
+	mutedUntil := time.Now().Add(muteDuration)
+	err := s.ModerationRepo.MuteUser(ctx, client.user.UUID, mutedUntil, reason)
+	if err != nil {
+		log.Println(err.Error())
+	}
+	s.countChat(ctx, client.user.UUID, moderation.CounterMutes)
+	client.enqueueJSON(mutedFrame(mutedUntil))
+}
+
+func (s *ChatService) countChat(ctx context.Context, userId uuid.UUID, counter string) {
+	err := s.ModerationRepo.IncrementChatCounter(ctx, userId, counter)
+	if err != nil {
+		log.Println(err.Error())
+	}
+}
+
+func mutedFrame(mutedUntil time.Time) gin.H {
+	return gin.H{
+		"status": http.StatusTooManyRequests,
+		"body": gin.H{
+			"muted_until": mutedUntil,
+			"retry_after": int64(math.Ceil(time.Until(mutedUntil).Seconds())),
+		},
+		"error": "muted",
+	}
+}
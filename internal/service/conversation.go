@@ -0,0 +1,347 @@
+package service
+
+import (
+	"context"
+	chatmessages "mymate/pkg/chat_messages"
+	"mymate/pkg/customerror"
+	"mymate/pkg/user"
+	"slices"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+// Максимальное количество участников группового чата
+const MaxConversationMembers = 20
+
+const EventConversationUpdated = "conversation_updated"
+
+func (s *ChatService) CreateConversation(user *user.User, title string, flatId int64, memberIds []uuid.UUID) (*chatmessages.Conversation, error) {
+	ctx, close := context.WithTimeout(context.Background(), time.Minute)
+	defer close()
+	uniqueMemberIds := []uuid.UUID{}
+	seen := map[uuid.UUID]bool{user.UUID: true}
+	for _, memberId := range memberIds {
+		if !seen[memberId] {
+			seen[memberId] = true
+			uniqueMemberIds = append(uniqueMemberIds, memberId)
+		}
+	}
+	memberIds = uniqueMemberIds
+	if len(memberIds)+1 > MaxConversationMembers {
+		return nil, customerror.ErrTooManyMembers
+	}
+	if flatId != 0 {
+		_, err := s.FlatRepo.GetFlat(ctx, flatId)
+		if err == pgx.ErrNoRows {
+			return nil, err
+		}
+		if err != nil {
+			err := err.(customerror.CustomError)
+			err.AppendModule("ChatService.CreateConversation")
+			return nil, err
+		}
+	}
+	for _, memberId := range memberIds {
+		err := s.checkInvitee(ctx, user.UUID, memberId)
+		if err != nil {
+			return nil, err
+		}
+	}
+	conversation := &chatmessages.Conversation{
+		Title:     title,
+		FlatId:    flatId,
+		CreatedBy: user.UUID,
+	}
+	_, err := s.ConversationRepo.CreateConversation(ctx, conversation, memberIds)
+	if err != nil {
+		err := err.(customerror.CustomError)
+		err.AppendModule("ChatService.CreateConversation")
+		return nil, err
+	}
+	return s.publishConversation(ctx, conversation.Id)
+}
+
+// checkInvitee проверяет, что приглашаемый пользователь существует и никто из двоих не заблокировал другого
+func (s *ChatService) checkInvitee(ctx context.Context, inviterId uuid.UUID, inviteeId uuid.UUID) error {
+	_, err := s.UserRepo.GetUser(ctx, inviteeId)
+	if err == pgx.ErrNoRows {
+		return err
+	}
+	if err != nil {
+		err := err.(customerror.CustomError)
+		err.AppendModule("ChatService.checkInvitee")
+		return err
+	}
+	blocked, err := s.ModerationRepo.IsBlocked(ctx, inviterId, inviteeId)
+	if err != nil {
+		err := err.(customerror.CustomError)
+		err.AppendModule("ChatService.checkInvitee")
+		return err
+	}
+	if blocked {
+		return customerror.ErrForbidden
+	}
+	return nil
+}
+
+func (s *ChatService) GetConversations(user *user.User) ([]chatmessages.Conversation, error) {
+	ctx, close := context.WithTimeout(context.Background(), time.Minute)
+	defer close()
+	conversations, err := s.ConversationRepo.GetConversations(ctx, user.UUID)
+	if err != nil {
+		err := err.(customerror.CustomError)
+		err.AppendModule("ChatService.GetConversations")
+		return nil, err
+	}
+	for i := range conversations {
+		if conversations[i].FlatId != 0 {
+			conversations[i].Flat = s.flatCard(ctx, conversations[i].FlatId)
+		}
+		if conversations[i].LastMessage != nil && conversations[i].LastMessage.Kind == chatmessages.KindFlat {
+			conversations[i].LastMessage.Flat = s.flatCard(ctx, conversations[i].LastMessage.FlatId)
+		}
+	}
+	return conversations, nil
+}
+
+// GetConversation отдает беседу только ее текущим участникам
+func (s *ChatService) GetConversation(user *user.User, conversationId int64) (*chatmessages.Conversation, error) {
+	ctx, close := context.WithTimeout(context.Background(), time.Minute)
+	defer close()
+	_, err := s.activeMember(ctx, conversationId, user.UUID)
+	if err != nil {
+		return nil, err
+	}
+	return s.loadConversation(ctx, conversationId)
+}
+
+func (s *ChatService) GetConversationMessages(user *user.User, conversationId int64, fromMessage int64, offset int64, limit int64) ([]chatmessages.ChatMessage, error) {
+	ctx, close := context.WithTimeout(context.Background(), time.Minute)
+	defer close()
+	_, err := s.ConversationRepo.GetMember(ctx, conversationId, user.UUID)
+	if err == pgx.ErrNoRows {
+		return nil, err
+	}
+	if err != nil {
+		err := err.(customerror.CustomError)
+		err.AppendModule("ChatService.GetConversationMessages")
+		return nil, err
+	}
+	messages, err := s.ConversationRepo.GetMessages(ctx, conversationId, user.UUID, fromMessage, offset, limit)
+	if err != nil {
+		err := err.(customerror.CustomError)
+		err.AppendModule("ChatService.GetConversationMessages")
+		return nil, err
+	}
+	s.attachFlatCards(ctx, messages)
+	return messages, nil
+}
+
+// InviteMembers доступно только администраторам группового чата
+func (s *ChatService) InviteMembers(user *user.User, conversationId int64, memberIds []uuid.UUID) (*chatmessages.Conversation, error) {
+	ctx, close := context.WithTimeout(context.Background(), time.Minute)
+	defer close()
+	conversation, err := s.adminConversation(ctx, conversationId, user.UUID)
+	if err != nil {
+		return nil, err
+	}
+	for _, memberId := range memberIds {
+		if slices.ContainsFunc(conversation.Members, func(member chatmessages.ConversationMember) bool {
+			return member.UserId == memberId
+		}) {
+			continue
+		}
+		if len(conversation.Members)+1 > MaxConversationMembers {
+			return nil, customerror.ErrTooManyMembers
+		}
+		err := s.checkInvitee(ctx, user.UUID, memberId)
+		if err != nil {
+			return nil, err
+		}
+		err = s.ConversationRepo.AddMember(ctx, conversationId, memberId)
+		if err != nil {
+			err := err.(customerror.CustomError)
+			err.AppendModule("ChatService.InviteMembers")
+			return nil, err
+		}
+		conversation.Members = append(conversation.Members, chatmessages.ConversationMember{UserId: memberId})
+	}
+	return s.publishConversation(ctx, conversationId)
+}
+
+func (s *ChatService) LeaveConversation(user *user.User, conversationId int64) error {
+	ctx, close := context.WithTimeout(context.Background(), time.Minute)
+	defer close()
+	conversation, err := s.loadConversation(ctx, conversationId)
+	if err != nil {
+		return err
+	}
+	if conversation.Kind != chatmessages.ConversationKindGroup {
+		return customerror.ErrForbidden
+	}
+	return s.removeMember(ctx, conversationId, user.UUID)
+}
+
+// KickMember доступно только администраторам. Себя исключить нельзя, для этого есть LeaveConversation.
+func (s *ChatService) KickMember(user *user.User, conversationId int64, memberId uuid.UUID) error {
+	ctx, close := context.WithTimeout(context.Background(), time.Minute)
+	defer close()
+	if memberId == user.UUID {
+		return customerror.ErrSelfAction
+	}
+	_, err := s.adminConversation(ctx, conversationId, user.UUID)
+	if err != nil {
+		return err
+	}
+	return s.removeMember(ctx, conversationId, memberId)
+}
+
+func (s *ChatService) SetMemberRole(user *user.User, conversationId int64, memberId uuid.UUID, role string) (*chatmessages.Conversation, error) {
+	ctx, close := context.WithTimeout(context.Background(), time.Minute)
+	defer close()
+	if memberId == user.UUID {
+		return nil, customerror.ErrSelfAction
+	}
+	_, err := s.adminConversation(ctx, conversationId, user.UUID)
+	if err != nil {
+		return nil, err
+	}
+	err = s.ConversationRepo.SetMemberRole(ctx, conversationId, memberId, role)
+	if err == pgx.ErrNoRows {
+		return nil, err
+	}
+	if err != nil {
+		err := err.(customerror.CustomError)
+		err.AppendModule("ChatService.SetMemberRole")
+		return nil, err
+	}
+	return s.publishConversation(ctx, conversationId)
+}
+
+func (s *ChatService) removeMember(ctx context.Context, conversationId int64, memberId uuid.UUID) error {
+	err := s.ConversationRepo.RemoveMember(ctx, conversationId, memberId)
+	if err == pgx.ErrNoRows {
+		return err
+	}
+	if err != nil {
+		err := err.(customerror.CustomError)
+		err.AppendModule("ChatService.removeMember")
+		return err
+	}
+	conversation, err := s.publishConversation(ctx, conversationId)
+	if err != nil {
+		return err
+	}
+	// Исключенный участник тоже должен узнать, что больше не состоит в беседе
+	s.sendToUsers(&WebsocketEvent{Event: EventConversationUpdated, Conversation: conversation}, memberId)
+	return nil
+}
+
+func (s *ChatService) activeMember(ctx context.Context, conversationId int64, userId uuid.UUID) (*chatmessages.ConversationMember, error) {
+	member, err := s.ConversationRepo.GetMember(ctx, conversationId, userId)
+	if err == pgx.ErrNoRows {
+		return nil, err
+	}
+	if err != nil {
+		err := err.(customerror.CustomError)
+		err.AppendModule("ChatService.activeMember")
+		return nil, err
+	}
+	if member.LeftAt.Valid {
+		return nil, pgx.ErrNoRows
+	}
+	return member, nil
+}
+
+// checkGroupMember проверяет, что пользователь может писать в групповую беседу.
+// Личные беседы через conversation_id не принимаются: у их сообщений должен быть заполнен получатель.
+func (s *ChatService) checkGroupMember(ctx context.Context, conversationId int64, userId uuid.UUID) error {
+	_, err := s.activeMember(ctx, conversationId, userId)
+	if err != nil {
+		return err
+	}
+	conversation, err := s.ConversationRepo.GetConversation(ctx, conversationId)
+	if err == pgx.ErrNoRows {
+		return err
+	}
+	if err != nil {
+		err := err.(customerror.CustomError)
+		err.AppendModule("ChatService.checkGroupMember")
+		return err
+	}
+	if conversation.Kind != chatmessages.ConversationKindGroup {
+		return pgx.ErrNoRows
+	}
+	return nil
+}
+
+// adminConversation возвращает групповую беседу, если userId - ее администратор
+func (s *ChatService) adminConversation(ctx context.Context, conversationId int64, userId uuid.UUID) (*chatmessages.Conversation, error) {
+	member, err := s.activeMember(ctx, conversationId, userId)
+	if err != nil {
+		return nil, err
+	}
+	conversation, err := s.loadConversation(ctx, conversationId)
+	if err != nil {
+		return nil, err
+	}
+	if conversation.Kind != chatmessages.ConversationKindGroup || member.Role != chatmessages.MemberRoleAdmin {
+		return nil, customerror.ErrForbidden
+	}
+	return conversation, nil
+}
+
+// loadConversation загружает беседу вместе с профилями участников и карточкой объявления
+func (s *ChatService) loadConversation(ctx context.Context, conversationId int64) (*chatmessages.Conversation, error) {
+	conversation, err := s.ConversationRepo.GetConversation(ctx, conversationId)
+	if err == pgx.ErrNoRows {
+		return nil, err
+	}
+	if err != nil {
+		err := err.(customerror.CustomError)
+		err.AppendModule("ChatService.loadConversation")
+		return nil, err
+	}
+	for i := range conversation.Members {
+		conversation.Members[i].User, err = s.UserRepo.GetUser(ctx, conversation.Members[i].UserId)
+		if err != nil && err != pgx.ErrNoRows {
+			err := err.(customerror.CustomError)
+			err.AppendModule("ChatService.loadConversation")
+			return nil, err
+		}
+	}
+	if conversation.FlatId != 0 {
+		conversation.Flat = s.flatCard(ctx, conversation.FlatId)
+	}
+	return conversation, nil
+}
+
+// publishConversation рассылает актуальное состояние беседы всем текущим участникам
+func (s *ChatService) publishConversation(ctx context.Context, conversationId int64) (*chatmessages.Conversation, error) {
+	conversation, err := s.loadConversation(ctx, conversationId)
+	if err != nil {
+		return nil, err
+	}
+	memberIds := make([]uuid.UUID, 0, len(conversation.Members))
+	for _, member := range conversation.Members {
+		memberIds = append(memberIds, member.UserId)
+	}
+	s.sendToUsers(&WebsocketEvent{Event: EventConversationUpdated, Conversation: conversation}, memberIds...)
+	return conversation, nil
+}
+
+// messageRecipients возвращает пользователей, которым нужно доставить изменения сообщения
+func (s *ChatService) messageRecipients(ctx context.Context, message *chatmessages.ChatMessage) ([]uuid.UUID, error) {
+	if message.ReceiverId != uuid.Nil {
+		return []uuid.UUID{message.SenderId, message.ReceiverId}, nil
+	}
+	memberIds, err := s.ConversationRepo.GetMemberIds(ctx, message.ConversationId)
+	if err != nil {
+		err := err.(customerror.CustomError)
+		err.AppendModule("ChatService.messageRecipients")
+		return nil, err
+	}
+	return memberIds, nil
+}
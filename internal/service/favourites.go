@@ -2,10 +2,15 @@ package service
 
 import (
 	"context"
+	"fmt"
+	"log"
 	"mymate/internal/repository"
 	"mymate/pkg/customerror"
 	"mymate/pkg/flat"
+	"mymate/pkg/notification"
 	"mymate/pkg/user"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
@@ -15,19 +20,22 @@ type FavouritesServiceI interface {
 	GetFavourites(offset int64, limit int64, userId uuid.UUID) ([]flat.Flat, error)
 	InsertFavourite(flat *flat.Flat, user *user.User) (int64, error)
 	DeleteFavourite(id int64, user *user.User) error
+	NotifyOwners()
 }
 
 type FavouritesService struct {
-	favouritesRepo repository.FavouritesRepositoryI
-	host           string
-	port           string
+	favouritesRepo      repository.FavouritesRepositoryI
+	notificationService NotificationServiceI
+	host                string
+	port                string
 }
 
-func NewFavouritesService(favouritesRepo repository.FavouritesRepositoryI, host string, port string) FavouritesServiceI {
+func NewFavouritesService(favouritesRepo repository.FavouritesRepositoryI, notificationService NotificationServiceI, host string, port string) FavouritesServiceI {
 	return &FavouritesService{
-		favouritesRepo: favouritesRepo,
-		host:           host,
-		port:           port,
+		favouritesRepo:      favouritesRepo,
+		notificationService: notificationService,
+		host:                host,
+		port:                port,
 	}
 }
 
@@ -52,9 +60,47 @@ func (s *FavouritesService) InsertFavourite(flat *flat.Flat, user *user.User) (i
 		customeErr.AppendModule("FavouritesService.InsertFavourite")
 		return 0, customeErr
 	}
+	s.notifyMatch(ctx, flat, user)
 	return id, nil
 }
 
+// notifyMatch сообщает обоим пользователям о взаимной симпатии: каждый добавил в избранное объявление другого
+func (s *FavouritesService) notifyMatch(ctx context.Context, flat *flat.Flat, user *user.User) {
+	if flat.CreatedById == user.UUID {
+		return
+	}
+	match, err := s.favouritesRepo.IsNewMatch(ctx, user.UUID, flat.CreatedById)
+	if err != nil {
+		log.Println(err.Error())
+		return
+	}
+	if !match {
+		return
+	}
+	s.notificationService.Notify(&notification.Notification{
+		Type:   notification.TypeMatch,
+		UserId: flat.CreatedById,
+		Title:  "Взаимная симпатия",
+		Body:   strings.TrimSpace(user.Firstname+" "+user.Lastname) + " добавил(а) в избранное ваше объявление «" + flat.Name + "»",
+		Data: map[string]string{
+			"user_id": user.UUID.String(),
+			"flat_id": strconv.FormatInt(flat.Id, 10),
+		},
+		Link: notification.UserLink(user.UUID),
+	})
+	s.notificationService.Notify(&notification.Notification{
+		Type:   notification.TypeMatch,
+		UserId: user.UUID,
+		Title:  "Взаимная симпатия",
+		Body:   strings.TrimSpace(flat.CreatedByUser.Firstname+" "+flat.CreatedByUser.Lastname) + " тоже интересуется вашим объявлением",
+		Data: map[string]string{
+			"user_id": flat.CreatedById.String(),
+			"flat_id": strconv.FormatInt(flat.Id, 10),
+		},
+		Link: notification.UserLink(flat.CreatedById),
+	})
+}
+
 func (s *FavouritesService) DeleteFavourite(id int64, user *user.User) error {
 	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
 	defer cancel()
@@ -66,3 +112,47 @@ func (s *FavouritesService) DeleteFavourite(id int64, user *user.User) error {
 	}
 	return nil
 }
+
+// NotifyOwners сообщает владельцам о новых добавлениях их объявлений в избранное. Запускается по расписанию,
+// поэтому несколько добавлений одного объявления за интервал приходят одним уведомлением.
+func (s *FavouritesService) NotifyOwners() {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	batches, err := s.favouritesRepo.ClaimOwnerBatches(ctx)
+	if err != nil {
+		customeErr := err.(customerror.CustomError)
+		customeErr.AppendModule("FavouritesService.NotifyOwners")
+		log.Println(customeErr.Error())
+		return
+	}
+	for _, batch := range batches {
+		body := strings.TrimSpace(batch.LastUser.Firstname+" "+batch.LastUser.Lastname) + " добавил(а) в избранное объявление «" + batch.FlatName + "»"
+		link := notification.UserLink(batch.LastUser.UUID)
+		if batch.Count > 1 {
+			body = fmt.Sprintf("Объявление «%s» добавили в избранное %d раз", batch.FlatName, batch.Count)
+			link = notification.FlatLink(batch.FlatId)
+		}
+		err := s.notificationService.Notify(&notification.Notification{
+			Type:   notification.TypeFlatFavourited,
+			UserId: batch.OwnerId,
+			Title:  "Объявление добавили в избранное",
+			Body:   body,
+			Data: map[string]string{
+				"flat_id":      strconv.FormatInt(batch.FlatId, 10),
+				"count":        strconv.FormatInt(batch.Count, 10),
+				"last_user_id": batch.LastUser.UUID.String(),
+			},
+			Link: link,
+		})
+		if err == nil {
+			continue
+		}
+		// Уведомление не принято: пачка вернется в следующий запуск
+		err = s.favouritesRepo.ReleaseOwnerBatch(ctx, &batch)
+		if err != nil {
+			customeErr := err.(customerror.CustomError)
+			customeErr.AppendModule("FavouritesService.NotifyOwners")
+			log.Println(customeErr.Error())
+		}
+	}
+}
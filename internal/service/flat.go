@@ -1,18 +1,19 @@
 package service
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"io"
 	"log"
 	"mime/multipart"
 	"mymate/internal/repository"
+	"mymate/pkg/blobstore"
 	"mymate/pkg/customerror"
 	modelsFlat "mymate/pkg/flat"
+	"mymate/pkg/imageproc"
 	"mymate/pkg/user"
-	"os"
-	"path/filepath"
-	"strconv"
+	"slices"
 	"time"
 
 	"github.com/google/uuid"
@@ -25,24 +26,48 @@ type FlatServiceI interface {
 	InsertFlat(flat *modelsFlat.Flat) (int64, error)
 	UpdateFlat(flat *modelsFlat.Flat, user *user.User) error
 	DeleteFlat(id int64, user *user.User) error
+	DeleteExpiredFlats()
 	GetFlatImages(flatId int64) ([]modelsFlat.FlatImage, error)
-	InsertFlatImage(file *multipart.FileHeader, user *modelsFlat.Flat) error
+	InsertFlatImage(file *multipart.FileHeader, flat *modelsFlat.Flat) (*modelsFlat.FlatImage, error)
+	InsertFlatImageFrom(src io.Reader, size int64, flat *modelsFlat.Flat) (*modelsFlat.FlatImage, error)
 	DeleteFlatImage(flatImage *modelsFlat.FlatImage) error
+	GetFlatMedia(flatId int64, kind string) ([]modelsFlat.FlatMedia, error)
+	GetFlatMediaItem(flatId int64, id int64) (*modelsFlat.FlatMedia, error)
+	InsertFlatVideo(file *multipart.FileHeader, flat *modelsFlat.Flat) (*modelsFlat.FlatMedia, error)
+	InsertFloorPlan(file *multipart.FileHeader, flat *modelsFlat.Flat) (*modelsFlat.FlatMedia, error)
+	DeleteFlatMedia(media *modelsFlat.FlatMedia) error
+	ReorderFlatImages(flat *modelsFlat.Flat, imageIds []int64, coverId int64) ([]modelsFlat.FlatImage, error)
+	GetFlatStats(flat *modelsFlat.Flat, days int64) (*modelsFlat.Stats, error)
+	RecordView(flat *modelsFlat.Flat, viewer *user.User)
+	GetRecentlyViewed(user *user.User, offset int64, limit int64) ([]modelsFlat.RecentlyViewed, error)
+	PruneViews()
+	RunViewRecorder(ctx context.Context)
 }
 
+// Насколько (в битах из 64) могут различаться хеши, чтобы фотографии считались одинаковыми
+const duplicateImageMaxDistance = 6
+
 type FlatService struct {
-	flatRepo repository.FlatRepositoryI
-	host     string
-	port     string
-	mainUrl  string
+	flatRepo       repository.FlatRepositoryI
+	moderationRepo repository.ModerationRepositoryI
+	blobs          blobstore.BlobStore
+	views          *viewRecorder
+	ffmpegPath     string
+	host           string
+	port           string
+	mainUrl        string
 }
 
-func NewFlatService(flatRepo repository.FlatRepositoryI, host string, port string, mainUrl string) FlatServiceI {
+func NewFlatService(flatRepo repository.FlatRepositoryI, moderationRepo repository.ModerationRepositoryI, blobs blobstore.BlobStore, ffmpegPath string, host string, port string, mainUrl string) FlatServiceI {
 	return &FlatService{
-		flatRepo: flatRepo,
-		host:     host,
-		port:     port,
-		mainUrl:  mainUrl,
+		flatRepo:       flatRepo,
+		moderationRepo: moderationRepo,
+		blobs:          blobs,
+		views:          newViewRecorder(flatRepo),
+		ffmpegPath:     ffmpegPath,
+		host:           host,
+		port:           port,
+		mainUrl:        mainUrl,
 	}
 }
 
@@ -62,6 +87,9 @@ func (flatService *FlatService) GetFlat(id int64) (*modelsFlat.Flat, error) {
 	ctx, close := context.WithTimeout(context.Background(), time.Minute)
 	defer close()
 	flat, err := flatService.flatRepo.GetFlat(ctx, id)
+	if err == pgx.ErrNoRows {
+		return nil, err
+	}
 	if err != nil {
 		customeErr := err.(customerror.CustomError)
 		customeErr.AppendModule("FlatService.GetFlat")
@@ -97,6 +125,7 @@ func (flatService *FlatService) UpdateFlat(flat *modelsFlat.Flat, user *user.Use
 	return nil
 }
 
+// DeleteFlat удаляет объявление и все зависимые строки одной транзакцией. Файлы удаляет MediaService по очереди заданий.
 func (flatService *FlatService) DeleteFlat(id int64, user *user.User) error {
 	ctx, close := context.WithTimeout(context.Background(), time.Minute)
 	defer close()
@@ -112,6 +141,31 @@ func (flatService *FlatService) DeleteFlat(id int64, user *user.User) error {
 	return nil
 }
 
+// DeleteExpiredFlats удаляет объявления старше месяца тем же способом, что и DeleteFlat
+func (flatService *FlatService) DeleteExpiredFlats() {
+	ctx, close := context.WithTimeout(context.Background(), 30*time.Minute)
+	defer close()
+	ids, err := flatService.flatRepo.GetFlatIdsCreatedBefore(ctx, time.Now().AddDate(0, -1, 0))
+	if err != nil {
+		customeErr := err.(customerror.CustomError)
+		customeErr.AppendModule("FlatService.DeleteExpiredFlats")
+		log.Println(customeErr.Error())
+		return
+	}
+	for _, id := range ids {
+		err = flatService.flatRepo.DeleteFlat(ctx, id, nil)
+		// Объявление могли удалить между выборкой и удалением
+		if err == pgx.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			customeErr := err.(customerror.CustomError)
+			customeErr.AppendModule("FlatService.DeleteExpiredFlats")
+			log.Println(customeErr.Error())
+		}
+	}
+}
+
 func (flatService *FlatService) GetFlatImages(flatId int64) ([]modelsFlat.FlatImage, error) {
 	ctx, close := context.WithTimeout(context.Background(), time.Minute)
 	defer close()
@@ -123,50 +177,151 @@ func (flatService *FlatService) GetFlatImages(flatId int64) ([]modelsFlat.FlatIm
 	}
 	return flatImages, nil
 }
-func (flatService *FlatService) InsertFlatImage(file *multipart.FileHeader, flat *modelsFlat.Flat) error {
-	fileUUID := uuid.New().String()
-	timestamp := time.Now().Unix()
-	fileExt := filepath.Ext(file.Filename)
-	uploadPath := filepath.Join(".", "media", "flats", strconv.FormatInt(flat.Id, 10))
-	if err := os.MkdirAll(uploadPath, 0755); err != nil {
-		return customerror.NewError("FlatService.SaveUserAvatar.MkdirAll", flatService.host+":"+flatService.port, err.Error())
-	}
-	if fileExt != ".jpg" && fileExt != ".jpeg" && fileExt != ".png" && fileExt != ".webp" {
-		return customerror.NewError("FlatService.SaveUserAvatar.FileExt", flatService.host+":"+flatService.port, "Invalid file extension")
+
+func (flatService *FlatService) InsertFlatImage(file *multipart.FileHeader, flat *modelsFlat.Flat) (*modelsFlat.FlatImage, error) {
+	if file.Size > imageproc.DefaultLimits.MaxBytes {
+		return nil, customerror.ErrImageTooLarge
 	}
-	newFilename := fmt.Sprintf("%s_%d%s", fileUUID, timestamp, fileExt)
-	fullPath := filepath.Join(uploadPath, newFilename)
 	src, err := file.Open()
 	if err != nil {
-		return customerror.NewError("FlatService.SaveUserAvatar.Open", flatService.host+":"+flatService.port, err.Error())
+		return nil, customerror.NewError("FlatService.InsertFlatImage.Open", flatService.host+":"+flatService.port, err.Error())
 	}
 	defer src.Close()
-	dst, err := os.Create(fullPath)
+	return flatService.InsertFlatImageFrom(src, file.Size, flat)
+}
+
+// InsertFlatImageFrom проверяет содержимое файла, удаляет из него метаданные (в том числе GPS) и сохраняет вместе с уменьшенными копиями
+func (flatService *FlatService) InsertFlatImageFrom(src io.Reader, size int64, flat *modelsFlat.Flat) (*modelsFlat.FlatImage, error) {
+	if size > imageproc.DefaultLimits.MaxBytes {
+		return nil, customerror.ErrImageTooLarge
+	}
+	c, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	// Лимит окончательно проверяется при вставке, здесь - чтобы не обрабатывать файл зря
+	count, err := flatService.flatRepo.CountFlatImages(c, flat.Id)
 	if err != nil {
-		return customerror.NewError("FlatService.SaveUserAvatar.Create", flatService.host+":"+flatService.port, err.Error())
+		customeErr := err.(customerror.CustomError)
+		customeErr.AppendModule("FlatService.InsertFlatImage")
+		return nil, customeErr
+	}
+	if count >= modelsFlat.MaxImages {
+		return nil, customerror.ErrTooManyImages
+	}
+	processed, err := imageproc.Process(src, imageproc.DefaultLimits, imageproc.DefaultVariants)
+	if err == imageproc.ErrTooLarge || err == imageproc.ErrDimensionsTooBig {
+		return nil, customerror.ErrImageTooLarge
+	}
+	if err == imageproc.ErrUnsupportedFormat || err == imageproc.ErrCorrupt {
+		return nil, customerror.ErrInvalidImage
 	}
-	defer dst.Close()
-	_, err = io.Copy(dst, src)
 	if err != nil {
-		return customerror.NewError("FlatService.SaveUserAvatar.Copy", flatService.host+":"+flatService.port, err.Error())
+		return nil, customerror.NewError("FlatService.InsertFlatImage.Process", flatService.host+":"+flatService.port, err.Error())
 	}
+	baseName := fmt.Sprintf("%s_%d", uuid.New().String(), time.Now().Unix())
 	flatImage := modelsFlat.FlatImage{
 		FlatId:   flat.Id,
-		Url:      fmt.Sprintf("%s/media/flats/%d/%s", flatService.mainUrl, flat.Id, newFilename),
-		Filename: newFilename,
+		Filename: baseName + processed.Original.Ext(),
+		Width:    processed.Original.Width,
+		Height:   processed.Original.Height,
+		Variants: map[string]string{},
+		Hash:     processed.Hash,
+	}
+	var uploaded []string
+	put := func(image *imageproc.Image, filename string) (string, error) {
+		key := modelsFlat.ImageKey(flat.Id, filename)
+		err := flatService.blobs.Put(c, key, bytes.NewReader(image.Data), int64(len(image.Data)), image.ContentType())
+		if err != nil {
+			return "", err
+		}
+		uploaded = append(uploaded, key)
+		return fmt.Sprintf("%s/media/%s", flatService.mainUrl, key), nil
+	}
+	flatImage.Url, err = put(&processed.Original, flatImage.Filename)
+	for i := 0; err == nil && i < len(processed.Variants); i++ {
+		variant := &processed.Variants[i]
+		flatImage.Variants[variant.Name], err = put(variant, baseName+"_"+variant.Name+variant.Ext())
+	}
+	if err != nil {
+		flatService.discardFiles(uploaded)
+		return nil, customerror.NewError("FlatService.InsertFlatImage.Put", flatService.host+":"+flatService.port, err.Error())
 	}
-	c, cancel := context.WithTimeout(context.Background(), time.Minute)
-	defer cancel()
 	err = flatService.flatRepo.InsertFlatImage(c, &flatImage)
+	if err == customerror.ErrTooManyImages {
+		flatService.discardFiles(uploaded)
+		return nil, err
+	}
 	if err != nil {
-		return customerror.NewError("FlatService.InsertFlatImage", flatService.host+":"+flatService.port, err.Error())
+		flatService.discardFiles(uploaded)
+		customeErr := err.(customerror.CustomError)
+		customeErr.AppendModule("FlatService.InsertFlatImage")
+		return nil, customeErr
 	}
-	return nil
+	if flatImage.Hash != 0 {
+		go flatService.flagDuplicates(flatImage.Id)
+	}
+	return &flatImage, nil
 }
 
+// flagDuplicates отправляет на модерацию фотографию, уже встречавшуюся в объявлениях других пользователей
+func (flatService *FlatService) flagDuplicates(imageId int64) {
+	ctx, close := context.WithTimeout(context.Background(), time.Minute)
+	defer close()
+	flagged, err := flatService.moderationRepo.FlagDuplicateImages(ctx, imageId, duplicateImageMaxDistance)
+	if err != nil {
+		customeErr := err.(customerror.CustomError)
+		customeErr.AppendModule("FlatService.flagDuplicates")
+		log.Println(customeErr.Error())
+		return
+	}
+	if flagged > 0 {
+		log.Printf("flat image %d matches %d images of other users, flagged for moderation", imageId, flagged)
+	}
+}
+
+// ReorderFlatImages принимает все фотографии объявления в новом порядке. coverId = 0 оставляет обложку прежней.
+func (flatService *FlatService) ReorderFlatImages(flat *modelsFlat.Flat, imageIds []int64, coverId int64) ([]modelsFlat.FlatImage, error) {
+	ctx, close := context.WithTimeout(context.Background(), time.Minute)
+	defer close()
+	images, err := flatService.flatRepo.GetFlatImages(ctx, flat.Id)
+	if err != nil {
+		customeErr := err.(customerror.CustomError)
+		customeErr.AppendModule("FlatService.ReorderFlatImages")
+		return nil, customeErr
+	}
+	if len(imageIds) != len(images) {
+		return nil, customerror.ErrInvalidImageOrder
+	}
+	existing := map[int64]bool{}
+	for _, image := range images {
+		existing[image.Id] = true
+	}
+	for _, id := range imageIds {
+		if !existing[id] {
+			return nil, customerror.ErrInvalidImageOrder
+		}
+		// Повтор id тоже означает, что какой-то фотографии в списке нет
+		delete(existing, id)
+	}
+	if coverId != 0 && !slices.Contains(imageIds, coverId) {
+		return nil, customerror.ErrInvalidImageOrder
+	}
+	err = flatService.flatRepo.ReorderFlatImages(ctx, flat.Id, imageIds, coverId)
+	if err != nil {
+		customeErr := err.(customerror.CustomError)
+		customeErr.AppendModule("FlatService.ReorderFlatImages")
+		return nil, customeErr
+	}
+	images, err = flatService.flatRepo.GetFlatImages(ctx, flat.Id)
+	if err != nil {
+		customeErr := err.(customerror.CustomError)
+		customeErr.AppendModule("FlatService.ReorderFlatImages")
+		return nil, customeErr
+	}
+	return images, nil
+}
+
+// DeleteFlatImage удаляет фотографию, ее файлы удалит RunDeletionJobs
 func (flatService *FlatService) DeleteFlatImage(flatImage *modelsFlat.FlatImage) error {
-	tempFilename := flatImage.Filename
-	tempFlatId := flatImage.FlatId
 	ctx, close := context.WithTimeout(context.Background(), time.Minute)
 	defer close()
 	err := flatService.flatRepo.DeleteFlatImage(ctx, flatImage)
@@ -178,17 +333,97 @@ func (flatService *FlatService) DeleteFlatImage(flatImage *modelsFlat.FlatImage)
 		customeErr.AppendModule("FlatService.DeleteFlatImage")
 		return customeErr
 	}
-	go flatService.DeleteFile(filepath.Join(".", "media", "flats", strconv.FormatInt(tempFlatId, 10), tempFilename))
 	return nil
 }
 
-func (flatService *FlatService) DeleteFile(path string) {
-	err := os.Remove(path)
-	fmt.Println(path)
+// discardFiles ставит в очередь удаления файлы, для которых не появилась строка в базе.
+// Если очередь недоступна, файлы удаляются сразу, без повторов.
+func (flatService *FlatService) discardFiles(keys []string) {
+	ctx, close := context.WithTimeout(context.Background(), time.Minute)
+	defer close()
+	err := flatService.flatRepo.EnqueueFileDeletions(ctx, keys)
+	if err != nil {
+		customeErr := err.(customerror.CustomError)
+		customeErr.AppendModule("FlatService.discardFiles")
+		log.Println(customeErr.Error())
+		go flatService.DeleteFiles(keys)
+	}
+}
+
+func (flatService *FlatService) DeleteFiles(keys []string) {
+	ctx, close := context.WithTimeout(context.Background(), time.Minute)
+	defer close()
+	for _, key := range keys {
+		err := flatService.blobs.Delete(ctx, key)
+		if err != nil {
+			customeErr := customerror.NewError("FlatService.DeleteFiles", flatService.host+":"+flatService.port, err.Error()).(customerror.CustomError)
+			customeErr.AppendModule("FlatService.DeleteFiles")
+			log.Println(customeErr)
+		}
+	}
+}
+
+// GetFlatStats собирает статистику объявления по дням за последние days дней, включая сегодняшний.
+// Дни без событий заполняются нулями, чтобы клиенту не приходилось достраивать график.
+func (flatService *FlatService) GetFlatStats(flat *modelsFlat.Flat, days int64) (*modelsFlat.Stats, error) {
+	ctx, close := context.WithTimeout(context.Background(), time.Minute)
+	defer close()
+	daily, err := flatService.flatRepo.GetFlatStats(ctx, flat.Id, days)
 	if err != nil {
-		customeErr := customerror.NewError("FlatService.DeleteFile", flatService.host+":"+flatService.port, err.Error()).(customerror.CustomError)
-		customeErr.AppendModule("FlatService.DeleteFile")
-		log.Println(customeErr)
+		customeErr := err.(customerror.CustomError)
+		customeErr.AppendModule("FlatService.GetFlatStats")
+		return nil, customeErr
+	}
+	stats := &modelsFlat.Stats{
+		FlatId:          flat.Id,
+		Days:            days,
+		FavouritesCount: flat.FavouritesCount,
+		Daily:           daily,
+	}
+	for _, dayStats := range daily {
+		stats.Views += dayStats.Views
+		stats.Favourites += dayStats.Favourites
+		stats.ChatStarts += dayStats.ChatStarts
+	}
+	return stats, nil
+}
+
+// RecordView ставит просмотр в очередь записи. Владелец, просматривающий свое объявление, не учитывается.
+func (flatService *FlatService) RecordView(flat *modelsFlat.Flat, viewer *user.User) {
+	if flat.CreatedById == viewer.UUID {
 		return
 	}
+	flatService.views.record(viewer.UUID, flat.Id)
+}
+
+func (flatService *FlatService) GetRecentlyViewed(user *user.User, offset int64, limit int64) ([]modelsFlat.RecentlyViewed, error) {
+	ctx, close := context.WithTimeout(context.Background(), time.Minute)
+	defer close()
+	viewed, err := flatService.flatRepo.GetRecentlyViewed(ctx, user.UUID, offset, limit)
+	if err != nil {
+		customeErr := err.(customerror.CustomError)
+		customeErr.AppendModule("FlatService.GetRecentlyViewed")
+		return nil, customeErr
+	}
+	for i := range viewed {
+		viewed[i].Flat.HideOwnerStats(user)
+	}
+	return viewed, nil
+}
+
+// PruneViews удаляет историю просмотров старше viewHistoryRetention
+func (flatService *FlatService) PruneViews() {
+	ctx, close := context.WithTimeout(context.Background(), 10*time.Minute)
+	defer close()
+	_, err := flatService.flatRepo.DeleteViewsBefore(ctx, time.Now().Add(-viewHistoryRetention))
+	if err != nil {
+		customeErr := err.(customerror.CustomError)
+		customeErr.AppendModule("FlatService.PruneViews")
+		log.Println(customeErr.Error())
+	}
+}
+
+// RunViewRecorder записывает накопленные просмотры, пока не отменен ctx
+func (flatService *FlatService) RunViewRecorder(ctx context.Context) {
+	flatService.views.run(ctx)
 }
@@ -0,0 +1,255 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"mymate/pkg/customerror"
+	modelsFlat "mymate/pkg/flat"
+	"mymate/pkg/imageproc"
+	"mymate/pkg/videoproc"
+	"os"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	// Постер берется с этой секунды, у коротких видео - из середины
+	posterOffset  = time.Second
+	posterMaxSide = 1280
+	// ffmpeg на испорченном файле может работать долго, поэтому время ограничено
+	posterTimeout = 30 * time.Second
+)
+
+func (flatService *FlatService) GetFlatMedia(flatId int64, kind string) ([]modelsFlat.FlatMedia, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	media, err := flatService.flatRepo.GetFlatMedia(ctx, flatId, kind)
+	if err != nil {
+		customeErr := err.(customerror.CustomError)
+		customeErr.AppendModule("FlatService.GetFlatMedia")
+		return nil, customeErr
+	}
+	return media, nil
+}
+
+func (flatService *FlatService) GetFlatMediaItem(flatId int64, id int64) (*modelsFlat.FlatMedia, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	media, err := flatService.flatRepo.GetFlatMediaItem(ctx, flatId, id)
+	if err == pgx.ErrNoRows {
+		return nil, err
+	}
+	if err != nil {
+		customeErr := err.(customerror.CustomError)
+		customeErr.AppendModule("FlatService.GetFlatMediaItem")
+		return nil, customeErr
+	}
+	return media, nil
+}
+
+func (flatService *FlatService) checkMediaLimit(ctx context.Context, flatId int64, kind string) error {
+	// Лимит окончательно проверяется при вставке, здесь - чтобы не принимать файл зря
+	count, err := flatService.flatRepo.CountFlatMedia(ctx, flatId, kind)
+	if err != nil {
+		customeErr := err.(customerror.CustomError)
+		customeErr.AppendModule("FlatService.checkMediaLimit")
+		return customeErr
+	}
+	if count >= int64(modelsFlat.MaxMedia(kind)) {
+		return customerror.ErrTooManyMedia
+	}
+	return nil
+}
+
+// InsertFlatVideo принимает MP4/MOV не длиннее modelsFlat.MaxVideoDuration. Файл сохраняется без перекодирования,
+// постер извлекается ffmpeg, если он настроен. Без постера видео все равно сохраняется.
+func (flatService *FlatService) InsertFlatVideo(file *multipart.FileHeader, flat *modelsFlat.Flat) (*modelsFlat.FlatMedia, error) {
+	if file.Size > modelsFlat.MaxVideoBytes {
+		return nil, customerror.ErrVideoTooLarge
+	}
+	c, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+	defer cancel()
+	err := flatService.checkMediaLimit(c, flat.Id, modelsFlat.MediaKindVideo)
+	if err != nil {
+		return nil, err
+	}
+	src, err := file.Open()
+	if err != nil {
+		return nil, customerror.NewError("FlatService.InsertFlatVideo.Open", flatService.host+":"+flatService.port, err.Error())
+	}
+	defer src.Close()
+	// ffmpeg нужен путь к файлу, поэтому видео сначала копируется во временный файл
+	temp, err := os.CreateTemp("", "flat-video-*")
+	if err != nil {
+		return nil, customerror.NewError("FlatService.InsertFlatVideo.CreateTemp", flatService.host+":"+flatService.port, err.Error())
+	}
+	defer os.Remove(temp.Name())
+	defer temp.Close()
+	size, err := io.Copy(temp, io.LimitReader(src, modelsFlat.MaxVideoBytes+1))
+	if err != nil {
+		return nil, customerror.NewError("FlatService.InsertFlatVideo.Copy", flatService.host+":"+flatService.port, err.Error())
+	}
+	if size > modelsFlat.MaxVideoBytes {
+		return nil, customerror.ErrVideoTooLarge
+	}
+	info, err := videoproc.Probe(temp, size, modelsFlat.MaxVideoDuration)
+	if err == videoproc.ErrTooLong {
+		return nil, customerror.ErrVideoTooLong
+	}
+	if err != nil {
+		return nil, customerror.ErrInvalidVideo
+	}
+	baseName := fmt.Sprintf("%s_%d", uuid.New().String(), time.Now().Unix())
+	media := modelsFlat.FlatMedia{
+		FlatId:      flat.Id,
+		Kind:        modelsFlat.MediaKindVideo,
+		Filename:    baseName + info.Ext(),
+		ContentType: info.ContentType(),
+		Size:        size,
+		Width:       info.Width,
+		Height:      info.Height,
+		DurationMs:  info.Duration.Milliseconds(),
+	}
+	_, err = temp.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, customerror.NewError("FlatService.InsertFlatVideo.Seek", flatService.host+":"+flatService.port, err.Error())
+	}
+	key := modelsFlat.ImageKey(flat.Id, media.Filename)
+	err = flatService.blobs.Put(c, key, temp, size, media.ContentType)
+	if err != nil {
+		return nil, customerror.NewError("FlatService.InsertFlatVideo.Put", flatService.host+":"+flatService.port, err.Error())
+	}
+	uploaded := []string{key}
+	media.Url = fmt.Sprintf("%s/media/%s", flatService.mainUrl, key)
+	poster, err := flatService.extractPoster(c, temp.Name(), info.Duration)
+	if err != nil {
+		log.Printf("ERROR|FlatService.InsertFlatVideo.Poster:%s", err.Error())
+	}
+	if poster != nil {
+		posterKey := modelsFlat.ImageKey(flat.Id, baseName+"_poster"+poster.Ext())
+		err = flatService.blobs.Put(c, posterKey, bytes.NewReader(poster.Data), int64(len(poster.Data)), poster.ContentType())
+		if err != nil {
+			log.Printf("ERROR|FlatService.InsertFlatVideo.PutPoster:%s", err.Error())
+		} else {
+			uploaded = append(uploaded, posterKey)
+			media.PosterUrl = fmt.Sprintf("%s/media/%s", flatService.mainUrl, posterKey)
+		}
+	}
+	return flatService.insertFlatMedia(c, &media, uploaded)
+}
+
+// extractPoster возвращает nil без ошибки, если ffmpeg не настроен
+func (flatService *FlatService) extractPoster(ctx context.Context, path string, duration time.Duration) (*imageproc.Image, error) {
+	if flatService.ffmpegPath == "" {
+		return nil, nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, posterTimeout)
+	defer cancel()
+	frame, err := videoproc.Poster(ctx, flatService.ffmpegPath, path, min(posterOffset, duration/2), posterMaxSide)
+	if err != nil {
+		return nil, err
+	}
+	// Кадр проходит ту же проверку, что и загруженные фотографии
+	processed, err := imageproc.Process(bytes.NewReader(frame), imageproc.DefaultLimits, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &processed.Original, nil
+}
+
+// InsertFloorPlan сохраняет планировку так же, как фотографию: без метаданных и с уменьшенными копиями
+func (flatService *FlatService) InsertFloorPlan(file *multipart.FileHeader, flat *modelsFlat.Flat) (*modelsFlat.FlatMedia, error) {
+	if file.Size > imageproc.DefaultLimits.MaxBytes {
+		return nil, customerror.ErrImageTooLarge
+	}
+	c, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	err := flatService.checkMediaLimit(c, flat.Id, modelsFlat.MediaKindFloorPlan)
+	if err != nil {
+		return nil, err
+	}
+	src, err := file.Open()
+	if err != nil {
+		return nil, customerror.NewError("FlatService.InsertFloorPlan.Open", flatService.host+":"+flatService.port, err.Error())
+	}
+	defer src.Close()
+	processed, err := imageproc.Process(src, imageproc.DefaultLimits, imageproc.DefaultVariants)
+	if err == imageproc.ErrTooLarge || err == imageproc.ErrDimensionsTooBig {
+		return nil, customerror.ErrImageTooLarge
+	}
+	if err == imageproc.ErrUnsupportedFormat || err == imageproc.ErrCorrupt {
+		return nil, customerror.ErrInvalidImage
+	}
+	if err != nil {
+		return nil, customerror.NewError("FlatService.InsertFloorPlan.Process", flatService.host+":"+flatService.port, err.Error())
+	}
+	baseName := fmt.Sprintf("%s_%d", uuid.New().String(), time.Now().Unix())
+	media := modelsFlat.FlatMedia{
+		FlatId:      flat.Id,
+		Kind:        modelsFlat.MediaKindFloorPlan,
+		Filename:    baseName + processed.Original.Ext(),
+		ContentType: processed.Original.ContentType(),
+		Size:        int64(len(processed.Original.Data)),
+		Width:       processed.Original.Width,
+		Height:      processed.Original.Height,
+		Variants:    map[string]string{},
+	}
+	var uploaded []string
+	put := func(image *imageproc.Image, filename string) (string, error) {
+		key := modelsFlat.ImageKey(flat.Id, filename)
+		err := flatService.blobs.Put(c, key, bytes.NewReader(image.Data), int64(len(image.Data)), image.ContentType())
+		if err != nil {
+			return "", err
+		}
+		uploaded = append(uploaded, key)
+		return fmt.Sprintf("%s/media/%s", flatService.mainUrl, key), nil
+	}
+	media.Url, err = put(&processed.Original, media.Filename)
+	for i := 0; err == nil && i < len(processed.Variants); i++ {
+		variant := &processed.Variants[i]
+		media.Variants[variant.Name], err = put(variant, baseName+"_"+variant.Name+variant.Ext())
+	}
+	if err != nil {
+		flatService.discardFiles(uploaded)
+		return nil, customerror.NewError("FlatService.InsertFloorPlan.Put", flatService.host+":"+flatService.port, err.Error())
+	}
+	return flatService.insertFlatMedia(c, &media, uploaded)
+}
+
+// insertFlatMedia записывает строку в базу, а при ошибке ставит уже загруженные файлы в очередь удаления
+func (flatService *FlatService) insertFlatMedia(ctx context.Context, media *modelsFlat.FlatMedia, uploaded []string) (*modelsFlat.FlatMedia, error) {
+	err := flatService.flatRepo.InsertFlatMedia(ctx, media)
+	if err == customerror.ErrTooManyMedia {
+		flatService.discardFiles(uploaded)
+		return nil, err
+	}
+	if err != nil {
+		flatService.discardFiles(uploaded)
+		customeErr := err.(customerror.CustomError)
+		customeErr.AppendModule("FlatService.insertFlatMedia")
+		return nil, customeErr
+	}
+	return media, nil
+}
+
+// DeleteFlatMedia удаляет медиафайл объявления, его файлы удалит RunDeletionJobs
+func (flatService *FlatService) DeleteFlatMedia(media *modelsFlat.FlatMedia) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	err := flatService.flatRepo.DeleteFlatMedia(ctx, media)
+	if err == pgx.ErrNoRows {
+		return err
+	}
+	if err != nil {
+		customeErr := err.(customerror.CustomError)
+		customeErr.AppendModule("FlatService.DeleteFlatMedia")
+		return customeErr
+	}
+	return nil
+}
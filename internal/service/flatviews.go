@@ -0,0 +1,99 @@
+package service
+
+import (
+	"context"
+	"log"
+	"mymate/internal/repository"
+	"mymate/pkg/customerror"
+	modelsFlat "mymate/pkg/flat"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// Как часто накопленные просмотры записываются в базу
+	viewFlushInterval = 10 * time.Second
+	// При таком количестве накопленных просмотров запись начинается не дожидаясь интервала
+	viewFlushSize = 1000
+	// Сколько хранится история просмотров пользователя
+	viewHistoryRetention = 90 * 24 * time.Hour
+)
+
+type viewKey struct {
+	userId uuid.UUID
+	flatId int64
+	day    string
+}
+
+// viewRecorder копит просмотры в памяти и пишет их в базу пачками, чтобы популярные объявления
+// не создавали отдельную запись на каждый просмотр. Повторные просмотры за день схлопываются еще до записи.
+type viewRecorder struct {
+	flatRepo repository.FlatRepositoryI
+	mu       sync.Mutex
+	pending  map[viewKey]time.Time
+	flushNow chan struct{}
+}
+
+func newViewRecorder(flatRepo repository.FlatRepositoryI) *viewRecorder {
+	return &viewRecorder{
+		flatRepo: flatRepo,
+		pending:  map[viewKey]time.Time{},
+		flushNow: make(chan struct{}, 1),
+	}
+}
+
+func (r *viewRecorder) record(userId uuid.UUID, flatId int64) {
+	now := time.Now()
+	r.mu.Lock()
+	r.pending[viewKey{userId: userId, flatId: flatId, day: now.Format(time.DateOnly)}] = now
+	full := len(r.pending) >= viewFlushSize
+	r.mu.Unlock()
+	if full {
+		select {
+		case r.flushNow <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// run пишет просмотры по таймеру или при переполнении буфера. После отмены ctx записывает остаток.
+func (r *viewRecorder) run(ctx context.Context) {
+	ticker := time.NewTicker(viewFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			r.flush()
+			return
+		case <-ticker.C:
+			r.flush()
+		case <-r.flushNow:
+			r.flush()
+		}
+	}
+}
+
+func (r *viewRecorder) flush() {
+	r.mu.Lock()
+	if len(r.pending) == 0 {
+		r.mu.Unlock()
+		return
+	}
+	pending := r.pending
+	r.pending = map[viewKey]time.Time{}
+	r.mu.Unlock()
+	views := make([]modelsFlat.View, 0, len(pending))
+	for key, viewedAt := range pending {
+		views = append(views, modelsFlat.View{UserId: key.userId, FlatId: key.flatId, ViewedAt: viewedAt})
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	err := r.flatRepo.InsertViews(ctx, views)
+	if err != nil {
+		customErr := err.(customerror.CustomError)
+		customErr.AppendModule("viewRecorder.flush")
+		log.Println(customErr.Error())
+	}
+}
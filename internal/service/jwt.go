@@ -23,6 +23,7 @@ type Claims struct {
 type JWTServiceI interface {
 	GenerateToken(user *user.User, isAccess bool) (string, error)
 	ValidateToken(token string) (*user.User, error)
+	TokenExpiresAt(token string) (time.Time, error)
 }
 
 type JWTService struct {
@@ -87,3 +88,21 @@ func (jwtService *JWTService) ValidateToken(token string) (*user.User, error) {
 	return user, nil
 
 }
+
+// TokenExpiresAt возвращает срок действия уже проверенного токена, по нему закрываются websocket-соединения
+func (jwtService *JWTService) TokenExpiresAt(token string) (time.Time, error) {
+	tokenClaims := &Claims{}
+	_, err := jwt.ParseWithClaims(token, tokenClaims, func(t *jwt.Token) (interface{}, error) {
+		return []byte(jwtService.appConfig.SecretKey), nil
+	})
+	if err != nil {
+		if errors.Is(err, jwt.ErrTokenExpired) {
+			return time.Time{}, err
+		}
+		return time.Time{}, customerror.ErrJwtInvalid
+	}
+	if tokenClaims.ExpiresAt == nil {
+		return time.Time{}, customerror.ErrJwtInvalid
+	}
+	return tokenClaims.ExpiresAt.Time, nil
+}
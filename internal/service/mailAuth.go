@@ -2,14 +2,13 @@ package service
 
 import (
 	"context"
-	"crypto/tls"
 	"database/sql"
 	"log"
 	"mymate/internal/repository"
 	"mymate/pkg/customerror"
+	"mymate/pkg/mailer"
 	"mymate/pkg/security"
 	"mymate/pkg/user"
-	"net/smtp"
 	"time"
 
 	"github.com/google/uuid"
@@ -251,67 +250,10 @@ func (mailService *MailAuthService) ResetEmail(userId uuid.UUID, email string) e
 	return nil
 }
 func (mailService *MailAuthService) SendOTP(toMail string, otp string) {
-	from := mailService.from
-	password := mailService.mailToken
-
-	to := []string{toMail}
-	smtpHost := "smtp.mail.ru"
-	smtpPort := "465"
-
-	subject := "Subject: Благодарим за регистрацию на MyMate\r\n"
-	body := "\nВаш пароль: " + otp + "\n"
-	message := []byte(subject + "\r\n" + body)
-	conn, err := tls.Dial("tcp", smtpHost+":"+smtpPort, &tls.Config{
-		InsecureSkipVerify: true,
-		ServerName:         smtpHost,
-	})
-	if err != nil {
-		log.Println(err)
-		return
-	}
-
-	c, err := smtp.NewClient(conn, smtpHost)
-	if err != nil {
-		log.Println(err)
-		return
-	}
-
-	auth := smtp.PlainAuth("", from, password, smtpHost)
-	if err = c.Auth(auth); err != nil {
-		log.Println(err)
-		return
-	}
-
-	if err = c.Mail(from); err != nil {
-		log.Println(err)
-		return
-	}
-
-	for _, addr := range to {
-		if err = c.Rcpt(addr); err != nil {
-			log.Println(err)
-			return
-		}
-	}
-
-	w, err := c.Data()
-	if err != nil {
-		log.Println(err)
-		return
-	}
-
-	_, err = w.Write(message)
-	if err != nil {
-		log.Println(err)
-		return
-	}
-
-	err = w.Close()
+	err := mailer.NewMailer(mailService.from, mailService.mailToken).Send(toMail, "Благодарим за регистрацию на MyMate", "\nВаш пароль: "+otp+"\n")
 	if err != nil {
 		log.Println(err)
-		return
 	}
-	c.Quit()
 }
 func (mailService *MailAuthService) ValidateOTP(userId uuid.UUID, otp string) error {
 	ctx, close := context.WithTimeout(context.Background(), time.Minute)
@@ -0,0 +1,245 @@
+package service
+
+import (
+	"context"
+	"log"
+	"mymate/internal/repository"
+	"mymate/pkg/blobstore"
+	"mymate/pkg/customerror"
+	"mymate/pkg/media"
+	"mymate/pkg/upload"
+	"mymate/pkg/user"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Вложения чатов лежат под chat/<id беседы>/ и доступны только участникам беседы
+const privateMediaPrefix = "chat/"
+
+// Имена файлов вида <uuid>_<unix>.<ext> и их копии <uuid>_<unix>_<копия>.<ext> никогда не перезаписываются, такие файлы можно кэшировать навсегда
+var immutableMediaName = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}_[0-9]+(_[a-z]+)?\.[a-z0-9]+$`)
+
+type MediaServiceI interface {
+	// Open не ограничивает время жизни ctx: тело объекта читается уже после возврата
+	Open(ctx context.Context, key string) (*blobstore.Object, error)
+	IsPrivate(key string) bool
+	IsImmutable(key string) bool
+	CanAccess(key string, user *user.User) (bool, error)
+	VerifySignature(key string, expires string, signature string) bool
+	SignedURL(key string, ttl time.Duration) (string, error)
+	CollectGarbage(dryRun bool) (*media.GCReport, error)
+	RunGarbageCollector()
+	RunDeletionJobs()
+}
+
+// Ключи, которыми управляет приложение: фотографии объявлений и аватары. Остальное (заглушки, вложения чатов) сборщик не трогает.
+var managedMediaKey = regexp.MustCompile(`^(flats/[0-9]+|[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12})/[^/]+$`)
+
+type MediaService struct {
+	blobs            blobstore.BlobStore
+	conversationRepo repository.ConversationRepositoryI
+	mediaRepo        repository.MediaRepositoryI
+	// Файл без ссылки из базы моложе gcGrace не удаляется: загрузка пишет файл раньше строки в базе
+	gcGrace time.Duration
+	host    string
+	port    string
+}
+
+func NewMediaService(blobs blobstore.BlobStore, conversationRepo repository.ConversationRepositoryI, mediaRepo repository.MediaRepositoryI, gcGrace time.Duration, host string, port string) MediaServiceI {
+	return &MediaService{
+		blobs:            blobs,
+		conversationRepo: conversationRepo,
+		mediaRepo:        mediaRepo,
+		gcGrace:          gcGrace,
+		host:             host,
+		port:             port,
+	}
+}
+
+func (s *MediaService) Open(ctx context.Context, key string) (*blobstore.Object, error) {
+	// Части незавершенных загрузок наружу не отдаются
+	if strings.HasPrefix(key, upload.ChunkPrefix) {
+		return nil, blobstore.ErrNotFound
+	}
+	object, err := s.blobs.Get(ctx, key)
+	if err == blobstore.ErrNotFound || err == blobstore.ErrInvalidKey {
+		return nil, err
+	}
+	if err != nil {
+		return nil, customerror.NewError("MediaService.Open", s.host+":"+s.port, err.Error())
+	}
+	return object, nil
+}
+
+func (s *MediaService) IsPrivate(key string) bool {
+	return strings.HasPrefix(key, privateMediaPrefix)
+}
+
+func (s *MediaService) IsImmutable(key string) bool {
+	return immutableMediaName.MatchString(key[strings.LastIndex(key, "/")+1:])
+}
+
+func (s *MediaService) CanAccess(key string, user *user.User) (bool, error) {
+	if !s.IsPrivate(key) || user.IsSuperUser {
+		return true, nil
+	}
+	parts := strings.SplitN(strings.TrimPrefix(key, privateMediaPrefix), "/", 2)
+	conversationId, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || len(parts) < 2 {
+		return false, nil
+	}
+	ctx, close := context.WithTimeout(context.Background(), time.Minute)
+	defer close()
+	_, err = s.conversationRepo.GetMember(ctx, conversationId, user.UUID)
+	if err == pgx.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		customErr := err.(customerror.CustomError)
+		customErr.AppendModule("MediaService.CanAccess")
+		return false, customErr
+	}
+	return true, nil
+}
+
+// VerifySignature проверяет ссылку, выданную SignedURL. У S3 подписанные ссылки ведут в само хранилище, поэтому здесь они не проверяются.
+func (s *MediaService) VerifySignature(key string, expires string, signature string) bool {
+	verifier, ok := s.blobs.(interface {
+		VerifySignature(key, expires, signature string) bool
+	})
+	return ok && verifier.VerifySignature(key, expires, signature)
+}
+
+func (s *MediaService) SignedURL(key string, ttl time.Duration) (string, error) {
+	ctx, close := context.WithTimeout(context.Background(), time.Minute)
+	defer close()
+	signedURL, err := s.blobs.SignedURL(ctx, key, ttl)
+	if err != nil {
+		return "", customerror.NewError("MediaService.SignedURL", s.host+":"+s.port, err.Error())
+	}
+	return signedURL, nil
+}
+
+// CollectGarbage сверяет хранилище с базой: удаляет файлы, на которые ничего не ссылается дольше gcGrace,
+// и сообщает о строках базы, чьих файлов нет. Сами строки не меняются.
+func (s *MediaService) CollectGarbage(dryRun bool) (*media.GCReport, error) {
+	ctx, close := context.WithTimeout(context.Background(), 30*time.Minute)
+	defer close()
+	report := &media.GCReport{
+		DryRun:            dryRun,
+		Grace:             s.gcGrace.String(),
+		StartedAt:         time.Now(),
+		OrphanKeys:        []string{},
+		MissingReferences: []media.Reference{},
+	}
+	// Ссылки читаются до обхода хранилища, иначе файл, загруженный во время обхода, попал бы в пропавшие
+	references, err := s.mediaRepo.GetReferences(ctx)
+	if err != nil {
+		customErr := err.(customerror.CustomError)
+		customErr.AppendModule("MediaService.CollectGarbage")
+		return nil, customErr
+	}
+	referenced := make(map[string]bool, len(references))
+	for _, reference := range references {
+		referenced[reference.Key] = true
+	}
+	report.Referenced = int64(len(referenced))
+	found := map[string]bool{}
+	orphanBefore := report.StartedAt.Add(-s.gcGrace)
+	err = s.blobs.List(ctx, "", func(object blobstore.ObjectInfo) error {
+		report.Scanned++
+		if referenced[object.Key] {
+			found[object.Key] = true
+			return nil
+		}
+		if !managedMediaKey.MatchString(object.Key) || object.ModTime.After(orphanBefore) {
+			return nil
+		}
+		report.Orphans++
+		if len(report.OrphanKeys) < media.ReportListLimit {
+			report.OrphanKeys = append(report.OrphanKeys, object.Key)
+		}
+		if dryRun {
+			return nil
+		}
+		if err := s.blobs.Delete(ctx, object.Key); err != nil {
+			report.Failed++
+			log.Printf("ERROR|MediaService.CollectGarbage:%s", err.Error())
+			return nil
+		}
+		report.Deleted++
+		return nil
+	})
+	if err != nil {
+		return nil, customerror.NewError("MediaService.CollectGarbage.List", s.host+":"+s.port, err.Error())
+	}
+	for _, reference := range references {
+		if found[reference.Key] {
+			continue
+		}
+		report.Missing++
+		if len(report.MissingReferences) < media.ReportListLimit {
+			report.MissingReferences = append(report.MissingReferences, reference)
+		}
+	}
+	report.FinishedAt = time.Now()
+	return report, nil
+}
+
+func (s *MediaService) RunGarbageCollector() {
+	report, err := s.CollectGarbage(false)
+	if err != nil {
+		customErr := err.(customerror.CustomError)
+		customErr.AppendModule("MediaService.RunGarbageCollector")
+		log.Println(customErr.Error())
+		return
+	}
+	log.Printf("media gc: scanned %d, orphans %d, deleted %d, failed %d, missing %d",
+		report.Scanned, report.Orphans, report.Deleted, report.Failed, report.Missing)
+	for _, reference := range report.MissingReferences {
+		log.Printf("media gc: %s %s points to missing %s", reference.Kind, reference.Id, reference.Key)
+	}
+}
+
+// RunDeletionJobs удаляет файлы из очереди media_deletion_jobs. Неудачное задание откладывается с растущей паузой и повторяется,
+// пока файл не удалится. Мертвым помечается только задание с ключом, который хранилище отвергает.
+func (s *MediaService) RunDeletionJobs() {
+	ctx, close := context.WithTimeout(context.Background(), 30*time.Minute)
+	defer close()
+	for {
+		jobs, err := s.mediaRepo.ClaimDeletionJobs(ctx, media.DeletionBatchSize, media.DeletionLease)
+		if err != nil {
+			customErr := err.(customerror.CustomError)
+			customErr.AppendModule("MediaService.RunDeletionJobs")
+			log.Println(customErr.Error())
+			return
+		}
+		for _, job := range jobs {
+			err = s.blobs.Delete(ctx, job.Key)
+			switch {
+			case err == nil:
+				err = s.mediaRepo.DeleteDeletionJob(ctx, job.Id)
+			// Ключ, который хранилище отвергает, не удалится никогда, повторять бессмысленно
+			case err == blobstore.ErrInvalidKey:
+				log.Printf("ERROR|MediaService.RunDeletionJobs:%s: invalid key, job marked dead: %s", job.Key, err.Error())
+				err = s.mediaRepo.MarkDeletionJobDead(ctx, job.Id, err.Error())
+			default:
+				log.Printf("ERROR|MediaService.RunDeletionJobs:%s: attempt %d: %s", job.Key, job.Attempts+1, err.Error())
+				err = s.mediaRepo.FailDeletionJob(ctx, job.Id, err.Error(), media.DeletionRetryDelay(job.Attempts+1))
+			}
+			// Если записать результат не удалось, задание вернется в очередь после DeletionLease
+			if err != nil {
+				customErr := err.(customerror.CustomError)
+				customErr.AppendModule("MediaService.RunDeletionJobs")
+				log.Println(customErr.Error())
+			}
+		}
+		if len(jobs) < media.DeletionBatchSize {
+			return
+		}
+	}
+}
@@ -0,0 +1,227 @@
+package service
+
+import (
+	"context"
+	"mymate/internal/repository"
+	"mymate/pkg/customerror"
+	"mymate/pkg/moderation"
+	"mymate/pkg/user"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+// Сколько последних сообщений переписки сохраняется в жалобе
+const reportExcerptSize = 50
+
+type ModerationServiceI interface {
+	BlockUser(blocker *user.User, blockedId uuid.UUID) error
+	UnblockUser(blocker *user.User, blockedId uuid.UUID) error
+	GetBlocks(blockerId uuid.UUID) ([]moderation.UserBlock, error)
+	ReportUser(reporter *user.User, reportedId uuid.UUID, reason string) (int64, error)
+	GetReports(status string, offset int64, limit int64) ([]moderation.Report, error)
+	UpdateReportStatus(id int64, status string) error
+	GetChatStats(days int64, offset int64, limit int64) ([]moderation.ChatStats, error)
+	UnmuteUser(userId uuid.UUID) error
+	GetDuplicateImageFlags(status string, offset int64, limit int64) ([]moderation.DuplicateImageFlag, error)
+	UpdateDuplicateImageFlagStatus(id int64, status string) error
+}
+
+type ModerationService struct {
+	moderationRepo repository.ModerationRepositoryI
+	userRepo       repository.UserRepositoryI
+	chatRepo       repository.ChatRepositoryI
+	host           string
+	port           string
+}
+
+func NewModerationService(moderationRepo repository.ModerationRepositoryI, userRepo repository.UserRepositoryI, chatRepo repository.ChatRepositoryI, host string, port string) ModerationServiceI {
+	return &ModerationService{
+		moderationRepo: moderationRepo,
+		userRepo:       userRepo,
+		chatRepo:       chatRepo,
+		host:           host,
+		port:           port,
+	}
+}
+
+func (s *ModerationService) BlockUser(blocker *user.User, blockedId uuid.UUID) error {
+	if blocker.UUID == blockedId {
+		return customerror.ErrSelfAction
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	_, err := s.userRepo.GetUser(ctx, blockedId)
+	if err == pgx.ErrNoRows {
+		return err
+	}
+	if err != nil {
+		customErr := err.(customerror.CustomError)
+		customErr.AppendModule("ModerationService.BlockUser")
+		return customErr
+	}
+	err = s.moderationRepo.BlockUser(ctx, blocker.UUID, blockedId)
+	if err != nil {
+		customErr := err.(customerror.CustomError)
+		customErr.AppendModule("ModerationService.BlockUser")
+		return customErr
+	}
+	return nil
+}
+
+func (s *ModerationService) UnblockUser(blocker *user.User, blockedId uuid.UUID) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	err := s.moderationRepo.UnblockUser(ctx, blocker.UUID, blockedId)
+	if err == pgx.ErrNoRows {
+		return err
+	}
+	if err != nil {
+		customErr := err.(customerror.CustomError)
+		customErr.AppendModule("ModerationService.UnblockUser")
+		return customErr
+	}
+	return nil
+}
+
+func (s *ModerationService) GetBlocks(blockerId uuid.UUID) ([]moderation.UserBlock, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	blocks, err := s.moderationRepo.GetBlocks(ctx, blockerId)
+	if err != nil {
+		customErr := err.(customerror.CustomError)
+		customErr.AppendModule("ModerationService.GetBlocks")
+		return nil, customErr
+	}
+	return blocks, nil
+}
+
+// ReportUser сохраняет жалобу вместе с последними сообщениями переписки, чтобы модератор видел контекст,
+// даже если сообщения потом будут удалены.
+func (s *ModerationService) ReportUser(reporter *user.User, reportedId uuid.UUID, reason string) (int64, error) {
+	if reporter.UUID == reportedId {
+		return 0, customerror.ErrSelfAction
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	_, err := s.userRepo.GetUser(ctx, reportedId)
+	if err == pgx.ErrNoRows {
+		return 0, err
+	}
+	if err != nil {
+		customErr := err.(customerror.CustomError)
+		customErr.AppendModule("ModerationService.ReportUser")
+		return 0, customErr
+	}
+	excerpt, err := s.chatRepo.GetReportExcerpt(ctx, reporter.UUID, reportedId, reportExcerptSize)
+	if err != nil {
+		customErr := err.(customerror.CustomError)
+		customErr.AppendModule("ModerationService.ReportUser")
+		return 0, customErr
+	}
+	report := moderation.Report{
+		ReporterId: reporter.UUID,
+		ReportedId: reportedId,
+		Reason:     reason,
+		Excerpt:    excerpt,
+		Status:     moderation.ReportStatusPending,
+	}
+	id, err := s.moderationRepo.InsertReport(ctx, &report)
+	if err != nil {
+		customErr := err.(customerror.CustomError)
+		customErr.AppendModule("ModerationService.ReportUser")
+		return 0, customErr
+	}
+	return id, nil
+}
+
+func (s *ModerationService) GetReports(status string, offset int64, limit int64) ([]moderation.Report, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	reports, err := s.moderationRepo.GetReports(ctx, status, offset, limit)
+	if err != nil {
+		customErr := err.(customerror.CustomError)
+		customErr.AppendModule("ModerationService.GetReports")
+		return nil, customErr
+	}
+	return reports, nil
+}
+
+func (s *ModerationService) UpdateReportStatus(id int64, status string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	err := s.moderationRepo.UpdateReportStatus(ctx, id, status)
+	if err == pgx.ErrNoRows {
+		return err
+	}
+	if err != nil {
+		customErr := err.(customerror.CustomError)
+		customErr.AppendModule("ModerationService.UpdateReportStatus")
+		return customErr
+	}
+	return nil
+}
+
+func (s *ModerationService) GetChatStats(days int64, offset int64, limit int64) ([]moderation.ChatStats, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	since := time.Now().AddDate(0, 0, -int(days-1))
+	stats, err := s.moderationRepo.GetChatStats(ctx, since, offset, limit)
+	if err != nil {
+		customErr := err.(customerror.CustomError)
+		customErr.AppendModule("ModerationService.GetChatStats")
+		return nil, customErr
+	}
+	for i := range stats {
+		stats[i].User, err = s.userRepo.GetUser(ctx, stats[i].UserId)
+		if err != nil && err != pgx.ErrNoRows {
+			customErr := err.(customerror.CustomError)
+			customErr.AppendModule("ModerationService.GetChatStats")
+			return nil, customErr
+		}
+	}
+	return stats, nil
+}
+
+func (s *ModerationService) UnmuteUser(userId uuid.UUID) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	err := s.moderationRepo.UnmuteUser(ctx, userId)
+	if err == pgx.ErrNoRows {
+		return err
+	}
+	if err != nil {
+		customErr := err.(customerror.CustomError)
+		customErr.AppendModule("ModerationService.UnmuteUser")
+		return customErr
+	}
+	return nil
+}
+
+func (s *ModerationService) GetDuplicateImageFlags(status string, offset int64, limit int64) ([]moderation.DuplicateImageFlag, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	flags, err := s.moderationRepo.GetDuplicateImageFlags(ctx, status, offset, limit)
+	if err != nil {
+		customErr := err.(customerror.CustomError)
+		customErr.AppendModule("ModerationService.GetDuplicateImageFlags")
+		return nil, customErr
+	}
+	return flags, nil
+}
+
+func (s *ModerationService) UpdateDuplicateImageFlagStatus(id int64, status string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	err := s.moderationRepo.UpdateDuplicateImageFlagStatus(ctx, id, status)
+	if err == pgx.ErrNoRows {
+		return err
+	}
+	if err != nil {
+		customErr := err.(customerror.CustomError)
+		customErr.AppendModule("ModerationService.UpdateDuplicateImageFlagStatus")
+		return customErr
+	}
+	return nil
+}
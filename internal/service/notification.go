@@ -0,0 +1,348 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"html"
+	"log"
+	"mymate/internal/repository"
+	"mymate/pkg/customerror"
+	"mymate/pkg/messagebus"
+	"mymate/pkg/notification"
+	"mymate/pkg/telegrambot"
+	"mymate/pkg/user"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	// Размер очереди уведомлений. При переполнении новые уведомления отбрасываются, чтобы не тормозить чат.
+	notificationQueueSize = 1024
+	// Сколько горутин параллельно отправляют уведомления провайдерам
+	notificationWorkers = 4
+	// За сколько до удаления объявления (через месяц после создания) владелец получает предупреждение
+	listingExpiryWarning = 3 * 24 * time.Hour
+	// Максимальная длина токена устройства
+	maxDeviceTokenLength = 4096
+)
+
+type NotificationServiceI interface {
+	RegisterDevice(user *user.User, platform string, token string) (*notification.Device, error)
+	UnregisterDevice(user *user.User, token string) error
+	GetPreferences(user *user.User) (*notification.Preferences, error)
+	UpdatePreferences(user *user.User, update *notification.PreferencesUpdate) (*notification.Preferences, error)
+	GetNotifications(user *user.User, unreadOnly bool, offset int64, limit int64) ([]notification.Notification, int64, error)
+	MarkRead(user *user.User, id int64) error
+	MarkAllRead(user *user.User) (int64, error)
+	Notify(notification *notification.Notification) error
+	NotifyExpiringFlats()
+	Run(ctx context.Context)
+}
+
+type NotificationService struct {
+	NotificationRepo repository.NotificationRepositoryI
+	FlatRepo         repository.FlatRepositoryI
+	UserRepo         repository.UserRepositoryI
+	// Через шину чата сохраненные уведомления доставляются в открытые websocket-соединения
+	Bus messagebus.MessageBusI
+	// Отправщик для каждой платформы устройства
+	Senders  map[string]notification.Sender
+	Telegram *telegrambot.Client
+	// Ссылка на Mini App (https://t.me/<bot>/<app>), к ней добавляется startapp. Пустая ссылка - сообщения без кнопки.
+	MiniAppURL string
+	queue      chan *notification.Notification
+	Host       string
+	Port       string
+}
+
+func NewNotificationService(notificationRepo repository.NotificationRepositoryI, flatRepo repository.FlatRepositoryI, userRepo repository.UserRepositoryI, bus messagebus.MessageBusI, senders map[string]notification.Sender, telegram *telegrambot.Client, miniAppURL string, host string, port string) NotificationServiceI {
+	return &NotificationService{
+		NotificationRepo: notificationRepo,
+		FlatRepo:         flatRepo,
+		UserRepo:         userRepo,
+		Bus:              bus,
+		Senders:          senders,
+		Telegram:         telegram,
+		MiniAppURL:       miniAppURL,
+		queue:            make(chan *notification.Notification, notificationQueueSize),
+		Host:             host,
+		Port:             port,
+	}
+}
+
+// validDeviceToken отсекает мусор до обращения к провайдеру. Токен APNs - hex-строка, он подставляется в путь запроса.
+func validDeviceToken(platform string, token string) bool {
+	if token == "" || len(token) > maxDeviceTokenLength {
+		return false
+	}
+	for _, r := range token {
+		if platform == notification.PlatformIOS && !unicode.Is(unicode.ASCII_Hex_Digit, r) {
+			return false
+		}
+		if r > unicode.MaxASCII || unicode.IsSpace(r) || unicode.IsControl(r) {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *NotificationService) RegisterDevice(user *user.User, platform string, token string) (*notification.Device, error) {
+	if !validDeviceToken(platform, token) {
+		return nil, customerror.ErrInvalidDeviceToken
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	device := &notification.Device{
+		UserId:   user.UUID,
+		Platform: platform,
+		Token:    token,
+	}
+	err := s.NotificationRepo.UpsertDevice(ctx, device)
+	if err != nil {
+		customErr := err.(customerror.CustomError)
+		customErr.AppendModule("NotificationService.RegisterDevice")
+		return nil, customErr
+	}
+	return device, nil
+}
+
+func (s *NotificationService) UnregisterDevice(user *user.User, token string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	err := s.NotificationRepo.DeleteDevice(ctx, user.UUID, token)
+	if err == pgx.ErrNoRows {
+		return err
+	}
+	if err != nil {
+		customErr := err.(customerror.CustomError)
+		customErr.AppendModule("NotificationService.UnregisterDevice")
+		return customErr
+	}
+	return nil
+}
+
+func (s *NotificationService) GetPreferences(user *user.User) (*notification.Preferences, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	preferences, err := s.NotificationRepo.GetPreferences(ctx, user.UUID)
+	if err != nil {
+		customErr := err.(customerror.CustomError)
+		customErr.AppendModule("NotificationService.GetPreferences")
+		return nil, customErr
+	}
+	return preferences, nil
+}
+
+func (s *NotificationService) UpdatePreferences(user *user.User, update *notification.PreferencesUpdate) (*notification.Preferences, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	preferences, err := s.NotificationRepo.GetPreferences(ctx, user.UUID)
+	if err != nil {
+		customErr := err.(customerror.CustomError)
+		customErr.AppendModule("NotificationService.UpdatePreferences")
+		return nil, customErr
+	}
+	if update.Telegram != nil && *update.Telegram && user.TelegramId == 0 {
+		return nil, customerror.ErrTelegramNotLinked
+	}
+	update.Apply(preferences)
+	err = s.NotificationRepo.UpsertPreferences(ctx, preferences)
+	if err != nil {
+		customErr := err.(customerror.CustomError)
+		customErr.AppendModule("NotificationService.UpdatePreferences")
+		return nil, customErr
+	}
+	return preferences, nil
+}
+
+// GetNotifications возвращает уведомления пользователя, новые первыми, и общее число непрочитанных
+func (s *NotificationService) GetNotifications(user *user.User, unreadOnly bool, offset int64, limit int64) ([]notification.Notification, int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	notifications, err := s.NotificationRepo.GetNotifications(ctx, user.UUID, unreadOnly, offset, limit)
+	if err != nil {
+		customErr := err.(customerror.CustomError)
+		customErr.AppendModule("NotificationService.GetNotifications")
+		return nil, 0, customErr
+	}
+	unread, err := s.NotificationRepo.CountUnread(ctx, user.UUID)
+	if err != nil {
+		customErr := err.(customerror.CustomError)
+		customErr.AppendModule("NotificationService.GetNotifications")
+		return nil, 0, customErr
+	}
+	return notifications, unread, nil
+}
+
+func (s *NotificationService) MarkRead(user *user.User, id int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	err := s.NotificationRepo.MarkRead(ctx, user.UUID, id)
+	if err == pgx.ErrNoRows {
+		return err
+	}
+	if err != nil {
+		customErr := err.(customerror.CustomError)
+		customErr.AppendModule("NotificationService.MarkRead")
+		return customErr
+	}
+	return nil
+}
+
+func (s *NotificationService) MarkAllRead(user *user.User) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	count, err := s.NotificationRepo.MarkAllRead(ctx, user.UUID)
+	if err != nil {
+		customErr := err.(customerror.CustomError)
+		customErr.AppendModule("NotificationService.MarkAllRead")
+		return 0, customErr
+	}
+	return count, nil
+}
+
+// Notify ставит уведомление в очередь и сразу возвращает управление. Отправку выполняет Run.
+func (s *NotificationService) Notify(n *notification.Notification) error {
+	select {
+	case s.queue <- n:
+		return nil
+	default:
+		log.Printf("notification queue overflow, dropping %s for user %s", n.Type, n.UserId)
+		return notification.ErrQueueFull
+	}
+}
+
+// Run разбирает очередь уведомлений, пока не отменен ctx
+func (s *NotificationService) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for range notificationWorkers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case notification := <-s.queue:
+					s.send(notification)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// send сохраняет уведомление в центре уведомлений и сразу показывает его в открытых websocket-соединениях,
+// затем доставляет на все устройства пользователя, если он не отключил уведомления этого типа.
+// Устройства, токены которых провайдер больше не принимает, удаляются.
+func (s *NotificationService) send(n *notification.Notification) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	if notification.Stored(n.Type) {
+		err := s.NotificationRepo.InsertNotification(ctx, n)
+		if err != nil {
+			log.Println(err.Error())
+		} else {
+			err = publishToUsers(s.Bus, &WebsocketEvent{Event: EventNotification, Notification: n}, n.UserId)
+			if err != nil {
+				log.Println(err.Error())
+			}
+		}
+	}
+	if !notification.Pushable(n.Type) {
+		return
+	}
+	preferences, err := s.NotificationRepo.GetPreferences(ctx, n.UserId)
+	if err != nil {
+		log.Println(err.Error())
+		return
+	}
+	if !preferences.Allows(n.Type) {
+		return
+	}
+	devices, err := s.NotificationRepo.GetDevices(ctx, n.UserId)
+	if err != nil {
+		log.Println(err.Error())
+		return
+	}
+	for i := range devices {
+		sender, ok := s.Senders[devices[i].Platform]
+		if !ok {
+			continue
+		}
+		err := sender.Send(ctx, &devices[i], n)
+		if errors.Is(err, notification.ErrInvalidToken) {
+			err = s.NotificationRepo.DeleteDeviceByToken(ctx, devices[i].Token)
+		}
+		if err != nil {
+			log.Println(err.Error())
+		}
+	}
+	if preferences.Telegram {
+		s.sendTelegram(ctx, preferences, n)
+	}
+}
+
+// sendTelegram дублирует уведомление в личный чат с ботом. Если бот больше не может писать пользователю,
+// настройка выключается, чтобы не повторять заведомо неудачные запросы.
+func (s *NotificationService) sendTelegram(ctx context.Context, preferences *notification.Preferences, n *notification.Notification) {
+	user, err := s.UserRepo.GetUser(ctx, n.UserId)
+	if err != nil {
+		if err != pgx.ErrNoRows {
+			log.Println(err.Error())
+		}
+		return
+	}
+	if user.TelegramId == 0 {
+		return
+	}
+	var button *telegrambot.InlineKeyboardButton
+	if s.MiniAppURL != "" {
+		link := s.MiniAppURL
+		if n.Link != "" {
+			link += "?startapp=" + url.QueryEscape(n.Link)
+		}
+		button = &telegrambot.InlineKeyboardButton{Text: "Открыть MyMate", Url: link}
+	}
+	text := "<b>" + html.EscapeString(n.Title) + "</b>\n" + html.EscapeString(n.Body)
+	err = s.Telegram.SendMessage(ctx, user.TelegramId, text, button)
+	if err == telegrambot.ErrChatUnavailable {
+		preferences.Telegram = false
+		err = s.NotificationRepo.UpsertPreferences(ctx, preferences)
+	}
+	if err != nil {
+		log.Println(err.Error())
+	}
+}
+
+// NotifyExpiringFlats предупреждает владельцев объявлений, которые скоро удалит ежемесячная очистка
+func (s *NotificationService) NotifyExpiringFlats() {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	flats, err := s.FlatRepo.ClaimExpiringFlats(ctx, time.Now().AddDate(0, -1, 0).Add(listingExpiryWarning))
+	if err != nil {
+		customErr := err.(customerror.CustomError)
+		customErr.AppendModule("NotificationService.NotifyExpiringFlats")
+		log.Println(customErr.Error())
+		return
+	}
+	for _, flat := range flats {
+		expiresAt := flat.CreatedAt.AddDate(0, 1, 0)
+		s.Notify(&notification.Notification{
+			Type:   notification.TypeListingExpiry,
+			UserId: flat.CreatedById,
+			Title:  "Объявление скоро будет удалено",
+			Body:   "Объявление «" + flat.Name + "» будет удалено после " + expiresAt.Format("02.01.2006") + ".",
+			Data: map[string]string{
+				"flat_id":    strconv.FormatInt(flat.Id, 10),
+				"expires_at": expiresAt.Format(time.RFC3339),
+			},
+			Link: notification.FlatLink(flat.Id),
+		})
+	}
+}
@@ -1,9 +1,13 @@
 package service
 
 import (
+	"bytes"
 	"context"
+	"log"
 	"mymate/internal/repository"
 	"mymate/pkg/customerror"
+	"mymate/pkg/imageproc"
+	"mymate/pkg/telegrambot"
 	"mymate/pkg/user"
 	"time"
 
@@ -17,16 +21,20 @@ type TelegramAuthenticationServiceI interface {
 }
 
 type TelegramAuthenticationService struct {
-	userRepo repository.UserRepositoryI
-	host     string
-	port     string
+	userRepo    repository.UserRepositoryI
+	userService UserServiceI
+	telegram    *telegrambot.Client
+	host        string
+	port        string
 }
 
-func NewTelegramAuthService(userRepo repository.UserRepositoryI, host, port string) TelegramAuthenticationServiceI {
+func NewTelegramAuthService(userRepo repository.UserRepositoryI, userService UserServiceI, telegram *telegrambot.Client, host, port string) TelegramAuthenticationServiceI {
 	return &TelegramAuthenticationService{
-		userRepo: userRepo,
-		host:     host,
-		port:     port,
+		userRepo:    userRepo,
+		userService: userService,
+		telegram:    telegram,
+		host:        host,
+		port:        port,
 	}
 }
 
@@ -75,6 +83,7 @@ func (tAuthService *TelegramAuthenticationService) SignUp(telegramId int64, firs
 		}
 		err = tAuthService.userRepo.InsertUser(ctx, &tempUser)
 		if err == nil {
+			go tAuthService.importProfilePhoto(tempUser.UUID, telegramId)
 			return &tempUser, nil
 		}
 		if err != customerror.ErrUUIDAlreadyExists {
@@ -85,3 +94,40 @@ func (tAuthService *TelegramAuthenticationService) SignUp(telegramId int64, firs
 	}
 	return nil, customerror.NewError("TelegramAuthenticationService.SignUp.InsertingUser", tAuthService.host+":"+tAuthService.port, "Retries Ended")
 }
+
+// importProfilePhoto делает фотографию профиля Telegram аватаром нового пользователя.
+// Фотография может быть скрыта настройками приватности, тогда остается аватар с инициалами.
+func (tAuthService *TelegramAuthenticationService) importProfilePhoto(id uuid.UUID, telegramId int64) {
+	// Импорт идет в отдельной горутине, вне Recovery gin: паника здесь остановила бы весь сервер
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("recovered from panic in importProfilePhoto for user %s: %v", id, r)
+		}
+	}()
+	if tAuthService.telegram == nil || tAuthService.telegram.Token == "" {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	data, err := tAuthService.telegram.DownloadProfilePhoto(ctx, telegramId, imageproc.DefaultLimits.MaxBytes)
+	if err == telegrambot.ErrNoProfilePhoto {
+		return
+	}
+	if err != nil {
+		log.Println(err.Error())
+		return
+	}
+	user, err := tAuthService.userService.GetUser(id)
+	if err != nil {
+		log.Printf("ERROR|TelegramAuthenticationService.importProfilePhoto:%s", err.Error())
+		return
+	}
+	// Пока фотография скачивалась, пользователь мог загрузить свой аватар
+	if user.AvatarFileName != "" {
+		return
+	}
+	err = tAuthService.userService.SaveUserAvatarFrom(user, bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		log.Printf("ERROR|TelegramAuthenticationService.importProfilePhoto:%s", err.Error())
+	}
+}
@@ -0,0 +1,363 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log"
+	"mymate/internal/repository"
+	"mymate/pkg/blobstore"
+	"mymate/pkg/customerror"
+	modelsFlat "mymate/pkg/flat"
+	"mymate/pkg/imageproc"
+	"mymate/pkg/upload"
+	"mymate/pkg/user"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+type UploadServiceI interface {
+	CreateUpload(user *user.User, session *upload.Session) (*upload.Session, error)
+	GetUpload(user *user.User, id uuid.UUID) (*upload.Session, error)
+	// PatchUpload дописывает часть data со смещения offset. После последней части создает фотографию или аватар.
+	// Пустой data при полностью загруженном файле повторяет неудавшуюся обработку.
+	PatchUpload(user *user.User, id uuid.UUID, offset int64, data []byte) (*upload.Session, *upload.Result, error)
+	DeleteUpload(user *user.User, id uuid.UUID) error
+	CleanUploads()
+}
+
+type UploadService struct {
+	uploadRepo  repository.UploadRepositoryI
+	flatService FlatServiceI
+	userService UserServiceI
+	blobs       blobstore.BlobStore
+	ttl         time.Duration
+	host        string
+	port        string
+}
+
+func NewUploadService(uploadRepo repository.UploadRepositoryI, flatService FlatServiceI, userService UserServiceI, blobs blobstore.BlobStore, ttl time.Duration, host string, port string) UploadServiceI {
+	return &UploadService{
+		uploadRepo:  uploadRepo,
+		flatService: flatService,
+		userService: userService,
+		blobs:       blobs,
+		ttl:         ttl,
+		host:        host,
+		port:        port,
+	}
+}
+
+// CreateUpload заранее проверяет то, что известно до загрузки: размер, расширение, владельца и заполненность галереи
+func (s *UploadService) CreateUpload(user *user.User, session *upload.Session) (*upload.Session, error) {
+	if session.Size > imageproc.DefaultLimits.MaxBytes {
+		return nil, customerror.ErrImageTooLarge
+	}
+	ext := strings.ToLower(filepath.Ext(session.Filename))
+	if ext != ".jpg" && ext != ".jpeg" && ext != ".png" && ext != ".webp" {
+		return nil, customerror.ErrInvalidImage
+	}
+	if session.Kind == upload.KindFlatImage {
+		flat, err := s.flatService.GetFlat(session.FlatId)
+		if err == pgx.ErrNoRows {
+			return nil, err
+		}
+		if err != nil {
+			customErr := err.(customerror.CustomError)
+			customErr.AppendModule("UploadService.CreateUpload")
+			return nil, customErr
+		}
+		if flat.CreatedById != user.UUID && !user.IsSuperUser {
+			return nil, customerror.ErrForbidden
+		}
+		images, err := s.flatService.GetFlatImages(flat.Id)
+		if err != nil {
+			customErr := err.(customerror.CustomError)
+			customErr.AppendModule("UploadService.CreateUpload")
+			return nil, customErr
+		}
+		if len(images) >= modelsFlat.MaxImages {
+			return nil, customerror.ErrTooManyImages
+		}
+	} else {
+		session.FlatId = 0
+	}
+	session.Id = uuid.New()
+	session.UserId = user.UUID
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	err := s.uploadRepo.InsertUpload(ctx, session, s.ttl)
+	if err != nil {
+		customErr := err.(customerror.CustomError)
+		customErr.AppendModule("UploadService.CreateUpload")
+		return nil, customErr
+	}
+	return session, nil
+}
+
+// GetUpload отвечает pgx.ErrNoRows и на чужую сессию, чтобы не раскрывать ее существование
+func (s *UploadService) GetUpload(user *user.User, id uuid.UUID) (*upload.Session, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	session, err := s.uploadRepo.GetUpload(ctx, id)
+	if err == pgx.ErrNoRows {
+		return nil, err
+	}
+	if err != nil {
+		customErr := err.(customerror.CustomError)
+		customErr.AppendModule("UploadService.GetUpload")
+		return nil, customErr
+	}
+	if session.UserId != user.UUID {
+		return nil, pgx.ErrNoRows
+	}
+	return session, nil
+}
+
+func (s *UploadService) PatchUpload(user *user.User, id uuid.UUID, offset int64, data []byte) (*upload.Session, *upload.Result, error) {
+	session, err := s.GetUpload(user, id)
+	if err != nil {
+		return nil, nil, err
+	}
+	if session.Offset != offset || session.Status != upload.StatusUploading {
+		return nil, nil, customerror.ErrUploadConflict
+	}
+	if offset+int64(len(data)) > session.Size {
+		return nil, nil, customerror.ErrImageTooLarge
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	if len(data) > 0 {
+		key := upload.ChunkKey(session.Id, offset)
+		err = s.blobs.Put(ctx, key, bytes.NewReader(data), int64(len(data)), "application/octet-stream")
+		if err != nil {
+			return nil, nil, customerror.NewError("UploadService.PatchUpload.Put", s.host+":"+s.port, err.Error())
+		}
+		session, err = s.uploadRepo.AppendChunk(ctx, id, offset, int64(len(data)), key, s.ttl)
+		if err != nil {
+			go s.deleteChunks([]string{key})
+		}
+		if err == customerror.ErrUploadConflict {
+			return nil, nil, err
+		}
+		if err != nil {
+			customErr := err.(customerror.CustomError)
+			customErr.AppendModule("UploadService.PatchUpload")
+			return nil, nil, customErr
+		}
+	}
+	if !session.Complete() {
+		return session, nil, nil
+	}
+	// Захват статуса не дает двум последним запросам обработать файл дважды
+	err = s.uploadRepo.SetUploadStatus(ctx, id, upload.StatusUploading, upload.StatusProcessing)
+	if err == customerror.ErrUploadConflict {
+		return nil, nil, err
+	}
+	if err != nil {
+		customErr := err.(customerror.CustomError)
+		customErr.AppendModule("UploadService.PatchUpload")
+		return nil, nil, customErr
+	}
+	session.Status = upload.StatusProcessing
+	result, err := s.finish(session)
+	if err == customerror.ErrInvalidImage || err == customerror.ErrImageTooLarge || err == customerror.ErrTooManyImages || err == pgx.ErrNoRows {
+		// Повтор не поможет: сессия больше не нужна
+		s.discard(session.Id)
+		return nil, nil, err
+	}
+	if err != nil {
+		// Сессия возвращается в загрузку, клиент может повторить обработку пустым PATCH
+		releaseErr := s.uploadRepo.SetUploadStatus(ctx, id, upload.StatusProcessing, upload.StatusUploading)
+		if releaseErr != nil && releaseErr != customerror.ErrUploadConflict {
+			log.Println(releaseErr.Error())
+		}
+		customErr := err.(customerror.CustomError)
+		customErr.AppendModule("UploadService.PatchUpload")
+		return nil, nil, customErr
+	}
+	s.discard(session.Id)
+	session.Status = upload.StatusCompleted
+	return session, result, nil
+}
+
+// finish собирает файл из частей и передает его туда же, куда попадает обычная загрузка формой
+func (s *UploadService) finish(session *upload.Session) (*upload.Result, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+	src := &chunkReader{ctx: ctx, blobs: s.blobs, keys: session.Chunks}
+	defer src.Close()
+	switch session.Kind {
+	case upload.KindFlatImage:
+		flat, err := s.flatService.GetFlat(session.FlatId)
+		if err != nil {
+			return nil, err
+		}
+		image, err := s.flatService.InsertFlatImageFrom(src, session.Size, flat)
+		if err != nil {
+			return nil, err
+		}
+		return &upload.Result{Image: image}, nil
+	case upload.KindAvatar:
+		owner, err := s.userService.GetUser(session.UserId)
+		if err != nil {
+			return nil, err
+		}
+		err = s.userService.SaveUserAvatarFrom(owner, src, session.Size)
+		if err != nil {
+			return nil, err
+		}
+		return &upload.Result{User: owner}, nil
+	}
+	return nil, customerror.NewError("UploadService.finish", s.host+":"+s.port, "unknown upload kind "+session.Kind)
+}
+
+func (s *UploadService) DeleteUpload(user *user.User, id uuid.UUID) error {
+	session, err := s.GetUpload(user, id)
+	if err != nil {
+		return err
+	}
+	if session.Status != upload.StatusUploading {
+		return customerror.ErrUploadConflict
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	chunks, err := s.uploadRepo.DeleteUpload(ctx, id)
+	if err == pgx.ErrNoRows {
+		return err
+	}
+	if err != nil {
+		customErr := err.(customerror.CustomError)
+		customErr.AppendModule("UploadService.DeleteUpload")
+		return customErr
+	}
+	go s.deleteChunks(chunks)
+	return nil
+}
+
+// CleanUploads удаляет просроченные сессии с их частями, а также части без сессии
+// (сессия удаляется вместе с объявлением или пользователем)
+func (s *UploadService) CleanUploads() {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Minute)
+	defer cancel()
+	sessions, err := s.uploadRepo.DeleteExpiredUploads(ctx)
+	if err != nil {
+		log.Println(err.Error())
+		return
+	}
+	for _, session := range sessions {
+		s.deleteChunks(session.Chunks)
+	}
+	orphans := map[uuid.UUID][]string{}
+	before := time.Now().Add(-s.ttl)
+	err = s.blobs.List(ctx, upload.ChunkPrefix, func(info blobstore.ObjectInfo) error {
+		if info.ModTime.After(before) {
+			return nil
+		}
+		dir, _, _ := strings.Cut(strings.TrimPrefix(info.Key, upload.ChunkPrefix), "/")
+		id, err := uuid.Parse(dir)
+		if err != nil {
+			return nil
+		}
+		orphans[id] = append(orphans[id], info.Key)
+		return nil
+	})
+	if err != nil {
+		log.Printf("ERROR|UploadService.CleanUploads:%s", err.Error())
+		return
+	}
+	if len(orphans) == 0 {
+		log.Printf("Upload cleaner: %d expired sessions removed", len(sessions))
+		return
+	}
+	ids := make([]uuid.UUID, 0, len(orphans))
+	for id := range orphans {
+		ids = append(ids, id)
+	}
+	existing, err := s.uploadRepo.GetExistingUploads(ctx, ids)
+	if err != nil {
+		log.Println(err.Error())
+		return
+	}
+	for _, id := range existing {
+		delete(orphans, id)
+	}
+	chunks := 0
+	for _, keys := range orphans {
+		s.deleteChunks(keys)
+		chunks += len(keys)
+	}
+	log.Printf("Upload cleaner: %d expired sessions removed, %d orphaned chunks deleted", len(sessions), chunks)
+}
+
+func (s *UploadService) discard(id uuid.UUID) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	chunks, err := s.uploadRepo.DeleteUpload(ctx, id)
+	if err == pgx.ErrNoRows {
+		return
+	}
+	if err != nil {
+		log.Println(err.Error())
+		return
+	}
+	go s.deleteChunks(chunks)
+}
+
+func (s *UploadService) deleteChunks(keys []string) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	for _, key := range keys {
+		err := s.blobs.Delete(ctx, key)
+		if err != nil {
+			log.Printf("ERROR|UploadService.deleteChunks:%s", err.Error())
+		}
+	}
+}
+
+// chunkReader последовательно читает части загрузки из хранилища, открывая следующую только когда закончилась предыдущая
+type chunkReader struct {
+	ctx     context.Context
+	blobs   blobstore.BlobStore
+	keys    []string
+	current io.ReadCloser
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	for {
+		if r.current == nil {
+			if len(r.keys) == 0 {
+				return 0, io.EOF
+			}
+			object, err := r.blobs.Get(r.ctx, r.keys[0])
+			if err != nil {
+				return 0, err
+			}
+			r.keys = r.keys[1:]
+			r.current = object.Body
+		}
+		n, err := r.current.Read(p)
+		if err == io.EOF {
+			r.current.Close()
+			r.current = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (r *chunkReader) Close() error {
+	if r.current == nil {
+		return nil
+	}
+	err := r.current.Close()
+	r.current = nil
+	return err
+}
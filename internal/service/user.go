@@ -1,16 +1,18 @@
 package service
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"io"
 	"log"
 	"mime/multipart"
 	"mymate/internal/repository"
+	"mymate/pkg/blobstore"
 	"mymate/pkg/customerror"
+	"mymate/pkg/imageproc"
+	"mymate/pkg/media"
 	"mymate/pkg/user"
-	"os"
-	"path/filepath"
 	"time"
 
 	"github.com/google/uuid"
@@ -21,20 +23,23 @@ type UserServiceI interface {
 	GetUser(id uuid.UUID) (*user.User, error)
 	UpdateUser(user *user.User) error
 	SaveUserAvatar(user *user.User, file *multipart.FileHeader) error
+	SaveUserAvatarFrom(user *user.User, src io.Reader, size int64) error
 	DeleteAvatar(user *user.User) error
-	DeleteFile(id uuid.UUID, filename string)
+	DeleteFiles(id uuid.UUID, filenames []string)
 }
 
 type UserService struct {
 	userRepo repository.UserRepositoryI
+	blobs    blobstore.BlobStore
 	host     string
 	port     string
 	mainUrl  string
 }
 
-func NewUserService(userRepo repository.UserRepositoryI, host string, port string, mainUrl string) UserServiceI {
+func NewUserService(userRepo repository.UserRepositoryI, blobs blobstore.BlobStore, host string, port string, mainUrl string) UserServiceI {
 	return &UserService{
 		userRepo: userRepo,
+		blobs:    blobs,
 		host:     host,
 		port:     port,
 		mainUrl:  mainUrl,
@@ -72,56 +77,86 @@ func (userService *UserService) UpdateUser(user *user.User) error {
 }
 
 func (userService *UserService) SaveUserAvatar(user *user.User, file *multipart.FileHeader) error {
-	tempFilename := user.AvatarFileName
-	fileUUID := uuid.New().String()
-	timestamp := time.Now().Unix()
-	fileExt := filepath.Ext(file.Filename)
-	if fileExt != ".jpg" && fileExt != ".jpeg" && fileExt != ".png" && fileExt != ".webp" {
-		return customerror.NewError("UserService.SaveUserAvatar.FileExt", userService.host+":"+userService.port, "Invalid file extension")
-	}
-	uploadPath := filepath.Join(".", "media", user.UUID.String())
-	if err := os.MkdirAll(uploadPath, 0755); err != nil {
-		return customerror.NewError("UserService.SaveUserAvatar.MkdirAll", userService.host+":"+userService.port, err.Error())
-	}
-	newFilename := fmt.Sprintf("%s_%d%s", fileUUID, timestamp, fileExt)
-	fullPath := filepath.Join(uploadPath, newFilename)
+	if file.Size > imageproc.DefaultLimits.MaxBytes {
+		return customerror.ErrImageTooLarge
+	}
 	src, err := file.Open()
 	if err != nil {
 		return customerror.NewError("UserService.SaveUserAvatar.Open", userService.host+":"+userService.port, err.Error())
 	}
 	defer src.Close()
-	dst, err := os.Create(fullPath)
+	return userService.SaveUserAvatarFrom(user, src, file.Size)
+}
+
+// SaveUserAvatarFrom проверяет изображение, кадрирует его в квадрат и сохраняет вместе с копиями imageproc.AvatarVariants
+func (userService *UserService) SaveUserAvatarFrom(user *user.User, src io.Reader, size int64) error {
+	if size > imageproc.DefaultLimits.MaxBytes {
+		return customerror.ErrImageTooLarge
+	}
+	processed, err := imageproc.ProcessSquare(src, imageproc.DefaultLimits, imageproc.AvatarMaxSide, imageproc.AvatarVariants)
+	if err == imageproc.ErrTooLarge || err == imageproc.ErrDimensionsTooBig {
+		return customerror.ErrImageTooLarge
+	}
+	if err == imageproc.ErrUnsupportedFormat || err == imageproc.ErrCorrupt {
+		return customerror.ErrInvalidImage
+	}
 	if err != nil {
-		return customerror.NewError("UserService.SaveUserAvatar.Create", userService.host+":"+userService.port, err.Error())
+		return customerror.NewError("UserService.SaveUserAvatar.Process", userService.host+":"+userService.port, err.Error())
+	}
+	oldFilenames := user.AvatarFileNames()
+	baseName := fmt.Sprintf("%s_%d", uuid.New().String(), time.Now().Unix())
+	ctx, close := context.WithTimeout(context.Background(), time.Minute)
+	defer close()
+	var uploaded []string
+	put := func(image *imageproc.Image, filename string) (string, error) {
+		key := media.AvatarKey(user.UUID, filename)
+		err := userService.blobs.Put(ctx, key, bytes.NewReader(image.Data), int64(len(image.Data)), image.ContentType())
+		if err != nil {
+			return "", err
+		}
+		uploaded = append(uploaded, filename)
+		return fmt.Sprintf("%s/media/%s", userService.mainUrl, key), nil
+	}
+	avatarUrl, err := put(&processed.Original, baseName+processed.Original.Ext())
+	variants := map[string]string{}
+	for i := 0; err == nil && i < len(processed.Variants); i++ {
+		variant := &processed.Variants[i]
+		variants[variant.Name], err = put(variant, baseName+"_"+variant.Name+variant.Ext())
 	}
-	defer dst.Close()
-	_, err = io.Copy(dst, src)
 	if err != nil {
-		return customerror.NewError("UserService.SaveUserAvatar.Copy", userService.host+":"+userService.port, err.Error())
+		go userService.DeleteFiles(user.UUID, uploaded)
+		return customerror.NewError("UserService.SaveUserAvatar.Put", userService.host+":"+userService.port, err.Error())
 	}
-	user.AvatarFileName = newFilename
-	user.AvatarUrl = fmt.Sprintf("%s/media/%s/%s", userService.mainUrl, user.UUID.String(), newFilename)
-	err = userService.userRepo.UpdateUser(context.Background(), user)
+	user.AvatarFileName = uploaded[0]
+	user.AvatarUrl = avatarUrl
+	user.AvatarVariants = variants
+	err = userService.userRepo.UpdateUser(ctx, user)
 	if err != nil {
+		go userService.DeleteFiles(user.UUID, uploaded)
 		return customerror.NewError("UserService.SaveUserAvatar.UpdateUser", userService.host+":"+userService.port, err.Error())
 	}
-	if tempFilename != "" {
-		go userService.DeleteFile(user.UUID, tempFilename)
+	if len(oldFilenames) > 0 {
+		go userService.DeleteFiles(user.UUID, oldFilenames)
 	}
 	return nil
 }
-func (userService *UserService) DeleteFile(id uuid.UUID, filename string) {
-	err := os.Remove(filepath.Join(".", "media", id.String(), filename))
-	if err != nil {
-		log.Printf("ERROR|UserService.DeleteFile:%s", err.Error())
-		return
+
+func (userService *UserService) DeleteFiles(id uuid.UUID, filenames []string) {
+	ctx, close := context.WithTimeout(context.Background(), time.Minute)
+	defer close()
+	for _, filename := range filenames {
+		err := userService.blobs.Delete(ctx, media.AvatarKey(id, filename))
+		if err != nil {
+			log.Printf("ERROR|UserService.DeleteFiles:%s", err.Error())
+		}
 	}
 }
 
 func (userService *UserService) DeleteAvatar(user *user.User) error {
-	tempFilename := user.AvatarFileName
+	oldFilenames := user.AvatarFileNames()
 	user.AvatarFileName = ""
 	user.AvatarUrl = ""
+	user.AvatarVariants = map[string]string{}
 	ctx, close := context.WithTimeout(context.Background(), time.Minute)
 	defer close()
 	err := userService.userRepo.UpdateUser(ctx, user)
@@ -133,8 +168,8 @@ func (userService *UserService) DeleteAvatar(user *user.User) error {
 		customErr.AppendModule("UserService.DeleteAvatar")
 		return customErr
 	}
-	if tempFilename != "" {
-		go userService.DeleteFile(user.UUID, tempFilename)
+	if len(oldFilenames) > 0 {
+		go userService.DeleteFiles(user.UUID, oldFilenames)
 	}
 	return nil
 }
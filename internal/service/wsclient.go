@@ -0,0 +1,127 @@
+package service
+
+import (
+	"encoding/json"
+	"log"
+	"mymate/pkg/user"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// Сколько ждем завершения записи одного кадра
+	writeWait = 10 * time.Second
+	// Если за это время от клиента не пришло ни одного кадра или pong, соединение считается мертвым
+	pongWait = 60 * time.Second
+	// Ping отправляется чаще, чем истекает pongWait
+	pingPeriod = pongWait * 9 / 10
+	// Максимальный размер входящего кадра
+	maxFrameSize = 64 * 1024
+	// Размер очереди исходящих кадров. Клиент, который не успевает ее разбирать, отключается.
+	sendQueueSize = 256
+)
+
+// wsClient - websocket-соединение пользователя. gorilla/websocket не допускает конкурентной записи,
+// поэтому все кадры проходят через очередь send, которую разбирает единственная горутина writePump.
+type wsClient struct {
+	conn *websocket.Conn
+	user *user.User
+	// Срок токена, с которым открыто соединение
+	tokenExpiresAt time.Time
+	send           chan []byte
+	done           chan struct{}
+	closeOnce      sync.Once
+}
+
+func newWsClient(conn *websocket.Conn, user *user.User, tokenExpiresAt time.Time) *wsClient {
+	return &wsClient{
+		conn:           conn,
+		user:           user,
+		tokenExpiresAt: tokenExpiresAt,
+		send:           make(chan []byte, sendQueueSize),
+		done:           make(chan struct{}),
+	}
+}
+
+// enqueue ставит кадр в очередь без блокировки. При переполнении очереди соединение сразу закрывается.
+func (c *wsClient) enqueue(payload []byte) bool {
+	select {
+	case <-c.done:
+		return false
+	default:
+	}
+	select {
+	case c.send <- payload:
+		return true
+	default:
+		log.Printf("websocket send queue overflow for user %s, disconnecting", c.user.UUID)
+		c.closeOnce.Do(func() { close(c.done) })
+		// Close можно вызывать конкурентно с записью, так зависшая запись в writePump тоже прервется
+		c.conn.Close()
+		return false
+	}
+}
+
+func (c *wsClient) enqueueJSON(value any) bool {
+	payload, err := json.Marshal(value)
+	if err != nil {
+		log.Println(err.Error())
+		return false
+	}
+	return c.enqueue(payload)
+}
+
+// close завершает соединение после отправки уже поставленных в очередь кадров
+func (c *wsClient) close() {
+	c.closeOnce.Do(func() { close(c.done) })
+}
+
+func (c *wsClient) writePump() {
+	ticker := time.NewTicker(pingPeriod)
+	defer func() {
+		ticker.Stop()
+		c.conn.Close()
+	}()
+	for {
+		select {
+		case payload := <-c.send:
+			if !c.write(websocket.TextMessage, payload) {
+				c.close()
+				return
+			}
+		case <-ticker.C:
+			if !c.write(websocket.PingMessage, nil) {
+				c.close()
+				return
+			}
+		case <-c.done:
+			for {
+				select {
+				case payload := <-c.send:
+					if !c.write(websocket.TextMessage, payload) {
+						return
+					}
+				default:
+					c.write(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+					return
+				}
+			}
+		}
+	}
+}
+
+func (c *wsClient) write(messageType int, payload []byte) bool {
+	c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+	return c.conn.WriteMessage(messageType, payload) == nil
+}
+
+// prepareRead настраивает ограничения чтения: каждый pong продлевает дедлайн, иначе соединение закрывается через pongWait
+func (c *wsClient) prepareRead() {
+	c.conn.SetReadLimit(maxFrameSize)
+	c.conn.SetReadDeadline(time.Now().Add(pongWait))
+	c.conn.SetPongHandler(func(string) error {
+		return c.conn.SetReadDeadline(time.Now().Add(pongWait))
+	})
+}
@@ -0,0 +1,52 @@
+package avatar
+
+import (
+	"fmt"
+	"hash/fnv"
+	"html"
+	"strings"
+	"unicode"
+
+	"github.com/google/uuid"
+)
+
+// Темные оттенки, на которых читается белый текст
+var palette = []string{
+	"#D32F2F", "#C2185B", "#7B1FA2", "#512DA8", "#303F9F", "#1976D2", "#0288D1", "#0097A7",
+	"#00796B", "#388E3C", "#689F38", "#F57C00", "#E64A19", "#5D4037", "#455A64",
+}
+
+// InitialsPath - адрес сгенерированного аватара для пользователя без загруженного
+func InitialsPath(id uuid.UUID) string {
+	return "/api/v1/users/" + id.String() + "/avatar/initials.svg"
+}
+
+// Color выбирает цвет фона по UUID, поэтому у пользователя он не меняется вместе с именем
+func Color(id uuid.UUID) string {
+	hash := fnv.New32a()
+	hash.Write(id[:])
+	return palette[hash.Sum32()%uint32(len(palette))]
+}
+
+func Initials(firstname string, lastname string) string {
+	var initials []rune
+	for _, name := range []string{firstname, lastname} {
+		for _, r := range strings.TrimSpace(name) {
+			if unicode.IsLetter(r) || unicode.IsDigit(r) {
+				initials = append(initials, unicode.ToUpper(r))
+				break
+			}
+		}
+	}
+	if len(initials) == 0 {
+		return "?"
+	}
+	return string(initials)
+}
+
+func InitialsSVG(id uuid.UUID, firstname string, lastname string) []byte {
+	return []byte(fmt.Sprintf(`<svg xmlns="http://www.w3.org/2000/svg" width="256" height="256" viewBox="0 0 256 256">`+
+		`<rect width="256" height="256" fill="%s"/>`+
+		`<text x="128" y="128" dy=".35em" text-anchor="middle" font-family="Helvetica, Arial, sans-serif" font-size="104" fill="#FFFFFF">%s</text>`+
+		`</svg>`, Color(id), html.EscapeString(Initials(firstname, lastname))))
+}
@@ -0,0 +1,60 @@
+package blobstore
+
+import (
+	"context"
+	"errors"
+	"io"
+	"path"
+	"strings"
+	"time"
+)
+
+// ErrNotFound возвращается Get, если объекта с таким ключом нет
+var ErrNotFound = errors.New("blob not found")
+
+// ErrInvalidKey возвращается для ключей, выходящих за пределы хранилища
+var ErrInvalidKey = errors.New("invalid blob key")
+
+// BlobStore - хранилище медиафайлов. Ключ - относительный путь через "/", например "flats/12/photo.jpg".
+type BlobStore interface {
+	Put(ctx context.Context, key string, body io.Reader, size int64, contentType string) error
+	Get(ctx context.Context, key string) (*Object, error)
+	// Delete не считает ошибкой отсутствие объекта
+	Delete(ctx context.Context, key string) error
+	// SignedURL возвращает ссылку на объект, действующую ttl
+	SignedURL(ctx context.Context, key string, ttl time.Duration) (string, error)
+	// List вызывает fn для каждого объекта с ключом, начинающимся с prefix. Ошибка fn прерывает обход.
+	List(ctx context.Context, prefix string, fn func(ObjectInfo) error) error
+}
+
+type ObjectInfo struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
+}
+
+// Object - содержимое и метаданные объекта. Body поддерживает Seek, чтобы отдавать диапазоны.
+type Object struct {
+	Body        io.ReadSeekCloser
+	Size        int64
+	ContentType string
+	ModTime     time.Time
+	ETag        string
+}
+
+// CleanKey нормализует ключ и отклоняет пустые, абсолютные и выходящие наверх через ".." пути
+func CleanKey(key string) (string, error) {
+	if key == "" || strings.ContainsRune(key, 0) || strings.Contains(key, "\\") {
+		return "", ErrInvalidKey
+	}
+	cleaned := path.Clean("/" + key)[1:]
+	if cleaned == "" || cleaned != strings.TrimPrefix(key, "/") {
+		return "", ErrInvalidKey
+	}
+	for _, part := range strings.Split(cleaned, "/") {
+		if part == ".." || part == "." {
+			return "", ErrInvalidKey
+		}
+	}
+	return cleaned, nil
+}
@@ -2,14 +2,91 @@ package chatmessages
 
 import (
 	"database/sql"
+	"mymate/pkg/user"
+	"time"
 
 	"github.com/google/uuid"
 )
 
+const (
+	KindText = "text"
+	KindFlat = "flat"
+)
+
+const (
+	ConversationKindDirect = "direct"
+	ConversationKindGroup  = "group"
+)
+
+const (
+	MemberRoleAdmin  = "admin"
+	MemberRoleMember = "member"
+)
+
+const (
+	FlatStatusActive  = "active"
+	FlatStatusDeleted = "deleted"
+)
+
 type ChatMessage struct {
-	Id         int64        `json:"id"`
-	CreatedAt  sql.NullTime `json:"created_at"`
-	Message    string       `json:"message"`
-	SenderId   uuid.UUID    `json:"sender_id"`
-	ReceiverId uuid.UUID    `json:"receiver_id"`
+	Id             int64        `json:"id"`
+	CreatedAt      sql.NullTime `json:"created_at"`
+	Message        string       `json:"message"`
+	SenderId       uuid.UUID    `json:"sender_id"`
+	ReceiverId     uuid.UUID    `json:"receiver_id"`
+	ConversationId int64        `json:"conversation_id,omitempty"`
+	Kind           string       `json:"kind"`
+	FlatId         int64        `json:"flat_id,omitempty"`
+	Flat           *FlatCard    `json:"flat,omitempty"`
+	EditedAt       sql.NullTime `json:"edited_at"`
+	DeletedAt      sql.NullTime `json:"deleted_at"`
+}
+
+// FlatCard - снимок объявления, который отдается вместе с сообщением типа KindFlat.
+// Если объявление уже удалено (например, cleaner'ом), Status = FlatStatusDeleted и заполнен только Id.
+type FlatCard struct {
+	Id        int64  `json:"id"`
+	Name      string `json:"name"`
+	PriceFrom uint64 `json:"price_from"`
+	PriceTo   uint64 `json:"price_to"`
+	ImageUrl  string `json:"image_url"`
+	Status    string `json:"status"`
+}
+
+// Conversation - беседа. Сообщения групповых бесед хранятся с пустым ReceiverId.
+// Личные переписки хранятся как беседы вида ConversationKindDirect из двух участников,
+// групповые чаты могут быть привязаны к объявлению (например, для соседей по квартире).
+type Conversation struct {
+	Id          int64                `json:"id"`
+	Kind        string               `json:"kind"`
+	Title       string               `json:"title"`
+	FlatId      int64                `json:"flat_id,omitempty"`
+	Flat        *FlatCard            `json:"flat,omitempty"`
+	CreatedBy   uuid.UUID            `json:"created_by"`
+	CreatedAt   time.Time            `json:"created_at"`
+	Members     []ConversationMember `json:"members"`
+	LastMessage *ChatMessage         `json:"last_message,omitempty"`
+}
+
+type ConversationMember struct {
+	UserId   uuid.UUID    `json:"user_id"`
+	Role     string       `json:"role"`
+	JoinedAt time.Time    `json:"joined_at"`
+	LeftAt   sql.NullTime `json:"left_at"`
+	User     *user.User   `json:"user,omitempty"`
+}
+
+// MessageSearchResult - найденное сообщение вместе с соседними сообщениями той же переписки
+type MessageSearchResult struct {
+	Message ChatMessage   `json:"message"`
+	Before  []ChatMessage `json:"before"`
+	After   []ChatMessage `json:"after"`
+}
+
+// ExportPeer - собеседник в выгрузке переписки: только то, что видно в профиле
+type ExportPeer struct {
+	Id        uuid.UUID `json:"id"`
+	Firstname string    `json:"firstname"`
+	Lastname  string    `json:"lastname"`
+	AvatarUrl string    `json:"avatar_url"`
 }
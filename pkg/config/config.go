@@ -3,6 +3,8 @@ package config
 import (
 	"mymate/pkg/customerror"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/joho/godotenv"
 )
@@ -20,6 +22,39 @@ type Config struct {
 	SecretKey        string
 	MailToken        string
 	From             string
+	MessageBus       string
+	UnreadEmailDelay time.Duration
+	AllowedOrigins   []string
+	// Push-уведомления. Если провайдер не настроен, его платформы push-уведомлений не получают.
+	FCMCredentialsFile string
+	FCMBaseURL         string
+	APNsKeyFile        string
+	APNsKeyId          string
+	APNsTeamId         string
+	APNsTopic          string
+	APNsBaseURL        string
+	// PushStub подключает заглушку, которая пишет push-уведомления в лог, - только для локальной разработки
+	PushStub bool
+	// Адрес Bot API (для локальной заглушки) и ссылка на Mini App для кнопок в сообщениях бота
+	TelegramBotAPIURL  string
+	TelegramMiniAppURL string
+	// Хранилище медиафайлов: local (каталог MediaRoot) или s3
+	MediaStorage string
+	MediaRoot    string
+	S3Endpoint   string
+	S3Region     string
+	S3Bucket     string
+	S3AccessKey  string
+	S3SecretKey  string
+	S3PathStyle  bool
+	// Ключ подписи ссылок на приватные файлы локального хранилища, отдельный от SECRET_KEY
+	MediaURLSecret string
+	// Сколько неиспользуемый файл хранится до удаления сборщиком
+	MediaGCGrace time.Duration
+	// Сколько живет незавершенная возобновляемая загрузка с момента последней принятой части
+	UploadSessionTTL time.Duration
+	// ffmpeg для постеров видео. Если он не найден, видео сохраняются без постера.
+	FFmpegPath string
 }
 
 func NewConfig(dotenvPath string) (*Config, error) {
@@ -76,5 +111,77 @@ func NewConfig(dotenvPath string) (*Config, error) {
 	if config.From == "" {
 		return &Config{}, customerror.NewError("config.NewConfig", "", "FROM empty")
 	}
+	config.MessageBus = os.Getenv("MESSAGE_BUS")
+	if config.MessageBus == "" {
+		config.MessageBus = "memory"
+	}
+	if config.MessageBus != "memory" && config.MessageBus != "postgres" {
+		return &Config{}, customerror.NewError("config.NewConfig", "", "MESSAGE_BUS incorrect")
+	}
+	config.UnreadEmailDelay = 30 * time.Minute
+	if unreadEmailDelay := os.Getenv("UNREAD_EMAIL_DELAY"); unreadEmailDelay != "" {
+		config.UnreadEmailDelay, err = time.ParseDuration(unreadEmailDelay)
+		if err != nil || config.UnreadEmailDelay <= 0 {
+			return &Config{}, customerror.NewError("config.NewConfig", "", "UNREAD_EMAIL_DELAY incorrect")
+		}
+	}
+	for _, origin := range strings.Split(os.Getenv("ALLOWED_ORIGINS"), ",") {
+		origin = strings.TrimSpace(origin)
+		if origin != "" {
+			config.AllowedOrigins = append(config.AllowedOrigins, origin)
+		}
+	}
+	config.FCMCredentialsFile = os.Getenv("FCM_CREDENTIALS_FILE")
+	config.FCMBaseURL = os.Getenv("FCM_BASE_URL")
+	config.APNsKeyFile = os.Getenv("APNS_KEY_FILE")
+	config.APNsKeyId = os.Getenv("APNS_KEY_ID")
+	config.APNsTeamId = os.Getenv("APNS_TEAM_ID")
+	config.APNsTopic = os.Getenv("APNS_TOPIC")
+	config.APNsBaseURL = os.Getenv("APNS_BASE_URL")
+	config.PushStub = os.Getenv("PUSH_STUB") == "true"
+	config.TelegramBotAPIURL = os.Getenv("TG_BOT_API_URL")
+	config.TelegramMiniAppURL = strings.TrimRight(os.Getenv("TG_MINI_APP_URL"), "/")
+	config.MediaStorage = os.Getenv("MEDIA_STORAGE")
+	if config.MediaStorage == "" {
+		config.MediaStorage = "local"
+	}
+	if config.MediaStorage != "local" && config.MediaStorage != "s3" {
+		return &Config{}, customerror.NewError("config.NewConfig", "", "MEDIA_STORAGE incorrect")
+	}
+	config.MediaRoot = os.Getenv("MEDIA_ROOT")
+	if config.MediaRoot == "" {
+		config.MediaRoot = "./media"
+	}
+	config.MediaURLSecret = os.Getenv("MEDIA_URL_SECRET")
+	if config.MediaStorage == "local" && config.MediaURLSecret == "" {
+		return &Config{}, customerror.NewError("config.NewConfig", "", "MEDIA_URL_SECRET empty")
+	}
+	config.S3Endpoint = os.Getenv("S3_ENDPOINT")
+	config.S3Region = os.Getenv("S3_REGION")
+	config.S3Bucket = os.Getenv("S3_BUCKET")
+	config.S3AccessKey = os.Getenv("S3_ACCESS_KEY")
+	config.S3SecretKey = os.Getenv("S3_SECRET_KEY")
+	config.S3PathStyle = os.Getenv("S3_PATH_STYLE") == "true"
+	config.MediaGCGrace = 24 * time.Hour
+	if mediaGCGrace := os.Getenv("MEDIA_GC_GRACE"); mediaGCGrace != "" {
+		config.MediaGCGrace, err = time.ParseDuration(mediaGCGrace)
+		if err != nil || config.MediaGCGrace < time.Hour {
+			return &Config{}, customerror.NewError("config.NewConfig", "", "MEDIA_GC_GRACE incorrect")
+		}
+	}
+	config.UploadSessionTTL = 24 * time.Hour
+	if uploadSessionTTL := os.Getenv("UPLOAD_SESSION_TTL"); uploadSessionTTL != "" {
+		config.UploadSessionTTL, err = time.ParseDuration(uploadSessionTTL)
+		if err != nil || config.UploadSessionTTL < time.Minute {
+			return &Config{}, customerror.NewError("config.NewConfig", "", "UPLOAD_SESSION_TTL incorrect")
+		}
+	}
+	config.FFmpegPath = os.Getenv("FFMPEG_PATH")
+	if config.FFmpegPath == "" {
+		config.FFmpegPath = "ffmpeg"
+	}
+	if config.MediaStorage == "s3" && (config.S3Endpoint == "" || config.S3Bucket == "" || config.S3AccessKey == "" || config.S3SecretKey == "") {
+		return &Config{}, customerror.NewError("config.NewConfig", "", "S3 storage settings incomplete")
+	}
 	return &config, nil
 }
@@ -26,6 +26,36 @@ var ErrEmailNotSet = fmt.Errorf("EmailNotSet")
 
 var ErrAttemptsEnded = fmt.Errorf("AttemptsEnded")
 
+var ErrForbidden = fmt.Errorf("Forbidden")
+
+var ErrMessageNotEditable = fmt.Errorf("MessageNotEditable")
+
+var ErrSelfAction = fmt.Errorf("SelfAction")
+
+var ErrTooManyMembers = fmt.Errorf("TooManyMembers")
+
+var ErrInvalidDeviceToken = fmt.Errorf("InvalidDeviceToken")
+
+var ErrTelegramNotLinked = fmt.Errorf("TelegramNotLinked")
+
+var ErrInvalidImage = fmt.Errorf("InvalidImage")
+
+var ErrImageTooLarge = fmt.Errorf("ImageTooLarge")
+
+var ErrTooManyImages = fmt.Errorf("TooManyImages")
+
+var ErrInvalidImageOrder = fmt.Errorf("InvalidImageOrder")
+
+var ErrUploadConflict = fmt.Errorf("UploadConflict")
+
+var ErrInvalidVideo = fmt.Errorf("InvalidVideo")
+
+var ErrVideoTooLarge = fmt.Errorf("VideoTooLarge")
+
+var ErrVideoTooLong = fmt.Errorf("VideoTooLong")
+
+var ErrTooManyMedia = fmt.Errorf("TooManyMedia")
+
 func (customError CustomError) Error() string {
 	return fmt.Sprintf("ERROR|%s|%s:%s", customError.Endpoint, customError.Module, customError.Message)
 }
@@ -2,6 +2,8 @@ package favourites
 
 import (
 	"mymate/pkg/flat"
+	"mymate/pkg/user"
+	"time"
 
 	"github.com/google/uuid"
 )
@@ -12,3 +14,15 @@ type Favourites struct {
 	UserId uuid.UUID `json:"user_id"`
 	Flat   flat.Flat `json:"flat"`
 }
+
+// OwnerBatch - новые добавления объявления в избранное, о которых владелец еще не знает
+type OwnerBatch struct {
+	FlatId   int64     `json:"flat_id"`
+	FlatName string    `json:"flat_name"`
+	OwnerId  uuid.UUID `json:"owner_id"`
+	Count    int64     `json:"count"`
+	// Последний добавивший
+	LastUser user.User `json:"last_user"`
+	// Отметка, поставленная при захвате: по ней захват снимается, если уведомление не ушло
+	ClaimedAt time.Time `json:"-"`
+}
@@ -2,6 +2,8 @@ package flat
 
 import (
 	"mymate/pkg/user"
+	"path"
+	"strconv"
 	"time"
 
 	"github.com/google/uuid"
@@ -21,6 +23,33 @@ type Flat struct {
 	CreatedById         uuid.UUID `json:"created_by_id"`
 	CreatedByUser       user.User `json:"user"`
 	UpInSearch          int       `json:"up_in_search"`
+	FavouritesCount     int64     `json:"favourites_count"`
+	// Видно только владельцу и администраторам, см. HideOwnerStats
+	ViewsCount *int64 `json:"views_count,omitempty"`
+	// Обложка для ленты: отмеченная is_cover фотография или первая по порядку. Заполняется только в GetFlats.
+	Cover *FlatImage `json:"cover,omitempty"`
+}
+
+// MaxImages - сколько фотографий можно загрузить к одному объявлению
+const MaxImages = 20
+
+// HideOwnerStats убирает из объявления данные, которые видит только его владелец
+func (f *Flat) HideOwnerStats(viewer *user.User) {
+	if f.CreatedById != viewer.UUID && !viewer.IsSuperUser {
+		f.ViewsCount = nil
+	}
+}
+
+// View - просмотр объявления пользователем. Просмотры одного объявления одним пользователем за день считаются один раз.
+type View struct {
+	UserId   uuid.UUID
+	FlatId   int64
+	ViewedAt time.Time
+}
+
+type RecentlyViewed struct {
+	Flat     Flat      `json:"flat"`
+	ViewedAt time.Time `json:"viewed_at"`
 }
 
 type FlatImage struct {
@@ -28,4 +57,115 @@ type FlatImage struct {
 	FlatId   int64  `json:"flat_id"`
 	Url      string `json:"url"`
 	Filename string `json:"filename"`
+	Width    int    `json:"width"`
+	Height   int    `json:"height"`
+	Position int    `json:"position"`
+	IsCover  bool   `json:"is_cover"`
+	// Уменьшенные копии: thumbnail, medium, large -> url. У старых фотографий копий нет.
+	Variants map[string]string `json:"variants"`
+	// Перцептивный хеш для поиска повторно используемых фотографий, 0 - не посчитан
+	Hash uint64 `json:"-"`
+}
+
+// VariantURL возвращает адрес копии name или оригинала, если такой копии нет
+func (image *FlatImage) VariantURL(name string) string {
+	if url, ok := image.Variants[name]; ok {
+		return url
+	}
+	return image.Url
+}
+
+// Keys возвращает ключи оригинала и всех копий в хранилище медиафайлов
+func (image *FlatImage) Keys() []string {
+	keys := []string{ImageKey(image.FlatId, image.Filename)}
+	for _, url := range image.Variants {
+		keys = append(keys, ImageKey(image.FlatId, path.Base(url)))
+	}
+	return keys
+}
+
+// Виды медиафайлов объявления помимо фотографий галереи
+const (
+	MediaKindVideo     = "video"
+	MediaKindFloorPlan = "floor_plan"
+)
+
+// Ограничения на видео и планировки одного объявления
+const (
+	MaxVideos        = 3
+	MaxFloorPlans    = 5
+	MaxVideoBytes    = 200 << 20
+	MaxVideoDuration = 3 * time.Minute
+)
+
+// MaxMedia возвращает, сколько файлов вида kind можно загрузить к объявлению. Для неизвестного вида - 0.
+func MaxMedia(kind string) int {
+	switch kind {
+	case MediaKindVideo:
+		return MaxVideos
+	case MediaKindFloorPlan:
+		return MaxFloorPlans
+	}
+	return 0
+}
+
+// FlatMedia - видео или планировка объявления. У видео PosterUrl - кадр, извлеченный при загрузке (пустой, если ffmpeg недоступен),
+// у планировки Variants - уменьшенные копии, как у фотографий.
+type FlatMedia struct {
+	Id          int64             `json:"id"`
+	FlatId      int64             `json:"flat_id"`
+	Kind        string            `json:"kind"`
+	Url         string            `json:"url"`
+	Filename    string            `json:"filename"`
+	ContentType string            `json:"content_type"`
+	Size        int64             `json:"size"`
+	Width       int               `json:"width"`
+	Height      int               `json:"height"`
+	DurationMs  int64             `json:"duration_ms,omitempty"`
+	PosterUrl   string            `json:"poster_url,omitempty"`
+	Variants    map[string]string `json:"variants,omitempty"`
+	Position    int               `json:"position"`
+	CreatedAt   time.Time         `json:"created_at"`
+}
+
+// Keys возвращает ключи файла, постера и копий в хранилище медиафайлов
+func (media *FlatMedia) Keys() []string {
+	keys := []string{ImageKey(media.FlatId, media.Filename)}
+	if media.PosterUrl != "" {
+		keys = append(keys, ImageKey(media.FlatId, path.Base(media.PosterUrl)))
+	}
+	for _, url := range media.Variants {
+		keys = append(keys, ImageKey(media.FlatId, path.Base(url)))
+	}
+	return keys
+}
+
+// ImageKey - ключ фотографии объявления в хранилище медиафайлов
+func ImageKey(flatId int64, filename string) string {
+	return "flats/" + strconv.FormatInt(flatId, 10) + "/" + filename
+}
+
+// Счетчики дневной статистики объявления
+const (
+	StatViews      = "views"
+	StatFavourites = "favourites"
+	StatChatStarts = "chat_starts"
+)
+
+type DailyStats struct {
+	Day        time.Time `json:"day"`
+	Views      int64     `json:"views"`
+	Favourites int64     `json:"favourites"`
+	ChatStarts int64     `json:"chat_starts"`
+}
+
+// Stats - статистика объявления за последние Days дней. FavouritesCount - текущее число добавлений в избранное.
+type Stats struct {
+	FlatId          int64        `json:"flat_id"`
+	Days            int64        `json:"days"`
+	Views           int64        `json:"views"`
+	Favourites      int64        `json:"favourites"`
+	ChatStarts      int64        `json:"chat_starts"`
+	FavouritesCount int64        `json:"favourites_count"`
+	Daily           []DailyStats `json:"daily"`
 }
@@ -0,0 +1,40 @@
+package imageproc
+
+import "image"
+
+// DHash - разностный перцептивный хеш: изображение сжимается до 9x8 в оттенках серого,
+// каждый бит - сравнение яркости соседних по горизонтали ячеек. Пересжатие, масштаб и
+// небольшая цветокоррекция хеш почти не меняют, поэтому похожие фото отличаются на несколько бит.
+func DHash(img *image.RGBA) uint64 {
+	const width, height = 9, 8
+	imgWidth, imgHeight := img.Rect.Dx(), img.Rect.Dy()
+	var cells [height][width]uint64
+	for cy := 0; cy < height; cy++ {
+		y0, y1 := cy*imgHeight/height, max((cy+1)*imgHeight/height, cy*imgHeight/height+1)
+		for cx := 0; cx < width; cx++ {
+			x0, x1 := cx*imgWidth/width, max((cx+1)*imgWidth/width, cx*imgWidth/width+1)
+			var sum, count uint64
+			for y := y0; y < y1 && y < imgHeight; y++ {
+				for x := x0; x < x1 && x < imgWidth; x++ {
+					offset := img.PixOffset(x, y)
+					// Яркость по ITU-R BT.601 в целых числах
+					sum += (299*uint64(img.Pix[offset]) + 587*uint64(img.Pix[offset+1]) + 114*uint64(img.Pix[offset+2])) / 1000
+					count++
+				}
+			}
+			if count > 0 {
+				cells[cy][cx] = sum / count
+			}
+		}
+	}
+	var hash uint64
+	for cy := 0; cy < height; cy++ {
+		for cx := 0; cx < width-1; cx++ {
+			hash <<= 1
+			if cells[cy][cx] < cells[cy][cx+1] {
+				hash |= 1
+			}
+		}
+	}
+	return hash
+}
@@ -0,0 +1,283 @@
+package imageproc
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+
+	"golang.org/x/image/webp"
+)
+
+const (
+	FormatJPEG = "jpeg"
+	FormatPNG  = "png"
+	FormatWebP = "webp"
+)
+
+var (
+	ErrUnsupportedFormat = errors.New("unsupported image format")
+	ErrCorrupt           = errors.New("corrupt image")
+	ErrTooLarge          = errors.New("image file too large")
+	ErrDimensionsTooBig  = errors.New("image dimensions too big")
+)
+
+// Limits ограничивают принимаемые изображения. MaxPixels защищает от файлов, которые малы на диске, но огромны после декодирования.
+type Limits struct {
+	MaxBytes  int64
+	MaxWidth  int
+	MaxHeight int
+	MaxPixels int64
+}
+
+var DefaultLimits = Limits{
+	MaxBytes:  20 << 20,
+	MaxWidth:  10000,
+	MaxHeight: 10000,
+	MaxPixels: 50_000_000,
+}
+
+// Variant - уменьшенная копия, вписанная в квадрат MaxSide x MaxSide. Изображение не увеличивается.
+type Variant struct {
+	Name    string
+	MaxSide int
+}
+
+var DefaultVariants = []Variant{
+	{Name: "thumbnail", MaxSide: 320},
+	{Name: "medium", MaxSide: 960},
+	{Name: "large", MaxSide: 1920},
+}
+
+// Аватар кадрируется по центру в квадрат, сам он не больше AvatarMaxSide, копии - квадраты со стороной MaxSide
+const AvatarMaxSide = 1024
+
+var AvatarVariants = []Variant{
+	{Name: "small", MaxSide: 64},
+	{Name: "medium", MaxSide: 256},
+	{Name: "large", MaxSide: 512},
+}
+
+type Image struct {
+	Name   string
+	Format string
+	Width  int
+	Height int
+	Data   []byte
+}
+
+func (i *Image) Ext() string {
+	return extensions[i.Format]
+}
+
+func (i *Image) ContentType() string {
+	return contentTypes[i.Format]
+}
+
+var extensions = map[string]string{FormatJPEG: ".jpg", FormatPNG: ".png", FormatWebP: ".webp"}
+
+var contentTypes = map[string]string{FormatJPEG: "image/jpeg", FormatPNG: "image/png", FormatWebP: "image/webp"}
+
+// Result - оригинал без метаданных (с примененной EXIF-ориентацией) и его уменьшенные копии.
+// Копии WebP кодируются в JPEG или PNG: кодировщика WebP нет.
+type Result struct {
+	Original Image
+	Variants []Image
+	// Hash - DHash оригинала. 0, если изображение однотонное.
+	Hash uint64
+}
+
+// Sniff определяет формат по сигнатуре файла, расширение и заявленный тип не учитываются
+func Sniff(header []byte) (string, error) {
+	switch {
+	case bytes.HasPrefix(header, []byte{0xFF, 0xD8, 0xFF}):
+		return FormatJPEG, nil
+	case bytes.HasPrefix(header, []byte("\x89PNG\r\n\x1a\n")):
+		return FormatPNG, nil
+	case len(header) >= 12 && string(header[:4]) == "RIFF" && string(header[8:12]) == "WEBP":
+		return FormatWebP, nil
+	}
+	return "", ErrUnsupportedFormat
+}
+
+func Process(r io.Reader, limits Limits, variants []Variant) (*Result, error) {
+	data, format, err := read(r, limits)
+	if err != nil {
+		return nil, err
+	}
+	pixels, err := decode(data, format, limits)
+	if err != nil {
+		return nil, err
+	}
+	result := &Result{}
+	orientation := 1
+	if format == FormatJPEG {
+		orientation = exifOrientation(data)
+	}
+	if orientation != 1 {
+		// Повернутый кадр приходится перекодировать, при этом метаданные не переносятся
+		encoded, err := encode(pixels, FormatJPEG)
+		if err != nil {
+			return nil, err
+		}
+		result.Original = Image{Format: FormatJPEG, Data: encoded}
+	} else if format == FormatJPEG {
+		stripped, err := stripJPEG(data)
+		if err != nil {
+			return nil, err
+		}
+		result.Original = Image{Format: FormatJPEG, Data: stripped}
+	} else if format == FormatWebP {
+		// WebP не перекодируется (кодировщика нет), копии при этом строятся в JPEG/PNG
+		stripped, err := stripWebP(data)
+		if err != nil {
+			return nil, err
+		}
+		result.Original = Image{Format: FormatWebP, Data: stripped}
+	} else {
+		stripped, err := stripPNG(data)
+		if err != nil {
+			return nil, err
+		}
+		result.Original = Image{Format: FormatPNG, Data: stripped}
+	}
+	result.Original.Width, result.Original.Height = pixels.Rect.Dx(), pixels.Rect.Dy()
+	result.Hash = DHash(pixels)
+	result.Variants, err = encodeVariants(pixels, format, variants)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// ProcessSquare готовит аватар: кадрирует по центру в квадрат, уменьшает до maxSide и строит квадратные копии.
+// Изображение всегда перекодируется (WebP - в JPEG или PNG), поэтому метаданных в результате нет.
+func ProcessSquare(r io.Reader, limits Limits, maxSide int, variants []Variant) (*Result, error) {
+	data, format, err := read(r, limits)
+	if err != nil {
+		return nil, err
+	}
+	pixels, err := decode(data, format, limits)
+	if err != nil {
+		return nil, err
+	}
+	pixels = resize(cropSquare(pixels), maxSide)
+	originalFormat := FormatJPEG
+	if format != FormatJPEG && !pixels.Opaque() {
+		originalFormat = FormatPNG
+	}
+	encoded, err := encode(pixels, originalFormat)
+	if err != nil {
+		return nil, err
+	}
+	result := &Result{
+		Original: Image{Format: originalFormat, Width: pixels.Rect.Dx(), Height: pixels.Rect.Dy(), Data: encoded},
+		Hash:     DHash(pixels),
+	}
+	result.Variants, err = encodeVariants(pixels, format, variants)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func read(r io.Reader, limits Limits) ([]byte, string, error) {
+	data, err := io.ReadAll(io.LimitReader(r, limits.MaxBytes+1))
+	if err != nil {
+		return nil, "", err
+	}
+	if int64(len(data)) > limits.MaxBytes {
+		return nil, "", ErrTooLarge
+	}
+	format, err := Sniff(data)
+	if err != nil {
+		return nil, "", err
+	}
+	return data, format, nil
+}
+
+// decode проверяет размеры до декодирования и возвращает пиксели с уже примененной EXIF-ориентацией
+func decode(data []byte, format string, limits Limits) (*image.RGBA, error) {
+	var config image.Config
+	var err error
+	switch format {
+	case FormatJPEG:
+		config, err = jpeg.DecodeConfig(bytes.NewReader(data))
+	case FormatWebP:
+		config.Width, config.Height, err = webpSize(data)
+	default:
+		config, err = png.DecodeConfig(bytes.NewReader(data))
+	}
+	if err != nil {
+		return nil, ErrCorrupt
+	}
+	if err := limits.check(config.Width, config.Height); err != nil {
+		return nil, err
+	}
+	var decoded image.Image
+	if format == FormatWebP {
+		// Анимированный WebP пакет не декодирует, такой файл тоже отклоняется
+		decoded, err = webp.Decode(bytes.NewReader(data))
+	} else {
+		decoded, _, err = image.Decode(bytes.NewReader(data))
+	}
+	if err != nil {
+		return nil, ErrCorrupt
+	}
+	pixels := toRGBA(decoded)
+	if format == FormatJPEG {
+		if orientation := exifOrientation(data); orientation != 1 {
+			pixels = orient(pixels, orientation)
+		}
+	}
+	return pixels, nil
+}
+
+func encodeVariants(pixels *image.RGBA, format string, variants []Variant) ([]Image, error) {
+	var images []Image
+	for _, variant := range variants {
+		resized := resize(pixels, variant.MaxSide)
+		variantFormat := FormatJPEG
+		if format != FormatJPEG && !resized.Opaque() {
+			variantFormat = FormatPNG
+		}
+		encoded, err := encode(resized, variantFormat)
+		if err != nil {
+			return nil, err
+		}
+		images = append(images, Image{
+			Name:   variant.Name,
+			Format: variantFormat,
+			Width:  resized.Rect.Dx(),
+			Height: resized.Rect.Dy(),
+			Data:   encoded,
+		})
+	}
+	return images, nil
+}
+
+func (limits Limits) check(width int, height int) error {
+	if width <= 0 || height <= 0 {
+		return ErrCorrupt
+	}
+	if width > limits.MaxWidth || height > limits.MaxHeight || int64(width)*int64(height) > limits.MaxPixels {
+		return ErrDimensionsTooBig
+	}
+	return nil
+}
+
+func encode(img *image.RGBA, format string) ([]byte, error) {
+	var buffer bytes.Buffer
+	var err error
+	if format == FormatPNG {
+		err = (&png.Encoder{CompressionLevel: png.BestCompression}).Encode(&buffer, img)
+	} else {
+		err = jpeg.Encode(&buffer, img, &jpeg.Options{Quality: 85})
+	}
+	if err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
@@ -0,0 +1,205 @@
+package imageproc
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// stripJPEG удаляет сегменты с метаданными без перекодирования: APP1 (EXIF, XMP), APP13 (IPTC) и комментарии.
+// JFIF (APP0), ICC-профиль (APP2) и Adobe (APP14) нужны для правильных цветов и остаются.
+func stripJPEG(data []byte) ([]byte, error) {
+	out := bytes.NewBuffer(make([]byte, 0, len(data)))
+	out.Write(data[:2])
+	i := 2
+	for i < len(data) {
+		if data[i] != 0xFF {
+			return nil, ErrCorrupt
+		}
+		for i < len(data) && data[i] == 0xFF {
+			i++
+		}
+		if i >= len(data) {
+			return nil, ErrCorrupt
+		}
+		marker := data[i]
+		i++
+		if marker == 0x01 || (marker >= 0xD0 && marker <= 0xD7) {
+			out.Write([]byte{0xFF, marker})
+			continue
+		}
+		if marker == 0xD9 {
+			out.Write([]byte{0xFF, marker})
+			return out.Bytes(), nil
+		}
+		if i+2 > len(data) {
+			return nil, ErrCorrupt
+		}
+		length := int(binary.BigEndian.Uint16(data[i:]))
+		if length < 2 || i+length > len(data) {
+			return nil, ErrCorrupt
+		}
+		segment := data[i : i+length]
+		i += length
+		if marker == 0xDA {
+			// Дальше идут сжатые данные, в них метаданных нет
+			out.Write([]byte{0xFF, marker})
+			out.Write(segment)
+			out.Write(data[i:])
+			return out.Bytes(), nil
+		}
+		if marker == 0xFE || (marker >= 0xE1 && marker <= 0xEF && marker != 0xE2 && marker != 0xEE) {
+			continue
+		}
+		out.Write([]byte{0xFF, marker})
+		out.Write(segment)
+	}
+	return nil, ErrCorrupt
+}
+
+// exifOrientation возвращает тег Orientation (1-8) из EXIF, 1 - если его нет
+func exifOrientation(data []byte) int {
+	i := 2
+	for i+4 <= len(data) && data[i] == 0xFF {
+		marker := data[i+1]
+		if marker == 0xDA || marker == 0xD9 {
+			break
+		}
+		length := int(binary.BigEndian.Uint16(data[i+2:]))
+		if length < 2 || i+2+length > len(data) {
+			break
+		}
+		segment := data[i+4 : i+2+length]
+		i += 2 + length
+		if marker != 0xE1 || !bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			continue
+		}
+		tiff := segment[6:]
+		if len(tiff) < 8 {
+			return 1
+		}
+		var order binary.ByteOrder
+		switch string(tiff[:2]) {
+		case "II":
+			order = binary.LittleEndian
+		case "MM":
+			order = binary.BigEndian
+		default:
+			return 1
+		}
+		offset := int(order.Uint32(tiff[4:]))
+		if offset+2 > len(tiff) {
+			return 1
+		}
+		count := int(order.Uint16(tiff[offset:]))
+		for entry := 0; entry < count; entry++ {
+			position := offset + 2 + entry*12
+			if position+12 > len(tiff) {
+				return 1
+			}
+			if order.Uint16(tiff[position:]) == 0x0112 {
+				orientation := int(order.Uint16(tiff[position+8:]))
+				if orientation < 1 || orientation > 8 {
+					return 1
+				}
+				return orientation
+			}
+		}
+		return 1
+	}
+	return 1
+}
+
+// Вспомогательные чанки PNG, которые можно удалить без потерь: текст, EXIF и время изменения
+var pngMetadataChunks = map[string]bool{"tEXt": true, "zTXt": true, "iTXt": true, "eXIf": true, "tIME": true}
+
+func stripPNG(data []byte) ([]byte, error) {
+	out := bytes.NewBuffer(make([]byte, 0, len(data)))
+	out.Write(data[:8])
+	i := 8
+	for i+8 <= len(data) {
+		length := int(binary.BigEndian.Uint32(data[i:]))
+		end := i + 12 + length
+		if length < 0 || end > len(data) {
+			return nil, ErrCorrupt
+		}
+		chunkType := string(data[i+4 : i+8])
+		if !pngMetadataChunks[chunkType] {
+			out.Write(data[i:end])
+		}
+		i = end
+		if chunkType == "IEND" {
+			return out.Bytes(), nil
+		}
+	}
+	return nil, ErrCorrupt
+}
+
+// webpMinChunk - сколько байт первого чанка нужно, чтобы прочитать из него размеры
+var webpMinChunk = map[string]int{"VP8X": 10, "VP8 ": 10, "VP8L": 5}
+
+// webpSize читает размеры из заголовка VP8X, VP8 или VP8L
+func webpSize(data []byte) (int, int, error) {
+	if len(data) < 30 {
+		return 0, 0, ErrCorrupt
+	}
+	minLength, ok := webpMinChunk[string(data[12:16])]
+	length := int64(binary.LittleEndian.Uint32(data[16:20]))
+	if !ok || length < int64(minLength) || 20+length > int64(len(data)) {
+		return 0, 0, ErrCorrupt
+	}
+	payload := data[20:]
+	switch string(data[12:16]) {
+	case "VP8X":
+		width := 1 + (int(payload[4]) | int(payload[5])<<8 | int(payload[6])<<16)
+		height := 1 + (int(payload[7]) | int(payload[8])<<8 | int(payload[9])<<16)
+		return width, height, nil
+	case "VP8 ":
+		if payload[3] != 0x9D || payload[4] != 0x01 || payload[5] != 0x2A {
+			return 0, 0, ErrCorrupt
+		}
+		width := int(binary.LittleEndian.Uint16(payload[6:])) & 0x3FFF
+		height := int(binary.LittleEndian.Uint16(payload[8:])) & 0x3FFF
+		return width, height, nil
+	case "VP8L":
+		if payload[0] != 0x2F {
+			return 0, 0, ErrCorrupt
+		}
+		bits := binary.LittleEndian.Uint32(payload[1:])
+		return int(bits&0x3FFF) + 1, int(bits>>14&0x3FFF) + 1, nil
+	}
+	return 0, 0, ErrCorrupt
+}
+
+// stripWebP удаляет чанки EXIF и XMP и снимает соответствующие флаги в VP8X
+func stripWebP(data []byte) ([]byte, error) {
+	out := bytes.NewBuffer(make([]byte, 0, len(data)))
+	out.Write(data[:12])
+	i := 12
+	for i+8 <= len(data) {
+		length := int(binary.LittleEndian.Uint32(data[i+4:]))
+		end := i + 8 + length + length%2
+		if length < 0 || i+8+length > len(data) {
+			return nil, ErrCorrupt
+		}
+		if end > len(data) {
+			end = len(data)
+		}
+		chunkType := string(data[i : i+4])
+		switch chunkType {
+		case "EXIF", "XMP ":
+		case "VP8X":
+			if length < 10 {
+				return nil, ErrCorrupt
+			}
+			chunk := append([]byte(nil), data[i:end]...)
+			chunk[8] &^= 0x08 | 0x04
+			out.Write(chunk)
+		default:
+			out.Write(data[i:end])
+		}
+		i = end
+	}
+	result := out.Bytes()
+	binary.LittleEndian.PutUint32(result[4:], uint32(len(result)-8))
+	return result, nil
+}
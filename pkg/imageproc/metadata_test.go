@@ -0,0 +1,75 @@
+package imageproc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// webpFile собирает RIFF/WEBP из готовых чанков, длина RIFF проставляется по фактическому размеру
+func webpFile(chunks ...[]byte) []byte {
+	data := append([]byte("RIFF\x00\x00\x00\x00WEBP"), bytes.Join(chunks, nil)...)
+	binary.LittleEndian.PutUint32(data[4:], uint32(len(data)-8))
+	return data
+}
+
+// webpChunk записывает в заголовок declared, а содержимое берет как есть - так получаются чанки с неверной длиной
+func webpChunk(chunkType string, declared uint32, payload []byte) []byte {
+	chunk := make([]byte, 8, 8+len(payload))
+	copy(chunk, chunkType)
+	binary.LittleEndian.PutUint32(chunk[4:], declared)
+	return append(chunk, payload...)
+}
+
+func TestProcessRejectsMalformedWebP(t *testing.T) {
+	tests := map[string][]byte{
+		"zero-length VP8X":     webpFile(webpChunk("VP8X", 0, make([]byte, 10))),
+		"short VP8X":           webpFile(webpChunk("VP8X", 4, make([]byte, 10))),
+		"zero-length VP8":      webpFile(webpChunk("VP8 ", 0, []byte{0, 0, 0, 0x9D, 0x01, 0x2A, 1, 0, 1, 0})),
+		"zero-length VP8L":     webpFile(webpChunk("VP8L", 0, []byte{0x2F, 0, 0, 0, 0, 0, 0, 0, 0, 0})),
+		"VP8X past end":        webpFile(webpChunk("VP8X", 100, make([]byte, 10))),
+		"truncated VP8X":       webpFile(webpChunk("VP8X", 10, make([]byte, 6))),
+		"unknown first chunk":  webpFile(webpChunk("ALPH", 10, make([]byte, 10))),
+		"second VP8X is empty": webpFile(webpChunk("VP8L", 5, []byte{0x2F, 0, 0, 0, 0, 0}), webpChunk("VP8X", 0, nil)),
+	}
+	for name, data := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := Process(bytes.NewReader(data), DefaultLimits, nil)
+			if err != ErrCorrupt {
+				t.Fatalf("Process: got %v, want ErrCorrupt", err)
+			}
+			_, err = ProcessSquare(bytes.NewReader(data), DefaultLimits, AvatarMaxSide, AvatarVariants)
+			if err != ErrCorrupt {
+				t.Fatalf("ProcessSquare: got %v, want ErrCorrupt", err)
+			}
+		})
+	}
+}
+
+func TestStripWebPRejectsShortVP8X(t *testing.T) {
+	for _, declared := range []uint32{0, 8} {
+		data := webpFile(webpChunk("VP8L", 5, []byte{0x2F, 0, 0, 0, 0, 0}), webpChunk("VP8X", declared, make([]byte, declared)))
+		if _, err := stripWebP(data); err != ErrCorrupt {
+			t.Fatalf("VP8X of %d bytes: got %v, want ErrCorrupt", declared, err)
+		}
+	}
+}
+
+func TestStripWebPClearsMetadataFlags(t *testing.T) {
+	vp8x := make([]byte, 10)
+	vp8x[0] = 0x08 | 0x04 | 0x10
+	data := webpFile(webpChunk("VP8X", 10, vp8x), webpChunk("EXIF", 2, []byte{1, 2}), webpChunk("VP8L", 5, []byte{0x2F, 0, 0, 0, 0, 0}))
+	stripped, err := stripWebP(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if flags := stripped[20]; flags != 0x10 {
+		t.Fatalf("VP8X flags: got %#x, want 0x10", flags)
+	}
+	if bytes.Contains(stripped, []byte("EXIF")) {
+		t.Fatal("EXIF chunk was not removed")
+	}
+	if size := binary.LittleEndian.Uint32(stripped[4:]); int(size) != len(stripped)-8 {
+		t.Fatalf("RIFF size: got %d, want %d", size, len(stripped)-8)
+	}
+}
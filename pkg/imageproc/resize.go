@@ -0,0 +1,96 @@
+package imageproc
+
+import (
+	"image"
+	"image/draw"
+)
+
+func toRGBA(img image.Image) *image.RGBA {
+	bounds := img.Bounds()
+	rgba := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(rgba, rgba.Rect, img, bounds.Min, draw.Src)
+	return rgba
+}
+
+// cropSquare вырезает из центра квадрат со стороной, равной меньшей стороне изображения
+func cropSquare(src *image.RGBA) *image.RGBA {
+	width, height := src.Rect.Dx(), src.Rect.Dy()
+	if width == height {
+		return src
+	}
+	side := min(width, height)
+	x0, y0 := (width-side)/2, (height-side)/2
+	return toRGBA(src.SubImage(image.Rect(x0, y0, x0+side, y0+side)))
+}
+
+// orient применяет EXIF-ориентацию: 2-4 - отражения и поворот на 180, 5-8 - с поворотом на 90
+func orient(src *image.RGBA, orientation int) *image.RGBA {
+	width, height := src.Rect.Dx(), src.Rect.Dy()
+	dstWidth, dstHeight := width, height
+	if orientation >= 5 {
+		dstWidth, dstHeight = height, width
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dstWidth, dstHeight))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			var dx, dy int
+			switch orientation {
+			case 2:
+				dx, dy = width-1-x, y
+			case 3:
+				dx, dy = width-1-x, height-1-y
+			case 4:
+				dx, dy = x, height-1-y
+			case 5:
+				dx, dy = y, x
+			case 6:
+				dx, dy = height-1-y, x
+			case 7:
+				dx, dy = height-1-y, width-1-x
+			case 8:
+				dx, dy = y, width-1-x
+			default:
+				dx, dy = x, y
+			}
+			copy(dst.Pix[dst.PixOffset(dx, dy):dst.PixOffset(dx, dy)+4], src.Pix[src.PixOffset(x, y):src.PixOffset(x, y)+4])
+		}
+	}
+	return dst
+}
+
+// resize уменьшает изображение усреднением по площади, чтобы вписать его в maxSide
+func resize(src *image.RGBA, maxSide int) *image.RGBA {
+	width, height := src.Rect.Dx(), src.Rect.Dy()
+	if width <= maxSide && height <= maxSide {
+		return src
+	}
+	dstWidth, dstHeight := maxSide, height*maxSide/width
+	if height > width {
+		dstWidth, dstHeight = width*maxSide/height, maxSide
+	}
+	dstWidth, dstHeight = max(dstWidth, 1), max(dstHeight, 1)
+	dst := image.NewRGBA(image.Rect(0, 0, dstWidth, dstHeight))
+	for dy := 0; dy < dstHeight; dy++ {
+		y0, y1 := dy*height/dstHeight, max((dy+1)*height/dstHeight, dy*height/dstHeight+1)
+		for dx := 0; dx < dstWidth; dx++ {
+			x0, x1 := dx*width/dstWidth, max((dx+1)*width/dstWidth, dx*width/dstWidth+1)
+			var r, g, b, a, count uint64
+			for y := y0; y < y1; y++ {
+				row := src.Pix[src.PixOffset(x0, y) : src.PixOffset(x1-1, y)+4]
+				for i := 0; i < len(row); i += 4 {
+					r += uint64(row[i])
+					g += uint64(row[i+1])
+					b += uint64(row[i+2])
+					a += uint64(row[i+3])
+					count++
+				}
+			}
+			offset := dst.PixOffset(dx, dy)
+			dst.Pix[offset] = uint8(r / count)
+			dst.Pix[offset+1] = uint8(g / count)
+			dst.Pix[offset+2] = uint8(b / count)
+			dst.Pix[offset+3] = uint8(a / count)
+		}
+	}
+	return dst
+}
@@ -0,0 +1,76 @@
+package mailer
+
+import (
+	"crypto/tls"
+	"mime"
+	"mymate/pkg/customerror"
+	"net/smtp"
+)
+
+const (
+	smtpHost = "smtp.mail.ru"
+	smtpPort = "465"
+)
+
+type Mailer struct {
+	From  string
+	Token string
+}
+
+func NewMailer(from string, token string) *Mailer {
+	return &Mailer{
+		From:  from,
+		Token: token,
+	}
+}
+
+func (m *Mailer) Send(toMail string, subject string, body string) error {
+	message := []byte("From: " + m.From + "\r\n" +
+		"To: " + toMail + "\r\n" +
+		"Subject: " + mime.QEncoding.Encode("utf-8", subject) + "\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: text/plain; charset=UTF-8\r\n" +
+		"\r\n" + body)
+	conn, err := tls.Dial("tcp", smtpHost+":"+smtpPort, &tls.Config{
+		InsecureSkipVerify: true,
+		ServerName:         smtpHost,
+	})
+	if err != nil {
+		return customerror.NewError("Mailer.Send", smtpHost, err.Error())
+	}
+
+	c, err := smtp.NewClient(conn, smtpHost)
+	if err != nil {
+		return customerror.NewError("Mailer.Send", smtpHost, err.Error())
+	}
+	defer c.Close()
+
+	auth := smtp.PlainAuth("", m.From, m.Token, smtpHost)
+	if err = c.Auth(auth); err != nil {
+		return customerror.NewError("Mailer.Send", smtpHost, err.Error())
+	}
+
+	if err = c.Mail(m.From); err != nil {
+		return customerror.NewError("Mailer.Send", smtpHost, err.Error())
+	}
+
+	if err = c.Rcpt(toMail); err != nil {
+		return customerror.NewError("Mailer.Send", smtpHost, err.Error())
+	}
+
+	w, err := c.Data()
+	if err != nil {
+		return customerror.NewError("Mailer.Send", smtpHost, err.Error())
+	}
+
+	_, err = w.Write(message)
+	if err != nil {
+		return customerror.NewError("Mailer.Send", smtpHost, err.Error())
+	}
+
+	err = w.Close()
+	if err != nil {
+		return customerror.NewError("Mailer.Send", smtpHost, err.Error())
+	}
+	return c.Quit()
+}
@@ -0,0 +1,73 @@
+package media
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Чем в базе занят файл хранилища
+const (
+	ReferenceFlatImage = "flat_image"
+	ReferenceFlatMedia = "flat_media"
+	ReferenceAvatar    = "avatar"
+)
+
+// Reference - ссылка из базы на объект хранилища. Id - id строки-владельца (фотографии, видео или планировки, пользователя).
+type Reference struct {
+	Kind string `json:"kind"`
+	Id   string `json:"id"`
+	Key  string `json:"key"`
+}
+
+// AvatarKey - ключ аватара в хранилище медиафайлов
+func AvatarKey(id uuid.UUID, filename string) string {
+	return id.String() + "/" + filename
+}
+
+// ReportListLimit ограничивает списки ключей в отчете, счетчики при этом полные
+const ReportListLimit = 1000
+
+// GCReport - результат сверки хранилища с базой. В режиме DryRun ничего не удаляется.
+type GCReport struct {
+	DryRun            bool        `json:"dry_run"`
+	Grace             string      `json:"grace"`
+	StartedAt         time.Time   `json:"started_at"`
+	FinishedAt        time.Time   `json:"finished_at"`
+	Scanned           int64       `json:"scanned"`
+	Referenced        int64       `json:"referenced"`
+	Orphans           int64       `json:"orphans"`
+	Deleted           int64       `json:"deleted"`
+	Failed            int64       `json:"failed"`
+	OrphanKeys        []string    `json:"orphan_keys"`
+	Missing           int64       `json:"missing"`
+	MissingReferences []Reference `json:"missing_references"`
+}
+
+const (
+	// Сколько заданий на удаление обрабатывается за один запрос к базе
+	DeletionBatchSize = 100
+	// Взятое задание не выдается другим обработчикам это время, после падения обработчика оно вернется в очередь
+	DeletionLease     = 10 * time.Minute
+	deletionRetryBase = time.Minute
+	deletionRetryMax  = 6 * time.Hour
+)
+
+// DeletionJob - файл хранилища, который остался после удаления строк базы. Задание повторяется, пока файл не будет удален.
+type DeletionJob struct {
+	Id            int64     `json:"id"`
+	Key           string    `json:"key"`
+	Attempts      int       `json:"attempts"`
+	LastError     string    `json:"last_error"`
+	NextAttemptAt time.Time `json:"next_attempt_at"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+// DeletionRetryDelay - пауза после attempts неудачных попыток: удваивается с каждой, но не больше deletionRetryMax
+func DeletionRetryDelay(attempts int) time.Duration {
+	delay := deletionRetryBase
+	for i := 1; i < attempts && delay < deletionRetryMax; i++ {
+		delay *= 2
+	}
+	return min(delay, deletionRetryMax)
+}
@@ -0,0 +1,49 @@
+package messagebus
+
+import (
+	"context"
+	"sync"
+)
+
+type Handler func(payload []byte)
+
+// MessageBusI рассылает сообщения между всеми репликами API.
+// Подписчики получают в том числе сообщения, опубликованные этим же узлом.
+type MessageBusI interface {
+	Publish(ctx context.Context, channel string, payload []byte) error
+	Subscribe(channel string, handler Handler)
+	Run(ctx context.Context) error
+}
+
+// InMemoryBus - реализация для одного узла: Publish синхронно вызывает локальных подписчиков.
+type InMemoryBus struct {
+	mu       sync.RWMutex
+	handlers map[string][]Handler
+}
+
+func NewInMemoryBus() MessageBusI {
+	return &InMemoryBus{
+		handlers: map[string][]Handler{},
+	}
+}
+
+func (b *InMemoryBus) Publish(ctx context.Context, channel string, payload []byte) error {
+	b.mu.RLock()
+	handlers := b.handlers[channel]
+	b.mu.RUnlock()
+	for _, handler := range handlers {
+		handler(payload)
+	}
+	return nil
+}
+
+func (b *InMemoryBus) Subscribe(channel string, handler Handler) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.handlers[channel] = append(b.handlers[channel], handler)
+}
+
+func (b *InMemoryBus) Run(ctx context.Context) error {
+	<-ctx.Done()
+	return nil
+}
@@ -0,0 +1,194 @@
+package messagebus
+
+import (
+	"context"
+	"log"
+	"mymate/pkg/customerror"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// NOTIFY принимает payload не длиннее 8000 байт, более длинные сообщения кладутся в message_bus_payloads,
+// а в канал уходит только ссылка на строку.
+const maxNotifyPayload = 7900
+
+const payloadRefPrefix = "@"
+
+// Столько уведомлений ждут медленного подписчика, следующие отбрасываются
+const subscriptionQueueSize = 1024
+
+type PostgresBus struct {
+	Pool          *pgxpool.Pool
+	Host          string
+	Port          string
+	mu            sync.RWMutex
+	subscriptions map[string][]*subscription
+}
+
+func NewPostgresBus(pool *pgxpool.Pool, host string, port string) *PostgresBus {
+	return &PostgresBus{
+		Pool:          pool,
+		Host:          host,
+		Port:          port,
+		subscriptions: map[string][]*subscription{},
+	}
+}
+
+// subscription обрабатывает уведомления в своей горутине, чтобы медленный подписчик
+// не задерживал цикл LISTEN и остальные каналы
+type subscription struct {
+	channel string
+	handler Handler
+	queue   chan []byte
+}
+
+func (s *subscription) run() {
+	for payload := range s.queue {
+		s.handle(payload)
+	}
+}
+
+func (s *subscription) handle(payload []byte) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("ERROR|PostgresBus.subscription:%s: recovered from panic in handler: %v", s.channel, r)
+		}
+	}()
+	s.handler(payload)
+}
+
+func (b *PostgresBus) CreateTables(ctx context.Context) error {
+	query := `CREATE UNLOGGED TABLE IF NOT EXISTS message_bus_payloads (
+		id BIGSERIAL PRIMARY KEY,
+		payload BYTEA NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);`
+	_, err := b.Pool.Exec(ctx, query)
+	if err != nil {
+		return customerror.NewError("PostgresBus.CreateTables", b.Host+":"+b.Port, err.Error())
+	}
+	return nil
+}
+
+func (b *PostgresBus) Publish(ctx context.Context, channel string, payload []byte) error {
+	message := string(payload)
+	if len(payload) > maxNotifyPayload || strings.HasPrefix(message, payloadRefPrefix) {
+		var id int64
+		err := b.Pool.QueryRow(ctx, `INSERT INTO message_bus_payloads (payload) VALUES ($1) RETURNING id`, payload).Scan(&id)
+		if err != nil {
+			return customerror.NewError("PostgresBus.Publish", b.Host+":"+b.Port, err.Error())
+		}
+		message = payloadRefPrefix + strconv.FormatInt(id, 10)
+	}
+	_, err := b.Pool.Exec(ctx, `SELECT pg_notify($1, $2)`, channel, message)
+	if err != nil {
+		return customerror.NewError("PostgresBus.Publish", b.Host+":"+b.Port, err.Error())
+	}
+	return nil
+}
+
+func (b *PostgresBus) Subscribe(channel string, handler Handler) {
+	subscription := &subscription{
+		channel: channel,
+		handler: handler,
+		queue:   make(chan []byte, subscriptionQueueSize),
+	}
+	go subscription.run()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.subscriptions[channel] = append(b.subscriptions[channel], subscription)
+}
+
+// Run держит отдельное соединение с LISTEN на все каналы подписчиков и переподключается при обрывах.
+// Уведомления, отправленные пока соединения нет, теряются.
+func (b *PostgresBus) Run(ctx context.Context) error {
+	go b.cleanPayloads(ctx)
+	for {
+		err := b.listen(ctx)
+		if ctx.Err() != nil {
+			return nil
+		}
+		log.Print(err.Error())
+		time.Sleep(time.Second)
+	}
+}
+
+func (b *PostgresBus) listen(ctx context.Context) error {
+	conn, err := b.Pool.Acquire(ctx)
+	if err != nil {
+		return customerror.NewError("PostgresBus.Run", b.Host+":"+b.Port, err.Error())
+	}
+	defer conn.Release()
+	b.mu.RLock()
+	channels := make([]string, 0, len(b.subscriptions))
+	for channel := range b.subscriptions {
+		channels = append(channels, channel)
+	}
+	b.mu.RUnlock()
+	for _, channel := range channels {
+		_, err := conn.Exec(ctx, "LISTEN "+pgx.Identifier{channel}.Sanitize())
+		if err != nil {
+			return customerror.NewError("PostgresBus.Run", b.Host+":"+b.Port, err.Error())
+		}
+	}
+	for {
+		notification, err := conn.Conn().WaitForNotification(ctx)
+		if err != nil {
+			// соединение могло остаться в LISTEN, в пул его возвращать нельзя
+			conn.Conn().Close(context.Background())
+			return customerror.NewError("PostgresBus.Run", b.Host+":"+b.Port, err.Error())
+		}
+		payload := []byte(notification.Payload)
+		if strings.HasPrefix(notification.Payload, payloadRefPrefix) {
+			payload, err = b.loadPayload(ctx, strings.TrimPrefix(notification.Payload, payloadRefPrefix))
+			if err != nil {
+				log.Print(err.Error())
+				continue
+			}
+		}
+		b.mu.RLock()
+		subscriptions := b.subscriptions[notification.Channel]
+		b.mu.RUnlock()
+		for _, subscription := range subscriptions {
+			select {
+			case subscription.queue <- payload:
+			default:
+				log.Printf("ERROR|PostgresBus.Run:%s: subscriber queue is full, notification dropped", notification.Channel)
+			}
+		}
+	}
+}
+
+func (b *PostgresBus) loadPayload(ctx context.Context, idStr string) ([]byte, error) {
+	id, err := strconv.ParseInt(idStr, 10, 64)
+	if err != nil {
+		return nil, customerror.NewError("PostgresBus.loadPayload", b.Host+":"+b.Port, err.Error())
+	}
+	var payload []byte
+	err = b.Pool.QueryRow(ctx, `SELECT payload FROM message_bus_payloads WHERE id = $1`, id).Scan(&payload)
+	if err != nil {
+		return nil, customerror.NewError("PostgresBus.loadPayload", b.Host+":"+b.Port, err.Error())
+	}
+	return payload, nil
+}
+
+func (b *PostgresBus) cleanPayloads(ctx context.Context) {
+	ticker := time.NewTicker(10 * time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			_, err := b.Pool.Exec(ctx, `DELETE FROM message_bus_payloads WHERE created_at < NOW() - INTERVAL '1 HOUR'`)
+			if err != nil {
+				log.Printf("ERROR|PostgresBus.cleanPayloads:%s", err.Error())
+			}
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package moderation
+
+import (
+	"database/sql"
+	chatmessages "mymate/pkg/chat_messages"
+	"mymate/pkg/user"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Счетчики антиспама в чате
+const (
+	CounterRateLimited = "rate_limited"
+	CounterSpam        = "spam_detected"
+	CounterMutes       = "mutes"
+)
+
+const (
+	ReportStatusPending   = "pending"
+	ReportStatusResolved  = "resolved"
+	ReportStatusDismissed = "dismissed"
+)
+
+type UserBlock struct {
+	BlockerId uuid.UUID  `json:"blocker_id"`
+	BlockedId uuid.UUID  `json:"blocked_id"`
+	CreatedAt time.Time  `json:"created_at"`
+	User      *user.User `json:"user,omitempty"`
+}
+
+type Report struct {
+	Id         int64                      `json:"id"`
+	ReporterId uuid.UUID                  `json:"reporter_id"`
+	ReportedId uuid.UUID                  `json:"reported_id"`
+	Reason     string                     `json:"reason"`
+	Excerpt    []chatmessages.ChatMessage `json:"excerpt"`
+	Status     string                     `json:"status"`
+	CreatedAt  time.Time                  `json:"created_at"`
+}
+
+// ChatStats - сводка срабатываний ограничений чата по пользователю за период
+type ChatStats struct {
+	UserId       uuid.UUID    `json:"user_id"`
+	RateLimited  int64        `json:"rate_limited"`
+	SpamDetected int64        `json:"spam_detected"`
+	Mutes        int64        `json:"mutes"`
+	MutedUntil   sql.NullTime `json:"muted_until"`
+	User         *user.User   `json:"user,omitempty"`
+}
+
+// DuplicateImageFlag - фотография объявления, похожая на фотографию объявления другого пользователя.
+// Статусы те же, что у жалоб.
+type DuplicateImageFlag struct {
+	Id              int64     `json:"id"`
+	ImageId         int64     `json:"image_id"`
+	ImageUrl        string    `json:"image_url"`
+	FlatId          int64     `json:"flat_id"`
+	OwnerId         uuid.UUID `json:"owner_id"`
+	MatchedImageId  int64     `json:"matched_image_id"`
+	MatchedImageUrl string    `json:"matched_image_url"`
+	MatchedFlatId   int64     `json:"matched_flat_id"`
+	MatchedOwnerId  uuid.UUID `json:"matched_owner_id"`
+	Distance        int       `json:"distance"`
+	Status          string    `json:"status"`
+	CreatedAt       time.Time `json:"created_at"`
+}
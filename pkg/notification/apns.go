@@ -0,0 +1,150 @@
+package notification
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mymate/pkg/customerror"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	DefaultAPNsBaseURL = "https://api.push.apple.com"
+	// Apple отклоняет токены старше часа и слишком частую их смену, поэтому токен переиспользуется
+	apnsTokenLifetime = 50 * time.Minute
+)
+
+// APNsSender отправляет уведомления через HTTP/2 API Apple с авторизацией по ключу .p8 (ES256)
+type APNsSender struct {
+	BaseURL string
+	Client  *http.Client
+	KeyId   string
+	TeamId  string
+	// Bundle id приложения
+	Topic  string
+	key    *ecdsa.PrivateKey
+	mu     sync.Mutex
+	token  string
+	issued time.Time
+}
+
+// NewAPNsSender читает ключ .p8. Пустой baseURL означает боевой адрес APNs.
+func NewAPNsSender(keyFile string, keyId string, teamId string, topic string, baseURL string) (*APNsSender, error) {
+	data, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, customerror.NewError("notification.NewAPNsSender", "", err.Error())
+	}
+	key, err := jwt.ParseECPrivateKeyFromPEM(data)
+	if err != nil {
+		return nil, customerror.NewError("notification.NewAPNsSender", "", err.Error())
+	}
+	if keyId == "" || teamId == "" || topic == "" {
+		return nil, customerror.NewError("notification.NewAPNsSender", "", "APNs key id, team id and topic are required")
+	}
+	if baseURL == "" {
+		baseURL = DefaultAPNsBaseURL
+	}
+	return &APNsSender{
+		BaseURL: strings.TrimRight(baseURL, "/"),
+		Client:  &http.Client{Timeout: 10 * time.Second},
+		KeyId:   keyId,
+		TeamId:  teamId,
+		Topic:   topic,
+		key:     key,
+	}, nil
+}
+
+type apnsAlert struct {
+	Title string `json:"title"`
+	Body  string `json:"body"`
+}
+
+type apnsAps struct {
+	Alert apnsAlert `json:"alert"`
+	Sound string    `json:"sound"`
+}
+
+func (s *APNsSender) Send(ctx context.Context, device *Device, notification *Notification) error {
+	authToken, err := s.authToken()
+	if err != nil {
+		return err
+	}
+	// Пользовательские данные передаются ключами верхнего уровня рядом с aps
+	payload := map[string]any{
+		"aps": apnsAps{
+			Alert: apnsAlert{Title: notification.Title, Body: notification.Body},
+			Sound: "default",
+		},
+		"type": notification.Type,
+	}
+	for key, value := range notification.Data {
+		if key != "aps" {
+			payload[key] = value
+		}
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return customerror.NewError("APNsSender.Send", s.BaseURL, err.Error())
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, s.BaseURL+"/3/device/"+device.Token, bytes.NewReader(body))
+	if err != nil {
+		return customerror.NewError("APNsSender.Send", s.BaseURL, err.Error())
+	}
+	request.Header.Set("Authorization", "bearer "+authToken)
+	request.Header.Set("apns-topic", s.Topic)
+	request.Header.Set("apns-push-type", "alert")
+	request.Header.Set("apns-priority", "10")
+	request.Header.Set("Content-Type", "application/json")
+	response, err := s.Client.Do(request)
+	if err != nil {
+		return customerror.NewError("APNsSender.Send", s.BaseURL, err.Error())
+	}
+	defer response.Body.Close()
+	if response.StatusCode == http.StatusOK {
+		io.Copy(io.Discard, response.Body)
+		return nil
+	}
+	var apnsErr struct {
+		Reason string `json:"reason"`
+	}
+	json.NewDecoder(io.LimitReader(response.Body, 64*1024)).Decode(&apnsErr)
+	switch {
+	case response.StatusCode == http.StatusGone, apnsErr.Reason == "BadDeviceToken", apnsErr.Reason == "Unregistered":
+		return ErrInvalidToken
+	case apnsErr.Reason == "ExpiredProviderToken":
+		s.mu.Lock()
+		s.token = ""
+		s.mu.Unlock()
+	}
+	return customerror.NewError("APNsSender.Send", s.BaseURL, fmt.Sprintf("status %d: %s", response.StatusCode, apnsErr.Reason))
+}
+
+func (s *APNsSender) authToken() (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.token != "" && time.Since(s.issued) < apnsTokenLifetime {
+		return s.token, nil
+	}
+	now := time.Now()
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, jwt.MapClaims{
+		"iss": s.TeamId,
+		"iat": now.Unix(),
+	})
+	token.Header["kid"] = s.KeyId
+	signed, err := token.SignedString(s.key)
+	if err != nil {
+		return "", customerror.NewError("APNsSender.authToken", s.BaseURL, err.Error())
+	}
+	s.token = signed
+	s.issued = now
+	return s.token, nil
+}
@@ -0,0 +1,207 @@
+package notification
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mymate/pkg/customerror"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	DefaultFCMBaseURL = "https://fcm.googleapis.com"
+	fcmScope          = "https://www.googleapis.com/auth/firebase.messaging"
+	// Токен доступа обновляется заранее, чтобы не отправить запрос с истекающим токеном
+	fcmTokenLeeway = time.Minute
+)
+
+// FCMSender отправляет уведомления через FCM HTTP v1 API. Токен доступа получается
+// по ключу сервисного аккаунта Google и кэшируется до истечения.
+type FCMSender struct {
+	BaseURL string
+	Client  *http.Client
+	account fcmServiceAccount
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+type fcmServiceAccount struct {
+	ProjectId   string `json:"project_id"`
+	ClientEmail string `json:"client_email"`
+	PrivateKey  string `json:"private_key"`
+	TokenURI    string `json:"token_uri"`
+}
+
+// NewFCMSender читает JSON-ключ сервисного аккаунта. Пустой baseURL означает боевой адрес FCM.
+func NewFCMSender(credentialsFile string, baseURL string) (*FCMSender, error) {
+	data, err := os.ReadFile(credentialsFile)
+	if err != nil {
+		return nil, customerror.NewError("notification.NewFCMSender", "", err.Error())
+	}
+	var account fcmServiceAccount
+	if err := json.Unmarshal(data, &account); err != nil {
+		return nil, customerror.NewError("notification.NewFCMSender", "", err.Error())
+	}
+	if account.ProjectId == "" || account.ClientEmail == "" || account.PrivateKey == "" || account.TokenURI == "" {
+		return nil, customerror.NewError("notification.NewFCMSender", "", "incomplete service account key")
+	}
+	if _, err := jwt.ParseRSAPrivateKeyFromPEM([]byte(account.PrivateKey)); err != nil {
+		return nil, customerror.NewError("notification.NewFCMSender", "", err.Error())
+	}
+	if baseURL == "" {
+		baseURL = DefaultFCMBaseURL
+	}
+	return &FCMSender{
+		BaseURL: strings.TrimRight(baseURL, "/"),
+		Client:  &http.Client{Timeout: 10 * time.Second},
+		account: account,
+	}, nil
+}
+
+type fcmRequest struct {
+	Message fcmMessage `json:"message"`
+}
+
+type fcmMessage struct {
+	Token        string            `json:"token"`
+	Notification fcmNotification   `json:"notification"`
+	Data         map[string]string `json:"data,omitempty"`
+	Android      *fcmAndroid       `json:"android,omitempty"`
+}
+
+type fcmNotification struct {
+	Title string `json:"title"`
+	Body  string `json:"body"`
+}
+
+type fcmAndroid struct {
+	Priority string `json:"priority"`
+}
+
+type fcmError struct {
+	Error struct {
+		Status  string `json:"status"`
+		Message string `json:"message"`
+		Details []struct {
+			ErrorCode string `json:"errorCode"`
+		} `json:"details"`
+	} `json:"error"`
+}
+
+func (s *FCMSender) Send(ctx context.Context, device *Device, notification *Notification) error {
+	accessToken, err := s.accessToken(ctx)
+	if err != nil {
+		return err
+	}
+	data := map[string]string{"type": notification.Type}
+	for key, value := range notification.Data {
+		data[key] = value
+	}
+	message := fcmMessage{
+		Token:        device.Token,
+		Notification: fcmNotification{Title: notification.Title, Body: notification.Body},
+		Data:         data,
+	}
+	if device.Platform == PlatformAndroid {
+		message.Android = &fcmAndroid{Priority: "high"}
+	}
+	body, err := json.Marshal(fcmRequest{Message: message})
+	if err != nil {
+		return customerror.NewError("FCMSender.Send", s.BaseURL, err.Error())
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, s.BaseURL+"/v1/projects/"+url.PathEscape(s.account.ProjectId)+"/messages:send", bytes.NewReader(body))
+	if err != nil {
+		return customerror.NewError("FCMSender.Send", s.BaseURL, err.Error())
+	}
+	request.Header.Set("Authorization", "Bearer "+accessToken)
+	request.Header.Set("Content-Type", "application/json")
+	response, err := s.Client.Do(request)
+	if err != nil {
+		return customerror.NewError("FCMSender.Send", s.BaseURL, err.Error())
+	}
+	defer response.Body.Close()
+	if response.StatusCode == http.StatusOK {
+		io.Copy(io.Discard, response.Body)
+		return nil
+	}
+	var fcmErr fcmError
+	json.NewDecoder(io.LimitReader(response.Body, 64*1024)).Decode(&fcmErr)
+	if response.StatusCode == http.StatusUnauthorized {
+		// Токен могли отозвать раньше срока, следующая отправка получит новый
+		s.mu.Lock()
+		s.token = ""
+		s.mu.Unlock()
+	}
+	for _, detail := range fcmErr.Error.Details {
+		if detail.ErrorCode == "UNREGISTERED" {
+			return ErrInvalidToken
+		}
+	}
+	if response.StatusCode == http.StatusNotFound {
+		return ErrInvalidToken
+	}
+	return customerror.NewError("FCMSender.Send", s.BaseURL, fmt.Sprintf("status %d: %s", response.StatusCode, fcmErr.Error.Message))
+}
+
+// accessToken обменивает подписанный ключом сервисного аккаунта JWT на OAuth2 токен доступа
+func (s *FCMSender) accessToken(ctx context.Context) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.token != "" && time.Now().Add(fcmTokenLeeway).Before(s.expires) {
+		return s.token, nil
+	}
+	key, err := jwt.ParseRSAPrivateKeyFromPEM([]byte(s.account.PrivateKey))
+	if err != nil {
+		return "", customerror.NewError("FCMSender.accessToken", s.account.TokenURI, err.Error())
+	}
+	now := time.Now()
+	assertion, err := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"iss":   s.account.ClientEmail,
+		"scope": fcmScope,
+		"aud":   s.account.TokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	}).SignedString(key)
+	if err != nil {
+		return "", customerror.NewError("FCMSender.accessToken", s.account.TokenURI, err.Error())
+	}
+	form := url.Values{}
+	form.Set("grant_type", "urn:ietf:params:oauth:grant-type:jwt-bearer")
+	form.Set("assertion", assertion)
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, s.account.TokenURI, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", customerror.NewError("FCMSender.accessToken", s.account.TokenURI, err.Error())
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	response, err := s.Client.Do(request)
+	if err != nil {
+		return "", customerror.NewError("FCMSender.accessToken", s.account.TokenURI, err.Error())
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return "", customerror.NewError("FCMSender.accessToken", s.account.TokenURI, fmt.Sprintf("status %d", response.StatusCode))
+	}
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&token); err != nil {
+		return "", customerror.NewError("FCMSender.accessToken", s.account.TokenURI, err.Error())
+	}
+	if token.AccessToken == "" {
+		return "", customerror.NewError("FCMSender.accessToken", s.account.TokenURI, "empty access token")
+	}
+	s.token = token.AccessToken
+	s.expires = now.Add(time.Duration(token.ExpiresIn) * time.Second)
+	return s.token, nil
+}
@@ -0,0 +1,147 @@
+package notification
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Типы уведомлений. От типа зависит, какая настройка пользователя его разрешает.
+const (
+	TypeChatMessage    = "chat_message"
+	TypeMatch          = "match"
+	TypeListingExpiry  = "listing_expiry"
+	TypeFlatFavourited = "flat_favourited"
+	TypeNewChat        = "new_chat"
+)
+
+// Платформы устройств. Android и web получают уведомления через FCM, iOS - через APNs.
+const (
+	PlatformAndroid = "android"
+	PlatformIOS     = "ios"
+	PlatformWeb     = "web"
+)
+
+// Параметры запуска Mini App. Telegram допускает в них только латиницу, цифры, "_" и "-".
+func ChatLink(userId uuid.UUID) string {
+	return "chat_" + userId.String()
+}
+
+func ConversationLink(conversationId int64) string {
+	return "conversation_" + strconv.FormatInt(conversationId, 10)
+}
+
+func UserLink(userId uuid.UUID) string {
+	return "user_" + userId.String()
+}
+
+func FlatLink(flatId int64) string {
+	return "flat_" + strconv.FormatInt(flatId, 10)
+}
+
+// ErrInvalidToken возвращается отправщиком, если провайдер больше не принимает токен устройства.
+// Такие устройства удаляются.
+var ErrInvalidToken = errors.New("device token is no longer valid")
+
+// ErrQueueFull - очередь отправки переполнена, уведомление не принято
+var ErrQueueFull = errors.New("notification queue is full")
+
+// Notification - событие для пользователя. Сохраненные в центре уведомлений события получают Id и CreatedAt.
+type Notification struct {
+	Id     int64             `json:"id,omitempty"`
+	Type   string            `json:"type"`
+	UserId uuid.UUID         `json:"user_id"`
+	Title  string            `json:"title"`
+	Body   string            `json:"body"`
+	Data   map[string]string `json:"data,omitempty"`
+	// Параметр запуска Mini App (startapp), открывающий связанный экран
+	Link      string       `json:"link,omitempty"`
+	ReadAt    sql.NullTime `json:"read_at"`
+	CreatedAt time.Time    `json:"created_at"`
+}
+
+// Stored сообщает, попадает ли событие в центр уведомлений. Сообщения чата там не хранятся:
+// у переписки есть собственные счетчики непрочитанного.
+func Stored(notificationType string) bool {
+	return notificationType != TypeChatMessage
+}
+
+// Pushable сообщает, отправляется ли событие на устройства и в Telegram. О новом собеседнике
+// пользователь и так узнает из push о самом сообщении, поэтому это событие есть только в приложении.
+func Pushable(notificationType string) bool {
+	return notificationType != TypeNewChat
+}
+
+type Device struct {
+	Id         int64     `json:"id"`
+	UserId     uuid.UUID `json:"user_id"`
+	Platform   string    `json:"platform"`
+	Token      string    `json:"token"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastSeenAt time.Time `json:"last_seen_at"`
+}
+
+type Preferences struct {
+	UserId        uuid.UUID `json:"user_id"`
+	ChatMessages  bool      `json:"chat_messages"`
+	Matches       bool      `json:"matches"`
+	ListingExpiry bool      `json:"listing_expiry"`
+	// Дублировать уведомления в Telegram. Выключено по умолчанию, доступно только пользователям с telegram_id.
+	Telegram bool `json:"telegram"`
+}
+
+// DefaultPreferences - настройки пользователя, который их ни разу не менял: все уведомления включены
+func DefaultPreferences(userId uuid.UUID) *Preferences {
+	return &Preferences{
+		UserId:        userId,
+		ChatMessages:  true,
+		Matches:       true,
+		ListingExpiry: true,
+	}
+}
+
+// Allows сообщает, хочет ли пользователь получать уведомления этого типа на устройства и в Telegram.
+// В центр уведомлений события попадают независимо от настроек.
+func (p *Preferences) Allows(notificationType string) bool {
+	switch notificationType {
+	case TypeChatMessage:
+		return p.ChatMessages
+	case TypeMatch, TypeFlatFavourited:
+		return p.Matches
+	case TypeListingExpiry:
+		return p.ListingExpiry
+	}
+	return true
+}
+
+// Sender доставляет уведомление на одно устройство
+type Sender interface {
+	Send(ctx context.Context, device *Device, notification *Notification) error
+}
+
+// PreferencesUpdate - частичное изменение настроек: nil-поля не меняются
+type PreferencesUpdate struct {
+	ChatMessages  *bool `json:"chat_messages"`
+	Matches       *bool `json:"matches"`
+	ListingExpiry *bool `json:"listing_expiry"`
+	Telegram      *bool `json:"telegram"`
+}
+
+func (u *PreferencesUpdate) Apply(preferences *Preferences) {
+	if u.ChatMessages != nil {
+		preferences.ChatMessages = *u.ChatMessages
+	}
+	if u.Matches != nil {
+		preferences.Matches = *u.Matches
+	}
+	if u.ListingExpiry != nil {
+		preferences.ListingExpiry = *u.ListingExpiry
+	}
+	if u.Telegram != nil {
+		preferences.Telegram = *u.Telegram
+	}
+}
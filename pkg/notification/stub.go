@@ -0,0 +1,50 @@
+package notification
+
+import (
+	"context"
+	"log"
+	"sync"
+)
+
+// StubSender ничего не отправляет, а запоминает уведомления. Используется локально (PUSH_STUB) и в тестах.
+type StubSender struct {
+	mu   sync.Mutex
+	Sent []StubDelivery
+	// Токены, для которых Send вернет ErrInvalidToken
+	InvalidTokens map[string]bool
+}
+
+type StubDelivery struct {
+	Device       Device
+	Notification Notification
+}
+
+// Сколько последних уведомлений хранит StubSender
+const stubHistorySize = 1000
+
+func NewStubSender() *StubSender {
+	return &StubSender{
+		InvalidTokens: map[string]bool{},
+	}
+}
+
+func (s *StubSender) Send(ctx context.Context, device *Device, notification *Notification) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.InvalidTokens[device.Token] {
+		return ErrInvalidToken
+	}
+	s.Sent = append(s.Sent, StubDelivery{Device: *device, Notification: *notification})
+	if len(s.Sent) > stubHistorySize {
+		s.Sent = s.Sent[len(s.Sent)-stubHistorySize:]
+	}
+	log.Printf("push stub: %s to %s device %d: %s", notification.Type, device.Platform, device.Id, notification.Title)
+	return nil
+}
+
+// Deliveries возвращает копию отправленных уведомлений
+func (s *StubSender) Deliveries() []StubDelivery {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]StubDelivery(nil), s.Sent...)
+}
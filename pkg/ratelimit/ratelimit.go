@@ -0,0 +1,66 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// Limiter - набор token bucket'ов по ключу. Каждый ключ может потратить до burst токенов подряд,
+// токены восстанавливаются со скоростью rate в секунду. Состояние хранится в памяти узла.
+type Limiter struct {
+	mu        sync.Mutex
+	rate      float64
+	burst     float64
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+type bucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// Как часто удаляются полностью восстановившиеся bucket'ы
+const sweepInterval = time.Minute
+
+func NewLimiter(rate float64, burst int) *Limiter {
+	return &Limiter{
+		rate:      rate,
+		burst:     float64(burst),
+		buckets:   map[string]*bucket{},
+		lastSweep: time.Now(),
+	}
+}
+
+// Allow тратит один токен ключа. Если токенов нет, возвращает false и время, через которое появится следующий.
+func (l *Limiter) Allow(key string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	if now.Sub(l.lastSweep) > sweepInterval {
+		l.sweep(now)
+	}
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: l.burst, updated: now}
+		l.buckets[key] = b
+	}
+	b.tokens = min(l.burst, b.tokens+now.Sub(b.updated).Seconds()*l.rate)
+	b.updated = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	retryAfter := time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	return false, retryAfter
+}
+
+// sweep удаляет bucket'ы, которые уже восстановились бы до полного: они ничем не отличаются от новых
+func (l *Limiter) sweep(now time.Time) {
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.updated).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+	l.lastSweep = now
+}
@@ -0,0 +1,182 @@
+package telegrambot
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mymate/pkg/customerror"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const DefaultBaseURL = "https://api.telegram.org"
+
+// ErrChatUnavailable - бот не может писать пользователю: тот заблокировал бота или ни разу его не запускал
+var ErrChatUnavailable = errors.New("telegram chat unavailable")
+
+// Client - минимальный клиент Telegram Bot API. BaseURL можно заменить на локальную заглушку.
+type Client struct {
+	BaseURL string
+	Token   string
+	Client  *http.Client
+}
+
+func NewClient(token string, baseURL string) *Client {
+	if baseURL == "" {
+		baseURL = DefaultBaseURL
+	}
+	return &Client{
+		BaseURL: strings.TrimRight(baseURL, "/"),
+		Token:   token,
+		Client:  &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+type InlineKeyboardButton struct {
+	Text string `json:"text"`
+	Url  string `json:"url"`
+}
+
+type inlineKeyboardMarkup struct {
+	InlineKeyboard [][]InlineKeyboardButton `json:"inline_keyboard"`
+}
+
+type sendMessageRequest struct {
+	ChatId      int64                 `json:"chat_id"`
+	Text        string                `json:"text"`
+	ParseMode   string                `json:"parse_mode,omitempty"`
+	ReplyMarkup *inlineKeyboardMarkup `json:"reply_markup,omitempty"`
+}
+
+type apiResponse struct {
+	Ok          bool            `json:"ok"`
+	ErrorCode   int             `json:"error_code"`
+	Description string          `json:"description"`
+	Result      json.RawMessage `json:"result"`
+}
+
+// SendMessage отправляет HTML-сообщение. Если button не nil, под сообщением показывается кнопка-ссылка.
+func (c *Client) SendMessage(ctx context.Context, chatId int64, html string, button *InlineKeyboardButton) error {
+	request := sendMessageRequest{
+		ChatId:    chatId,
+		Text:      html,
+		ParseMode: "HTML",
+	}
+	if button != nil {
+		request.ReplyMarkup = &inlineKeyboardMarkup{InlineKeyboard: [][]InlineKeyboardButton{{*button}}}
+	}
+	return c.call(ctx, "sendMessage", request)
+}
+
+type photoSize struct {
+	FileId   string `json:"file_id"`
+	Width    int    `json:"width"`
+	Height   int    `json:"height"`
+	FileSize int64  `json:"file_size"`
+}
+
+type userProfilePhotos struct {
+	TotalCount int           `json:"total_count"`
+	Photos     [][]photoSize `json:"photos"`
+}
+
+type file struct {
+	FilePath string `json:"file_path"`
+	FileSize int64  `json:"file_size"`
+}
+
+// ErrNoProfilePhoto - у пользователя нет фотографии профиля или она скрыта настройками приватности
+var ErrNoProfilePhoto = errors.New("telegram profile photo unavailable")
+
+// DownloadProfilePhoto скачивает самый крупный размер текущей фотографии профиля, не больше maxBytes
+func (c *Client) DownloadProfilePhoto(ctx context.Context, userId int64, maxBytes int64) ([]byte, error) {
+	var photos userProfilePhotos
+	err := c.callResult(ctx, "getUserProfilePhotos", map[string]any{"user_id": userId, "limit": 1}, &photos)
+	if err != nil {
+		return nil, err
+	}
+	if len(photos.Photos) == 0 || len(photos.Photos[0]) == 0 {
+		return nil, ErrNoProfilePhoto
+	}
+	largest := photos.Photos[0][0]
+	for _, size := range photos.Photos[0] {
+		if size.Width*size.Height > largest.Width*largest.Height {
+			largest = size
+		}
+	}
+	var photoFile file
+	err = c.callResult(ctx, "getFile", map[string]any{"file_id": largest.FileId}, &photoFile)
+	if err != nil {
+		return nil, err
+	}
+	if photoFile.FilePath == "" {
+		return nil, ErrNoProfilePhoto
+	}
+	if photoFile.FileSize > maxBytes {
+		return nil, customerror.NewError("telegrambot.Client.DownloadProfilePhoto", c.BaseURL, "photo too large")
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, c.BaseURL+"/file/bot"+c.Token+"/"+photoFile.FilePath, nil)
+	if err != nil {
+		return nil, customerror.NewError("telegrambot.Client.DownloadProfilePhoto", c.BaseURL, "invalid file path")
+	}
+	response, err := c.Client.Do(request)
+	if err != nil {
+		return nil, customerror.NewError("telegrambot.Client.DownloadProfilePhoto", c.BaseURL, "request failed")
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, customerror.NewError("telegrambot.Client.DownloadProfilePhoto", c.BaseURL, fmt.Sprintf("status %d", response.StatusCode))
+	}
+	data, err := io.ReadAll(io.LimitReader(response.Body, maxBytes+1))
+	if err != nil {
+		return nil, customerror.NewError("telegrambot.Client.DownloadProfilePhoto", c.BaseURL, "read failed")
+	}
+	if int64(len(data)) > maxBytes {
+		return nil, customerror.NewError("telegrambot.Client.DownloadProfilePhoto", c.BaseURL, "photo too large")
+	}
+	return data, nil
+}
+
+func (c *Client) call(ctx context.Context, method string, payload any) error {
+	return c.callResult(ctx, method, payload, nil)
+}
+
+// callResult вызывает метод API и, если out не nil, разбирает в него поле result ответа
+func (c *Client) callResult(ctx context.Context, method string, payload any, out any) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return customerror.NewError("telegrambot.Client."+method, c.BaseURL, err.Error())
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, c.BaseURL+"/bot"+c.Token+"/"+method, bytes.NewReader(body))
+	if err != nil {
+		return customerror.NewError("telegrambot.Client."+method, c.BaseURL, err.Error())
+	}
+	request.Header.Set("Content-Type", "application/json")
+	response, err := c.Client.Do(request)
+	if err != nil {
+		// Ошибка net/http содержит URL вместе с токеном бота, поэтому в лог попадает только метод
+		return customerror.NewError("telegrambot.Client."+method, c.BaseURL, "request failed")
+	}
+	defer response.Body.Close()
+	var result apiResponse
+	if err := json.NewDecoder(io.LimitReader(response.Body, 64*1024)).Decode(&result); err != nil {
+		return customerror.NewError("telegrambot.Client."+method, c.BaseURL, fmt.Sprintf("status %d", response.StatusCode))
+	}
+	if result.Ok {
+		if out == nil {
+			return nil
+		}
+		if err := json.Unmarshal(result.Result, out); err != nil {
+			return customerror.NewError("telegrambot.Client."+method, c.BaseURL, err.Error())
+		}
+		return nil
+	}
+	if result.ErrorCode == http.StatusForbidden || (result.ErrorCode == http.StatusBadRequest && strings.Contains(result.Description, "chat not found")) {
+		return ErrChatUnavailable
+	}
+	return customerror.NewError("telegrambot.Client."+method, c.BaseURL, fmt.Sprintf("%d: %s", result.ErrorCode, result.Description))
+}
@@ -0,0 +1,55 @@
+package upload
+
+import (
+	"fmt"
+	"mymate/pkg/flat"
+	"mymate/pkg/user"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	KindFlatImage = "flat_image"
+	KindAvatar    = "avatar"
+
+	StatusUploading  = "uploading"
+	StatusProcessing = "processing"
+	// Сессия обработана и удалена, статус бывает только в ответе на последний PATCH
+	StatusCompleted = "completed"
+
+	// Один PATCH держится в памяти целиком, поэтому большие файлы клиент шлет частями
+	MaxChunkSize = 8 << 20
+	// Префикс ключей хранилища, под которым лежат части незавершенных загрузок
+	ChunkPrefix = "uploads/"
+)
+
+// Session - возобновляемая загрузка. Части файла лежат в хранилище, сессия хранит их ключи и текущее смещение.
+type Session struct {
+	Id        uuid.UUID `json:"id"`
+	UserId    uuid.UUID `json:"user_id"`
+	Kind      string    `json:"kind"`
+	FlatId    int64     `json:"flat_id,omitempty"`
+	Filename  string    `json:"filename"`
+	Size      int64     `json:"size"`
+	Offset    int64     `json:"offset"`
+	Status    string    `json:"status"`
+	Chunks    []string  `json:"-"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+func (s *Session) Complete() bool {
+	return s.Offset == s.Size
+}
+
+// Result - то, что создано после получения последней части
+type Result struct {
+	Image *flat.FlatImage `json:"image,omitempty"`
+	User  *user.User      `json:"user,omitempty"`
+}
+
+// ChunkKey возвращает ключ части. Случайный суффикс не дает параллельному запросу с тем же смещением перезаписать принятую часть.
+func ChunkKey(id uuid.UUID, offset int64) string {
+	return fmt.Sprintf("%s%s/%012d_%s", ChunkPrefix, id, offset, uuid.New().String()[:8])
+}
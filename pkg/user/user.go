@@ -2,6 +2,7 @@ package user
 
 import (
 	"database/sql"
+	"path"
 
 	"github.com/google/uuid"
 )
@@ -30,4 +31,19 @@ type User struct {
 	JWTVersion         uint         `json:"jwt_version"`
 	IsSuperUser        bool         `json:"is_superuser"`
 	Amount             uint64       `json:"amount"`
+
+	// Квадратные копии аватара: имя копии -> URL
+	AvatarVariants map[string]string `json:"avatar_variants"`
+}
+
+// AvatarFileNames возвращает имена всех файлов аватара в хранилище: оригинала и копий
+func (user *User) AvatarFileNames() []string {
+	if user.AvatarFileName == "" {
+		return nil
+	}
+	filenames := []string{user.AvatarFileName}
+	for _, url := range user.AvatarVariants {
+		filenames = append(filenames, path.Base(url))
+	}
+	return filenames
 }
@@ -0,0 +1,242 @@
+package videoproc
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"time"
+)
+
+const (
+	FormatMP4       = "mp4"
+	FormatQuickTime = "quicktime"
+)
+
+var (
+	ErrUnsupportedFormat = errors.New("unsupported video format")
+	ErrCorrupt           = errors.New("corrupt video")
+	// ErrNoVideoTrack - в файле только звук
+	ErrNoVideoTrack = errors.New("no video track")
+	ErrTooLong      = errors.New("video too long")
+)
+
+// Info - то, что удается узнать из заголовков контейнера без декодирования
+type Info struct {
+	Format   string
+	Duration time.Duration
+	Width    int
+	Height   int
+}
+
+func (i *Info) Ext() string {
+	if i.Format == FormatQuickTime {
+		return ".mov"
+	}
+	return ".mp4"
+}
+
+func (i *Info) ContentType() string {
+	if i.Format == FormatQuickTime {
+		return "video/quicktime"
+	}
+	return "video/mp4"
+}
+
+// Probe читает длительность и размер кадра из атомов MP4/QuickTime (ftyp, moov/mvhd, moov/trak/tkhd).
+// moov может быть и в конце файла, поэтому нужен io.ReadSeeker. Видео длиннее maxDuration отклоняется с ErrTooLong.
+func Probe(r io.ReadSeeker, size int64, maxDuration time.Duration) (*Info, error) {
+	boxType, bodyStart, boxEnd, err := readBox(r, 0, size)
+	if err != nil || boxType != "ftyp" || boxEnd-bodyStart < 4 {
+		return nil, ErrUnsupportedFormat
+	}
+	brand := make([]byte, 4)
+	if _, err := readAt(r, bodyStart, brand); err != nil {
+		return nil, ErrUnsupportedFormat
+	}
+	info := &Info{Format: FormatMP4}
+	if string(brand) == "qt  " {
+		info.Format = FormatQuickTime
+	}
+	for offset := boxEnd; offset < size; {
+		boxType, bodyStart, boxEnd, err = readBox(r, offset, size)
+		if err != nil {
+			return nil, err
+		}
+		if boxType == "moov" {
+			err = parseMoov(r, bodyStart, boxEnd, maxDuration, info)
+			if err != nil {
+				return nil, err
+			}
+			if info.Width == 0 || info.Height == 0 {
+				return nil, ErrNoVideoTrack
+			}
+			return info, nil
+		}
+		offset = boxEnd
+	}
+	return nil, ErrCorrupt
+}
+
+func parseMoov(r io.ReadSeeker, start int64, end int64, maxDuration time.Duration, info *Info) error {
+	foundHeader := false
+	for offset := start; offset < end; {
+		boxType, bodyStart, boxEnd, err := readBox(r, offset, end)
+		if err != nil {
+			return err
+		}
+		switch boxType {
+		case "mvhd":
+			err = parseMvhd(r, bodyStart, boxEnd, maxDuration, info)
+			if err != nil {
+				return err
+			}
+			foundHeader = true
+		case "trak":
+			width, height, err := parseTrak(r, bodyStart, boxEnd)
+			if err != nil {
+				return err
+			}
+			// Берется первая дорожка с изображением, у звуковых дорожек размер нулевой
+			if info.Width == 0 && width > 0 && height > 0 {
+				info.Width, info.Height = width, height
+			}
+		}
+		offset = boxEnd
+	}
+	if !foundHeader {
+		return ErrCorrupt
+	}
+	return nil
+}
+
+func parseMvhd(r io.ReadSeeker, start int64, end int64, maxDuration time.Duration, info *Info) error {
+	header := make([]byte, 32)
+	n, err := readAt(r, start, header[:min(int64(len(header)), end-start)])
+	if err != nil || n < 20 {
+		return ErrCorrupt
+	}
+	var timescale uint32
+	var duration uint64
+	if header[0] == 1 {
+		if n < 32 {
+			return ErrCorrupt
+		}
+		timescale = binary.BigEndian.Uint32(header[20:24])
+		duration = binary.BigEndian.Uint64(header[24:32])
+	} else {
+		timescale = binary.BigEndian.Uint32(header[12:16])
+		duration = uint64(binary.BigEndian.Uint32(header[16:20]))
+	}
+	if timescale == 0 || duration == 0 {
+		return ErrCorrupt
+	}
+	// Длительность из файла может быть любой, поэтому сначала сравниваются целые секунды: так time.Duration не переполнится
+	seconds := duration / uint64(timescale)
+	if seconds > uint64(maxDuration/time.Second) {
+		return ErrTooLong
+	}
+	// Остаток меньше timescale (до 2^32), произведение на 10^9 умещается в uint64
+	fraction := duration % uint64(timescale) * uint64(time.Second) / uint64(timescale)
+	info.Duration = time.Duration(seconds)*time.Second + time.Duration(fraction)
+	if info.Duration <= 0 {
+		return ErrCorrupt
+	}
+	if info.Duration > maxDuration {
+		return ErrTooLong
+	}
+	return nil
+}
+
+func parseTrak(r io.ReadSeeker, start int64, end int64) (int, int, error) {
+	for offset := start; offset < end; {
+		boxType, bodyStart, boxEnd, err := readBox(r, offset, end)
+		if err != nil {
+			return 0, 0, err
+		}
+		if boxType == "tkhd" {
+			// Ширина и высота - последние 8 байт tkhd, числа с фиксированной точкой 16.16
+			if boxEnd-bodyStart < 84 {
+				return 0, 0, ErrCorrupt
+			}
+			size := make([]byte, 8)
+			if _, err := readAt(r, boxEnd-8, size); err != nil {
+				return 0, 0, ErrCorrupt
+			}
+			return int(binary.BigEndian.Uint32(size[0:4]) >> 16), int(binary.BigEndian.Uint32(size[4:8]) >> 16), nil
+		}
+		offset = boxEnd
+	}
+	return 0, 0, nil
+}
+
+// readBox читает заголовок атома по смещению offset и возвращает его тип, начало содержимого и конец атома
+func readBox(r io.ReadSeeker, offset int64, limit int64) (string, int64, int64, error) {
+	header := make([]byte, 16)
+	if limit-offset < 8 {
+		return "", 0, 0, ErrCorrupt
+	}
+	if _, err := readAt(r, offset, header[:8]); err != nil {
+		return "", 0, 0, ErrCorrupt
+	}
+	size := int64(binary.BigEndian.Uint32(header[0:4]))
+	boxType := string(header[4:8])
+	bodyStart := offset + 8
+	switch size {
+	case 0:
+		size = limit - offset
+	case 1:
+		if limit-offset < 16 {
+			return "", 0, 0, ErrCorrupt
+		}
+		if _, err := readAt(r, offset+8, header[8:16]); err != nil {
+			return "", 0, 0, ErrCorrupt
+		}
+		largeSize := binary.BigEndian.Uint64(header[8:16])
+		if largeSize > uint64(limit-offset) {
+			return "", 0, 0, ErrCorrupt
+		}
+		size = int64(largeSize)
+		bodyStart = offset + 16
+	}
+	if size < bodyStart-offset || size > limit-offset {
+		return "", 0, 0, ErrCorrupt
+	}
+	return boxType, bodyStart, offset + size, nil
+}
+
+func readAt(r io.ReadSeeker, offset int64, buffer []byte) (int, error) {
+	if _, err := r.Seek(offset, io.SeekStart); err != nil {
+		return 0, err
+	}
+	return io.ReadFull(r, buffer)
+}
+
+// Poster извлекает кадр на отметке at через ffmpeg и возвращает его в JPEG, вписанным в maxSide.
+// ffmpeg читает только локальный файл: сетевые протоколы и внешние ссылки из контейнера запрещены.
+func Poster(ctx context.Context, ffmpegPath string, path string, at time.Duration, maxSide int) ([]byte, error) {
+	var stdout, stderr bytes.Buffer
+	command := exec.CommandContext(ctx, ffmpegPath,
+		"-nostdin", "-hide_banner", "-loglevel", "error",
+		"-protocol_whitelist", "file",
+		"-ss", fmt.Sprintf("%.3f", at.Seconds()),
+		"-i", path,
+		"-frames:v", "1",
+		"-vf", fmt.Sprintf("scale=w='min(%d,iw)':h='min(%d,ih)':force_original_aspect_ratio=decrease", maxSide, maxSide),
+		"-f", "image2pipe", "-vcodec", "mjpeg", "-q:v", "3",
+		"-",
+	)
+	command.Stdout = &stdout
+	command.Stderr = &stderr
+	err := command.Run()
+	if err != nil {
+		return nil, fmt.Errorf("ffmpeg: %w: %s", err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	if stdout.Len() == 0 {
+		return nil, errors.New("ffmpeg: no frame extracted")
+	}
+	return stdout.Bytes(), nil
+}
@@ -0,0 +1,83 @@
+package videoproc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+const testMaxDuration = 3 * time.Minute
+
+// box собирает атом из типа и содержимого
+func box(boxType string, payload ...[]byte) []byte {
+	body := bytes.Join(payload, nil)
+	data := make([]byte, 8, 8+len(body))
+	binary.BigEndian.PutUint32(data, uint32(8+len(body)))
+	copy(data[4:], boxType)
+	return append(data, body...)
+}
+
+// mvhdV0 и mvhdV1 заполняют только поля, которые читает parseMvhd
+func mvhdV0(timescale uint32, duration uint32) []byte {
+	body := make([]byte, 100)
+	binary.BigEndian.PutUint32(body[12:16], timescale)
+	binary.BigEndian.PutUint32(body[16:20], duration)
+	return box("mvhd", body)
+}
+
+func mvhdV1(timescale uint32, duration uint64) []byte {
+	body := make([]byte, 112)
+	body[0] = 1
+	binary.BigEndian.PutUint32(body[20:24], timescale)
+	binary.BigEndian.PutUint64(body[24:32], duration)
+	return box("mvhd", body)
+}
+
+func videoFile(mvhd []byte) []byte {
+	tkhd := make([]byte, 84)
+	binary.BigEndian.PutUint32(tkhd[76:80], 640<<16)
+	binary.BigEndian.PutUint32(tkhd[80:84], 360<<16)
+	return append(box("ftyp", []byte("isom\x00\x00\x02\x00")), box("moov", mvhd, box("trak", box("tkhd", tkhd)))...)
+}
+
+func probe(data []byte) (*Info, error) {
+	return Probe(bytes.NewReader(data), int64(len(data)), testMaxDuration)
+}
+
+func TestProbeReadsDuration(t *testing.T) {
+	info, err := probe(videoFile(mvhdV0(600, 90*600+300)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Duration != 90*time.Second+500*time.Millisecond {
+		t.Fatalf("duration: got %s", info.Duration)
+	}
+	if info.Width != 640 || info.Height != 360 {
+		t.Fatalf("size: got %dx%d", info.Width, info.Height)
+	}
+}
+
+func TestProbeRejectsHostileMvhd(t *testing.T) {
+	tests := map[string]struct {
+		mvhd []byte
+		want error
+	}{
+		// float64(1<<63) секунд в time.Duration на amd64 превращалось в отрицательное число
+		"huge duration":           {mvhdV1(1, 1<<63), ErrTooLong},
+		"max duration":            {mvhdV1(1, ^uint64(0)), ErrTooLong},
+		"max duration, max scale": {mvhdV1(^uint32(0), ^uint64(0)), ErrTooLong},
+		"just over limit":         {mvhdV0(1000, 180001), ErrTooLong},
+		"zero duration":           {mvhdV0(600, 0), ErrCorrupt},
+		"zero timescale":          {mvhdV0(0, 600), ErrCorrupt},
+		"rounds to zero":          {mvhdV1(^uint32(0), 1), ErrCorrupt},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			info, err := probe(videoFile(test.mvhd))
+			if err != test.want {
+				t.Fatalf("got %v (%+v), want %v", err, info, test.want)
+			}
+		})
+	}
+}